@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// How long a password reset link stays valid
+const passwordResetTTL = time.Hour
+
+// Frontend address used in emailed links, set from the configuration
+var appURL string
+
+// Validate an optional email address and return it normalised
+func (v *validator) email(field, value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return ""
+	}
+	addr, err := mail.ParseAddress(value)
+	if err != nil || addr.Address != value {
+		v.add(field, FieldInvalidFormat, field+" must be a valid email address")
+		return ""
+	}
+	return value
+}
+
+// Random token handed to the user, only its hash is stored
+func newResetToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashResetToken(token), nil
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func errInvalidResetToken() *APIError {
+	return newAPIError(http.StatusBadRequest, CodeInvalidResetToken, "Password reset token is invalid or has expired")
+}
+
+type SetEmailRequest struct {
+	Token    string `json:"token"`    // JWT token for authentication
+	Email    string `json:"email"`    // New address for password resets
+	Password string `json:"password"` // Current password, confirms the change
+}
+
+func SetEmail(c echo.Context) error {
+	var req SetEmailRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := validateToken(c.Request().Context(), requestToken(c, req.Token))
+	if err != nil {
+		return errInvalidToken(err)
+	}
+
+	v := &validator{}
+	v.required("email", req.Email)
+	email := v.email("email", req.Email)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	user, err := store.GetUser(ctx, userID)
+	if err != nil {
+		return errDatabase(err)
+	}
+	if err := confirmPassword(user, requestToken(c, req.Token), "password", req.Password); err != nil {
+		return err
+	}
+
+	err = store.SetUserEmail(ctx, userID, email)
+	if errors.Is(err, ErrConflict) {
+		return errEmailTaken()
+	}
+	if err != nil {
+		return errInternal("Failed to update email", err)
+	}
+
+	return respond(c, http.StatusOK, "Email updated successfully", map[string]string{"email": email})
+}
+
+type ChangePasswordRequest struct {
+	Token           string `json:"token"` // JWT token for authentication
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// Change the password and sign out every other session. The response carries
+// a fresh token for the caller, the one it used stops working.
+func ChangePassword(c echo.Context) error {
+	var req ChangePasswordRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := validateToken(c.Request().Context(), requestToken(c, req.Token))
+	if err != nil {
+		return errInvalidToken(err)
+	}
+
+	v := &validator{}
+	v.password("new_password", req.NewPassword)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	user, err := store.GetUser(ctx, userID)
+	if err != nil {
+		return errDatabase(err)
+	}
+	// Also how accounts created through single sign-on set their first password
+	if err := confirmPassword(user, requestToken(c, req.Token), "current_password", req.CurrentPassword); err != nil {
+		return err
+	}
+
+	hashedPassword, err := hashPassword(req.NewPassword)
+	if err != nil {
+		return errInternal("Failed to process password", err)
+	}
+
+	err = store.WithTx(ctx, func(tx Store) error {
+		user, err = tx.SetUserPassword(ctx, userID, hashedPassword)
+		if err != nil {
+			return errInternal("Failed to change password", err)
+		}
+		// Outstanding reset links were issued for the old password
+		if err := tx.DeletePasswordResets(ctx, userID); err != nil {
+			return errDatabase(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	endStreams(userID, 0)
+
+	token, err := generateToken(user)
+	if err != nil {
+		return errInternal("Failed to generate token", err)
+	}
+
+	return respond(c, http.StatusOK, "Password changed successfully", map[string]interface{}{
+		"user_id": userID,
+		"token":   token,
+	})
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"` // Address the reset link is sent to
+}
+
+// Email a password reset link. The response is the same whether or not the
+// address belongs to an account so it cannot be used to discover users.
+func ForgotPassword(c echo.Context) error {
+	var req ForgotPasswordRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	v := &validator{}
+	v.required("email", req.Email)
+	email := v.email("email", req.Email)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	// Limit how many emails one client can trigger
+	limit := ipKey(c, "forgot")
+	if err := checkRateLimits(c, limit); err != nil {
+		return err
+	}
+	hitRateLimits(c, limit)
+
+	const message = "If an account uses this address, a password reset link has been sent to it"
+
+	ctx := c.Request().Context()
+	user, err := store.GetUserByEmail(ctx, email)
+	if errors.Is(err, ErrNotFound) {
+		return respond(c, http.StatusAccepted, message, nil)
+	}
+	if err != nil {
+		return errDatabase(err)
+	}
+
+	token, tokenHash, err := newResetToken()
+	if err != nil {
+		return errInternal("Failed to create reset token", err)
+	}
+
+	now := time.Now().UTC()
+	err = store.WithTx(ctx, func(tx Store) error {
+		// Only the most recent link works
+		if err := tx.DeletePasswordResets(ctx, user.ID); err != nil {
+			return err
+		}
+		return tx.CreatePasswordReset(ctx, PasswordReset{
+			TokenHash: tokenHash,
+			UserID:    user.ID,
+			ExpiresAt: now.Add(passwordResetTTL),
+			CreatedAt: now,
+		})
+	})
+	if err != nil {
+		return errInternal("Failed to create reset token", err)
+	}
+
+	msg := MailMessage{
+		To:      user.Email,
+		Subject: "Reset your Expense Tracker password",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Someone asked to reset the password of your Expense Tracker account.\n"+
+			"Open the link below to choose a new one:\n\n%s/reset-password?token=%s\n\n"+
+			"The link can be used once and expires in %d minutes.\n"+
+			"If you did not ask for this, you can ignore this email.\n",
+			user.Username, appURL, url.QueryEscape(token), int(passwordResetTTL.Minutes())),
+	}
+	// Send in the background so the response time does not reveal whether the account exists
+	go func() {
+		if err := mailer.Send(context.Background(), msg); err != nil {
+			log.Printf("Error sending password reset email to user %d: %v", user.ID, err)
+		}
+	}()
+
+	return respond(c, http.StatusAccepted, message, nil)
+}
+
+type ResetPasswordRequest struct {
+	ResetToken  string `json:"reset_token"` // Token from the reset email
+	NewPassword string `json:"new_password"`
+}
+
+func ResetPassword(c echo.Context) error {
+	var req ResetPasswordRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	v := &validator{}
+	v.required("reset_token", req.ResetToken)
+	v.password("new_password", req.NewPassword)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	hashedPassword, err := hashPassword(req.NewPassword)
+	if err != nil {
+		return errInternal("Failed to process password", err)
+	}
+
+	ctx := c.Request().Context()
+	tokenHash := hashResetToken(req.ResetToken)
+	var user User
+	err = store.WithTx(ctx, func(tx Store) error {
+		reset, err := tx.GetPasswordReset(ctx, tokenHash)
+		if errors.Is(err, ErrNotFound) {
+			return errInvalidResetToken()
+		}
+		if err != nil {
+			return errDatabase(err)
+		}
+
+		now := time.Now().UTC()
+		if reset.UsedAt != nil || now.After(reset.ExpiresAt) {
+			return errInvalidResetToken()
+		}
+		// Conditional update so two concurrent resets cannot both succeed
+		err = tx.UsePasswordReset(ctx, tokenHash, now)
+		if errors.Is(err, ErrNotFound) {
+			return errInvalidResetToken()
+		}
+		if err != nil {
+			return errDatabase(err)
+		}
+
+		user, err = tx.SetUserPassword(ctx, reset.UserID, hashedPassword)
+		if err != nil {
+			return errInternal("Failed to reset password", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	endStreams(user.ID, 0)
+
+	// The email proves control of the mailbox, not of the second factor
+	enabled, err := twoFactorEnabled(ctx, store, user.ID)
+	if err != nil {
+		return errDatabase(err)
+	}
+	if enabled {
+		return respondTwoFactorChallenge(c, user, "Password reset successfully, two-factor authentication required")
+	}
+
+	token, err := generateToken(user)
+	if err != nil {
+		return errInternal("Failed to generate token", err)
+	}
+
+	return respond(c, http.StatusOK, "Password reset successfully", map[string]interface{}{
+		"user_id": user.ID,
+		"token":   token,
+	})
+}
+
+type DeleteAccountRequest struct {
+	Token    string `json:"token"`    // JWT token for authentication
+	Password string `json:"password"` // Current password, confirms the deletion
+}
+
+type TransferredGroup struct {
+	GroupID    int `json:"group_id"`
+	NewOwnerID int `json:"new_owner_id"`
+}
+
+// Delete the caller's account. Groups the user owns are handed to the member
+// with the lowest user ID; groups nobody else is in are deleted together with
+// their expenses. Expenses of shared groups stay with the group.
+func DeleteAccount(c echo.Context) error {
+	var req DeleteAccountRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := validateToken(c.Request().Context(), requestToken(c, req.Token))
+	if err != nil {
+		return errInvalidToken(err)
+	}
+
+	ctx := c.Request().Context()
+	deleted := []int{}
+	transferred := []TransferredGroup{}
+	left := []Event{}
+	err = store.WithTx(ctx, func(tx Store) error {
+		user, err := tx.GetUser(ctx, userID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if err := confirmPassword(user, requestToken(c, req.Token), "password", req.Password); err != nil {
+			return err
+		}
+
+		groups, err := tx.ListUserGroups(ctx, userID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		for _, g := range groups {
+			group, err := tx.GetGroup(ctx, g.ID)
+			if err != nil {
+				return errDatabase(err)
+			}
+
+			others := []int{}
+			for _, memberID := range group.UsersIDs {
+				if memberID != userID {
+					others = append(others, memberID)
+				}
+			}
+
+			if len(others) == 0 {
+				if err := tx.DeleteGroup(ctx, group.ID); err != nil {
+					return errInternal("Failed to delete group", err)
+				}
+				deleted = append(deleted, group.ID)
+				continue
+			}
+
+			if group.OwnerID == userID {
+				// UsersIDs is ordered, so this is the member with the lowest ID
+				if err := tx.SetGroupOwner(ctx, group.ID, others[0]); err != nil {
+					return errInternal("Failed to transfer group ownership", err)
+				}
+				transferred = append(transferred, TransferredGroup{GroupID: group.ID, NewOwnerID: others[0]})
+				group.OwnerID = others[0]
+			}
+			if err := tx.RemoveMember(ctx, group.ID, userID); err != nil {
+				return errInternal("Failed to leave group", err)
+			}
+
+			group.UsersIDs = others
+			event := Event{Type: EventMemberRemoved, GroupID: group.ID, ActorID: userID, MemberID: userID,
+				Data: MemberEventData{Member: publicProfile(user), Group: group}}
+			if err := queueWebhooks(ctx, tx, event); err != nil {
+				return errInternal("Failed to queue webhooks", err)
+			}
+			left = append(left, event)
+		}
+
+		// Expenses the user paid for stay, without a payer
+		if err := tx.ClearPayer(ctx, userID); err != nil {
+			return errDatabase(err)
+		}
+		if err := tx.DeletePasswordResets(ctx, userID); err != nil {
+			return errDatabase(err)
+		}
+		if err := tx.DeleteTOTP(ctx, userID); err != nil {
+			return errDatabase(err)
+		}
+		if err := tx.DeleteAPIKeys(ctx, userID); err != nil {
+			return errDatabase(err)
+		}
+		if err := tx.DeleteIdentities(ctx, userID); err != nil {
+			return errDatabase(err)
+		}
+		if err := tx.DeleteUserImports(ctx, userID); err != nil {
+			return errDatabase(err)
+		}
+		if err := tx.DeleteUser(ctx, userID); err != nil {
+			return errInternal("Failed to delete account", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, event := range left {
+		publish(event)
+	}
+
+	return respond(c, http.StatusOK, "Account deleted successfully", map[string]interface{}{
+		"deleted_groups":     deleted,
+		"transferred_groups": transferred,
+	})
+}
+
+func (s *sqlStore) CreatePasswordReset(ctx context.Context, reset PasswordReset) error {
+	_, err := s.exec(ctx, `INSERT INTO password_resets (token_hash, user_id, expires_at, created_at)
+		VALUES (?, ?, ?, ?)`, reset.TokenHash, reset.UserID, reset.ExpiresAt, reset.CreatedAt)
+	return err
+}
+
+func (s *sqlStore) GetPasswordReset(ctx context.Context, tokenHash string) (PasswordReset, error) {
+	reset := PasswordReset{TokenHash: tokenHash}
+	var usedAt sql.NullTime
+	err := s.queryRow(ctx, `SELECT user_id, expires_at, used_at, created_at FROM password_resets WHERE token_hash = ?`, tokenHash).
+		Scan(&reset.UserID, &reset.ExpiresAt, &usedAt, &reset.CreatedAt)
+	if usedAt.Valid {
+		reset.UsedAt = &usedAt.Time
+	}
+	return reset, notFound(err)
+}
+
+func (s *sqlStore) UsePasswordReset(ctx context.Context, tokenHash string, usedAt time.Time) error {
+	result, err := s.exec(ctx, "UPDATE password_resets SET used_at = ? WHERE token_hash = ? AND used_at IS NULL", usedAt, tokenHash)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) DeletePasswordResets(ctx context.Context, userID int) error {
+	_, err := s.exec(ctx, "DELETE FROM password_resets WHERE user_id = ?", userID)
+	return err
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// API keys start with this so they can be told apart from JWTs and found by secret scanners
+	apiKeyPrefix = "et_"
+	// Characters of the key kept in clear text to help users recognise it
+	apiKeyDisplayLength = len(apiKeyPrefix) + 8
+	// last_used_at is written at most this often per key
+	apiKeyTouchInterval = time.Minute
+
+	scopeRead  = "read"
+	scopeWrite = "write" // Includes read
+)
+
+// A personal access token for scripts. Only a hash of the key is stored.
+type APIKey struct {
+	ID      int    `json:"id"`
+	UserID  int    `json:"-"`
+	Name    string `json:"name"`
+	Prefix  string `json:"prefix"` // Start of the key, e.g. "et_Ab12Cd34"
+	KeyHash string `json:"-"`
+	Scope   string `json:"scope"` // "read" or "write"
+	// Whether the key only works for GroupIDs. A limited key whose groups
+	// were all deleted works for none.
+	GroupLimited bool       `json:"group_limited"`
+	GroupIDs     []int      `json:"group_ids"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Who a request is made by, and with which API key if any
+type Principal struct {
+	UserID int
+	APIKey *APIKey // nil for session tokens
+}
+
+type principalKey struct{}
+
+func principalFromContext(ctx context.Context) Principal {
+	p, _ := ctx.Value(principalKey{}).(Principal)
+	return p
+}
+
+// Groups the request is limited to, nil when it may see all of the user's groups
+func (p Principal) groupIDs() []int {
+	if p.APIKey == nil || !p.APIKey.GroupLimited {
+		return nil
+	}
+	if p.APIKey.GroupIDs == nil {
+		return []int{}
+	}
+	return p.APIKey.GroupIDs
+}
+
+func (p Principal) allowsGroup(groupID int) bool {
+	groups := p.groupIDs()
+	if groups == nil {
+		return true
+	}
+	for _, id := range groups {
+		if id == groupID {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate a request made with either a session JWT or an API key and
+// check that the key has the scope the endpoint needs. The principal is put
+// into the request context, where group checks pick up key restrictions.
+func authenticate(c echo.Context, bodyToken, scope string) (int, error) {
+	token := requestToken(c, bodyToken)
+
+	principal := Principal{}
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		key, err := validateAPIKey(c.Request().Context(), token)
+		if err != nil {
+			return 0, errInvalidToken(err)
+		}
+		if scope == scopeWrite && key.Scope != scopeWrite {
+			return 0, newAPIError(http.StatusForbidden, CodeInsufficientScope, "API key is read-only")
+		}
+		principal = Principal{UserID: key.UserID, APIKey: &key}
+	} else {
+		userID, err := validateToken(c.Request().Context(), token)
+		if err != nil {
+			return 0, errInvalidToken(err)
+		}
+		principal = Principal{UserID: userID}
+	}
+
+	ctx := context.WithValue(c.Request().Context(), principalKey{}, principal)
+	c.SetRequest(c.Request().WithContext(ctx))
+	return principal.UserID, nil
+}
+
+func validateAPIKey(ctx context.Context, token string) (APIKey, error) {
+	key, err := store.GetAPIKeyByHash(ctx, hashAPIKey(token))
+	if errors.Is(err, ErrNotFound) {
+		return key, errors.New("unknown API key")
+	}
+	if err != nil {
+		return key, err
+	}
+	if key.RevokedAt != nil {
+		return key, errors.New("API key has been revoked")
+	}
+
+	now := time.Now().UTC()
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyTouchInterval {
+		if err := store.TouchAPIKey(ctx, key.ID, now); err != nil {
+			return key, err
+		}
+	}
+	return key, nil
+}
+
+func newAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+type CreateAPIKeyRequest struct {
+	Token    string `json:"token"`               // JWT token for authentication
+	Name     string `json:"name"`                // What the key is for, e.g. "bank import script"
+	Scope    string `json:"scope"`               // "read" or "write"
+	GroupIDs []int  `json:"group_ids,omitempty"` // Optional: limit the key to these groups
+}
+
+// Create an API key. The key itself is only part of this response.
+func CreateAPIKey(c echo.Context) error {
+	var req CreateAPIKeyRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	// Keys are managed with a session, a key cannot create more keys
+	userID, err := validateToken(c.Request().Context(), requestToken(c, req.Token))
+	if err != nil {
+		return errInvalidToken(err)
+	}
+
+	v := &validator{}
+	v.required("name", req.Name)
+	if len(req.Name) > 100 {
+		v.add("name", FieldTooLong, "name must be at most 100 characters long")
+	}
+	if req.Scope != scopeRead && req.Scope != scopeWrite {
+		v.add("scope", FieldInvalidFormat, `scope must be "read" or "write"`)
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	secret, err := newAPIKey()
+	if err != nil {
+		return errInternal("Failed to create API key", err)
+	}
+
+	ctx := c.Request().Context()
+	key := APIKey{
+		UserID:       userID,
+		Name:         req.Name,
+		Prefix:       secret[:apiKeyDisplayLength],
+		KeyHash:      hashAPIKey(secret),
+		Scope:        req.Scope,
+		GroupLimited: len(req.GroupIDs) > 0,
+		GroupIDs:     uniqueIDs(req.GroupIDs),
+		CreatedAt:    time.Now().UTC(),
+	}
+	err = store.WithTx(ctx, func(tx Store) error {
+		for _, groupID := range key.GroupIDs {
+			isMember, err := tx.IsMember(ctx, userID, groupID)
+			if err != nil {
+				return errDatabase(err)
+			}
+			if !isMember {
+				return newAPIError(http.StatusForbidden, CodeNotGroupMember, fmt.Sprintf("User is not part of group %d", groupID))
+			}
+		}
+		if err := tx.CreateAPIKey(ctx, &key); err != nil {
+			return errInternal("Failed to create API key", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return respondCreated(c, "", "API key created. Copy it now, it will not be shown again", map[string]interface{}{
+		"key":     secret,
+		"api_key": key,
+	})
+}
+
+func uniqueIDs(ids []int) []int {
+	seen := map[int]bool{}
+	unique := []int{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+type ListAPIKeysRequest struct {
+	Token string `json:"token"` // JWT token for authentication
+}
+
+func ListAPIKeys(c echo.Context) error {
+	var req ListAPIKeysRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := validateToken(c.Request().Context(), requestToken(c, req.Token))
+	if err != nil {
+		return errInvalidToken(err)
+	}
+
+	keys, err := store.ListAPIKeys(c.Request().Context(), userID)
+	if err != nil {
+		return errDatabase(err)
+	}
+
+	return respond(c, http.StatusOK, "", keys)
+}
+
+type RevokeAPIKeyRequest struct {
+	Token string `json:"token"`  // JWT token for authentication
+	KeyID int    `json:"key_id"` // ID of the key to revoke
+}
+
+func RevokeAPIKey(c echo.Context) error {
+	var req RevokeAPIKeyRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := validateToken(c.Request().Context(), requestToken(c, req.Token))
+	if err != nil {
+		return errInvalidToken(err)
+	}
+
+	v := &validator{}
+	v.requiredID("key_id", req.KeyID)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	err = store.RevokeAPIKey(c.Request().Context(), userID, req.KeyID, time.Now().UTC())
+	if errors.Is(err, ErrNotFound) {
+		return newAPIError(http.StatusNotFound, CodeNotFound, "API key not found")
+	}
+	if err != nil {
+		return errInternal("Failed to revoke API key", err)
+	}
+	endStreams(userID, req.KeyID)
+
+	return respond(c, http.StatusOK, "API key revoked", nil)
+}
+
+const apiKeyColumns = "k.id, k.user_id, k.name, k.prefix, k.key_hash, k.scope, k.group_limited, k.created_at, k.last_used_at, k.revoked_at"
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (APIKey, error) {
+	var key APIKey
+	var groupLimited int
+	var lastUsedAt, revokedAt sql.NullTime
+	err := row.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.KeyHash, &key.Scope, &groupLimited,
+		&key.CreatedAt, &lastUsedAt, &revokedAt)
+	key.GroupLimited = groupLimited != 0
+	if lastUsedAt.Valid {
+		key.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+	return key, notFound(err)
+}
+
+func (s *sqlStore) apiKeyGroups(ctx context.Context, keyID int) ([]int, error) {
+	rows, err := s.query(ctx, "SELECT group_id FROM api_key_groups WHERE key_id = ? ORDER BY group_id", keyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groupIDs := []int{}
+	for rows.Next() {
+		var groupID int
+		if err := rows.Scan(&groupID); err != nil {
+			return nil, err
+		}
+		groupIDs = append(groupIDs, groupID)
+	}
+	return groupIDs, rows.Err()
+}
+
+func (s *sqlStore) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	groupLimited := 0
+	if key.GroupLimited {
+		groupLimited = 1
+	}
+	id, err := s.insertID(ctx, `INSERT INTO api_keys (user_id, name, prefix, key_hash, scope, group_limited, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, key.UserID, key.Name, key.Prefix, key.KeyHash, key.Scope, groupLimited, key.CreatedAt)
+	if err != nil {
+		return err
+	}
+	key.ID = id
+
+	for _, groupID := range key.GroupIDs {
+		if _, err := s.exec(ctx, "INSERT INTO api_key_groups (key_id, group_id) VALUES (?, ?)", id, groupID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) GetAPIKeyByHash(ctx context.Context, keyHash string) (APIKey, error) {
+	key, err := scanAPIKey(s.queryRow(ctx, "SELECT "+apiKeyColumns+" FROM api_keys k WHERE k.key_hash = ?", keyHash))
+	if err != nil {
+		return key, err
+	}
+	key.GroupIDs, err = s.apiKeyGroups(ctx, key.ID)
+	return key, err
+}
+
+func (s *sqlStore) ListAPIKeys(ctx context.Context, userID int) ([]APIKey, error) {
+	rows, err := s.query(ctx, "SELECT "+apiKeyColumns+" FROM api_keys k WHERE k.user_id = ? ORDER BY k.created_at DESC, k.id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Load groups once the rows are closed, a transaction has a single connection
+	for i := range keys {
+		if keys[i].GroupIDs, err = s.apiKeyGroups(ctx, keys[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func (s *sqlStore) RevokeAPIKey(ctx context.Context, userID, keyID int, revokedAt time.Time) error {
+	result, err := s.exec(ctx, "UPDATE api_keys SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL", revokedAt, keyID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) TouchAPIKey(ctx context.Context, keyID int, usedAt time.Time) error {
+	_, err := s.exec(ctx, "UPDATE api_keys SET last_used_at = ? WHERE id = ?", usedAt, keyID)
+	return err
+}
+
+func (s *sqlStore) DeleteAPIKeys(ctx context.Context, userID int) error {
+	if _, err := s.exec(ctx, "DELETE FROM api_key_groups WHERE key_id IN (SELECT id FROM api_keys WHERE user_id = ?)", userID); err != nil {
+		return err
+	}
+	_, err := s.exec(ctx, "DELETE FROM api_keys WHERE user_id = ?", userID)
+	return err
+}
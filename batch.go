@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// Operations accepted per batch
+	maxBatchOperations = 100
+
+	batchApplied    = "applied"
+	batchFailed     = "failed"
+	batchRolledBack = "rolled_back"
+)
+
+// Returned inside the batch transaction to roll it back after an operation failed
+var errBatchFailed = errors.New("batch operation failed")
+
+// One change in a batch. Fields left out of an update keep their value.
+type BatchOperation struct {
+	Op        string `json:"op"`                   // "create", "update" or "delete"
+	ExpenseID int    `json:"expense_id,omitempty"` // Expense to update or delete
+	// Group of a created expense. For updates and deletes it is optional and
+	// must be the expense's group when given.
+	GroupID int `json:"group_id,omitempty"`
+	// Optional: moves an updated expense to this group
+	ToGroupID   int      `json:"to_group_id,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Amount      float64  `json:"amount,omitempty"`
+	Category    string   `json:"category,omitempty"`
+	Date        string   `json:"date,omitempty"`
+	PaidBy      int      `json:"paid_by,omitempty"`
+	Notes       *string  `json:"notes,omitempty"`
+	Merchant    *string  `json:"merchant,omitempty"`
+	Tags        []string `json:"tags,omitempty"` // Replaces the tags of an updated expense, [] removes all
+}
+
+type BatchRequest struct {
+	Token      string           `json:"token"` // JWT token or API key for authentication
+	Operations []BatchOperation `json:"operations"`
+}
+
+type BatchResult struct {
+	Index  int    `json:"index"` // Position of the operation in the request
+	Op     string `json:"op"`
+	Status string `json:"status"` // "applied", "failed" or "rolled_back"
+	// The expense after the operation, missing for deletes and rolled back batches
+	Expense *Expense  `json:"expense,omitempty"`
+	Error   *APIError `json:"error,omitempty"`
+}
+
+// Error response of a batch that was rolled back, with the result of every operation
+type batchFailure struct {
+	*APIError
+	Results []BatchResult `json:"results"`
+}
+
+// Create, update and delete many expenses in one transaction. Either all
+// operations are applied or none.
+func BatchExpenses(c echo.Context) error {
+	var req BatchRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	v := &validator{}
+	if len(req.Operations) == 0 {
+		v.add("operations", FieldRequired, "operations is required")
+	}
+	if len(req.Operations) > maxBatchOperations {
+		v.add("operations", FieldTooLong, fmt.Sprintf("at most %d operations can be sent at once", maxBatchOperations))
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	userID, err := authenticate(c, req.Token, scopeWrite)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	results := make([]BatchResult, len(req.Operations))
+	var changes []Event
+	failed := 0
+	err = store.WithTx(ctx, func(tx Store) error {
+		// Keep going after a failure, so the response lists every operation that would fail
+		for i, op := range req.Operations {
+			result := BatchResult{Index: i, Op: op.Op, Status: batchApplied}
+			opEvents, err := applyBatchOperation(ctx, tx, userID, op, &result)
+			var apiErr *APIError
+			if err != nil && (!errors.As(err, &apiErr) || apiErr.Status >= http.StatusInternalServerError) {
+				return err
+			}
+			if apiErr != nil {
+				result.Status = batchFailed
+				result.Expense = nil
+				result.Error = apiErr
+				failed++
+			}
+			results[i] = result
+			changes = append(changes, opEvents...)
+		}
+		if failed > 0 {
+			return errBatchFailed
+		}
+		for _, event := range changes {
+			if err := queueWebhooks(ctx, tx, event); err != nil {
+				return errInternal("Failed to queue webhooks", err)
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errBatchFailed) {
+		for i := range results {
+			if results[i].Status == batchApplied {
+				results[i].Status = batchRolledBack
+				results[i].Expense = nil
+			}
+		}
+		message := fmt.Sprintf("No changes were made, %d of %d operations failed", failed, len(results))
+		return c.JSON(http.StatusUnprocessableEntity, batchFailure{
+			APIError: newAPIError(http.StatusUnprocessableEntity, CodeBatchFailed, message),
+			Results:  results,
+		})
+	}
+	if err != nil {
+		return err
+	}
+	for _, event := range changes {
+		publish(event)
+	}
+
+	return respond(c, http.StatusOK, fmt.Sprintf("%d operations applied", len(results)), results)
+}
+
+func applyBatchOperation(ctx context.Context, tx Store, userID int, op BatchOperation, result *BatchResult) ([]Event, error) {
+	switch op.Op {
+	case mutationCreate:
+		return batchCreate(ctx, tx, userID, op, result)
+	case mutationUpdate:
+		return batchUpdate(ctx, tx, userID, op, result)
+	case mutationDelete:
+		return batchDelete(ctx, tx, userID, op)
+	}
+	v := &validator{}
+	v.add("op", FieldInvalidFormat, `op must be "create", "update" or "delete"`)
+	return nil, v.err()
+}
+
+func batchCreate(ctx context.Context, tx Store, userID int, op BatchOperation, result *BatchResult) ([]Event, error) {
+	v := &validator{}
+	v.requiredID("group_id", op.GroupID)
+	v.required("description", op.Description)
+	v.positive("amount", op.Amount)
+	category := v.category("category", op.Category)
+	date, occurredAt := v.expenseDate("date", op.Date)
+	notes := ""
+	if op.Notes != nil {
+		notes = *op.Notes
+		v.notes("notes", notes)
+	}
+	merchant := ""
+	if op.Merchant != nil {
+		merchant = strings.TrimSpace(*op.Merchant)
+		v.merchant("merchant", merchant)
+	}
+	tags := v.tags("tags", op.Tags)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	isMember, err := isMemberOf(ctx, tx, userID, op.GroupID)
+	if err != nil {
+		return nil, errDatabase(err)
+	}
+	if !isMember {
+		return nil, errNotGroupMember()
+	}
+	if err := checkPayer(ctx, tx, op.GroupID, op.PaidBy); err != nil {
+		return nil, err
+	}
+
+	expense := Expense{
+		Description:  op.Description,
+		Amount:       op.Amount,
+		Category:     category,
+		Date:         date,
+		OwnerGroupID: op.GroupID,
+		OccurredAt:   occurredAt,
+		PaidBy:       &userID,
+		Notes:        notes,
+		Merchant:     merchant,
+	}
+	if op.PaidBy > 0 {
+		expense.PaidBy = &op.PaidBy
+	}
+	if err := tx.CreateExpense(ctx, &expense); err != nil {
+		return nil, errInternal("Failed to add expense", err)
+	}
+	if err := tx.SetExpenseTags(ctx, &expense, tags); err != nil {
+		return nil, errInternal("Failed to tag expense", err)
+	}
+	result.Expense = &expense
+	return []Event{{Type: EventExpenseCreated, GroupID: expense.OwnerGroupID, ActorID: userID, Data: expense}}, nil
+}
+
+// Find the expense an update or delete refers to, in a group the caller is a member of
+func batchTarget(ctx context.Context, tx Store, userID int, op BatchOperation) (Expense, error) {
+	v := &validator{}
+	v.requiredID("expense_id", op.ExpenseID)
+	if err := v.err(); err != nil {
+		return Expense{}, err
+	}
+
+	expense, err := tx.GetExpense(ctx, op.ExpenseID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return expense, errDatabase(err)
+	}
+	if err != nil || (op.GroupID > 0 && expense.OwnerGroupID != op.GroupID) {
+		return expense, newAPIError(http.StatusNotFound, CodeExpenseNotFound, "Expense not found")
+	}
+
+	isMember, err := isMemberOf(ctx, tx, userID, expense.OwnerGroupID)
+	if err != nil {
+		return expense, errDatabase(err)
+	}
+	if !isMember {
+		return expense, errNotGroupMember()
+	}
+	return expense, nil
+}
+
+func batchUpdate(ctx context.Context, tx Store, userID int, op BatchOperation, result *BatchResult) ([]Event, error) {
+	expense, err := batchTarget(ctx, tx, userID, op)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &validator{}
+	if op.Description != "" {
+		expense.Description = op.Description
+	}
+	if op.Amount != 0 {
+		v.positive("amount", op.Amount)
+		expense.Amount = op.Amount
+	}
+	if category := strings.TrimSpace(op.Category); category != "" {
+		expense.Category = category
+	}
+	if op.Date != "" {
+		expense.Date, expense.OccurredAt = v.expenseDate("date", op.Date)
+	}
+	if op.Notes != nil {
+		v.notes("notes", *op.Notes)
+		expense.Notes = *op.Notes
+	}
+	if op.Merchant != nil {
+		v.merchant("merchant", *op.Merchant)
+		expense.Merchant = strings.TrimSpace(*op.Merchant)
+	}
+	tags := v.tags("tags", op.Tags)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	fromGroupID := expense.OwnerGroupID
+	toGroupID := fromGroupID
+	if op.ToGroupID > 0 && op.ToGroupID != fromGroupID {
+		toGroupID = op.ToGroupID
+		isMember, err := isMemberOf(ctx, tx, userID, toGroupID)
+		if err != nil {
+			return nil, errDatabase(err)
+		}
+		if !isMember {
+			return nil, errNotGroupMember()
+		}
+	}
+
+	// The payer has to belong to the group the expense ends up in
+	if toGroupID != fromGroupID {
+		if err := targetPayer(ctx, tx, &expense, toGroupID, op.PaidBy); err != nil {
+			return nil, err
+		}
+	} else if op.PaidBy > 0 {
+		if err := checkPayer(ctx, tx, toGroupID, op.PaidBy); err != nil {
+			return nil, err
+		}
+		expense.PaidBy = &op.PaidBy
+	}
+
+	if err := tx.UpdateExpense(ctx, &expense); err != nil {
+		return nil, errInternal("Failed to update expense", err)
+	}
+	if tags != nil {
+		if err := tx.SetExpenseTags(ctx, &expense, tags); err != nil {
+			return nil, errInternal("Failed to tag expense", err)
+		}
+	}
+	if toGroupID == fromGroupID {
+		result.Expense = &expense
+		return []Event{{Type: EventExpenseUpdated, GroupID: expense.OwnerGroupID, ActorID: userID, Data: expense}}, nil
+	}
+
+	if err := tx.MoveExpense(ctx, &expense, toGroupID); err != nil {
+		return nil, errInternal("Failed to move expense", err)
+	}
+	result.Expense = &expense
+	return movedEvents(expense, fromGroupID, userID), nil
+}
+
+func batchDelete(ctx context.Context, tx Store, userID int, op BatchOperation) ([]Event, error) {
+	expense, err := batchTarget(ctx, tx, userID, op)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.DeleteExpense(ctx, expense.ID); err != nil {
+		return nil, errInternal("Failed to remove expense", err)
+	}
+	return []Event{{Type: EventExpenseDeleted, GroupID: expense.OwnerGroupID, ActorID: userID, Data: DeletedExpenseData{ID: expense.ID}}}, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ISO 20022 camt.053 bank to customer statements. Element names are
+// matched without their namespace, so the versions banks use (001.02 to
+// 001.08 and later) are all read. Only booked entries are imported.
+
+func isCAMT053(content string) bool {
+	head := content[:min(len(content), 4096)]
+	return strings.Contains(head, "BkToCstmrStmt") || strings.Contains(head, "camt.053")
+}
+
+type camtDocument struct {
+	Statements []camtStatement `xml:"BkToCstmrStmt>Stmt"`
+}
+
+type camtStatement struct {
+	IBAN    string      `xml:"Acct>Id>IBAN"`
+	Other   string      `xml:"Acct>Id>Othr>Id"`
+	Entries []camtEntry `xml:"Ntry"`
+}
+
+type camtEntry struct {
+	Ref        string       `xml:"NtryRef"`
+	ServicerID string       `xml:"AcctSvcrRef"`
+	Amount     string       `xml:"Amt"`
+	Indicator  string       `xml:"CdtDbtInd"` // "CRDT" or "DBIT"
+	Status     camtStatus   `xml:"Sts"`
+	BookedOn   camtDate     `xml:"BookgDt"`
+	ValueOn    camtDate     `xml:"ValDt"`
+	Info       string       `xml:"AddtlNtryInf"`
+	Details    []camtDetail `xml:"NtryDtls>TxDtls"`
+}
+
+// Status of an entry, a code of its own from version 001.08 on
+type camtStatus struct {
+	Value string `xml:",chardata"`
+	Code  string `xml:"Cd"`
+}
+
+type camtDate struct {
+	Date     string `xml:"Dt"`
+	DateTime string `xml:"DtTm"`
+}
+
+// Calendar date of a camt date, ignoring the time of day
+func (d camtDate) day() (string, bool) {
+	value := d.Date
+	if value == "" {
+		value = d.DateTime
+	}
+	if len(value) < 10 {
+		return "", false
+	}
+	t, err := time.Parse(dateLayout, value[:10])
+	if err != nil || t.Year() < minExpenseYear || t.Year() > maxExpenseYear {
+		return "", false
+	}
+	return t.Format(dateLayout), true
+}
+
+// One of the transactions booked together as an entry
+type camtDetail struct {
+	ServicerID string `xml:"Refs>AcctSvcrRef"`
+	Amount     string `xml:"AmtDtls>TxAmt>Amt"`
+	// Counterparties, the party element moved under Pty in version 001.08
+	Creditor      string   `xml:"RltdPties>Cdtr>Nm"`
+	CreditorParty string   `xml:"RltdPties>Cdtr>Pty>Nm"`
+	Debtor        string   `xml:"RltdPties>Dbtr>Nm"`
+	DebtorParty   string   `xml:"RltdPties>Dbtr>Pty>Nm"`
+	Unstructured  []string `xml:"RmtInf>Ustrd"`
+	Reference     string   `xml:"RmtInf>Strd>CdtrRefInf>Ref"`
+	Info          string   `xml:"AddtlTxInf"`
+}
+
+func parseCAMT053(content string, _ statementOptions) ([]StatementTransaction, error) {
+	var doc camtDocument
+	if err := xml.Unmarshal([]byte(content), &doc); err != nil {
+		if syntaxErr, ok := err.(*xml.SyntaxError); ok {
+			return nil, statementErrorf(syntaxErr.Line, "%s", syntaxErr.Msg)
+		}
+		return nil, err
+	}
+	if len(doc.Statements) == 0 {
+		return nil, statementErrorf(0, "no BkToCstmrStmt>Stmt element")
+	}
+
+	var transactions []StatementTransaction
+	for s, statement := range doc.Statements {
+		account := statement.IBAN
+		if account == "" {
+			account = statement.Other
+		}
+		start := len(transactions)
+		for e, entry := range statement.Entries {
+			status := firstNonEmpty(entry.Status.Code, entry.Status.Value)
+			if status != "" && status != "BOOK" {
+				continue // Pending and informational entries may still change
+			}
+			entryTransactions, err := camtTransactions(entry, account)
+			if err != nil {
+				return nil, statementErrorf(0, "statement %d, entry %d: %s", s+1, e+1, err)
+			}
+			transactions = append(transactions, entryTransactions...)
+		}
+		fillExternalIDs("camt:"+account, transactions[start:])
+	}
+	uniqueExternalIDs(transactions)
+	return transactions, nil
+}
+
+// The transactions of an entry. A batch booked as one entry gives one
+// transaction per detail carrying its own amount.
+func camtTransactions(entry camtEntry, account string) ([]StatementTransaction, error) {
+	date, ok := entry.BookedOn.day()
+	if !ok {
+		date, ok = entry.ValueOn.day()
+	}
+	if !ok {
+		return nil, fmt.Errorf("no valid BookgDt")
+	}
+	// The indicator is the direction of the booking itself. A reversal
+	// of a debit is booked as a credit, RvslInd only tells it reverses one.
+	sign := 0.0
+	switch strings.TrimSpace(entry.Indicator) {
+	case "DBIT":
+		sign = -1
+	case "CRDT":
+		sign = 1
+	default:
+		return nil, fmt.Errorf("CdtDbtInd must be CRDT or DBIT")
+	}
+
+	ref := firstNonEmpty(entry.ServicerID, entry.Ref)
+	details := entry.Details
+	split := len(details) > 1
+	for _, detail := range details {
+		if strings.TrimSpace(detail.Amount) == "" {
+			split = false
+		}
+	}
+	if !split {
+		amount, ok := parseStatementAmount(entry.Amount)
+		if !ok {
+			return nil, fmt.Errorf("invalid Amt %q", entry.Amount)
+		}
+		t := StatementTransaction{Date: date, Amount: sign * amount, Memo: strings.TrimSpace(entry.Info)}
+		if len(details) > 0 {
+			camtDetails(&t, details[0], sign)
+			ref = firstNonEmpty(ref, details[0].ServicerID)
+		}
+		if ref != "" {
+			t.ExternalID = "camt:" + account + ":" + ref
+		}
+		return []StatementTransaction{t}, nil
+	}
+
+	transactions := make([]StatementTransaction, len(details))
+	for i, detail := range details {
+		amount, ok := parseStatementAmount(detail.Amount)
+		if !ok {
+			return nil, fmt.Errorf("invalid TxAmt %q", detail.Amount)
+		}
+		t := StatementTransaction{Date: date, Amount: sign * amount, Memo: strings.TrimSpace(entry.Info)}
+		camtDetails(&t, detail, sign)
+		switch {
+		case detail.ServicerID != "":
+			t.ExternalID = "camt:" + account + ":" + detail.ServicerID
+		case ref != "":
+			t.ExternalID = fmt.Sprintf("camt:%s:%s:%d", account, ref, i+1)
+		}
+		transactions[i] = t
+	}
+	return transactions, nil
+}
+
+// Take the counterparty and remittance information from a detail. The
+// counterparty of money going out is the creditor.
+func camtDetails(t *StatementTransaction, detail camtDetail, sign float64) {
+	if sign < 0 {
+		t.Payee = firstNonEmpty(detail.Creditor, detail.CreditorParty)
+	} else {
+		t.Payee = firstNonEmpty(detail.Debtor, detail.DebtorParty)
+	}
+	t.Payee = strings.TrimSpace(t.Payee)
+
+	var parts []string
+	for _, line := range detail.Unstructured {
+		if line = strings.TrimSpace(line); line != "" {
+			parts = append(parts, line)
+		}
+	}
+	if len(parts) == 0 && detail.Reference != "" {
+		parts = append(parts, strings.TrimSpace(detail.Reference))
+	}
+	if len(parts) > 0 {
+		t.Memo = strings.Join(parts, " ")
+	} else if detail.Info != "" {
+		t.Memo = strings.TrimSpace(detail.Info)
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" && value != "NOTPROVIDED" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Number references repeated within a statement, some banks give every
+// transaction of a batch the reference of the batch
+func uniqueExternalIDs(transactions []StatementTransaction) {
+	seen := map[string]int{}
+	for i := range transactions {
+		id := transactions[i].ExternalID
+		if id == "" {
+			continue
+		}
+		seen[id]++
+		if seen[id] > 1 {
+			transactions[i].ExternalID = fmt.Sprintf("%s#%d", id, seen[id])
+		}
+	}
+}
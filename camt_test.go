@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCAMT053(t *testing.T) {
+	got, err := parseCAMT053(readStatement(t, "statement.camt053.xml"), statementOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTransactions(t, got, []StatementTransaction{
+		{ExternalID: "camt:DE89370400440532013000:REF-001", Date: "2024-10-05", Amount: -23.4, Payee: "REWE Markt GmbH", Memo: "Einkauf 04.10. Karte 1234"},
+		// The counterparty of money coming in is the debtor
+		{ExternalID: "camt:DE89370400440532013000:REF-002", Date: "2024-10-01", Amount: 2500, Payee: "Employer AG"},
+		// A batch is split by the amounts of its transactions
+		{ExternalID: "camt:DE89370400440532013000:BATCH-9:1", Date: "2024-10-06", Amount: -10, Payee: "Spotify"},
+		{ExternalID: "camt:DE89370400440532013000:BATCH-9:2", Date: "2024-10-06", Amount: -20, Payee: "Netflix", Memo: "RF18 5390"},
+		// Reversals keep the direction of CdtDbtInd: a refund comes in, a returned transfer goes out
+		{ExternalID: "camt:DE89370400440532013000:REF-003", Date: "2024-10-08", Amount: 23.4, Memo: "Storno Lastschrift"},
+		{ExternalID: "camt:DE89370400440532013000:N-7", Date: "2024-10-09", Amount: -100, Memo: "Rueckbuchung Gutschrift"},
+		{ExternalID: "camt:DE89370400440532013000:*", Date: "2024-10-10", Amount: -1.5, Memo: "Entgelt"},
+		{ExternalID: "camt:DE89370400440532013000:*", Date: "2024-10-10", Amount: -1.5, Memo: "Entgelt"},
+		{ExternalID: "camt:0532013001:B-1", Date: "2024-10-11", Amount: -7},
+		{ExternalID: "camt:0532013001:B-1#2", Date: "2024-10-11", Amount: -8},
+	})
+	if got[6].ExternalID == got[7].ExternalID {
+		t.Errorf("identical entries share the ID %q", got[6].ExternalID)
+	}
+}
+
+func TestParseCAMT053Errors(t *testing.T) {
+	entry := func(ntry string) string {
+		return `<Document><BkToCstmrStmt><Stmt><Acct><Id><IBAN>DE1</IBAN></Id></Acct>` + ntry + `</Stmt></BkToCstmrStmt></Document>`
+	}
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"not XML", "<Document>\n<BkToCstmrStmt>\n</Document>", "line 3: element <BkToCstmrStmt> closed by </Document>"},
+		{"no statement", "<Document><BkToCstmrStmt></BkToCstmrStmt></Document>", "no BkToCstmrStmt>Stmt element"},
+		{"no indicator", entry(`<Ntry><Amt>1.00</Amt><Sts>BOOK</Sts><BookgDt><Dt>2024-10-05</Dt></BookgDt></Ntry>`),
+			"statement 1, entry 1: CdtDbtInd must be CRDT or DBIT"},
+		{"no date", entry(`<Ntry><Amt>1.00</Amt><CdtDbtInd>DBIT</CdtDbtInd></Ntry>`), "statement 1, entry 1: no valid BookgDt"},
+		{"invalid amount", entry(`<Ntry><Amt>x</Amt><CdtDbtInd>DBIT</CdtDbtInd><BookgDt><Dt>2024-10-05</Dt></BookgDt></Ntry>`),
+			`statement 1, entry 1: invalid Amt "x"`},
+	}
+	for _, tt := range tests {
+		_, err := parseCAMT053(tt.content, statementOptions{})
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestUniqueExternalIDs(t *testing.T) {
+	transactions := []StatementTransaction{{ExternalID: "a"}, {ExternalID: "b"}, {ExternalID: "a"}, {}, {ExternalID: "a"}, {}}
+	uniqueExternalIDs(transactions)
+	var got []string
+	for _, t := range transactions {
+		got = append(got, t.ExternalID)
+	}
+	want := []string{"a", "b", "a#2", "", "a#3", ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("uniqueExternalIDs gave %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server configuration read from environment variables
+type Config struct {
+	// Storage backend: "sqlite" (default) or "postgres"
+	DBDriver string
+	// SQLite file path or PostgreSQL connection URL
+	DatabaseURL string
+
+	// Public address of the frontend, used for links in emails
+	AppURL string
+
+	// How emails are delivered: "log" (default), "file" or "smtp"
+	MailDriver string
+	// Sender address of outgoing emails
+	MailFrom string
+	// Directory the "file" driver writes messages to
+	MailDir      string
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+
+	// Failed logins allowed per username before it is locked
+	LoginMaxAttempts int
+	// Attempts allowed per client IP on each of /login, /register and /password/forgot
+	IPMaxAttempts int
+	// Period the attempts are counted over
+	RateLimitWindow time.Duration
+	// First lockout, doubled on every further lockout up to RateLimitMaxLockout
+	RateLimitLockout    time.Duration
+	RateLimitMaxLockout time.Duration
+	// Take the client IP from X-Forwarded-For, only safe behind a reverse proxy
+	TrustProxy bool
+
+	// OpenID Connect provider for single sign-on, disabled when empty
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string // Empty for public clients, PKCE protects the code either way
+	// Address of /auth/oidc/callback as registered with the provider
+	OIDCRedirectURL string
+	OIDCScopes      []string
+	// Name of the provider shown on the sign-in button
+	OIDCProviderName string
+	// Create accounts for identities that are not linked to a user yet
+	OIDCAutoProvision bool
+
+	// Shortest password accepted for new passwords
+	PasswordMinLength int
+	// File of breached passwords new passwords are checked against, see readPasswordBlocklist
+	PasswordBlocklist string
+	// Argon2id cost of new password hashes, older hashes are upgraded on login
+	Argon2Memory      uint32 // KiB
+	Argon2Iterations  uint32
+	Argon2Parallelism uint8
+
+	// Attempts made to deliver a webhook event before giving up
+	WebhookMaxAttempts int
+	// How long a receiver has to answer
+	WebhookTimeout time.Duration
+	// Allow webhooks to loopback and private addresses, for receivers on the same machine or network
+	WebhookAllowPrivate bool
+}
+
+func loadConfig() Config {
+	cfg := Config{
+		DBDriver: normalizeDBDriver(envOr("DB_DRIVER", "sqlite")),
+	}
+
+	defaultURL := "./expenses.db"
+	if cfg.DBDriver == "postgres" {
+		defaultURL = "postgres://localhost:5432/expenses?sslmode=disable"
+	}
+	cfg.DatabaseURL = envOr("DATABASE_URL", defaultURL)
+
+	cfg.AppURL = strings.TrimRight(envOr("APP_URL", "http://localhost:8080"), "/")
+	cfg.MailDriver = envOr("MAIL_DRIVER", "log")
+	cfg.MailFrom = envOr("MAIL_FROM", "no-reply@localhost")
+	cfg.MailDir = envOr("MAIL_DIR", "./mail")
+	cfg.SMTPHost = envOr("SMTP_HOST", "localhost")
+	cfg.SMTPPort = envOr("SMTP_PORT", "587")
+	cfg.SMTPUsername = os.Getenv("SMTP_USERNAME")
+	cfg.SMTPPassword = os.Getenv("SMTP_PASSWORD")
+
+	cfg.LoginMaxAttempts = envInt("LOGIN_MAX_ATTEMPTS", 5)
+	cfg.IPMaxAttempts = envInt("IP_MAX_ATTEMPTS", 20)
+	cfg.RateLimitWindow = envDuration("RATE_LIMIT_WINDOW", 15*time.Minute)
+	cfg.RateLimitLockout = envDuration("RATE_LIMIT_LOCKOUT", time.Minute)
+	cfg.RateLimitMaxLockout = envDuration("RATE_LIMIT_MAX_LOCKOUT", time.Hour)
+	cfg.TrustProxy = envOr("TRUST_PROXY", "false") == "true"
+
+	cfg.OIDCIssuer = strings.TrimRight(os.Getenv("OIDC_ISSUER"), "/")
+	cfg.OIDCClientID = os.Getenv("OIDC_CLIENT_ID")
+	cfg.OIDCClientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	cfg.OIDCRedirectURL = envOr("OIDC_REDIRECT_URL", "http://localhost:1234/auth/oidc/callback")
+	cfg.OIDCScopes = strings.Fields(envOr("OIDC_SCOPES", "openid profile email"))
+	cfg.OIDCProviderName = envOr("OIDC_PROVIDER_NAME", "SSO")
+	cfg.OIDCAutoProvision = envOr("OIDC_AUTO_PROVISION", "false") == "true"
+	if cfg.OIDCIssuer != "" && cfg.OIDCClientID == "" {
+		log.Fatalf("OIDC_CLIENT_ID is required when OIDC_ISSUER is set")
+	}
+
+	cfg.PasswordMinLength = envInt("PASSWORD_MIN_LENGTH", 8)
+	cfg.PasswordBlocklist = os.Getenv("PASSWORD_BLOCKLIST")
+	cfg.Argon2Memory = uint32(envIntRange("ARGON2_MEMORY_KIB", 64*1024, 8*1024, 4*1024*1024))
+	cfg.Argon2Iterations = uint32(envIntRange("ARGON2_ITERATIONS", 3, 1, 100))
+	cfg.Argon2Parallelism = uint8(envIntRange("ARGON2_PARALLELISM", 2, 1, 255))
+
+	cfg.WebhookMaxAttempts = envIntRange("WEBHOOK_MAX_ATTEMPTS", 8, 1, 20)
+	cfg.WebhookTimeout = envDuration("WEBHOOK_TIMEOUT", 10*time.Second)
+	cfg.WebhookAllowPrivate = envOr("WEBHOOK_ALLOW_PRIVATE_NETWORKS", "false") == "true"
+
+	return cfg
+}
+
+// Map the accepted spellings of a driver to "sqlite" or "postgres", unknown
+// names are left for openStore to reject
+func normalizeDBDriver(driver string) string {
+	driver = strings.ToLower(strings.TrimSpace(driver))
+	switch driver {
+	case "sqlite3":
+		return "sqlite"
+	case "postgresql":
+		return "postgres"
+	}
+	return driver
+}
+
+// Get an environment variable or a default when it is unset
+func envOr(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	value := envOr(key, strconv.Itoa(fallback))
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Fatalf("%s must be a positive integer, got %q", key, value)
+	}
+	return n
+}
+
+// An integer that must lie between min and max
+func envIntRange(key string, fallback, min, max int) int {
+	n := envInt(key, fallback)
+	if n < min || n > max {
+		log.Fatalf("%s must be between %d and %d, got %d", key, min, max, n)
+	}
+	return n
+}
+
+// Durations use Go syntax, e.g. "90s", "15m" or "1h"
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value := envOr(key, fallback.String())
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Fatalf("%s must be a positive duration such as 15m, got %q", key, value)
+	}
+	return d
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestLoadConfigDatabase(t *testing.T) {
+	tests := []struct {
+		driver string
+		want   string
+		url    string
+	}{
+		{"", "sqlite", "./expenses.db"},
+		{"sqlite3", "sqlite", "./expenses.db"},
+		{"SQLite", "sqlite", "./expenses.db"},
+		{"postgres", "postgres", "postgres://localhost:5432/expenses?sslmode=disable"},
+		{"postgresql", "postgres", "postgres://localhost:5432/expenses?sslmode=disable"},
+		{" PostgreSQL ", "postgres", "postgres://localhost:5432/expenses?sslmode=disable"},
+		{"mysql", "mysql", "./expenses.db"},
+	}
+	for _, tt := range tests {
+		t.Setenv("DB_DRIVER", tt.driver)
+		t.Setenv("DATABASE_URL", "")
+		cfg := loadConfig()
+		if cfg.DBDriver != tt.want || cfg.DatabaseURL != tt.url {
+			t.Errorf("DB_DRIVER=%q gave driver %q and URL %q, want %q and %q", tt.driver, cfg.DBDriver, cfg.DatabaseURL, tt.want, tt.url)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	_ "time/tzdata" // Embed the zone database so user time zones work in minimal containers
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// Layout of the normalised calendar date stored in expenses.date
+	dateLayout = "2006-01-02"
+
+	minExpenseYear = 1900
+	maxExpenseYear = 2100
+)
+
+var errInvalidDate = errors.New("invalid date")
+
+// Parse an expense date given either as a calendar date (YYYY-MM-DD) or as a
+// full RFC 3339 timestamp with time zone. Returns the normalised calendar date
+// and, for timestamps, the instant in UTC.
+func parseExpenseDate(value string) (string, *time.Time, error) {
+	value = strings.TrimSpace(value)
+
+	if t, err := time.Parse(dateLayout, value); err == nil {
+		if t.Year() < minExpenseYear || t.Year() > maxExpenseYear {
+			return "", nil, errInvalidDate
+		}
+		return t.Format(dateLayout), nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", nil, errInvalidDate
+	}
+	if t.Year() < minExpenseYear || t.Year() > maxExpenseYear {
+		return "", nil, errInvalidDate
+	}
+	// The calendar date is the one the client saw in its own offset
+	occurredAt := t.UTC()
+	return t.Format(dateLayout), &occurredAt, nil
+}
+
+// Validate an expense date field and return its normalised parts
+func (v *validator) expenseDate(field, value string) (string, *time.Time) {
+	if value == "" {
+		v.required(field, value)
+		return "", nil
+	}
+	date, occurredAt, err := parseExpenseDate(value)
+	if err != nil {
+		v.add(field, FieldInvalidFormat, field+" must be a date in YYYY-MM-DD format or an RFC 3339 timestamp with time zone")
+	}
+	return date, occurredAt
+}
+
+// Calendar day of an expense as seen from the given location. Expenses with a
+// timestamp are converted, plain dates are the same everywhere.
+func expenseDay(expense Expense, loc *time.Location) string {
+	if expense.OccurredAt != nil {
+		return expense.OccurredAt.In(loc).Format(dateLayout)
+	}
+	return expense.Date
+}
+
+// Load the preferred time zone of a user, falling back to UTC
+func userLocation(ctx context.Context, userID int) (*time.Location, error) {
+	user, err := store.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(user.Timezone)
+	if err != nil {
+		return time.UTC, nil
+	}
+	return loc, nil
+}
+
+// Unambiguous formats accepted when normalising old rows
+var legacyDateLayouts = []string{
+	"2006-1-2",
+	"2006/01/02",
+	"2006/1/2",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	time.RFC3339,
+	time.RFC3339Nano,
+}
+
+func parseLegacyDate(value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range legacyDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.Format(dateLayout), true
+		}
+	}
+	return "", false
+}
+
+type SetTimezoneRequest struct {
+	Token    string `json:"token"`    // JWT token for authentication
+	Timezone string `json:"timezone"` // IANA time zone name, e.g. "Europe/Bratislava"
+}
+
+func SetTimezone(c echo.Context) error {
+	var req SetTimezoneRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	// Validate JWT token
+	userID, err := validateToken(c.Request().Context(), requestToken(c, req.Token))
+	if err != nil {
+		return errInvalidToken(err)
+	}
+
+	v := &validator{}
+	v.required("timezone", req.Timezone)
+	if req.Timezone != "" {
+		if _, err := time.LoadLocation(req.Timezone); err != nil {
+			v.add("timezone", FieldInvalidFormat, "timezone must be an IANA time zone name")
+		}
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	err = store.SetUserTimezone(c.Request().Context(), userID, req.Timezone)
+	if errors.Is(err, ErrNotFound) {
+		return newAPIError(http.StatusNotFound, CodeUserNotFound, "User not found")
+	}
+	if err != nil {
+		return errInternal("Failed to update time zone", err)
+	}
+
+	return respond(c, http.StatusOK, "Time zone updated successfully", map[string]string{"timezone": req.Timezone})
+}
+
+type ExpenseSummaryRequest struct {
+	Token   string   `json:"token"`              // JWT token for authentication
+	GroupID int      `json:"group_id,omitempty"` // Optional: filter by group, 0 for all groups
+	Period  string   `json:"period"`             // "day" or "month"
+	From    string   `json:"from,omitempty"`     // Optional first day (YYYY-MM-DD) in the user's time zone
+	To      string   `json:"to,omitempty"`       // Optional last day (YYYY-MM-DD) in the user's time zone
+	Tags    []string `json:"tags,omitempty"`     // Optional: only expenses with all of these tags
+}
+
+type SummaryBucket struct {
+	Period     string             `json:"period"` // "2024-01-15" for days, "2024-01" for months
+	Total      float64            `json:"total"`
+	Count      int                `json:"count"`
+	ByCategory map[string]float64 `json:"by_category"`
+	// Expenses with several tags count towards each of them
+	ByTag map[string]float64 `json:"by_tag"`
+}
+
+// Totals per day or month, bucketed in the caller's preferred time zone
+func GetExpenseSummary(c echo.Context) error {
+	var req ExpenseSummaryRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := authenticate(c, req.Token, scopeRead)
+	if err != nil {
+		return err
+	}
+
+	v := &validator{}
+	if req.Period == "" {
+		req.Period = "month"
+	}
+	if req.Period != "day" && req.Period != "month" {
+		v.add("period", FieldInvalidFormat, `period must be "day" or "month"`)
+	}
+	if req.From != "" {
+		if _, err := time.Parse(dateLayout, req.From); err != nil {
+			v.add("from", FieldInvalidFormat, "from must be a date in YYYY-MM-DD format")
+		}
+	}
+	if req.To != "" {
+		if _, err := time.Parse(dateLayout, req.To); err != nil {
+			v.add("to", FieldInvalidFormat, "to must be a date in YYYY-MM-DD format")
+		}
+	}
+	tags := v.tags("tags", req.Tags)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	if req.GroupID > 0 {
+		isMember, err := isUserInGroup(ctx, userID, req.GroupID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if !isMember {
+			return errNotGroupMember()
+		}
+	}
+
+	loc, err := userLocation(ctx, userID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return newAPIError(http.StatusNotFound, CodeUserNotFound, "User not found")
+		}
+		return errDatabase(err)
+	}
+
+	expenses, err := store.ListExpenses(ctx, ExpenseFilter{
+		UserID:   userID,
+		GroupID:  req.GroupID,
+		GroupIDs: principalFromContext(ctx).groupIDs(),
+		Tags:     tags,
+	})
+	if err != nil {
+		return errDatabase(err)
+	}
+
+	buckets := map[string]*SummaryBucket{}
+	for _, expense := range expenses {
+		day := expenseDay(expense, loc)
+		if len(day) != len(dateLayout) {
+			// Legacy date that could not be normalised
+			continue
+		}
+		if (req.From != "" && day < req.From) || (req.To != "" && day > req.To) {
+			continue
+		}
+		key := day
+		if req.Period == "month" {
+			key = day[:7]
+		}
+
+		bucket, ok := buckets[key]
+		if !ok {
+			bucket = &SummaryBucket{Period: key, ByCategory: map[string]float64{}, ByTag: map[string]float64{}}
+			buckets[key] = bucket
+		}
+		bucket.Total += expense.Amount
+		bucket.Count++
+		bucket.ByCategory[expense.Category] += expense.Amount
+		for _, tag := range expense.Tags {
+			bucket.ByTag[tag] += expense.Amount
+		}
+	}
+
+	summary := make([]SummaryBucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		summary = append(summary, *bucket)
+	}
+	sort.Slice(summary, func(i, j int) bool { return summary[i].Period < summary[j].Period })
+
+	return respond(c, http.StatusOK, "", map[string]interface{}{
+		"timezone": loc.String(),
+		"period":   req.Period,
+		"buckets":  summary,
+	})
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// Expenses this many days apart or less can be duplicates
+	duplicateMaxDays = 3
+	// Amounts may differ by up to 1% or a cent, whichever is more
+	duplicateAmountTolerance = 0.01
+	// Lowest description similarity of duplicates, 1 for the same text
+	duplicateMinSimilarity = 0.8
+
+	WarningPossibleDuplicate = "possible_duplicate"
+)
+
+// Two expenses of a group that look like the same purchase
+type DuplicateCandidate struct {
+	Expense    Expense `json:"expense"`   // The one added first
+	Duplicate  Expense `json:"duplicate"` // The one added later
+	Similarity float64 `json:"similarity"`
+	DaysApart  int     `json:"days_apart"`
+}
+
+// Whether two expenses are likely the same purchase, and how alike their
+// descriptions are. Expenses whose date is not known are never duplicates.
+func likelyDuplicate(a, b Expense) (float64, int, bool) {
+	if a.ID == b.ID || a.OwnerGroupID != b.OwnerGroupID {
+		return 0, 0, false
+	}
+	if math.Abs(a.Amount-b.Amount) > math.Max(0.01, duplicateAmountTolerance*math.Max(a.Amount, b.Amount)) {
+		return 0, 0, false
+	}
+	dayA, errA := time.Parse(dateLayout, a.Date)
+	dayB, errB := time.Parse(dateLayout, b.Date)
+	if errA != nil || errB != nil {
+		return 0, 0, false
+	}
+	days := int(math.Abs(dayA.Sub(dayB).Hours()) / 24)
+	if days > duplicateMaxDays {
+		return 0, 0, false
+	}
+	similarity := descriptionSimilarity(a.Description, b.Description)
+	return similarity, days, similarity >= duplicateMinSimilarity
+}
+
+// Similarity of two descriptions between 0 and 1, ignoring case,
+// punctuation and the order of words
+func descriptionSimilarity(a, b string) float64 {
+	wordsA, wordsB := descriptionWords(a), descriptionWords(b)
+	similarity := stringSimilarity(strings.Join(wordsA, " "), strings.Join(wordsB, " "))
+	sort.Strings(wordsA)
+	sort.Strings(wordsB)
+	return math.Round(math.Max(similarity, stringSimilarity(strings.Join(wordsA, " "), strings.Join(wordsB, " ")))*1000) / 1000
+}
+
+func descriptionWords(description string) []string {
+	return strings.FieldsFunc(strings.ToLower(description), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// One minus the edit distance relative to the longer string
+func stringSimilarity(a, b string) float64 {
+	runesA, runesB := []rune(a), []rune(b)
+	longest := max(len(runesA), len(runesB))
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(editDistance(runesA, runesB))/float64(longest)
+}
+
+// Levenshtein distance, keeping a single row of the table
+func editDistance(a, b []rune) int {
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		diagonal := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			above := row[j]
+			row[j] = min(row[j]+1, row[j-1]+1, diagonal+cost)
+			diagonal = above
+		}
+	}
+	return row[len(b)]
+}
+
+// Pair up the likely duplicates among a group's expenses, leaving out
+// dismissed pairs. The pairs most alike come first.
+func findDuplicates(expenses []Expense, dismissed map[[2]int]bool) []DuplicateCandidate {
+	sorted := append([]Expense(nil), expenses...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Date != sorted[j].Date {
+			return sorted[i].Date < sorted[j].Date
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	candidates := []DuplicateCandidate{}
+	for i, a := range sorted {
+		day, err := time.Parse(dateLayout, a.Date)
+		if err != nil {
+			continue
+		}
+		// Sorted by date, so later expenses can stop at the end of the window
+		last := day.AddDate(0, 0, duplicateMaxDays).Format(dateLayout)
+		for _, b := range sorted[i+1:] {
+			if b.Date > last {
+				break
+			}
+			similarity, days, ok := likelyDuplicate(a, b)
+			if !ok {
+				continue
+			}
+			first, second := a, b
+			if first.ID > second.ID {
+				first, second = second, first
+			}
+			if dismissed[[2]int{first.ID, second.ID}] {
+				continue
+			}
+			candidates = append(candidates, DuplicateCandidate{Expense: first, Duplicate: second, Similarity: similarity, DaysApart: days})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Similarity != candidates[j].Similarity {
+			return candidates[i].Similarity > candidates[j].Similarity
+		}
+		return candidates[i].Duplicate.ID > candidates[j].Duplicate.ID
+	})
+	return candidates
+}
+
+// Warn about expenses of the group that a new expense looks like
+func duplicateWarning(ctx context.Context, tx Store, expense Expense) (*Warning, error) {
+	day, err := time.Parse(dateLayout, expense.Date)
+	if err != nil {
+		return nil, nil
+	}
+	window := duplicateMaxDays * 24 * time.Hour
+	nearby, err := tx.ListExpensesBetween(ctx, expense.OwnerGroupID, day.Add(-window).Format(dateLayout), day.Add(window).Format(dateLayout))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for _, other := range nearby {
+		if _, _, ok := likelyDuplicate(expense, other); ok {
+			ids = append(ids, other.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return &Warning{
+		Code:       WarningPossibleDuplicate,
+		Message:    fmt.Sprintf("The group has %d similar expense(s) around the same date, this may be a duplicate", len(ids)),
+		ExpenseIDs: ids,
+	}, nil
+}
+
+type ListDuplicatesRequest struct {
+	Token   string `json:"token"`    // JWT token or API key for authentication
+	GroupID int    `json:"group_id"` // ID of the group to check
+}
+
+// List pairs of the group's expenses that look like duplicates
+func ListDuplicates(c echo.Context) error {
+	var req ListDuplicatesRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	v := &validator{}
+	v.requiredID("group_id", req.GroupID)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	userID, err := authenticate(c, req.Token, scopeRead)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	isMember, err := isUserInGroup(ctx, userID, req.GroupID)
+	if err != nil {
+		return errDatabase(err)
+	}
+	if !isMember {
+		return errNotGroupMember()
+	}
+
+	expenses, err := store.ListExpenses(ctx, ExpenseFilter{UserID: userID, GroupID: req.GroupID})
+	if err != nil {
+		return errDatabase(err)
+	}
+	pairs, err := store.ListDismissedDuplicates(ctx, req.GroupID)
+	if err != nil {
+		return errDatabase(err)
+	}
+	dismissed := map[[2]int]bool{}
+	for _, pair := range pairs {
+		dismissed[pair] = true
+	}
+
+	return respond(c, http.StatusOK, "", findDuplicates(expenses, dismissed))
+}
+
+type DuplicatePairRequest struct {
+	Token     string `json:"token"`        // JWT token or API key for authentication
+	ExpenseID int    `json:"expense_id"`   // Expense to keep
+	OtherID   int    `json:"duplicate_id"` // Its duplicate, removed by a merge
+}
+
+// Load both expenses of a pair, which must be in the same group of the caller
+func duplicatePair(ctx context.Context, tx Store, userID int, req DuplicatePairRequest) (Expense, Expense, error) {
+	var expenses [2]Expense
+	for i, id := range []int{req.ExpenseID, req.OtherID} {
+		expense, err := tx.GetExpense(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			return expenses[0], expenses[1], newAPIError(http.StatusNotFound, CodeExpenseNotFound, "Expense not found")
+		}
+		if err != nil {
+			return expenses[0], expenses[1], errDatabase(err)
+		}
+		expenses[i] = expense
+	}
+	keep, duplicate := expenses[0], expenses[1]
+	isMember, err := isMemberOf(ctx, tx, userID, keep.OwnerGroupID)
+	if err != nil {
+		return keep, duplicate, errDatabase(err)
+	}
+	if !isMember {
+		return keep, duplicate, errNotGroupMember()
+	}
+	if duplicate.OwnerGroupID != keep.OwnerGroupID {
+		return keep, duplicate, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "Both expenses must belong to the same group")
+	}
+	return keep, duplicate, nil
+}
+
+func (req DuplicatePairRequest) validate() error {
+	v := &validator{}
+	v.requiredID("expense_id", req.ExpenseID)
+	v.requiredID("duplicate_id", req.OtherID)
+	if req.ExpenseID > 0 && req.ExpenseID == req.OtherID {
+		v.add("duplicate_id", FieldInvalidFormat, "duplicate_id must differ from expense_id")
+	}
+	return v.err()
+}
+
+// Remove the duplicate of an expense. The kept expense gains the
+// duplicate's tags, and its notes and merchant when it has none.
+func MergeDuplicates(c echo.Context) error {
+	var req DuplicatePairRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+	if err := req.validate(); err != nil {
+		return err
+	}
+
+	userID, err := authenticate(c, req.Token, scopeWrite)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	var keep Expense
+	var changes []Event
+	err = store.WithTx(ctx, func(tx Store) error {
+		var duplicate Expense
+		keep, duplicate, err = duplicatePair(ctx, tx, userID, req)
+		if err != nil {
+			return err
+		}
+
+		tags := mergeTags(keep.Tags, duplicate.Tags)
+		changed := len(tags) != len(keep.Tags)
+		if keep.Notes == "" && duplicate.Notes != "" {
+			keep.Notes = duplicate.Notes
+			changed = true
+		}
+		if keep.Merchant == "" && duplicate.Merchant != "" {
+			keep.Merchant = duplicate.Merchant
+			changed = true
+		}
+		if changed {
+			if err := tx.UpdateExpense(ctx, &keep); err != nil {
+				return errInternal("Failed to update expense", err)
+			}
+			if err := tx.SetExpenseTags(ctx, &keep, tags); err != nil {
+				return errInternal("Failed to tag expense", err)
+			}
+			changes = append(changes, Event{Type: EventExpenseUpdated, GroupID: keep.OwnerGroupID, ActorID: userID, Data: keep})
+		}
+
+		if err := tx.DeleteExpense(ctx, duplicate.ID); err != nil {
+			return errInternal("Failed to remove expense", err)
+		}
+		changes = append(changes, Event{Type: EventExpenseDeleted, GroupID: duplicate.OwnerGroupID, ActorID: userID, Data: DeletedExpenseData{ID: duplicate.ID}})
+		for _, event := range changes {
+			if err := queueWebhooks(ctx, tx, event); err != nil {
+				return errInternal("Failed to queue webhooks", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, event := range changes {
+		publish(event)
+	}
+
+	return respond(c, http.StatusOK, "Duplicate removed", keep)
+}
+
+// Mark two expenses as not being duplicates, so they are no longer listed
+func DismissDuplicate(c echo.Context) error {
+	var req DuplicatePairRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+	if err := req.validate(); err != nil {
+		return err
+	}
+
+	userID, err := authenticate(c, req.Token, scopeWrite)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	err = store.WithTx(ctx, func(tx Store) error {
+		if _, _, err := duplicatePair(ctx, tx, userID, req); err != nil {
+			return err
+		}
+		if err := tx.DismissDuplicate(ctx, req.ExpenseID, req.OtherID); err != nil {
+			return errInternal("Failed to dismiss duplicate", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return respond(c, http.StatusOK, "Duplicate dismissed", nil)
+}
+
+func (s *sqlStore) ListExpensesBetween(ctx context.Context, groupID int, from, to string) ([]Expense, error) {
+	return s.listExpenses(ctx, "SELECT "+expenseColumns+" FROM expenses e WHERE e.owner_group_id = ? AND e.date BETWEEN ? AND ? ORDER BY e.id",
+		groupID, from, to)
+}
+
+func (s *sqlStore) DismissDuplicate(ctx context.Context, expenseID, otherID int) error {
+	if expenseID > otherID {
+		expenseID, otherID = otherID, expenseID
+	}
+	_, err := s.exec(ctx, `INSERT INTO duplicate_dismissals (expense_id, other_id, created_at) VALUES (?, ?, ?)
+		ON CONFLICT (expense_id, other_id) DO NOTHING`, expenseID, otherID, time.Now().UTC())
+	return err
+}
+
+func (s *sqlStore) ListDismissedDuplicates(ctx context.Context, groupID int) ([][2]int, error) {
+	rows, err := s.query(ctx, `SELECT d.expense_id, d.other_id FROM duplicate_dismissals d
+		INNER JOIN expenses e ON e.id = d.expense_id
+		WHERE e.owner_group_id = ?`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pairs := [][2]int{}
+	for rows.Next() {
+		var pair [2]int
+		if err := rows.Scan(&pair[0], &pair[1]); err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs, rows.Err()
+}
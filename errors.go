@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Stable machine-readable error codes returned in the "code" field.
+// Clients should switch on these instead of the human readable message.
+const (
+	CodeInvalidRequest    = "invalid_request"
+	CodeValidationFailed  = "validation_failed"
+	CodeInvalidToken      = "invalid_token"
+	CodeInvalidCreds      = "invalid_credentials"
+	CodeReauthRequired    = "reauthentication_required"
+	CodeForbidden         = "forbidden"
+	CodeInsufficientScope = "insufficient_scope"
+	CodeNotGroupMember    = "not_group_member"
+	CodeNotGroupOwner     = "not_group_owner"
+	CodeNotFound          = "not_found"
+	CodeUserNotFound      = "user_not_found"
+	CodeGroupNotFound     = "group_not_found"
+	CodeExpenseNotFound   = "expense_not_found"
+	CodeConflict          = "conflict"
+	CodeBatchFailed       = "batch_failed"
+	CodeUsernameTaken     = "username_taken"
+	CodeEmailTaken        = "email_taken"
+	CodeInvalidResetToken = "invalid_reset_token"
+	CodeInvalidTwoFactor  = "invalid_two_factor_code"
+	CodeTwoFactorEnabled  = "two_factor_enabled"
+	CodeTwoFactorDisabled = "two_factor_not_enabled"
+	CodeAlreadyMember     = "already_member"
+	CodeIdempotencyReuse  = "idempotency_key_reused"
+	CodeIdempotencyBusy   = "idempotency_key_in_progress"
+	CodeMethodNotAllowed  = "method_not_allowed"
+	CodeTooManyRequests   = "too_many_requests"
+	CodeSSOFailed         = "sso_failed"
+	CodeSSONotLinked      = "sso_not_linked"
+	CodeInternal          = "internal_error"
+)
+
+// Field-level validation codes used in FieldError.Code
+const (
+	FieldRequired       = "required"
+	FieldInvalidFormat  = "invalid_format"
+	FieldInvalidType    = "invalid_type"
+	FieldMustBePositive = "must_be_positive"
+	FieldTooShort       = "too_short"
+	FieldTooLong        = "too_long"
+	FieldBreached       = "breached"
+	FieldNotMember      = "not_member"
+)
+
+// A validation problem with a single request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error returned by handlers and rendered by apiErrorHandler
+type APIError struct {
+	Status  int          `json:"-"`
+	Code    string       `json:"code"`
+	Message string       `json:"error"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func newAPIError(status int, code, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+func errInvalidRequest() *APIError {
+	return newAPIError(http.StatusBadRequest, CodeInvalidRequest, "Invalid request")
+}
+
+func errInvalidToken(err error) *APIError {
+	return newAPIError(http.StatusUnauthorized, CodeInvalidToken, "Invalid token: "+err.Error())
+}
+
+func errNotGroupMember() *APIError {
+	return newAPIError(http.StatusForbidden, CodeNotGroupMember, "User is not part of the group")
+}
+
+func errUsernameTaken() *APIError {
+	return newAPIError(http.StatusConflict, CodeUsernameTaken, "Username already exists")
+}
+
+func errEmailTaken() *APIError {
+	return newAPIError(http.StatusConflict, CodeEmailTaken, "Email address is already in use")
+}
+
+// Internal errors are logged with their cause, the client only sees the message
+func errInternal(message string, cause error) *APIError {
+	log.Printf("%s: %v", message, cause)
+	return newAPIError(http.StatusInternalServerError, CodeInternal, message)
+}
+
+func errDatabase(cause error) *APIError {
+	return errInternal("Database error", cause)
+}
+
+// Collects field errors while validating a request
+type validator struct {
+	fields []FieldError
+}
+
+func (v *validator) add(field, code, message string) {
+	v.fields = append(v.fields, FieldError{Field: field, Code: code, Message: message})
+}
+
+func (v *validator) required(field, value string) {
+	if value == "" {
+		v.add(field, FieldRequired, field+" is required")
+	}
+}
+
+func (v *validator) requiredID(field string, value int) {
+	if value <= 0 {
+		v.add(field, FieldRequired, field+" is required")
+	}
+}
+
+func (v *validator) positive(field string, value float64) {
+	if value <= 0 {
+		v.add(field, FieldMustBePositive, field+" must be greater than zero")
+	}
+}
+
+func (v *validator) minLength(field, value string, min int) {
+	if value != "" && len(value) < min {
+		v.add(field, FieldTooShort, fmt.Sprintf("%s must be at least %d characters long", field, min))
+	}
+}
+
+// Returns a validation error if any field failed, nil otherwise
+func (v *validator) err() error {
+	if len(v.fields) == 0 {
+		return nil
+	}
+	return &APIError{
+		Status:  http.StatusBadRequest,
+		Code:    CodeValidationFailed,
+		Message: "Request validation failed",
+		Fields:  v.fields,
+	}
+}
+
+// Bind the request body, turning type mismatches into field errors
+func bindRequest(c echo.Context, req interface{}) error {
+	err := c.Bind(req)
+	if err == nil {
+		return nil
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		v := &validator{}
+		v.add(typeErr.Field, FieldInvalidType, fmt.Sprintf("%s must be of type %s", typeErr.Field, typeErr.Type))
+		return v.err()
+	}
+	return errInvalidRequest()
+}
+
+// Central Echo error handler rendering every error as {"error", "code", "fields"}
+func apiErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	var apiErr *APIError
+	var httpErr *echo.HTTPError
+	switch {
+	case errors.As(err, &apiErr):
+	case errors.As(err, &httpErr):
+		apiErr = newAPIError(httpErr.Code, httpStatusCode(httpErr.Code), fmt.Sprint(httpErr.Message))
+	case errors.Is(err, ErrConflict):
+		// A unique constraint caught a write the handler did not check for
+		apiErr = newAPIError(http.StatusConflict, CodeConflict, "Resource already exists")
+	default:
+		apiErr = errInternal("Internal server error", err)
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(apiErr.Status)
+	} else {
+		err = c.JSON(apiErr.Status, apiErr)
+	}
+	if err != nil {
+		log.Printf("Error writing error response: %v", err)
+	}
+}
+
+// Map an HTTP status produced by Echo itself to an error code
+func httpStatusCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeInvalidRequest
+	case http.StatusUnauthorized:
+		return CodeInvalidToken
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusTooManyRequests:
+		return CodeTooManyRequests
+	default:
+		if status >= http.StatusInternalServerError {
+			return CodeInternal
+		}
+		return CodeInvalidRequest
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Event types pushed to subscribers
+const (
+	EventExpenseCreated = "expense.created"
+	EventExpenseUpdated = "expense.updated"
+	EventExpenseDeleted = "expense.deleted"
+	EventMemberAdded    = "member.added"
+	EventMemberRemoved  = "member.removed"
+	// Sent instead of a replay when events since Last-Event-ID are no longer
+	// known, clients should fetch their data again
+	EventResync = "resync"
+	// Internal, never sent: ends the streams opened with credentials that
+	// stopped working
+	eventCredentialsRevoked = "credentials.revoked"
+)
+
+const (
+	// Events kept for clients reconnecting with Last-Event-ID
+	eventReplaySize = 512
+	// Events queued for a subscriber before it is considered too slow and dropped
+	subscriberBuffer   = 64
+	eventStreamPing    = 25 * time.Second
+	eventStreamRetryMs = 3000
+)
+
+// A change in a group, published after it was committed
+type Event struct {
+	ID      int64       `json:"id"`
+	Type    string      `json:"type"`
+	GroupID int         `json:"group_id"`
+	ActorID int         `json:"actor_id"` // User who made the change
+	Data    interface{} `json:"data"`
+	At      time.Time   `json:"at"`
+	// The member added or removed by a member event. Subscriptions of an added
+	// member start receiving the group's events.
+	MemberID int `json:"-"`
+	// The API key of a credentials.revoked event, 0 for the user's sessions
+	APIKeyID int `json:"-"`
+}
+
+// Hands events to the subscriptions of the groups they happened in. Only
+// covers this process, see DEPLOYMENT.md for running several instances.
+type EventBus struct {
+	mu     sync.Mutex
+	nextID int64
+	recent []Event
+	subs   map[*Subscription]struct{}
+}
+
+type Subscription struct {
+	C      <-chan Event // Closed when the subscriber fell too far behind
+	ch     chan Event
+	userID int
+	// The API key the stream was opened with, 0 for a session
+	apiKeyID int
+	groups   map[int]bool
+	// Limited to the groups of an API key, joining more groups does not widen it
+	fixed bool
+}
+
+var events = newEventBus()
+
+// Announce a committed change to subscribers and wake the webhook
+// dispatcher, whose deliveries were queued by queueWebhooks in the change's
+// transaction
+func publish(event Event) {
+	events.Publish(event)
+	webhooks.notify()
+}
+
+// End the event streams of a user's sessions, after their tokens were
+// revoked, or those of one API key
+func endStreams(userID, apiKeyID int) {
+	events.Publish(Event{Type: eventCredentialsRevoked, ActorID: userID, APIKeyID: apiKeyID})
+}
+
+func newEventBus() *EventBus {
+	// IDs keep growing across restarts, so an old Last-Event-ID is never taken for a recent one
+	return &EventBus{nextID: time.Now().UnixMicro(), subs: map[*Subscription]struct{}{}}
+}
+
+// Whether the subscriber gets the event, following the subscriber's own
+// membership changes. Members who are removed still get the event telling
+// them so, and nothing of the group after it.
+func (s *Subscription) receive(event Event) bool {
+	if event.MemberID == s.userID {
+		switch {
+		case event.Type == EventMemberAdded && !s.fixed:
+			s.groups[event.GroupID] = true
+		case event.Type == EventMemberRemoved:
+			wanted := s.groups[event.GroupID]
+			delete(s.groups, event.GroupID)
+			return wanted
+		}
+	}
+	return s.groups[event.GroupID]
+}
+
+// Publish numbers an event and delivers it without blocking. Subscribers
+// whose buffer is full are dropped, they reconnect and catch up by replay.
+func (b *EventBus) Publish(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Closing the channel ends the stream, the client's reconnect is refused
+	if event.Type == eventCredentialsRevoked {
+		for sub := range b.subs {
+			if sub.userID == event.ActorID && sub.apiKeyID == event.APIKeyID {
+				delete(b.subs, sub)
+				close(sub.ch)
+			}
+		}
+		return
+	}
+
+	event.ID = b.nextID
+	b.nextID++
+	if event.At.IsZero() {
+		event.At = time.Now().UTC()
+	}
+	b.recent = append(b.recent, event)
+	if len(b.recent) > eventReplaySize {
+		b.recent = b.recent[len(b.recent)-eventReplaySize:]
+	}
+
+	for sub := range b.subs {
+		if !sub.receive(event) {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+			delete(b.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// Subscribe the principal to the events of groupIDs. With a lastEventID the
+// events after it are returned for replay, or a resync event if they are no
+// longer known.
+func (b *EventBus) Subscribe(principal Principal, groupIDs []int, lastEventID int64) (*Subscription, []Event) {
+	ch := make(chan Event, subscriberBuffer)
+	sub := &Subscription{C: ch, ch: ch, userID: principal.UserID, groups: map[int]bool{}, fixed: principal.groupIDs() != nil}
+	if principal.APIKey != nil {
+		sub.apiKeyID = principal.APIKey.ID
+	}
+	for _, id := range groupIDs {
+		sub.groups[id] = true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[sub] = struct{}{}
+
+	if lastEventID <= 0 {
+		return sub, nil
+	}
+	oldest := b.nextID
+	if len(b.recent) > 0 {
+		oldest = b.recent[0].ID
+	}
+	if lastEventID+1 < oldest || lastEventID >= b.nextID {
+		return sub, []Event{{ID: b.nextID - 1, Type: EventResync, At: time.Now().UTC()}}
+	}
+	var replay []Event
+	for _, event := range b.recent {
+		if event.ID <= lastEventID {
+			continue
+		}
+		if sub.receive(event) {
+			replay = append(replay, event)
+		}
+	}
+	return sub, replay
+}
+
+func (b *EventBus) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// Payload of member events
+type MemberEventData struct {
+	Member PublicProfile `json:"member"`
+	Group  UsersGroup    `json:"group"`
+}
+
+// Payload of expense.deleted
+type DeletedExpenseData struct {
+	ID int `json:"id"`
+}
+
+// Stream the events of the caller's groups as Server-Sent Events. Browsers
+// cannot set headers on an EventSource, so the token may also be passed as
+// the "token" query parameter. The stream ends when the token expires or
+// stops being valid.
+func StreamEvents(c echo.Context) error {
+	token := requestToken(c, c.QueryParam("token"))
+	userID, err := authenticate(c, token, scopeRead)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	groups, err := store.ListUserGroups(ctx, userID)
+	if err != nil {
+		return errDatabase(err)
+	}
+	principal := principalFromContext(ctx)
+	groupIDs := []int{}
+	for _, group := range groups {
+		if principal.allowsGroup(group.ID) {
+			groupIDs = append(groupIDs, group.ID)
+		}
+	}
+
+	lastEventID, _ := strconv.ParseInt(c.Request().Header.Get("Last-Event-ID"), 10, 64)
+	sub, replay := events.Subscribe(principal, groupIDs, lastEventID)
+	defer events.Unsubscribe(sub)
+
+	// A nil channel never fires, API keys do not expire
+	var expired <-chan time.Time
+	if principal.APIKey == nil {
+		claims, err := tokenClaims(token)
+		if err != nil {
+			return errInvalidToken(err)
+		}
+		if claims.ExpiresAt != nil {
+			timer := time.NewTimer(time.Until(claims.ExpiresAt.Time))
+			defer timer.Stop()
+			expired = timer.C
+		}
+	}
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep reverse proxies such as nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventStreamRetryMs)
+	for _, event := range replay {
+		if err := writeEvent(w, event); err != nil {
+			return nil
+		}
+	}
+	w.Flush()
+
+	ping := time.NewTicker(eventStreamPing)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-expired:
+			return nil
+		case <-ping.C:
+			// Catches revocations endStreams is not told about, such as a deleted account
+			if !streamCredentialsValid(ctx, token) {
+				return nil
+			}
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return nil
+			}
+		case event, ok := <-sub.C:
+			if !ok {
+				// Too slow, the client reconnects and is replayed what it
+				// missed. Or its credentials were revoked, then the reconnect
+				// is refused.
+				return nil
+			}
+			if err := writeEvent(w, event); err != nil {
+				return nil
+			}
+		}
+		w.Flush()
+	}
+}
+
+func streamCredentialsValid(ctx context.Context, token string) bool {
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		_, err := validateAPIKey(ctx, token)
+		return err == nil
+	}
+	_, err := validateToken(ctx, token)
+	return err == nil
+}
+
+// Logger middleware configuration logging the URI with the token query
+// parameter of the event stream blanked out, it holds a JWT or API key
+func requestLoggerConfig() middleware.LoggerConfig {
+	config := middleware.DefaultLoggerConfig
+	config.Format = strings.Replace(config.Format, "${uri}", "${custom}", 1)
+	config.CustomTagFunc = func(c echo.Context, buf *bytes.Buffer) (int, error) {
+		return buf.WriteString(redactedURI(c.Request().URL))
+	}
+	return config
+}
+
+func redactedURI(u *url.URL) string {
+	query := u.Query()
+	if !query.Has("token") {
+		return u.RequestURI()
+	}
+	query.Set("token", "REDACTED")
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.RequestURI()
+}
+
+func writeEvent(w http.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestEventBusCredentialsRevoked(t *testing.T) {
+	bus := newEventBus()
+	session, _ := bus.Subscribe(Principal{UserID: 1}, []int{10}, 0)
+	key, _ := bus.Subscribe(Principal{UserID: 1, APIKey: &APIKey{ID: 7}}, []int{10}, 0)
+	otherKey, _ := bus.Subscribe(Principal{UserID: 1, APIKey: &APIKey{ID: 8}}, []int{10}, 0)
+	otherUser, _ := bus.Subscribe(Principal{UserID: 2}, []int{10}, 0)
+	closed := func(sub *Subscription) bool {
+		select {
+		case _, ok := <-sub.C:
+			return !ok
+		default:
+			return false
+		}
+	}
+
+	bus.Publish(Event{Type: eventCredentialsRevoked, ActorID: 1})
+	if !closed(session) || closed(key) || closed(otherKey) || closed(otherUser) {
+		t.Errorf("revoking sessions closed session %v, key %v, other key %v, other user %v, want only the session",
+			closed(session), closed(key), closed(otherKey), closed(otherUser))
+	}
+	bus.Publish(Event{Type: eventCredentialsRevoked, ActorID: 1, APIKeyID: 7})
+	if !closed(key) || closed(otherKey) {
+		t.Errorf("revoking key 7 closed it %v and key 8 %v, want only key 7", closed(key), closed(otherKey))
+	}
+
+	// Internal events are not numbered, delivered or kept for replays
+	next := bus.nextID
+	bus.Publish(Event{Type: EventExpenseCreated, GroupID: 10})
+	if event := <-otherUser.C; event.ID != next || event.Type != EventExpenseCreated {
+		t.Errorf("got %+v, want the expense event numbered %d", event, next)
+	}
+	if len(bus.recent) != 1 {
+		t.Errorf("%d events kept for replays, want 1", len(bus.recent))
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	roleOwner  = "owner"
+	roleMember = "member"
+)
+
+// A member as listed in a group's details
+type GroupMember struct {
+	PublicProfile
+	Role     string     `json:"role"`                // "owner" or "member"
+	JoinedAt *time.Time `json:"joined_at,omitempty"` // Unknown for members added by older versions
+}
+
+// A group with figures computed for the requesting user
+type GroupDetail struct {
+	UsersGroup
+	Members     []GroupMember `json:"members,omitempty"`
+	MemberCount int           `json:"member_count"`
+	// What the caller paid minus their share of the expenses with a payer,
+	// split equally between the current members. Positive means the others
+	// owe the caller.
+	Balance float64 `json:"balance"`
+	// Total of the group's expenses in the current month of the caller's time zone
+	SpentThisMonth float64 `json:"spent_this_month"`
+	// Latest of the group's creation, a member joining and an expense being added or changed
+	LastActivityAt time.Time `json:"last_activity_at"`
+}
+
+// Compute the details of groups the user is a member of. Members and
+// expenses of all the groups are loaded with one query each.
+func groupDetails(ctx context.Context, userID int, groups []UsersGroup, withMembers bool) ([]GroupDetail, error) {
+	details := make([]GroupDetail, len(groups))
+	if len(groups) == 0 {
+		return details, nil
+	}
+
+	index := map[int]*GroupDetail{}
+	groupIDs := make([]int, len(groups))
+	for i, group := range groups {
+		details[i] = GroupDetail{UsersGroup: group, LastActivityAt: group.CreatedAt}
+		index[group.ID] = &details[i]
+		groupIDs[i] = group.ID
+	}
+
+	memberships, err := store.ListMemberships(ctx, groupIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range memberships {
+		detail := index[m.GroupID]
+		detail.MemberCount++
+		if m.JoinedAt != nil && m.JoinedAt.After(detail.LastActivityAt) {
+			detail.LastActivityAt = *m.JoinedAt
+		}
+		if withMembers {
+			role := roleMember
+			if m.User.ID == detail.OwnerID {
+				role = roleOwner
+			}
+			detail.Members = append(detail.Members, GroupMember{PublicProfile: publicProfile(m.User), Role: role, JoinedAt: m.JoinedAt})
+		}
+	}
+
+	loc, err := userLocation(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	month := time.Now().In(loc).Format("2006-01")
+
+	expenses, err := store.ListExpenses(ctx, ExpenseFilter{UserID: userID, GroupIDs: groupIDs})
+	if err != nil {
+		return nil, err
+	}
+	paid := map[int]float64{}
+	shared := map[int]float64{}
+	for _, expense := range expenses {
+		detail := index[expense.OwnerGroupID]
+		if strings.HasPrefix(expenseDay(expense, loc), month) {
+			detail.SpentThisMonth += expense.Amount
+		}
+		if expense.UpdatedAt.After(detail.LastActivityAt) {
+			detail.LastActivityAt = expense.UpdatedAt
+		}
+		if expense.PaidBy != nil {
+			shared[expense.OwnerGroupID] += expense.Amount
+			if *expense.PaidBy == userID {
+				paid[expense.OwnerGroupID] += expense.Amount
+			}
+		}
+	}
+
+	for i := range details {
+		detail := &details[i]
+		if detail.MemberCount > 0 {
+			detail.Balance = roundCents(paid[detail.ID] - shared[detail.ID]/float64(detail.MemberCount))
+		}
+		detail.SpentThisMonth = roundCents(detail.SpentThisMonth)
+	}
+	return details, nil
+}
+
+func roundCents(amount float64) float64 {
+	rounded := math.Round(amount*100) / 100
+	if rounded == 0 {
+		return 0 // No "-0" in responses
+	}
+	return rounded
+}
+
+func (s *sqlStore) ListMemberships(ctx context.Context, groupIDs []int) ([]Membership, error) {
+	if len(groupIDs) == 0 {
+		return []Membership{}, nil
+	}
+	args := make([]interface{}, len(groupIDs))
+	for i, id := range groupIDs {
+		args[i] = id
+	}
+
+	rows, err := s.query(ctx, `SELECT gm.group_id, gm.joined_at, `+userColumns+`
+		FROM group_members gm
+		INNER JOIN users u ON u.id = gm.user_id
+		WHERE gm.group_id IN (?`+strings.Repeat(", ?", len(groupIDs)-1)+`)
+		ORDER BY gm.group_id, u.username`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := []Membership{}
+	for rows.Next() {
+		var m Membership
+		var joinedAt sql.NullTime
+		m.User, err = scanUser(prefixScanner{rows, []interface{}{&m.GroupID, &joinedAt}})
+		if err != nil {
+			return nil, err
+		}
+		if joinedAt.Valid {
+			m.JoinedAt = &joinedAt.Time
+		}
+		memberships = append(memberships, m)
+	}
+	return memberships, rows.Err()
+}
+
+// Scans columns selected before those a scan function knows about
+type prefixScanner struct {
+	row    interface{ Scan(...interface{}) error }
+	prefix []interface{}
+}
+
+func (p prefixScanner) Scan(dest ...interface{}) error {
+	return p.row.Scan(append(p.prefix, dest...)...)
+}
+
+func (s *sqlStore) ClearPayer(ctx context.Context, userID int) error {
+	rows, err := s.query(ctx, "SELECT id, owner_group_id FROM expenses WHERE paid_by = ?", userID)
+	if err != nil {
+		return err
+	}
+	changed := map[int]int{}
+	for rows.Next() {
+		var id, groupID int
+		if err := rows.Scan(&id, &groupID); err != nil {
+			rows.Close()
+			return err
+		}
+		changed[id] = groupID
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if _, err := s.exec(ctx, "UPDATE expenses SET paid_by = NULL WHERE paid_by = ?", userID); err != nil {
+		return err
+	}
+	if _, err := s.exec(ctx, "UPDATE expense_rules SET paid_by = NULL WHERE paid_by = ?", userID); err != nil {
+		return err
+	}
+	for id, groupID := range changed {
+		if err := s.logChange(ctx, entityExpense, id, groupID, changeUpsert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// Header clients send to make a mutating request safe to retry
+	idempotencyHeader = "Idempotency-Key"
+	// Header set on responses that were replayed from a stored result
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+
+	idempotencyKeyMaxLength = 255
+	idempotencyRetention    = 24 * time.Hour
+	// A reservation still running after this long is taken to belong to a
+	// request that died with the server, and the key is handed to the retry
+	idempotencyLockTimeout = time.Minute
+)
+
+// idempotencyRecorder captures the response so it can be stored for replays
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *idempotencyRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// Idempotency middleware: requests carrying an Idempotency-Key header are
+// executed once, later retries with the same key get the stored response.
+// Keys are scoped to the caller, two users sending the same key never see
+// each other's responses.
+func Idempotency(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get(idempotencyHeader)
+		if key == "" {
+			return next(c)
+		}
+		if len(key) > idempotencyKeyMaxLength {
+			return newAPIError(http.StatusBadRequest, CodeInvalidRequest, "Idempotency-Key is too long")
+		}
+
+		// Read the body so it can be fingerprinted, then put it back for the handler
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return errInvalidRequest()
+		}
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx := c.Request().Context()
+		caller, ok := idempotencyCaller(c, body)
+		if !ok {
+			// The handler rejects the request, there is nothing to store
+			return next(c)
+		}
+		record := IdempotencyRecord{
+			Key:         caller + ":" + key,
+			Method:      c.Request().Method,
+			Path:        c.Path(),
+			RequestHash: idempotencyHash(body),
+			CreatedAt:   time.Now().UTC(),
+		}
+
+		// Look for a previous request with the same key
+		stored, err := store.GetIdempotencyRecord(ctx, record.Key, record.Method, record.Path)
+		switch {
+		case errors.Is(err, ErrNotFound):
+		case err != nil:
+			return errDatabase(err)
+		case time.Since(stored.CreatedAt) > idempotencyRetention:
+			// Expired keys can be reused as if they were new
+			if err := store.DeleteIdempotencyKey(ctx, record.Key, record.Method, record.Path); err != nil {
+				return errDatabase(err)
+			}
+		case stored.StatusCode == 0 && time.Since(stored.CreatedAt) > idempotencyLockTimeout:
+			// Only the first retry gets the key, the others find the new reservation
+			cutoff := time.Now().UTC().Add(-idempotencyLockTimeout)
+			if err := store.DeleteAbandonedIdempotencyKey(ctx, record.Key, record.Method, record.Path, cutoff); err != nil {
+				return errDatabase(err)
+			}
+		case stored.RequestHash != record.RequestHash:
+			return newAPIError(http.StatusUnprocessableEntity, CodeIdempotencyReuse, "Idempotency-Key was already used with a different request")
+		case stored.StatusCode == 0:
+			return newAPIError(http.StatusConflict, CodeIdempotencyBusy, "A request with this Idempotency-Key is still being processed")
+		default:
+			c.Response().Header().Set(idempotencyReplayedHeader, "true")
+			return c.Blob(stored.StatusCode, stored.ContentType, stored.Body)
+		}
+
+		// Reserve the key before running the handler so concurrent retries are rejected
+		if err := store.ReserveIdempotencyKey(ctx, record); err != nil {
+			if !errors.Is(err, ErrConflict) {
+				return errDatabase(err)
+			}
+			return newAPIError(http.StatusConflict, CodeIdempotencyBusy, "A request with this Idempotency-Key is still being processed")
+		}
+
+		// Release the key unless a response was stored, also when the
+		// handler panics, so the client can retry. Use a fresh context, the
+		// request's one may already be cancelled.
+		ctx = context.Background()
+		completed := false
+		defer func() {
+			if completed {
+				return
+			}
+			if err := store.DeleteIdempotencyKey(ctx, record.Key, record.Method, record.Path); err != nil {
+				log.Printf("Error releasing idempotency key: %v", err)
+			}
+		}()
+
+		recorder := &idempotencyRecorder{ResponseWriter: c.Response().Writer}
+		c.Response().Writer = recorder
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+
+		record.StatusCode = c.Response().Status
+		if record.StatusCode >= http.StatusInternalServerError || record.StatusCode == http.StatusTooManyRequests {
+			// Server errors and rate limiting are not stored so the client can retry
+			return nil
+		}
+
+		record.ContentType = c.Response().Header().Get(echo.HeaderContentType)
+		record.Body = recorder.body.Bytes()
+		if err := store.CompleteIdempotencyKey(ctx, record); err != nil {
+			log.Printf("Error storing idempotent response: %v", err)
+			return nil
+		}
+		completed = true
+		return nil
+	}
+}
+
+// The user a request is made for, from the token in the body or the
+// Authorization header. API keys are told apart from sessions of the same
+// user so a script and the app never share keys.
+func idempotencyCaller(c echo.Context, body []byte) (string, bool) {
+	var request struct {
+		Token string `json:"token"`
+	}
+	_ = json.Unmarshal(body, &request)
+	token := requestToken(c, request.Token)
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		apiKey, err := store.GetAPIKeyByHash(c.Request().Context(), hashAPIKey(token))
+		if err != nil || apiKey.RevokedAt != nil {
+			return "", false
+		}
+		return fmt.Sprintf("key-%d", apiKey.ID), true
+	}
+	userID, err := validateToken(c.Request().Context(), token)
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("user-%d", userID), true
+}
+
+// Fingerprint of the request body without the token, so a retry made
+// after refreshing the token still matches
+func idempotencyHash(body []byte) string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err == nil {
+		delete(fields, "token")
+		// Map keys are marshalled sorted, the result does not depend on their order in the body
+		if canonical, err := json.Marshal(fields); err == nil {
+			body = canonical
+		}
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Periodically remove idempotency keys older than the retention window
+func cleanupIdempotencyKeys() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		cutoff := time.Now().UTC().Add(-idempotencyRetention)
+		if err := store.DeleteIdempotencyKeysBefore(context.Background(), cutoff); err != nil {
+			log.Printf("Error cleaning up idempotency keys: %v", err)
+		}
+	}
+}
+
+func (s *sqlStore) GetIdempotencyRecord(ctx context.Context, key, method, path string) (IdempotencyRecord, error) {
+	record := IdempotencyRecord{Key: key, Method: method, Path: path}
+	var statusCode sql.NullInt64
+	var contentType sql.NullString
+	err := s.queryRow(ctx, `SELECT request_hash, status_code, content_type, response_body, created_at
+		FROM idempotency_keys WHERE idempotency_key = ? AND method = ? AND path = ?`, key, method, path).
+		Scan(&record.RequestHash, &statusCode, &contentType, &record.Body, &record.CreatedAt)
+	if err != nil {
+		return record, notFound(err)
+	}
+	record.StatusCode = int(statusCode.Int64)
+	record.ContentType = contentType.String
+	return record, nil
+}
+
+func (s *sqlStore) ReserveIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	_, err := s.exec(ctx, `INSERT INTO idempotency_keys (idempotency_key, method, path, request_hash, created_at)
+		VALUES (?, ?, ?, ?, ?)`, record.Key, record.Method, record.Path, record.RequestHash, record.CreatedAt)
+	return err
+}
+
+func (s *sqlStore) CompleteIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	_, err := s.exec(ctx, `UPDATE idempotency_keys SET status_code = ?, content_type = ?, response_body = ?
+		WHERE idempotency_key = ? AND method = ? AND path = ?`,
+		record.StatusCode, record.ContentType, record.Body, record.Key, record.Method, record.Path)
+	return err
+}
+
+func (s *sqlStore) DeleteIdempotencyKey(ctx context.Context, key, method, path string) error {
+	_, err := s.exec(ctx, "DELETE FROM idempotency_keys WHERE idempotency_key = ? AND method = ? AND path = ?", key, method, path)
+	return err
+}
+
+func (s *sqlStore) DeleteAbandonedIdempotencyKey(ctx context.Context, key, method, path string, cutoff time.Time) error {
+	_, err := s.exec(ctx, `DELETE FROM idempotency_keys
+		WHERE idempotency_key = ? AND method = ? AND path = ? AND status_code IS NULL AND created_at < ?`,
+		key, method, path, cutoff)
+	return err
+}
+
+func (s *sqlStore) DeleteIdempotencyKeysBefore(ctx context.Context, cutoff time.Time) error {
+	_, err := s.exec(ctx, "DELETE FROM idempotency_keys WHERE created_at < ?", cutoff)
+	return err
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Bank statements are imported in two steps. A preview parses the file,
+// maps its transactions onto expenses and stores the result for the
+// caller, without adding anything. Committing the preview adds the
+// expenses. Transactions are remembered by their external ID, so importing
+// an overlapping statement again only adds what is new.
+
+const (
+	maxStatementSize         = 5 << 20 // Bytes of statement text
+	maxStatementTransactions = 5000
+	// Previews that were not committed are deleted after this long
+	importPreviewTTL = 24 * time.Hour
+
+	defaultImportCategory = "Uncategorized"
+
+	importNew             = "new"              // Will be added
+	importAlreadyImported = "already_imported" // Added by an earlier import
+	importSkipped         = "skipped"          // Not an expense, such as money coming in
+	importImported        = "imported"         // Added by committing the preview
+	importExcluded        = "excluded"         // Left out when committing
+)
+
+// A transaction read from a bank statement
+type StatementTransaction struct {
+	// Identifies the transaction for its account, transactions with an ID
+	// seen before in the group are not imported again
+	ExternalID string  `json:"external_id"`
+	Date       string  `json:"date"`   // YYYY-MM-DD
+	Amount     float64 `json:"amount"` // Negative for money going out
+	Payee      string  `json:"payee,omitempty"`
+	Memo       string  `json:"memo,omitempty"`
+	Category   string  `json:"category,omitempty"` // For formats that carry one
+}
+
+// Options for formats that cannot tell everything from the file itself
+type statementOptions struct {
+	// Order of day and month in dates like 01/02/2024, "mdy" or "dmy"
+	DateFormat string
+}
+
+type statementFormat struct {
+	name    string
+	aliases []string
+	// Whether content looks like this format, for requests without a format
+	detect func(content string) bool
+	parse  func(content string, options statementOptions) ([]StatementTransaction, error)
+}
+
+// Formats in the order they are tried when detecting
+var statementFormats = []statementFormat{
+	{name: "ofx", aliases: []string{"qfx"}, detect: isOFX, parse: parseOFX},
+	{name: "qif", detect: isQIF, parse: parseQIF},
+	{name: "camt053", aliases: []string{"camt.053", "camt"}, detect: isCAMT053, parse: parseCAMT053},
+	{name: "mt940", aliases: []string{"sta"}, detect: isMT940, parse: parseMT940},
+}
+
+// Find a format by name, or detect it from content when name is empty
+func findStatementFormat(name, content string) (statementFormat, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, format := range statementFormats {
+		if name == "" && format.detect(content) || name != "" && (name == format.name || containsString(format.aliases, name)) {
+			return format, true
+		}
+	}
+	return statementFormat{}, false
+}
+
+func statementFormatNames() []string {
+	var names []string
+	for _, format := range statementFormats {
+		names = append(names, format.name)
+		names = append(names, format.aliases...)
+	}
+	return names
+}
+
+// Error of a statement that could not be read, with the line it happened on
+type statementError struct {
+	line    int
+	message string
+}
+
+func (e *statementError) Error() string {
+	if e.line > 0 {
+		return fmt.Sprintf("line %d: %s", e.line, e.message)
+	}
+	return e.message
+}
+
+func statementErrorf(line int, format string, args ...interface{}) error {
+	return &statementError{line: line, message: fmt.Sprintf(format, args...)}
+}
+
+// Stable ID for transactions of formats without one, from what the
+// statement says about them. n counts identical transactions, so paying
+// the same amount to the same payee twice on a day gives two IDs.
+func contentExternalID(prefix string, n int, parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x1f")))
+	return fmt.Sprintf("%s:%s:%d", prefix, hex.EncodeToString(sum[:12]), n)
+}
+
+// Give transactions without an external ID one derived from their content
+func fillExternalIDs(prefix string, transactions []StatementTransaction) {
+	seen := map[string]int{}
+	for i := range transactions {
+		t := &transactions[i]
+		if t.ExternalID != "" {
+			continue
+		}
+		parts := []string{t.Date, fmt.Sprintf("%.2f", t.Amount), t.Payee, t.Memo}
+		key := strings.Join(parts, "\x1f")
+		seen[key]++
+		t.ExternalID = contentExternalID(prefix, seen[key], parts...)
+	}
+}
+
+// Parse an amount written with a decimal point or comma and optional
+// thousands separators, such as "-1,234.56" or "1.234,56"
+func parseStatementAmount(value string) (float64, bool) {
+	value = strings.ReplaceAll(strings.TrimSpace(value), " ", "")
+	if value == "" {
+		return 0, false
+	}
+	lastDot, lastComma := strings.LastIndex(value, "."), strings.LastIndex(value, ",")
+	if lastComma > lastDot {
+		// The comma is the decimal separator
+		value = strings.ReplaceAll(value, ".", "")
+		value = strings.Replace(value, ",", ".", 1)
+	} else {
+		value = strings.ReplaceAll(value, ",", "")
+	}
+	amount, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsInf(amount, 0) || math.IsNaN(amount) {
+		return 0, false
+	}
+	return math.Round(amount*100) / 100, true
+}
+
+// A transaction of a preview and what becomes of it
+type ImportRow struct {
+	Index       int                  `json:"index"`
+	Transaction StatementTransaction `json:"transaction"`
+	Status      string               `json:"status"` // "new", "already_imported", "skipped", and after committing "imported" or "excluded"
+	Reason      string               `json:"reason,omitempty"`
+	// The expense that is added for new rows, or was added once imported
+	Expense *Expense `json:"expense,omitempty"`
+	RuleID  int      `json:"rule_id,omitempty"` // Rule that filled in the expense
+	// Existing expenses of the group the transaction looks like, see /duplicates
+	PossibleDuplicates []int `json:"possible_duplicates,omitempty"`
+}
+
+type StatementImport struct {
+	ID          int         `json:"id"`
+	GroupID     int         `json:"group_id"`
+	UserID      int         `json:"user_id"`
+	Format      string      `json:"format"`
+	FileName    string      `json:"file_name,omitempty"`
+	Rows        []ImportRow `json:"rows"`
+	New         int         `json:"new"`
+	Skipped     int         `json:"skipped"` // Including those already imported
+	CreatedAt   time.Time   `json:"created_at"`
+	CommittedAt *time.Time  `json:"committed_at,omitempty"`
+}
+
+func (imp *StatementImport) count() {
+	imp.New, imp.Skipped = 0, 0
+	for _, row := range imp.Rows {
+		if row.Status == importNew || row.Status == importImported {
+			imp.New++
+		} else {
+			imp.Skipped++
+		}
+	}
+}
+
+func errImportNotFound() *APIError {
+	return newAPIError(http.StatusNotFound, CodeNotFound, "Import not found")
+}
+
+type PreviewImportRequest struct {
+	Token    string `json:"token"`               // JWT token or API key for authentication
+	GroupID  int    `json:"group_id"`            // Group the expenses are added to
+	Content  string `json:"content"`             // The statement file as text
+	Format   string `json:"format,omitempty"`    // Optional: detected from content when left out
+	FileName string `json:"file_name,omitempty"` // Optional: shown with the import
+	// Optional: "mdy" (default) or "dmy", for QIF dates like 01/02/2024
+	DateFormat string `json:"date_format,omitempty"`
+	// Optional: category of expenses neither the statement nor a rule categorises
+	DefaultCategory string `json:"default_category,omitempty"`
+	PaidBy          int    `json:"paid_by,omitempty"` // Optional: defaults to a rule's payer or the caller
+}
+
+// Parse a statement and show what importing it would add
+func PreviewImport(c echo.Context) error {
+	var req PreviewImportRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	// Before parsing, only callers who may import are worth the work
+	userID, err := authenticate(c, req.Token, scopeWrite)
+	if err != nil {
+		return err
+	}
+
+	v := &validator{}
+	v.requiredID("group_id", req.GroupID)
+	v.required("content", strings.TrimSpace(req.Content))
+	if len(req.Content) > maxStatementSize {
+		v.add("content", FieldTooLong, fmt.Sprintf("content must be at most %d MB", maxStatementSize>>20))
+	}
+	format, ok := findStatementFormat(req.Format, req.Content)
+	if !ok && req.Format != "" {
+		v.add("format", FieldInvalidFormat, "format must be one of "+strings.Join(statementFormatNames(), ", "))
+	} else if !ok && req.Content != "" {
+		v.add("format", FieldRequired, "the format of the file could not be detected, format is required")
+	}
+	options := statementOptions{DateFormat: strings.ToLower(req.DateFormat)}
+	if options.DateFormat == "" {
+		options.DateFormat = "mdy"
+	}
+	if options.DateFormat != "mdy" && options.DateFormat != "dmy" {
+		v.add("date_format", FieldInvalidFormat, `date_format must be "mdy" or "dmy"`)
+	}
+	category := strings.TrimSpace(req.DefaultCategory)
+	if category == "" {
+		category = defaultImportCategory
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	transactions, err := format.parse(req.Content, options)
+	if err == nil && len(transactions) > maxStatementTransactions {
+		err = fmt.Errorf("the statement has more than %d transactions", maxStatementTransactions)
+	}
+	if err != nil {
+		v.add("content", FieldInvalidFormat, fmt.Sprintf("not a valid %s statement: %s", format.name, err))
+		return v.err()
+	}
+
+	ctx := c.Request().Context()
+	imp := StatementImport{
+		GroupID:   req.GroupID,
+		UserID:    userID,
+		Format:    format.name,
+		FileName:  strings.TrimSpace(req.FileName),
+		CreatedAt: time.Now().UTC(),
+	}
+	err = store.WithTx(ctx, func(tx Store) error {
+		isMember, err := isMemberOf(ctx, tx, userID, req.GroupID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if !isMember {
+			return errNotGroupMember()
+		}
+		if err := checkPayer(ctx, tx, req.GroupID, req.PaidBy); err != nil {
+			return err
+		}
+
+		imp.Rows, err = importRows(ctx, tx, req.GroupID, transactions, category, req.PaidBy)
+		if err != nil {
+			return errDatabase(err)
+		}
+		imp.count()
+
+		if err := tx.DeleteImportsBefore(ctx, imp.CreatedAt.Add(-importPreviewTTL)); err != nil {
+			return errDatabase(err)
+		}
+		if err := tx.CreateImport(ctx, &imp); err != nil {
+			return errInternal("Failed to save import", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return respondCreated(c, "", fmt.Sprintf("%d of %d transactions can be imported", imp.New, len(imp.Rows)), imp)
+}
+
+// Map transactions onto expenses of the group
+func importRows(ctx context.Context, tx Store, groupID int, transactions []StatementTransaction, category string, paidBy int) ([]ImportRow, error) {
+	ids := make([]string, len(transactions))
+	for i, t := range transactions {
+		ids[i] = t.ExternalID
+	}
+	imported, err := tx.ImportedTransactions(ctx, groupID, ids)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := loadRules(ctx, tx, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]ImportRow, len(transactions))
+	seen := map[string]bool{}
+	var from, to string
+	for i, t := range transactions {
+		row := ImportRow{Index: i, Transaction: t, Status: importNew}
+		switch {
+		case imported[t.ExternalID]:
+			row.Status = importAlreadyImported
+		case seen[t.ExternalID]:
+			row.Status, row.Reason = importSkipped, "appears twice in the statement"
+		case t.Amount >= 0:
+			row.Status, row.Reason = importSkipped, "not money going out"
+		}
+		seen[t.ExternalID] = true
+		if row.Status == importNew {
+			expense, tags := transactionExpense(t, groupID, category, paidBy)
+			rule, tags, err := rules.fill(ctx, tx, &expense, tags, paidBy > 0)
+			if err != nil {
+				return nil, err
+			}
+			if rule != nil {
+				row.RuleID = rule.ID
+			}
+			if expense.Category == "" {
+				expense.Category = category
+			}
+			expense.Tags = tags
+			row.Expense = &expense
+			if from == "" || t.Date < from {
+				from = t.Date
+			}
+			if t.Date > to {
+				to = t.Date
+			}
+		}
+		rows[i] = row
+	}
+	if from == "" {
+		return rows, nil
+	}
+
+	// Point out transactions that were already added by hand
+	window := duplicateMaxDays * 24 * time.Hour
+	start, _ := time.Parse(dateLayout, from)
+	end, _ := time.Parse(dateLayout, to)
+	existing, err := tx.ListExpensesBetween(ctx, groupID, start.Add(-window).Format(dateLayout), end.Add(window).Format(dateLayout))
+	if err != nil {
+		return nil, err
+	}
+	for i := range rows {
+		if rows[i].Expense == nil {
+			continue
+		}
+		for _, other := range existing {
+			if _, _, ok := likelyDuplicate(*rows[i].Expense, other); ok {
+				rows[i].PossibleDuplicates = append(rows[i].PossibleDuplicates, other.ID)
+			}
+		}
+	}
+	return rows, nil
+}
+
+// The expense for a transaction going out. The payee becomes the merchant
+// and the description, the memo the notes, or the description when there
+// is no payee.
+func transactionExpense(t StatementTransaction, groupID int, category string, paidBy int) (Expense, []string) {
+	description := t.Payee
+	notes := t.Memo
+	if description == "" {
+		description, notes = t.Memo, ""
+	}
+	if description == "" {
+		description = "Imported transaction"
+	}
+	expense := Expense{
+		Description:  truncateRunes(description, merchantMaxLength),
+		Amount:       math.Round(-t.Amount*100) / 100,
+		Category:     t.Category,
+		Date:         t.Date,
+		OwnerGroupID: groupID,
+		Merchant:     truncateRunes(t.Payee, merchantMaxLength),
+		Notes:        truncateRunes(notes, notesMaxLength),
+	}
+	if paidBy > 0 {
+		expense.PaidBy = &paidBy
+	}
+	return expense, []string{}
+}
+
+type CommitImportRequest struct {
+	Token    string `json:"token"`     // JWT token or API key for authentication
+	ImportID int    `json:"import_id"` // ID returned by the preview
+	// Optional: indexes of rows not to import
+	Exclude []int `json:"exclude,omitempty"`
+	// Optional: categories replacing those of the preview, by row index
+	Categories map[int]string `json:"categories,omitempty"`
+}
+
+// Add the expenses of a preview
+func CommitImport(c echo.Context) error {
+	var req CommitImportRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	v := &validator{}
+	v.requiredID("import_id", req.ImportID)
+	for index, category := range req.Categories {
+		if strings.TrimSpace(category) == "" {
+			v.add(fmt.Sprintf("categories.%d", index), FieldRequired, "categories cannot be empty")
+		}
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	userID, err := authenticate(c, req.Token, scopeWrite)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	var imp StatementImport
+	var changes []Event
+	err = store.WithTx(ctx, func(tx Store) error {
+		imp, err = tx.GetImport(ctx, req.ImportID)
+		if errors.Is(err, ErrNotFound) || err == nil && imp.UserID != userID {
+			// Previews are only visible to whoever made them
+			return errImportNotFound()
+		}
+		if err != nil {
+			return errDatabase(err)
+		}
+		if imp.CommittedAt != nil {
+			return newAPIError(http.StatusConflict, CodeConflict, "The import was already committed")
+		}
+		isMember, err := isMemberOf(ctx, tx, userID, imp.GroupID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if !isMember {
+			return errNotGroupMember()
+		}
+
+		for _, index := range req.Exclude {
+			if index >= 0 && index < len(imp.Rows) && imp.Rows[index].Status == importNew {
+				imp.Rows[index].Status = importExcluded
+			}
+		}
+		changes, err = commitRows(ctx, tx, userID, &imp, req.Categories)
+		if err != nil {
+			return err
+		}
+		for _, event := range changes {
+			if err := queueWebhooks(ctx, tx, event); err != nil {
+				return errInternal("Failed to queue webhooks", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, event := range changes {
+		publish(event)
+	}
+
+	return respond(c, http.StatusOK, fmt.Sprintf("%d expenses imported", len(changes)), imp)
+}
+
+func commitRows(ctx context.Context, tx Store, userID int, imp *StatementImport, categories map[int]string) ([]Event, error) {
+	ids := make([]string, len(imp.Rows))
+	for i, row := range imp.Rows {
+		ids[i] = row.Transaction.ExternalID
+	}
+	// Another import may have added some of them since the preview
+	imported, err := tx.ImportedTransactions(ctx, imp.GroupID, ids)
+	if err != nil {
+		return nil, errDatabase(err)
+	}
+
+	var changes []Event
+	hits := map[int]int{}
+	payers := map[int]bool{}
+	for i := range imp.Rows {
+		row := &imp.Rows[i]
+		if row.Status != importNew {
+			continue
+		}
+		if imported[row.Transaction.ExternalID] {
+			row.Status, row.Expense = importAlreadyImported, nil
+			continue
+		}
+
+		expense := *row.Expense
+		if category, ok := categories[i]; ok {
+			expense.Category = strings.TrimSpace(category)
+		}
+		// Fall back to the caller when the payer left the group since the preview
+		if expense.PaidBy != nil {
+			isMember, ok := payers[*expense.PaidBy]
+			if !ok {
+				isMember, err = tx.IsMember(ctx, *expense.PaidBy, imp.GroupID)
+				if err != nil {
+					return nil, errDatabase(err)
+				}
+				payers[*expense.PaidBy] = isMember
+			}
+			if !isMember {
+				expense.PaidBy = nil
+			}
+		}
+		if expense.PaidBy == nil {
+			expense.PaidBy = &userID
+		}
+
+		tags := expense.Tags
+		if err := tx.CreateExpense(ctx, &expense); err != nil {
+			return nil, errInternal("Failed to add expense", err)
+		}
+		if err := tx.SetExpenseTags(ctx, &expense, tags); err != nil {
+			return nil, errInternal("Failed to tag expense", err)
+		}
+		if err := tx.RecordImportedTransaction(ctx, imp.GroupID, row.Transaction.ExternalID, expense.ID, imp.ID); err != nil {
+			return nil, errInternal("Failed to record imported transaction", err)
+		}
+		if row.RuleID > 0 {
+			hits[row.RuleID]++
+		}
+		row.Status = importImported
+		row.Expense = &expense
+		changes = append(changes, Event{Type: EventExpenseCreated, GroupID: imp.GroupID, ActorID: userID, Data: expense})
+	}
+
+	if len(hits) > 0 {
+		if err := tx.RecordRuleHits(ctx, hits, time.Now().UTC()); err != nil {
+			return nil, errDatabase(err)
+		}
+	}
+	now := time.Now().UTC()
+	imp.CommittedAt = &now
+	imp.count()
+	if err := tx.SaveImport(ctx, *imp); err != nil {
+		return nil, errInternal("Failed to save import", err)
+	}
+	return changes, nil
+}
+
+func (s *sqlStore) CreateImport(ctx context.Context, imp *StatementImport) error {
+	rows, err := json.Marshal(imp.Rows)
+	if err != nil {
+		return err
+	}
+	id, err := s.insertID(ctx, `INSERT INTO statement_imports (group_id, user_id, format, file_name, transactions, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, imp.GroupID, imp.UserID, imp.Format, imp.FileName, string(rows), imp.CreatedAt)
+	if err != nil {
+		return err
+	}
+	imp.ID = id
+	return nil
+}
+
+func (s *sqlStore) GetImport(ctx context.Context, importID int) (StatementImport, error) {
+	var imp StatementImport
+	var rows string
+	var committedAt sql.NullTime
+	err := s.queryRow(ctx, `SELECT id, group_id, user_id, format, file_name, transactions, created_at, committed_at
+		FROM statement_imports WHERE id = ?`, importID).
+		Scan(&imp.ID, &imp.GroupID, &imp.UserID, &imp.Format, &imp.FileName, &rows, &imp.CreatedAt, &committedAt)
+	if err != nil {
+		return imp, notFound(err)
+	}
+	if committedAt.Valid {
+		imp.CommittedAt = &committedAt.Time
+	}
+	if err := json.Unmarshal([]byte(rows), &imp.Rows); err != nil {
+		return imp, err
+	}
+	imp.count()
+	return imp, nil
+}
+
+func (s *sqlStore) SaveImport(ctx context.Context, imp StatementImport) error {
+	rows, err := json.Marshal(imp.Rows)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(ctx, "UPDATE statement_imports SET transactions = ?, committed_at = ? WHERE id = ?", string(rows), imp.CommittedAt, imp.ID)
+	return err
+}
+
+func (s *sqlStore) DeleteImportsBefore(ctx context.Context, before time.Time) error {
+	_, err := s.exec(ctx, "DELETE FROM statement_imports WHERE committed_at IS NULL AND created_at < ?", before)
+	return err
+}
+
+func (s *sqlStore) DeleteUserImports(ctx context.Context, userID int) error {
+	_, err := s.exec(ctx, "DELETE FROM statement_imports WHERE user_id = ?", userID)
+	return err
+}
+
+func (s *sqlStore) ImportedTransactions(ctx context.Context, groupID int, externalIDs []string) (map[string]bool, error) {
+	imported := map[string]bool{}
+	ids := append([]string(nil), externalIDs...)
+	sort.Strings(ids)
+	for start := 0; start < len(ids); start += tagLoadChunkSize {
+		chunk := ids[start:min(start+tagLoadChunkSize, len(ids))]
+		args := []interface{}{groupID}
+		for _, id := range chunk {
+			args = append(args, id)
+		}
+		rows, err := s.query(ctx, `SELECT external_id FROM imported_transactions
+			WHERE group_id = ? AND external_id IN (?`+strings.Repeat(", ?", len(chunk)-1)+`)`, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			imported[id] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return imported, nil
+}
+
+func (s *sqlStore) RecordImportedTransaction(ctx context.Context, groupID int, externalID string, expenseID, importID int) error {
+	_, err := s.exec(ctx, `INSERT INTO imported_transactions (group_id, external_id, expense_id, import_id, created_at)
+		VALUES (?, ?, ?, ?, ?)`, groupID, externalID, expenseID, importID, time.Now().UTC())
+	return err
+}
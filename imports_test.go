@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readStatement(t *testing.T, name string) string {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+// Compare parsed transactions. A want ExternalID ending in "*" only has to
+// be a prefix, for IDs derived from a hash of the content.
+func checkTransactions(t *testing.T, got, want []StatementTransaction) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d transactions, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		idMatches := g.ExternalID == w.ExternalID
+		if prefix, ok := strings.CutSuffix(w.ExternalID, "*"); ok {
+			idMatches = strings.HasPrefix(g.ExternalID, prefix)
+		}
+		g.ExternalID, w.ExternalID = "", ""
+		if !idMatches || g != w {
+			t.Errorf("transaction %d:\n got %+v (ID %q)\nwant %+v (ID %q)", i, got[i], got[i].ExternalID, want[i], want[i].ExternalID)
+		}
+	}
+}
+
+func TestParseStatementAmount(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+		ok    bool
+	}{
+		{"-35.20", -35.2, true},
+		{"1500", 1500, true},
+		{"+7.5", 7.5, true},
+		{" 12.00 ", 12, true},
+		{"-4,50", -4.5, true},
+		{"1,234.56", 1234.56, true},
+		{"1.234,56", 1234.56, true},
+		{"-1.234.567,89", -1234567.89, true},
+		{"1 234,50", 1234.5, true},
+		{"0.005", 0.01, true},
+		{"", 0, false},
+		{"abc", 0, false},
+		{"12-", 0, false},
+		{"1e400", 0, false},
+		{"NaN", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseStatementAmount(tt.value)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseStatementAmount(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFillExternalIDs(t *testing.T) {
+	coffee := StatementTransaction{Date: "2024-10-08", Amount: -4.5, Payee: "COFFEE"}
+	transactions := []StatementTransaction{
+		coffee,
+		{ExternalID: "ofx:1:A1", Date: "2024-10-08", Amount: -4.5, Payee: "COFFEE"},
+		coffee,
+	}
+	fillExternalIDs("ofx:1", transactions)
+
+	if transactions[1].ExternalID != "ofx:1:A1" {
+		t.Errorf("an external ID from the statement was replaced by %q", transactions[1].ExternalID)
+	}
+	first, second := transactions[0].ExternalID, transactions[2].ExternalID
+	if !strings.HasPrefix(first, "ofx:1:") || !strings.HasSuffix(first, ":1") || !strings.HasSuffix(second, ":2") {
+		t.Errorf("identical transactions got IDs %q and %q, want them numbered", first, second)
+	}
+
+	// The same statement imported again gives the same IDs
+	again := []StatementTransaction{coffee, coffee}
+	fillExternalIDs("ofx:1", again)
+	if again[0].ExternalID != first || again[1].ExternalID != second {
+		t.Errorf("IDs changed between imports: %q, %q then %q, %q", first, second, again[0].ExternalID, again[1].ExternalID)
+	}
+	// Other accounts get other IDs
+	other := []StatementTransaction{coffee}
+	fillExternalIDs("ofx:2", other)
+	if other[0].ExternalID == first {
+		t.Errorf("two accounts share the ID %q", first)
+	}
+}
+
+func TestFindStatementFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string // Empty when no format is found
+	}{
+		{"ofx", "", "ofx"},
+		{"QFX", "", "ofx"},
+		{" qif ", "", "qif"},
+		{"camt.053", "", "camt053"},
+		{"sta", "", "mt940"},
+		{"csv", "", ""},
+		{"", readStatement(t, "statement.ofx"), "ofx"},
+		{"", readStatement(t, "statement-v2.ofx"), "ofx"},
+		{"", readStatement(t, "statement.qif"), "qif"},
+		{"", readStatement(t, "statement.camt053.xml"), "camt053"},
+		{"", readStatement(t, "statement.sta"), "mt940"},
+		{"", "date,amount\n2024-10-07,-3.50\n", ""},
+	}
+	for _, tt := range tests {
+		format, ok := findStatementFormat(tt.name, tt.content)
+		if ok != (tt.want != "") || format.name != tt.want {
+			t.Errorf("findStatementFormat(%q, %.20q) = %q, %v, want %q", tt.name, tt.content, format.name, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// An outgoing plain text email
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Delivers emails such as password reset links
+type MailSender interface {
+	Send(ctx context.Context, msg MailMessage) error
+}
+
+var mailer MailSender
+
+// Create the sender selected by MAIL_DRIVER
+func newMailSender(cfg Config) (MailSender, error) {
+	switch cfg.MailDriver {
+	case "log":
+		return logMailSender{}, nil
+	case "file":
+		if err := os.MkdirAll(cfg.MailDir, 0o750); err != nil {
+			return nil, err
+		}
+		return fileMailSender{dir: cfg.MailDir, from: cfg.MailFrom}, nil
+	case "smtp":
+		return smtpMailSender{
+			addr:     net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort),
+			host:     cfg.SMTPHost,
+			username: cfg.SMTPUsername,
+			password: cfg.SMTPPassword,
+			from:     cfg.MailFrom,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAIL_DRIVER %q", cfg.MailDriver)
+	}
+}
+
+// Render a message in RFC 5322 format
+func formatMail(from string, msg MailMessage) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// Writes emails to the server log, for local development
+type logMailSender struct{}
+
+func (logMailSender) Send(ctx context.Context, msg MailMessage) error {
+	log.Printf("Email to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// Stores every email as an .eml file in a directory
+type fileMailSender struct {
+	dir  string
+	from string
+}
+
+func (s fileMailSender) Send(ctx context.Context, msg MailMessage) error {
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), sanitizeFileName(msg.To))
+	return os.WriteFile(filepath.Join(s.dir, name), formatMail(s.from, msg), 0o640)
+}
+
+func sanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// Sends emails through an SMTP server, using STARTTLS when the server offers it
+type smtpMailSender struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+func (s smtpMailSender) Send(ctx context.Context, msg MailMessage) error {
+	var auth smtp.Auth
+	if s.username != "" {
+		auth = smtp.PlainAuth("", s.username, s.password, s.host)
+	}
+	// The envelope needs the bare address of a "Name <address>" sender
+	envelopeFrom := s.from
+	if addr, err := mail.ParseAddress(s.from); err == nil {
+		envelopeFrom = addr.Address
+	}
+	return smtp.SendMail(s.addr, auth, envelopeFrom, []string{msg.To}, formatMail(s.from, msg))
+}
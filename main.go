@@ -1,61 +1,83 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	_ "github.com/mattn/go-sqlite3"
-	"golang.org/x/crypto/bcrypt"
 )
 
-const salt = "1afdcf647dbd07d353987550168"
-
 type Expense struct {
-	ID           int     `json:"id" db:"id"`
-	Description  string  `json:"description" db:"description"`
-	Amount       float64 `json:"amount" db:"amount"`
-	Category     string  `json:"category" db:"category"`
-	Date         string  `json:"date" db:"date"`
-	OwnerGroupID int     `json:"owner_group_id" db:"owner_group_id"`
+	ID           int       `json:"id" db:"id"`
+	Description  string    `json:"description" db:"description"`
+	Amount       float64   `json:"amount" db:"amount"`
+	Category     string    `json:"category" db:"category"`
+	Date         string    `json:"date" db:"date"`
+	OwnerGroupID int        `json:"owner_group_id" db:"owner_group_id"`
+	OccurredAt   *time.Time `json:"occurred_at,omitempty" db:"occurred_at"` // Set when the expense was entered with a full timestamp
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at" db:"updated_at"`
+	PaidBy       *int       `json:"paid_by" db:"paid_by"` // Member who paid, nil for expenses from before payers were recorded
+	ClientID     string     `json:"client_id,omitempty" db:"client_id"` // ID given by an offline client that created the expense through /sync
+	Notes        string     `json:"notes,omitempty" db:"notes"`
+	Merchant     string     `json:"merchant,omitempty" db:"merchant"` // Shop or payee, as printed on receipts and bank statements
+	Tags         []string   `json:"tags,omitempty" db:"-"` // Names of the expense's tags, sorted
 }
 
 type UsersGroup struct {
-	ID       int    `json:"id" db:"id"`
-	Name     string `json:"name" db:"name"`
-	OwnerID  int    `json:"owner_id" db:"owner_id"`   // ID of the user who owns the group
-	UsersIDs []int  `json:"users_ids" db:"users_ids"` // List of user IDs in the group
+	ID        int       `json:"id" db:"id"`
+	Name      string    `json:"name" db:"name"`
+	OwnerID   int       `json:"owner_id" db:"owner_id"`     // ID of the user who owns the group
+	UsersIDs  []int     `json:"users_ids" db:"users_ids"`   // List of user IDs in the group
+	CreatedAt time.Time `json:"created_at" db:"created_at"` // When the group was created
 }
 
 type User struct {
 	ID       int    `json:"id" db:"id"`
 	Username string `json:"username" db:"username"`
-	Password string `json:"password" db:"password"`
+	Password string `json:"-" db:"password"` // Password hash, never sent to clients
+	Timezone string `json:"timezone" db:"timezone"` // IANA time zone used for reports
+	Email    string `json:"-" db:"email"`           // Address for password resets, empty if not set
+	// Profile shown to other users and preferences, see profiles.go
+	DisplayName string `json:"display_name,omitempty" db:"display_name"`
+	AvatarURL   string `json:"avatar_url,omitempty" db:"avatar_url"`
+	Currency    string `json:"currency" db:"currency"`
+	Locale      string `json:"locale" db:"locale"`
+	// Bumped whenever the password changes so previously issued tokens stop working
+	TokenVersion int `json:"-" db:"token_version"`
 }
 
-var db *sql.DB
-
 // JWT secret key
 var jwtSecret = []byte("380cde94f76c8d37d6c3946dff11dffdc5f469bdca3aff5931f1ae1a445856a9776c7624bfbdd8017806c64af182337e51a10c746321ac689cafef2a5bc1e90e")
 
 // JWT Claims structure
 type JWTClaims struct {
-	UserID int `json:"user_id"`
+	UserID       int `json:"user_id"`
+	TokenVersion int    `json:"token_version"`     // Must match the user's current token version
+	Purpose      string `json:"purpose,omitempty"` // Empty for session tokens, see twoFactorPurpose
 	jwt.RegisteredClaims
 }
 
 // Generate JWT token for user
-func generateToken(userID int) (string, error) {
+func generateToken(user User) (string, error) {
+	return signToken(user, "", 24*time.Hour) // Token expires in 24 hours
+}
+
+func signToken(user User, purpose string, ttl time.Duration) (string, error) {
 	claims := &JWTClaims{
-		UserID: userID,
+		UserID:       user.ID,
+		TokenVersion: user.TokenVersion,
+		Purpose:      purpose,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)), // Token expires in 24 hours
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
@@ -65,10 +87,18 @@ func generateToken(userID int) (string, error) {
 }
 
 // Validate JWT token and extract user ID
-func validateToken(tokenString string) (int, error) {
+func validateToken(ctx context.Context, tokenString string) (int, error) {
+	return validateTokenFor(ctx, tokenString, "")
+}
+
+// Validate a JWT token issued for the given purpose
+func validateTokenFor(ctx context.Context, tokenString, purpose string) (int, error) {
 	if tokenString == "" {
 		return 0, errors.New("token is required")
 	}
+	if strings.HasPrefix(tokenString, apiKeyPrefix) {
+		return 0, errors.New("API keys cannot be used for this request, sign in instead")
+	}
 
 	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
 		return jwtSecret, nil
@@ -78,174 +108,207 @@ func validateToken(tokenString string) (int, error) {
 		return 0, err
 	}
 
-	if claims, ok := token.Claims.(*JWTClaims); ok && token.Valid {
-		return claims.UserID, nil
+	claims, ok := token.Claims.(*JWTClaims)
+	if !ok || !token.Valid {
+		return 0, errors.New("invalid token")
+	}
+	if claims.Purpose != purpose {
+		return 0, errors.New("token cannot be used for this request")
 	}
 
-	return 0, errors.New("invalid token")
-}
-
-// Hash password using bcrypt
-func hashPassword(password string) (string, error) {
-	// Add salt to password before hashing
-	saltedPassword := password + salt
-
-	// Generate bcrypt hash with cost 12 (recommended for production)
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(saltedPassword), 12)
+	// Tokens die with the account and whenever the password changes
+	user, err := store.GetUser(ctx, claims.UserID)
+	if errors.Is(err, ErrNotFound) {
+		return 0, errors.New("user no longer exists")
+	}
 	if err != nil {
-		return "", err
+		return 0, err
+	}
+	if user.TokenVersion != claims.TokenVersion {
+		return 0, errors.New("token has been revoked")
 	}
 
-	return string(hashedBytes), nil
+	return claims.UserID, nil
 }
 
-// Verify password using bcrypt
-func verifyPassword(password, hashedPassword string) bool {
-	// Add salt to password before verification
-	saltedPassword := password + salt
-
-	// Compare password with hash
-	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(saltedPassword))
-	return err == nil
+// Claims of a validated token, such as when it expires
+func tokenClaims(tokenString string) (*JWTClaims, error) {
+	claims := &JWTClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	})
+	return claims, err
 }
 
-func initDB() {
-	var err error
-	db, err = sql.Open("sqlite3", "./expenses.db")
+// When a validated token was issued, for requests that need a recent sign-in
+func tokenIssuedAt(tokenString string) (time.Time, error) {
+	claims, err := tokenClaims(tokenString)
 	if err != nil {
-		log.Fatal(err)
+		return time.Time{}, err
 	}
-
-	// Crete Users table
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS users (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		username TEXT UNIQUE NOT NULL,
-		password TEXT NOT NULL
-	)`)
-	if err != nil {
-		log.Fatal(err)
+	if claims.IssuedAt == nil {
+		return time.Time{}, errors.New("token has no issue time")
 	}
+	return claims.IssuedAt.Time, nil
+}
 
-	// Create Expenses table
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS expenses (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		description TEXT NOT NULL,
-		amount REAL NOT NULL,
-		category TEXT NOT NULL,
-		date TEXT NOT NULL,
-		owner_group_id INTEGER NOT NULL,
-		FOREIGN KEY (owner_group_id) REFERENCES users_groups(id)
-	)`)
-	if err != nil {
-		log.Fatal(err)
+// The payer of an expense must be a member of its group. 0 means the caller, who was checked already.
+func checkPayer(ctx context.Context, tx Store, groupID, payerID int) error {
+	if payerID <= 0 {
+		return nil
 	}
-
-	// Create UsersGroups table
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS users_groups (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		name TEXT NOT NULL,
-		owner_id INTEGER NOT NULL,
-		FOREIGN KEY (owner_id) REFERENCES users(id)
-	)`)
+	isMember, err := tx.IsMember(ctx, payerID, groupID)
 	if err != nil {
-		log.Fatal(err)
+		return errDatabase(err)
 	}
-
-	// Create group_members table for many-to-many relationship
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS group_members (
-		group_id INTEGER NOT NULL,
-		user_id INTEGER NOT NULL,
-		PRIMARY KEY (group_id, user_id),
-		FOREIGN KEY (group_id) REFERENCES users_groups(id),
-		FOREIGN KEY (user_id) REFERENCES users(id)
-	)`)
-	if err != nil {
-		log.Fatal(err)
+	if !isMember {
+		return &APIError{
+			Status:  http.StatusBadRequest,
+			Code:    CodeValidationFailed,
+			Message: "Request validation failed",
+			Fields:  []FieldError{{Field: "paid_by", Code: FieldNotMember, Message: "paid_by must be a member of the group"}},
+		}
 	}
+	return nil
 }
 
-func isUserInGroup(userID, groupID int) (bool, error) {
-	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM group_members WHERE user_id = ? AND group_id = ?)", userID, groupID).Scan(&exists)
-	if err != nil {
-		return false, err
-	}
-	return exists, nil
+func isUserInGroup(ctx context.Context, userID, groupID int) (bool, error) {
+	return isMemberOf(ctx, store, userID, groupID)
 }
 
-func userExists(userID int) (bool, error) {
-	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", userID).Scan(&exists)
-	if err != nil {
-		return false, err
+// Membership check that also honours the groups an API key is limited to
+func isMemberOf(ctx context.Context, s Store, userID, groupID int) (bool, error) {
+	if !principalFromContext(ctx).allowsGroup(groupID) {
+		return false, nil
 	}
-	return exists, nil
+	return s.IsMember(ctx, userID, groupID)
+}
+
+func userExists(ctx context.Context, userID int) (bool, error) {
+	return store.UserExists(ctx, userID)
 }
 
 type AddExpenseRequest struct {
-	Token       string  `json:"token"`    // JWT token for authentication
-	GroupID     int     `json:"group_id"` // ID of the group to which the expense belongs
-	Description string  `json:"description"`
-	Amount      float64 `json:"amount"`
-	Category    string  `json:"category"`
-	Date        string  `json:"date"`
+	Token       string   `json:"token"`    // JWT token for authentication
+	GroupID     int      `json:"group_id"` // ID of the group to which the expense belongs
+	Description string   `json:"description"`
+	Amount      float64  `json:"amount"`
+	Category    string   `json:"category,omitempty"` // Optional when one of the group's rules sets it
+	Date        string   `json:"date"`
+	PaidBy      int      `json:"paid_by,omitempty"`  // Optional: member who paid, defaults to a rule's payer or the caller
+	Notes       string   `json:"notes,omitempty"`    // Optional: free-form notes
+	Merchant    string   `json:"merchant,omitempty"` // Optional: shop or payee
+	Tags        []string `json:"tags,omitempty"`     // Optional: tags, created in the group when new
 }
 
 func AddExpense(c echo.Context) error {
 	var req AddExpenseRequest
-	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	if err := bindRequest(c, &req); err != nil {
+		return err
 	}
 
 	// Validate required fields
-	if req.Description == "" || req.Amount <= 0 || req.Category == "" || req.Date == "" || req.GroupID <= 0 {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "All fields are required"})
+	v := &validator{}
+	v.requiredID("group_id", req.GroupID)
+	v.required("description", req.Description)
+	v.positive("amount", req.Amount)
+	date, occurredAt := v.expenseDate("date", req.Date)
+	v.notes("notes", req.Notes)
+	v.merchant("merchant", req.Merchant)
+	tags := v.tags("tags", req.Tags)
+	if err := v.err(); err != nil {
+		return err
 	}
 
-	// Validate JWT token and get user ID
-	userID, err := validateToken(req.Token)
+	// Validate JWT token or API key and get user ID
+	userID, err := authenticate(c, req.Token, scopeWrite)
 	if err != nil {
-		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token: " + err.Error()})
+		return err
 	}
 
-	// check if the user exists
-	exists, err := userExists(userID)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
-	}
-	if !exists {
-		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
-	}
+	ctx := c.Request().Context()
 
-	// Check if the user is part of the group
-	isMember, err := isUserInGroup(userID, req.GroupID)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	expense := Expense{
+		Description:  req.Description,
+		Amount:       req.Amount,
+		Category:     strings.TrimSpace(req.Category),
+		Date:         date,
+		OwnerGroupID: req.GroupID,
+		OccurredAt:   occurredAt,
+		Notes:        req.Notes,
+		Merchant:     strings.TrimSpace(req.Merchant),
 	}
-	if !isMember {
-		return c.JSON(http.StatusForbidden, map[string]string{"error": "User is not part of the group"})
-	}
-
-	// Insert the expense into the database
-	_, err = db.Exec(`INSERT INTO expenses (description, amount, category, date, owner_group_id) VALUES (?, ?, ?, ?, ?)`,
-		req.Description, req.Amount, req.Category, req.Date, req.GroupID)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to add expense"})
+	if req.PaidBy > 0 {
+		expense.PaidBy = &req.PaidBy
 	}
+	var event Event
+	var warnings []Warning
+	err = store.WithTx(ctx, func(tx Store) error {
+		// check if the user exists
+		exists, err := tx.UserExists(ctx, userID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if !exists {
+			return newAPIError(http.StatusNotFound, CodeUserNotFound, "User not found")
+		}
 
-	return c.JSON(http.StatusOK, map[string]string{"message": "Expense added successfully"})
-}
+		// Check if the user is part of the group
+		isMember, err := isMemberOf(ctx, tx, userID, req.GroupID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if !isMember {
+			return errNotGroupMember()
+		}
+		if err := checkPayer(ctx, tx, req.GroupID, req.PaidBy); err != nil {
+			return err
+		}
 
+		// Let the group's rules fill in what was left out
+		tags, err = applyRules(ctx, tx, &expense, tags, req.PaidBy > 0)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if expense.Category == "" {
+			v := &validator{}
+			v.add("category", FieldRequired, "category is required, no rule of the group sets it")
+			return v.err()
+		}
+		if expense.PaidBy == nil {
+			expense.PaidBy = &userID
+		}
 
-func checkExpenseExists(expenseID int) (bool, error) {
-	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM expenses WHERE id = ?)", expenseID).Scan(&exists)
+		// Insert the expense into the database
+		if err := tx.CreateExpense(ctx, &expense); err != nil {
+			return errInternal("Failed to add expense", err)
+		}
+		if err := tx.SetExpenseTags(ctx, &expense, tags); err != nil {
+			return errInternal("Failed to tag expense", err)
+		}
+		// The expense is added either way, the client can remove it again
+		warning, err := duplicateWarning(ctx, tx, expense)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if warning != nil {
+			warnings = append(warnings, *warning)
+		}
+		event = Event{Type: EventExpenseCreated, GroupID: expense.OwnerGroupID, ActorID: userID, Data: expense}
+		if err := queueWebhooks(ctx, tx, event); err != nil {
+			return errInternal("Failed to queue webhooks", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return false, err
+		return err
 	}
-	return exists, nil
+	publish(event)
+
+	return respondCreated(c, fmt.Sprintf("/expenses/%d", expense.ID), "Expense added successfully", expense, warnings...)
 }
 
+
 type removeExpenseRequest struct {
 	Token     string `json:"token"`      // JWT token for authentication
 	GroupID   int    `json:"group_id"`   // ID of the group to which the expense belongs
@@ -254,121 +317,153 @@ type removeExpenseRequest struct {
 
 
 func RemoveExpense(c echo.Context) error {
-	fmt.Println("RemoveExpense called")
 	var req removeExpenseRequest
-	if err := c.Bind(&req); err != nil {
-		fmt.Println("Error binding request:", err)
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	if err := bindRequest(c, &req); err != nil {
+		return err
 	}
 
 	// Validate required fields
-	if req.ExpenseID <= 0 || req.GroupID <= 0 {
-		fmt.Println("Invalid request: Expense ID and Group ID are required")
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Expense ID and Group ID are required"})
+	v := &validator{}
+	v.requiredID("expense_id", req.ExpenseID)
+	v.requiredID("group_id", req.GroupID)
+	if err := v.err(); err != nil {
+		return err
 	}
 
-	// Validate JWT token and get user ID
-	userID, err := validateToken(req.Token)
+	// Validate JWT token or API key and get user ID
+	userID, err := authenticate(c, req.Token, scopeWrite)
 	if err != nil {
-		fmt.Println("Error validating token:", err)
-		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token: " + err.Error()})
+		return err
 	}
 
-	// check if the user exists
-	exists, err := userExists(userID)
-	if err != nil {
-		fmt.Println("Error checking user existence:", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
-	}
-	if !exists {
-		fmt.Println("User not found")
-		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
-	}
+	ctx := c.Request().Context()
 
-	// Check if the user is part of the group
-	isMember, err := isUserInGroup(userID, req.GroupID)
-	if err != nil {
-		fmt.Println("Error checking group membership:", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
-	}
-	if !isMember {
-		fmt.Println("User is not part of the group")
-		return c.JSON(http.StatusForbidden, map[string]string{"error": "User is not part of the group"})
-	}
+	event := Event{Type: EventExpenseDeleted, GroupID: req.GroupID, ActorID: userID, Data: DeletedExpenseData{ID: req.ExpenseID}}
+	err = store.WithTx(ctx, func(tx Store) error {
+		// check if the user exists
+		exists, err := tx.UserExists(ctx, userID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if !exists {
+			return newAPIError(http.StatusNotFound, CodeUserNotFound, "User not found")
+		}
 
-	// Check if the expense exists
-	exists, err = checkExpenseExists(req.ExpenseID)
-	if err != nil {
-		fmt.Println("Error checking expense existence:", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
-	}
-	if !exists {
-		fmt.Println("Expense not found")
-		return c.JSON(http.StatusNotFound, map[string]string{"error": "Expense not found"})
-	}
+		// Check if the user is part of the group
+		isMember, err := isMemberOf(ctx, tx, userID, req.GroupID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if !isMember {
+			return errNotGroupMember()
+		}
 
-	// Delete the expense from the database
-	_, err = db.Exec(`DELETE FROM expenses WHERE id = ?`, req.ExpenseID)
+		// Check if the expense exists in the group
+		expense, err := tx.GetExpense(ctx, req.ExpenseID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return errDatabase(err)
+		}
+		if err != nil || expense.OwnerGroupID != req.GroupID {
+			return newAPIError(http.StatusNotFound, CodeExpenseNotFound, "Expense not found")
+		}
+
+		// Delete the expense from the database
+		if err := tx.DeleteExpense(ctx, req.ExpenseID); err != nil {
+			return errInternal("Failed to remove expense", err)
+		}
+		if err := queueWebhooks(ctx, tx, event); err != nil {
+			return errInternal("Failed to queue webhooks", err)
+		}
+		return nil
+	})
 	if err != nil {
-		fmt.Println("Error deleting expense:", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to remove expense"})
+		return err
 	}
+	publish(event)
 
-	return c.JSON(http.StatusOK, map[string]string{"message": "Expense removed successfully"})
+	return respond(c, http.StatusOK, "Expense removed successfully", nil)
 }
 
 // User Registration
 type RegisterRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Email    string `json:"email,omitempty"` // Optional, needed to reset a forgotten password
 }
 
 func Register(c echo.Context) error {
 	var req RegisterRequest
-	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	if err := bindRequest(c, &req); err != nil {
+		return err
 	}
 
-	// Validate required fields
-	if req.Username == "" || req.Password == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Username and password are required"})
+	// Validate required fields and password strength
+	v := &validator{}
+	v.required("username", req.Username)
+	v.password("password", req.Password)
+	email := v.email("email", req.Email)
+	if err := v.err(); err != nil {
+		return err
 	}
 
-	// Validate password strength (optional but recommended)
-	if len(req.Password) < 8 {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Password must be at least 8 characters long"})
+	// Every registration counts, successful or not, so accounts cannot be created in bulk
+	limit := ipKey(c, "register")
+	if err := checkRateLimits(c, limit); err != nil {
+		return err
 	}
+	hitRateLimits(c, limit)
+
+	ctx := c.Request().Context()
 
 	// Check if username already exists
-	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", req.Username).Scan(&exists)
+	exists, err := store.UsernameExists(ctx, req.Username)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		return errDatabase(err)
 	}
 	if exists {
-		return c.JSON(http.StatusConflict, map[string]string{"error": "Username already exists"})
+		return errUsernameTaken()
 	}
 
-	// Hash the password using bcrypt
+	// Hash the password with the configured algorithm (Argon2id by default)
 	hashedPassword, err := hashPassword(req.Password)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to process password"})
+		return errInternal("Failed to process password", err)
 	}
 
 	// Insert new user with hashed password
-	result, err := db.Exec("INSERT INTO users (username, password) VALUES (?, ?)", req.Username, hashedPassword)
+	var user User
+	err = store.WithTx(ctx, func(tx Store) error {
+		// The unique index decides when two registrations race for the same name
+		user, err = tx.CreateUser(ctx, req.Username, hashedPassword)
+		if errors.Is(err, ErrConflict) {
+			return errUsernameTaken()
+		}
+		if err != nil {
+			return errInternal("Failed to create user", err)
+		}
+
+		if email != "" {
+			err = tx.SetUserEmail(ctx, user.ID, email)
+			if errors.Is(err, ErrConflict) {
+				return errEmailTaken()
+			}
+			if err != nil {
+				return errInternal("Failed to create user", err)
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create user"})
+		return err
 	}
 
-	userID, _ := result.LastInsertId()
-	token, err := generateToken(int(userID))
+	userID := user.ID
+	token, err := generateToken(user)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate token"})
+		return errInternal("Failed to generate token", err)
 	}
 
-	return c.JSON(http.StatusCreated, map[string]interface{}{
-		"message": "User registered successfully",
+	return respondCreated(c, "", "User registered successfully", map[string]interface{}{
 		"user_id": userID,
 		"token":   token,
 	})
@@ -382,39 +477,69 @@ type LoginRequest struct {
 
 func Login(c echo.Context) error {
 	var req LoginRequest
-	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	if err := bindRequest(c, &req); err != nil {
+		return err
 	}
 
 	// Validate required fields
-	if req.Username == "" || req.Password == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Username and password are required"})
+	v := &validator{}
+	v.required("username", req.Username)
+	v.required("password", req.Password)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	// Failed attempts lock the username and the client IP separately
+	limits := []limitKey{ipKey(c, "login"), usernameKey(req.Username)}
+	if err := checkRateLimits(c, limits...); err != nil {
+		return err
 	}
 
 	// Check user credentials
-	var userID int
-	var storedHashedPassword string
-	err := db.QueryRow("SELECT id, password FROM users WHERE username = ?", req.Username).Scan(&userID, &storedHashedPassword)
+	user, err := store.GetUserByUsername(c.Request().Context(), req.Username)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid credentials"})
+		if errors.Is(err, ErrNotFound) {
+			hitRateLimits(c, limits...)
+			return newAPIError(http.StatusUnauthorized, CodeInvalidCreds, "Invalid credentials")
 		}
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		return errDatabase(err)
+	}
+
+	// Verify the password against its stored hash, of any supported scheme
+	userID := user.ID
+	if !verifyPassword(req.Password, user.Password) {
+		hitRateLimits(c, limits...)
+		return newAPIError(http.StatusUnauthorized, CodeInvalidCreds, "Invalid credentials")
 	}
+	resetRateLimits(c, usernameKey(req.Username))
 
-	// Verify password using bcrypt
-	if !verifyPassword(req.Password, storedHashedPassword) {
-		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid credentials"})
+	// Hashes of older versions or weaker settings are replaced while the
+	// password is at hand. A failure only means trying again next time.
+	if passwordNeedsRehash(user.Password) {
+		if newHash, err := hashPassword(req.Password); err != nil {
+			log.Printf("Failed to rehash password of user %d: %v", userID, err)
+		} else if err := store.UpdatePasswordHash(c.Request().Context(), userID, user.Password, newHash); err != nil {
+			log.Printf("Failed to rehash password of user %d: %v", userID, err)
+		}
+	}
+
+	// With two-factor authentication the password only earns a challenge,
+	// the session token is issued by /login/2fa
+	enabled, err := twoFactorEnabled(c.Request().Context(), store, userID)
+	if err != nil {
+		return errDatabase(err)
+	}
+	if enabled {
+		return respondTwoFactorChallenge(c, user, "Two-factor authentication required")
 	}
 
 	// Generate JWT token
-	token, err := generateToken(userID)
+	token, err := generateToken(user)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate token"})
+		return errInternal("Failed to generate token", err)
 	}
 
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"message": "Login successful",
+	return respond(c, http.StatusOK, "Login successful", map[string]interface{}{
 		"user_id": userID,
 		"token":   token,
 	})
@@ -427,39 +552,57 @@ type CreateGroupRequest struct {
 
 func CreateGroup(c echo.Context) error {
 	var req CreateGroupRequest
-	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	if err := bindRequest(c, &req); err != nil {
+		return err
 	}
 
 	// Validate required fields
-	if req.Name == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Group name is required"})
+	v := &validator{}
+	v.required("name", req.Name)
+	if err := v.err(); err != nil {
+		return err
 	}
 
-	// Validate JWT token
-	userID, err := validateToken(req.Token)
+	// Validate JWT token or API key
+	userID, err := authenticate(c, req.Token, scopeWrite)
 	if err != nil {
-		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token: " + err.Error()})
+		return err
 	}
 
-	// Insert new group into the database
-	result, err := db.Exec("INSERT INTO users_groups (name, owner_id) VALUES (?, ?)", req.Name, userID)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create group"})
+	ctx := c.Request().Context()
+
+	// A key limited to some groups cannot create new ones
+	if principalFromContext(ctx).groupIDs() != nil {
+		return newAPIError(http.StatusForbidden, CodeInsufficientScope, "API key is limited to specific groups")
 	}
 
-	groupID, _ := result.LastInsertId()
+	var group UsersGroup
+	err = store.WithTx(ctx, func(tx Store) error {
+		// Insert new group into the database
+		groupID, err := tx.CreateGroup(ctx, req.Name, userID)
+		if errors.Is(err, ErrInvalidReference) {
+			return newAPIError(http.StatusNotFound, CodeUserNotFound, "User not found")
+		}
+		if err != nil {
+			return errInternal("Failed to create group", err)
+		}
+
+		// Add the owner to the group as a member
+		if err := tx.AddMember(ctx, groupID, userID); err != nil {
+			return errInternal("Failed to add owner to group", err)
+		}
 
-	// Add the owner to the group as a member
-	_, err = db.Exec("INSERT INTO group_members (group_id, user_id) VALUES (?, ?)", groupID, userID)
+		group, err = tx.GetGroup(ctx, groupID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		return nil
+	})
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to add owner to group"})
+		return err
 	}
 
-	return c.JSON(http.StatusCreated, map[string]interface{}{
-		"message":  "Group created successfully",
-		"group_id": groupID,
-	})
+	return respondCreated(c, fmt.Sprintf("/groups/%d", group.ID), "Group created successfully", group)
 }
 
 type AddUserToGroupRequest struct {
@@ -470,219 +613,372 @@ type AddUserToGroupRequest struct {
 
 func AddUserToGroup(c echo.Context) error {
 	var req AddUserToGroupRequest
-	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	if err := bindRequest(c, &req); err != nil {
+		return err
 	}
 
 	// Validate required fields
-	if req.GroupID <= 0 || req.UserID <= 0 {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Group ID and User ID are required"})
+	v := &validator{}
+	v.requiredID("group_id", req.GroupID)
+	v.requiredID("user_id", req.UserID)
+	if err := v.err(); err != nil {
+		return err
 	}
 
-	// Validate JWT token
-	validUserID, err := validateToken(req.Token)
+	// Validate JWT token or API key
+	validUserID, err := authenticate(c, req.Token, scopeWrite)
 	if err != nil {
-		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token: " + err.Error()})
+		return err
 	}
 
-	// Check if the user is the owner of the group
-	var ownerID int
-	err = db.QueryRow("SELECT owner_id FROM users_groups WHERE id = ?", req.GroupID).Scan(&ownerID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return c.JSON(http.StatusNotFound, map[string]string{"error": "Group not found"})
-		}
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
-	}
+	ctx := c.Request().Context()
 
-	if ownerID != validUserID {
-		return c.JSON(http.StatusForbidden, map[string]string{"error": "Only the group owner can add users"})
+	if !principalFromContext(ctx).allowsGroup(req.GroupID) {
+		return newAPIError(http.StatusNotFound, CodeGroupNotFound, "Group not found")
 	}
 
-	// Check if the user already exists in the group
-	var exists bool
-	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM group_members WHERE group_id = ? AND user_id = ?)", req.GroupID, req.UserID).Scan(&exists)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
-	}
-	if exists {
-		return c.JSON(http.StatusConflict, map[string]string{"error": "User already exists in the group"})
-	}
+	var group UsersGroup
+	var event Event
+	err = store.WithTx(ctx, func(tx Store) error {
+		// Check if the user is the owner of the group
+		group, err = tx.GetGroup(ctx, req.GroupID)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return newAPIError(http.StatusNotFound, CodeGroupNotFound, "Group not found")
+			}
+			return errDatabase(err)
+		}
 
-	// Add the user to the group
-	_, err = db.Exec("INSERT INTO group_members (group_id, user_id) VALUES (?, ?)", req.GroupID, req.UserID)
+		if group.OwnerID != validUserID {
+			return newAPIError(http.StatusForbidden, CodeNotGroupOwner, "Only the group owner can add users")
+		}
+
+		// Add the user to the group, the constraints catch duplicates and unknown users
+		err = tx.AddMember(ctx, req.GroupID, req.UserID)
+		if errors.Is(err, ErrConflict) {
+			return newAPIError(http.StatusConflict, CodeAlreadyMember, "User already exists in the group")
+		}
+		if errors.Is(err, ErrInvalidReference) {
+			return newAPIError(http.StatusNotFound, CodeUserNotFound, "User not found")
+		}
+		if err != nil {
+			return errInternal("Failed to add user to group", err)
+		}
+
+		group, err = tx.GetGroup(ctx, req.GroupID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		member, err := tx.GetUser(ctx, req.UserID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		event = Event{Type: EventMemberAdded, GroupID: group.ID, ActorID: validUserID, MemberID: member.ID,
+			Data: MemberEventData{Member: publicProfile(member), Group: group}}
+		if err := queueWebhooks(ctx, tx, event); err != nil {
+			return errInternal("Failed to queue webhooks", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to add user to group"})
+		return err
 	}
+	publish(event)
 
-	return c.JSON(http.StatusOK, map[string]string{"message": "User added to group successfully"})
+	return respondCreated(c, fmt.Sprintf("/groups/%d", group.ID), "User added to group successfully", group)
 }
 
 type GetExpensesRequest struct {
-	Token   string `json:"token"`              // JWT token for authentication
-	GroupID int    `json:"group_id,omitempty"` // Optional: filter by group, -1 for all groups
+	Token   string   `json:"token"`              // JWT token for authentication
+	GroupID int      `json:"group_id,omitempty"` // Optional: filter by group, -1 for all groups
+	Tags    []string `json:"tags,omitempty"`     // Optional: only expenses with all of these tags
 }
 
 func GetExpenses(c echo.Context) error {
 	var req GetExpensesRequest
-	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	if err := bindRequest(c, &req); err != nil {
+		return err
 	}
 
-	// Validate JWT token
-	UserID, err := validateToken(req.Token)
+	v := &validator{}
+	tags := v.tags("tags", req.Tags)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	// Validate JWT token or API key
+	UserID, err := authenticate(c, req.Token, scopeRead)
 	if err != nil {
-		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token: " + err.Error()})
+		return err
 	}
 
-	// Build query based on group filter
-	var query string
-	var args []interface{}
+	ctx := c.Request().Context()
 
+	// Filter by group only when a specific group is requested
+	filter := ExpenseFilter{UserID: UserID, GroupIDs: principalFromContext(ctx).groupIDs(), Tags: tags}
 	if req.GroupID > 0 {
 		// Check if user is member of the specific group
-		isMember, err := isUserInGroup(UserID, req.GroupID)
+		isMember, err := isUserInGroup(ctx, UserID, req.GroupID)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+			return errDatabase(err)
 		}
 		if !isMember {
-			return c.JSON(http.StatusForbidden, map[string]string{"error": "User is not part of the group"})
+			return errNotGroupMember()
 		}
 
 		// Get expenses from specific group
-		query = `SELECT e.id, e.description, e.amount, e.category, e.date, e.owner_group_id 
-                 FROM expenses e 
-                 WHERE e.owner_group_id = ?
-                 ORDER BY e.date DESC`
-		args = []interface{}{req.GroupID}
-	} else {
-		// Get all expenses from groups where user is a member (GroupID = 0, -1, or not provided)
-		query = `SELECT e.id, e.description, e.amount, e.category, e.date, e.owner_group_id 
-                 FROM expenses e 
-                 INNER JOIN group_members gm ON e.owner_group_id = gm.group_id 
-                 WHERE gm.user_id = ?
-                 ORDER BY e.date DESC`
-		args = []interface{}{UserID}
+		filter.GroupID = req.GroupID
 	}
 
-	rows, err := db.Query(query, args...)
+	// Otherwise get all expenses from groups where user is a member (GroupID = 0, -1, or not provided)
+	expenses, err := store.ListExpenses(ctx, filter)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
-	}
-	defer rows.Close()
-
-	var expenses []Expense
-	for rows.Next() {
-		var expense Expense
-		err := rows.Scan(&expense.ID, &expense.Description, &expense.Amount,
-			&expense.Category, &expense.Date, &expense.OwnerGroupID)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
-		}
-		expenses = append(expenses, expense)
+		return errDatabase(err)
 	}
 
-	return c.JSON(http.StatusOK, expenses)
+	return respond(c, http.StatusOK, "", expenses)
 }
 
 type UpdateExpenseRequest struct {
-	Token       string  `json:"token"`       // JWT token for authentication
-	GroupID     int     `json:"group_id"`    // ID of the group to which the expense belongs
-	ExpenseID   int     `json:"expense_id"`  // ID of the expense to be updated
-	Description string  `json:"description"` // Updated description of the expense
-	Amount      float64 `json:"amount"`      // Updated amount of the expense
-	Category    string  `json:"category"`    // Updated category of the expense
-	Date        string  `json:"date"`        // Updated date of the expense
+	Token       string   `json:"token"`              // JWT token for authentication
+	GroupID     int      `json:"group_id"`           // ID of the group to which the expense belongs
+	ExpenseID   int      `json:"expense_id"`         // ID of the expense to be updated
+	Description string   `json:"description"`        // Updated description of the expense
+	Amount      float64  `json:"amount"`             // Updated amount of the expense
+	Category    string   `json:"category"`           // Updated category of the expense
+	Date        string   `json:"date"`               // Updated date of the expense
+	PaidBy      int      `json:"paid_by,omitempty"`  // Optional: member who paid, unchanged when left out
+	Notes       *string  `json:"notes,omitempty"`    // Optional: unchanged when left out, "" clears them
+	Merchant    *string  `json:"merchant,omitempty"` // Optional: unchanged when left out, "" clears it
+	Tags        []string `json:"tags,omitempty"`     // Optional: replaces the tags, unchanged when left out, [] removes all
 }
 
 func UpdateExpense(c echo.Context) error {
 	var req UpdateExpenseRequest
-	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	if err := bindRequest(c, &req); err != nil {
+		return err
 	}
 	// Validate required fields
-	if req.ExpenseID <= 0 || req.GroupID <= 0 {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Expense ID and Group ID are required"})
-	}
-	// Validate JWT token and get user ID
-	userID, err := validateToken(req.Token)
-	if err != nil {
-		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token: " + err.Error()})
+	v := &validator{}
+	v.requiredID("expense_id", req.ExpenseID)
+	v.requiredID("group_id", req.GroupID)
+	v.required("description", req.Description)
+	v.positive("amount", req.Amount)
+	category := v.category("category", req.Category)
+	date, occurredAt := v.expenseDate("date", req.Date)
+	if req.Notes != nil {
+		v.notes("notes", *req.Notes)
+	}
+	if req.Merchant != nil {
+		v.merchant("merchant", *req.Merchant)
+	}
+	tags := v.tags("tags", req.Tags)
+	if err := v.err(); err != nil {
+		return err
 	}
-	// check if the user exists
-	exists, err := userExists(userID)
+	// Validate JWT token or API key and get user ID
+	userID, err := authenticate(c, req.Token, scopeWrite)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		return err
 	}
-	if !exists {
-		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+
+	ctx := c.Request().Context()
+
+	expense := Expense{
+		ID:           req.ExpenseID,
+		Description:  req.Description,
+		Amount:       req.Amount,
+		Category:     category,
+		Date:         date,
+		OwnerGroupID: req.GroupID,
+		OccurredAt:   occurredAt,
 	}
-	// Check if the user is part of the group
-	isMember, err := isUserInGroup(userID, req.GroupID)
+	var event Event
+	err = store.WithTx(ctx, func(tx Store) error {
+		// check if the user exists
+		exists, err := tx.UserExists(ctx, userID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if !exists {
+			return newAPIError(http.StatusNotFound, CodeUserNotFound, "User not found")
+		}
+		// Check if the user is part of the group
+		isMember, err := isMemberOf(ctx, tx, userID, req.GroupID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if !isMember {
+			return errNotGroupMember()
+		}
+
+		// Check if the expense exists
+		current, err := tx.GetExpense(ctx, req.ExpenseID)
+		if errors.Is(err, ErrNotFound) {
+			return newAPIError(http.StatusNotFound, CodeExpenseNotFound, "Expense not found")
+		}
+		if err != nil {
+			return errDatabase(err)
+		}
+		expense.PaidBy = current.PaidBy
+		expense.Notes = current.Notes
+		if req.Notes != nil {
+			expense.Notes = *req.Notes
+		}
+		expense.Merchant = current.Merchant
+		if req.Merchant != nil {
+			expense.Merchant = strings.TrimSpace(*req.Merchant)
+		}
+		if req.PaidBy > 0 {
+			if err := checkPayer(ctx, tx, req.GroupID, req.PaidBy); err != nil {
+				return err
+			}
+			expense.PaidBy = &req.PaidBy
+		}
+		// Update the expense in the database
+		err = tx.UpdateExpense(ctx, &expense)
+		if errors.Is(err, ErrNotFound) {
+			// The expense exists but belongs to another group
+			return newAPIError(http.StatusNotFound, CodeExpenseNotFound, "Expense not found")
+		}
+		if err != nil {
+			return errInternal("Failed to update expense", err)
+		}
+		if tags != nil {
+			if err := tx.SetExpenseTags(ctx, &expense, tags); err != nil {
+				return errInternal("Failed to tag expense", err)
+			}
+		}
+
+		expense, err = tx.GetExpense(ctx, req.ExpenseID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		event = Event{Type: EventExpenseUpdated, GroupID: expense.OwnerGroupID, ActorID: userID, Data: expense}
+		if err := queueWebhooks(ctx, tx, event); err != nil {
+			return errInternal("Failed to queue webhooks", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		return err
 	}
-	if !isMember {
-		return c.JSON(http.StatusForbidden, map[string]string{"error": "User is not part of the group"})
+	publish(event)
+	return respond(c, http.StatusOK, "Expense updated successfully", expense)
+}
+
+func GetExpense(c echo.Context) error {
+	expenseID, err := strconv.Atoi(c.Param("id"))
+	if err != nil || expenseID <= 0 {
+		return newAPIError(http.StatusBadRequest, CodeInvalidRequest, "Invalid expense ID")
 	}
 
-	// Check if the expense exists
-	exists, err = checkExpenseExists(req.ExpenseID)
+	// Validate JWT token or API key from the Authorization header
+	userID, err := authenticate(c, "", scopeRead)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		return err
 	}
-	if !exists {
-		return c.JSON(http.StatusNotFound, map[string]string{"error": "Expense not found"})
+
+	ctx := c.Request().Context()
+
+	expense, err := store.GetExpense(ctx, expenseID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return newAPIError(http.StatusNotFound, CodeExpenseNotFound, "Expense not found")
+		}
+		return errDatabase(err)
 	}
-	// Update the expense in the database
-	_, err = db.Exec(`UPDATE expenses SET description = ?, amount = ?, category = ?, date = ?
-		WHERE id = ? AND owner_group_id = ?`, req.Description, req.Amount, req.Category, req.Date, req.ExpenseID, req.GroupID)
+
+	// Only members of the owning group may see the expense
+	isMember, err := isUserInGroup(ctx, userID, expense.OwnerGroupID)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update expense"})
+		return errDatabase(err)
 	}
-	return c.JSON(http.StatusOK, map[string]string{"message": "Expense updated successfully"})
+	if !isMember {
+		return newAPIError(http.StatusNotFound, CodeExpenseNotFound, "Expense not found")
+	}
+
+	return respond(c, http.StatusOK, "", expense)
 }
 
 type GetGroupsRequest struct {
-	Token string `json:"token"` // JWT token for authentication
+	Token   string `json:"token"`             // JWT token for authentication
+	Details bool   `json:"details,omitempty"` // Optional: embed members, balance and activity, see GroupDetail
 }
 
 func GetUserGroups(c echo.Context) error {
 	var req GetGroupsRequest
-	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	if err := bindRequest(c, &req); err != nil {
+		return err
 	}
 
-	// Validate JWT token
-	validUserID, err := validateToken(req.Token)
+	// Validate JWT token or API key
+	validUserID, err := authenticate(c, req.Token, scopeRead)
 	if err != nil {
-		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token: " + err.Error()})
+		return err
 	}
 
-	// Get all groups where user is a member
-	query := `SELECT ug.id, ug.name, ug.owner_id 
-              FROM users_groups ug 
-              INNER JOIN group_members gm ON ug.id = gm.group_id 
-              WHERE gm.user_id = ?
-              ORDER BY ug.name`
+	ctx := c.Request().Context()
 
-	rows, err := db.Query(query, validUserID)
+	// Get all groups where user is a member
+	groups, err := store.ListUserGroups(ctx, validUserID)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		return errDatabase(err)
 	}
-	defer rows.Close()
 
-	var groups []UsersGroup
-	for rows.Next() {
-		var group UsersGroup
-		err := rows.Scan(&group.ID, &group.Name, &group.OwnerID)
+	// API keys limited to some groups only see those
+	principal := principalFromContext(ctx)
+	visible := []UsersGroup{}
+	for _, group := range groups {
+		if principal.allowsGroup(group.ID) {
+			visible = append(visible, group)
+		}
+	}
+	groups = visible
+
+	if req.Details {
+		details, err := groupDetails(ctx, validUserID, groups, true)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+			return errDatabase(err)
 		}
-		groups = append(groups, group)
+		return respond(c, http.StatusOK, "", details)
+	}
+	return respond(c, http.StatusOK, "", groups)
+}
+
+func GetGroup(c echo.Context) error {
+	groupID, err := strconv.Atoi(c.Param("id"))
+	if err != nil || groupID <= 0 {
+		return newAPIError(http.StatusBadRequest, CodeInvalidRequest, "Invalid group ID")
+	}
+
+	// Validate JWT token or API key from the Authorization header
+	userID, err := authenticate(c, "", scopeRead)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+
+	// Groups are only visible to their members
+	isMember, err := isUserInGroup(ctx, userID, groupID)
+	if err != nil {
+		return errDatabase(err)
+	}
+	if !isMember {
+		return newAPIError(http.StatusNotFound, CodeGroupNotFound, "Group not found")
+	}
+
+	group, err := store.GetGroup(ctx, groupID)
+	if err != nil {
+		return errDatabase(err)
 	}
 
-	return c.JSON(http.StatusOK, groups)
+	details, err := groupDetails(ctx, userID, []UsersGroup{group}, true)
+	if err != nil {
+		return errDatabase(err)
+	}
+	return respond(c, http.StatusOK, "", details[0])
 }
 
 type ValidateUserTokenRequest struct {
@@ -691,32 +987,35 @@ type ValidateUserTokenRequest struct {
 
 func ValidateUserToken(c echo.Context) error {
 	var req ValidateUserTokenRequest
-	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request", "valid": "false"})
+	if err := bindRequest(c, &req); err != nil {
+		return err
 	}
 
-	// Validate JWT token
-	userID, err := validateToken(req.Token)
+	// Validate JWT token or API key
+	userID, err := authenticate(c, req.Token, scopeRead)
 	if err != nil {
-		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token: " + err.Error(), "valid": "false"})
+		return err
 	}
 
+	ctx := c.Request().Context()
+
 	// Check if user exists
-	exists, err := userExists(userID)
+	exists, err := userExists(ctx, userID)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error", "valid": "false"})
+		return errDatabase(err)
 	}
 	if !exists {
-		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+		return newAPIError(http.StatusNotFound, CodeUserNotFound, "User not found")
 	}
 
-	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Token is valid", "user_id": userID, "valid": "true"})
+	return respond(c, http.StatusOK, "Token is valid", map[string]interface{}{"user_id": userID, "valid": true})
 }
 
 func populateFakeData() error {
+	ctx := context.Background()
+
 	// Check if data already exists to avoid duplicates
-	var userCount int
-	err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&userCount)
+	userCount, err := store.CountUsers(ctx)
 	if err != nil {
 		return err
 	}
@@ -749,14 +1048,13 @@ func populateFakeData() error {
 			return err
 		}
 
-		result, err := db.Exec("INSERT INTO users (username, password) VALUES (?, ?)", user.username, hashedPassword)
+		created, err := store.CreateUser(ctx, user.username, hashedPassword)
 		if err != nil {
 			fmt.Println("Error inserting user:", user.username, err)
 			return err
 		}
 
-		userID, _ := result.LastInsertId()
-		userIDs = append(userIDs, int(userID))
+		userIDs = append(userIDs, created.ID)
 	}
 
 	// Create fake groups
@@ -773,17 +1071,16 @@ func populateFakeData() error {
 
 	var groupIDs []int
 	for _, group := range fakeGroups {
-		result, err := db.Exec("INSERT INTO users_groups (name, owner_id) VALUES (?, ?)", group.name, group.ownerID)
+		groupID, err := store.CreateGroup(ctx, group.name, group.ownerID)
 		if err != nil {
 			return err
 		}
 
-		groupID, _ := result.LastInsertId()
-		groupIDs = append(groupIDs, int(groupID))
+		groupIDs = append(groupIDs, groupID)
 
 		// Add members to group
 		for _, memberID := range group.members {
-			_, err = db.Exec("INSERT INTO group_members (group_id, user_id) VALUES (?, ?)", groupID, memberID)
+			err = store.AddMember(ctx, groupID, memberID)
 			if err != nil {
 				return err
 			}
@@ -816,8 +1113,13 @@ func populateFakeData() error {
 	}
 
 	for _, expense := range fakeExpenses {
-		_, err = db.Exec("INSERT INTO expenses (description, amount, category, date, owner_group_id) VALUES (?, ?, ?, ?, ?)",
-			expense.description, expense.amount, expense.category, expense.date, expense.groupID)
+		err = store.CreateExpense(ctx, &Expense{
+			Description:  expense.description,
+			Amount:       expense.amount,
+			Category:     expense.category,
+			Date:         expense.date,
+			OwnerGroupID: expense.groupID,
+		})
 		if err != nil {
 			return err
 		}
@@ -834,95 +1136,69 @@ type GetGroupMembersRequest struct {
 
 func GetGroupMembers(c echo.Context) error {
     var req GetGroupMembersRequest
-    if err := c.Bind(&req); err != nil {
-        return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+    if err := bindRequest(c, &req); err != nil {
+        return err
     }
 
-    // Validate JWT token
-    userID, err := validateToken(req.Token)
+    // Validate JWT token or API key
+    userID, err := authenticate(c, req.Token, scopeRead)
     if err != nil {
-        return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token: " + err.Error()})
+        return err
     }
 
+    ctx := c.Request().Context()
+
     // Check if user is member of the group
-    isMember, err := isUserInGroup(userID, req.GroupID)
+    isMember, err := isUserInGroup(ctx, userID, req.GroupID)
     if err != nil {
-        return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+        return errDatabase(err)
     }
     if !isMember {
-        return c.JSON(http.StatusForbidden, map[string]string{"error": "User is not part of the group"})
+        return errNotGroupMember()
     }
 
     // Get all users in the group
-    query := `SELECT u.id, u.username 
-              FROM users u 
-              INNER JOIN group_members gm ON u.id = gm.user_id 
-              WHERE gm.group_id = ?
-              ORDER BY u.username`
-
-    rows, err := db.Query(query, req.GroupID)
+    members, err := store.ListMembers(ctx, req.GroupID)
     if err != nil {
-        return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+        return errDatabase(err)
     }
-    defer rows.Close()
 
-    var users []struct {
+    users := []struct {
         ID       int    `json:"id"`
         Username string `json:"username"`
-    }
+    }{}
 
-    for rows.Next() {
-        var user struct {
+    for _, member := range members {
+        users = append(users, struct {
             ID       int    `json:"id"`
             Username string `json:"username"`
-        }
-        err := rows.Scan(&user.ID, &user.Username)
-        if err != nil {
-            return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
-        }
-        users = append(users, user)
+        }{member.ID, member.Username})
     }
 
-    return c.JSON(http.StatusOK, map[string]interface{}{
-        "users": users,
-    })
+    return respond(c, http.StatusOK, "", users)
 }
 
 func GetUsers(c echo.Context) error {
 	var req GetGroupsRequest
-	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
-	}
-
-	// Validate JWT token
-	validUserID, err := validateToken(req.Token)
-	if err != nil {
-		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token: " + err.Error()})
+	if err := bindRequest(c, &req); err != nil {
+		return err
 	}
 
-	// Get all users
-	rows, err := db.Query("SELECT id, username FROM users WHERE id != ?", validUserID)
+	// Validate JWT token or API key
+	validUserID, err := authenticate(c, req.Token, scopeRead)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		return err
 	}
-	defer rows.Close()
 
-	var users []User
-	for rows.Next() {
-		var user User
-		err := rows.Scan(&user.ID, &user.Username)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
-		}
-		users = append(users, user)
-	}
+	ctx := c.Request().Context()
 
-	if err := rows.Err(); err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	// Only people the caller already shares a group with, others are found with /users/search
+	users, err := listContacts(ctx, validUserID)
+	if err != nil {
+		return errDatabase(err)
 	}
 
-	fmt.Println("Returning users:", users)
-	return c.JSON(http.StatusOK, users)
+	return respond(c, http.StatusOK, "", users)
 }
 
 func Ping(c echo.Context) error {
@@ -930,8 +1206,35 @@ func Ping(c echo.Context) error {
 }
 
 func main() {
-	initDB()
-	defer db.Close()
+	cfg := loadConfig()
+
+	var err error
+	store, err = openStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+	log.Printf("Using %s storage", cfg.DBDriver)
+
+	mailer, err = newMailSender(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	appURL = cfg.AppURL
+	setupRateLimits(cfg)
+	passwordHasher = newArgon2idHasher(cfg)
+	passwordPolicy, err = loadPasswordPolicy(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	oidcProvider = newOIDCProvider(cfg)
+	if oidcProvider != nil {
+		log.Printf("Single sign-on enabled with %s", cfg.OIDCIssuer)
+	}
+
+	go cleanupIdempotencyKeys()
+	webhooks.configure(cfg)
+	go webhooks.run()
 
 	// // Populate fake data if database is empty
 	// if err := populateFakeData(); err != nil {
@@ -939,6 +1242,13 @@ func main() {
 	// }
 
 	e := echo.New()
+	e.HTTPErrorHandler = apiErrorHandler
+	// Client IPs feed the rate limits, only believe proxy headers when told to
+	if cfg.TrustProxy {
+		e.IPExtractor = echo.ExtractIPFromXFFHeader()
+	} else {
+		e.IPExtractor = echo.ExtractIPDirect()
+	}
 
 	// Add CORS middleware with more permissive settings
     e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
@@ -959,27 +1269,80 @@ func main() {
             echo.HeaderAuthorization,
             "X-Requested-With",
             "Access-Control-Allow-Origin",
+            idempotencyHeader,
+        },
+        ExposeHeaders: []string{
+            idempotencyReplayedHeader,
         },
         AllowCredentials: true,
     }))
 
-    // Add logging middleware to see requests
-    e.Use(middleware.Logger())
+    // Add logging middleware to see requests, without the event stream's token
+    e.Use(middleware.LoggerWithConfig(requestLoggerConfig()))
 
 	// Routes
 	e.GET("/ping", Ping)
 	e.POST("/register", Register)
 	e.POST("/login", Login)
-	e.POST("/expenses", AddExpense)
+	e.POST("/login/2fa", LoginTwoFactor)
+	e.GET("/auth/oidc", GetOIDCConfig)
+	e.GET("/auth/oidc/login", StartOIDCLogin)
+	e.GET("/auth/oidc/callback", OIDCCallback)
+	e.POST("/expenses", AddExpense, Idempotency)
 	e.POST("/expenses/get", GetExpenses)
-	e.POST("/expenses/update", UpdateExpense)
-	e.DELETE("/expenses", RemoveExpense)
-	e.POST("/groups", CreateGroup)
+	e.GET("/expenses/:id", GetExpense)
+	e.POST("/expenses/update", UpdateExpense, Idempotency)
+	e.POST("/expenses/summary", GetExpenseSummary)
+	e.DELETE("/expenses", RemoveExpense, Idempotency)
+	e.POST("/expenses/batch", BatchExpenses, Idempotency)
+	e.POST("/expenses/move", MoveExpense, Idempotency)
+	e.POST("/expenses/copy", CopyExpense, Idempotency)
+	e.POST("/tags/get", ListTags)
+	e.POST("/tags/rename", RenameTag)
+	e.POST("/tags/merge", MergeTags)
+	e.POST("/rules", CreateRule)
+	e.POST("/rules/get", ListRules)
+	e.POST("/rules/update", UpdateRule)
+	e.DELETE("/rules", DeleteRule)
+	e.POST("/rules/apply", ApplyRules)
+	e.POST("/categories/suggest", SuggestCategory)
+	e.POST("/duplicates/get", ListDuplicates)
+	e.POST("/duplicates/merge", MergeDuplicates)
+	e.POST("/duplicates/dismiss", DismissDuplicate)
+	e.POST("/imports/preview", PreviewImport)
+	e.POST("/imports/commit", CommitImport, Idempotency)
+	e.POST("/groups", CreateGroup, Idempotency)
 	e.POST("/groups/get", GetUserGroups)
+	e.GET("/groups/:id", GetGroup)
+	e.GET("/events", StreamEvents)
+	e.POST("/sync", Sync)
+	e.POST("/webhooks", CreateWebhook)
+	e.POST("/webhooks/get", ListWebhooks)
+	e.DELETE("/webhooks", DeleteWebhook)
+	e.POST("/webhooks/deliveries/get", ListWebhookDeliveries)
+	e.POST("/webhooks/deliveries/redeliver", RedeliverWebhook)
 	e.POST("/groups/members/get", GetGroupMembers)
-	e.POST("/groups/members/add", AddUserToGroup)
+	e.POST("/groups/members/add", AddUserToGroup, Idempotency)
 	e.POST("/validate/token", ValidateUserToken)
 	e.POST("/users/get", GetUsers)
+	e.POST("/users/timezone", SetTimezone, Idempotency)
+	e.POST("/users/me", GetProfile)
+	e.POST("/users/profile", UpdateProfile, Idempotency)
+	e.POST("/users/search", SearchUsers)
+	e.POST("/users/email", SetEmail, Idempotency)
+	e.POST("/users/password", ChangePassword)
+	e.DELETE("/users", DeleteAccount)
+	e.POST("/users/2fa/setup", SetupTwoFactor)
+	e.POST("/users/2fa/activate", ActivateTwoFactor)
+	e.POST("/users/2fa/disable", DisableTwoFactor)
+	e.POST("/users/api-keys", CreateAPIKey)
+	e.POST("/users/api-keys/get", ListAPIKeys)
+	e.DELETE("/users/api-keys", RevokeAPIKey)
+	e.POST("/users/identities", LinkIdentity)
+	e.POST("/users/identities/get", ListIdentities)
+	e.DELETE("/users/identities", UnlinkIdentity)
+	e.POST("/password/forgot", ForgotPassword)
+	e.POST("/password/reset", ResetPassword)
 
 	// Start server
 	log.Println("Server starting on :1234")
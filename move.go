@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type MoveExpenseRequest struct {
+	Token     string `json:"token"`       // JWT token or API key for authentication
+	ExpenseID int    `json:"expense_id"`  // ID of the expense to move or copy
+	GroupID   int    `json:"group_id"`    // ID of the group the expense is in
+	ToGroupID int    `json:"to_group_id"` // ID of the group to move or copy it to
+	// Optional: payer in the target group. Required when the current payer is not a member of it.
+	PaidBy int `json:"paid_by,omitempty"`
+}
+
+// Move an expense to another group. It keeps its ID, creation time and
+// everything else, only the group changes.
+func MoveExpense(c echo.Context) error {
+	return transferExpense(c, false)
+}
+
+// Copy an expense into another group as a new expense with the same fields
+func CopyExpense(c echo.Context) error {
+	return transferExpense(c, true)
+}
+
+func transferExpense(c echo.Context, asCopy bool) error {
+	var req MoveExpenseRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	// Validate required fields
+	v := &validator{}
+	v.requiredID("expense_id", req.ExpenseID)
+	v.requiredID("group_id", req.GroupID)
+	v.requiredID("to_group_id", req.ToGroupID)
+	if req.ToGroupID > 0 && req.ToGroupID == req.GroupID {
+		v.add("to_group_id", FieldInvalidFormat, "to_group_id must be another group than group_id")
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	// Validate JWT token or API key and get user ID
+	userID, err := authenticate(c, req.Token, scopeWrite)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+
+	var expense Expense
+	var changes []Event
+	err = store.WithTx(ctx, func(tx Store) error {
+		// The caller must be a member of both groups
+		for _, groupID := range []int{req.GroupID, req.ToGroupID} {
+			isMember, err := isMemberOf(ctx, tx, userID, groupID)
+			if err != nil {
+				return errDatabase(err)
+			}
+			if !isMember {
+				return errNotGroupMember()
+			}
+		}
+
+		var err error
+		expense, err = tx.GetExpense(ctx, req.ExpenseID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return errDatabase(err)
+		}
+		if err != nil || expense.OwnerGroupID != req.GroupID {
+			return newAPIError(http.StatusNotFound, CodeExpenseNotFound, "Expense not found")
+		}
+
+		if err := targetPayer(ctx, tx, &expense, req.ToGroupID, req.PaidBy); err != nil {
+			return err
+		}
+
+		if asCopy {
+			expense.OwnerGroupID = req.ToGroupID
+			expense.ClientID = ""
+			if err := tx.CreateExpense(ctx, &expense); err != nil {
+				return errInternal("Failed to copy expense", err)
+			}
+			if err := tx.SetExpenseTags(ctx, &expense, expense.Tags); err != nil {
+				return errInternal("Failed to copy expense", err)
+			}
+			changes = []Event{{Type: EventExpenseCreated, GroupID: expense.OwnerGroupID, ActorID: userID, Data: expense}}
+		} else {
+			if req.PaidBy > 0 {
+				if err := tx.UpdateExpense(ctx, &expense); err != nil {
+					return errInternal("Failed to update expense", err)
+				}
+			}
+			if err := tx.MoveExpense(ctx, &expense, req.ToGroupID); err != nil {
+				return errInternal("Failed to move expense", err)
+			}
+			changes = movedEvents(expense, req.GroupID, userID)
+		}
+		for _, event := range changes {
+			if err := queueWebhooks(ctx, tx, event); err != nil {
+				return errInternal("Failed to queue webhooks", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, event := range changes {
+		publish(event)
+	}
+
+	if asCopy {
+		return respondCreated(c, fmt.Sprintf("/expenses/%d", expense.ID), "Expense copied successfully", expense)
+	}
+	return respond(c, http.StatusOK, "Expense moved successfully", expense)
+}
+
+// Set the payer an expense gets in the group it is moved or copied to. The
+// current payer is kept when they are a member there, otherwise paidBy has to
+// name a member.
+func targetPayer(ctx context.Context, tx Store, expense *Expense, toGroupID, paidBy int) error {
+	if paidBy > 0 {
+		expense.PaidBy = &paidBy
+	}
+	if expense.PaidBy == nil {
+		return nil
+	}
+	err := checkPayer(ctx, tx, toGroupID, *expense.PaidBy)
+	var apiErr *APIError
+	if paidBy == 0 && errors.As(err, &apiErr) && apiErr.Code == CodeValidationFailed {
+		apiErr.Fields[0].Message = "the payer is not a member of the target group, pass paid_by to choose another"
+	}
+	return err
+}
+
+// An expense moved between groups leaves one group and arrives in the other
+func movedEvents(expense Expense, fromGroupID, actorID int) []Event {
+	return []Event{
+		{Type: EventExpenseDeleted, GroupID: fromGroupID, ActorID: actorID, Data: DeletedExpenseData{ID: expense.ID}},
+		{Type: EventExpenseCreated, GroupID: expense.OwnerGroupID, ActorID: actorID, Data: expense},
+	}
+}
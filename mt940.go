@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SWIFT MT940 customer statements. A statement is a list of fields such
+// as ":25:" for the account, each ":61:" line is a transaction and the
+// ":86:" field after it tells more about it. Several statements can follow
+// each other in a file, with or without the SWIFT message envelope.
+
+var (
+	mt940Tag = regexp.MustCompile(`^:(\d{2}[A-Z]?):`)
+	// Value date, optional entry date, debit or credit mark, optional third
+	// letter of the currency, amount, transaction type and references
+	mt940Line = regexp.MustCompile(`^(\d{6})(\d{4})?(RC|RD|C|D)([A-Z])?(\d[\d,]*)([NFS][A-Z0-9]{3})([^/]*)(?://(.*))?$`)
+	// "?20" to "?29" and the other subfields of German :86: fields
+	mt940Subfield = regexp.MustCompile(`\?(\d{2})`)
+	sepaKey       = regexp.MustCompile(`[A-Z]{4}\+`)
+)
+
+func isMT940(content string) bool {
+	head := content[:min(len(content), 8192)]
+	return strings.Contains(head, ":20:") && strings.Contains(head, ":25:") && strings.Contains(head, ":61:")
+}
+
+type mt940Field struct {
+	tag   string
+	value string // Lines of the field joined with "\n"
+	line  int
+}
+
+func mt940Fields(content string) []mt940Field {
+	var fields []mt940Field
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		// The SWIFT envelope and the end of a message
+		if trimmed == "" || trimmed == "-" || trimmed == "-}" || strings.HasPrefix(trimmed, "{") {
+			continue
+		}
+		if m := mt940Tag.FindStringSubmatch(line); m != nil {
+			fields = append(fields, mt940Field{tag: m[1], value: line[len(m[0]):], line: i + 1})
+		} else if len(fields) > 0 {
+			fields[len(fields)-1].value += "\n" + line
+		}
+	}
+	return fields
+}
+
+func parseMT940(content string, _ statementOptions) ([]StatementTransaction, error) {
+	fields := mt940Fields(content)
+	var transactions []StatementTransaction
+	account := ""
+	start := 0 // First transaction of the account
+	previous := ""
+	for _, field := range fields {
+		switch field.tag {
+		case "25":
+			fillExternalIDs("mt940:"+account, transactions[start:])
+			account, start = strings.TrimSpace(field.value), len(transactions)
+		case "61":
+			t, err := mt940Transaction(field, account)
+			if err != nil {
+				return nil, err
+			}
+			transactions = append(transactions, t)
+		case "86":
+			// Tells about the transaction right before it, or the statement as a whole
+			if previous != "61" {
+				break
+			}
+			t := &transactions[len(transactions)-1]
+			payee, memo := mt940Information(field.value)
+			t.Payee = payee
+			if memo != "" {
+				t.Memo = memo
+			}
+		}
+		previous = field.tag
+	}
+	if len(fields) == 0 || account == "" {
+		return nil, statementErrorf(0, "no :25: account field")
+	}
+
+	fillExternalIDs("mt940:"+account, transactions[start:])
+	uniqueExternalIDs(transactions)
+	return transactions, nil
+}
+
+func mt940Transaction(field mt940Field, account string) (StatementTransaction, error) {
+	var t StatementTransaction
+	first, supplementary, _ := strings.Cut(field.value, "\n")
+	m := mt940Line.FindStringSubmatch(strings.TrimSpace(first))
+	if m == nil {
+		return t, statementErrorf(field.line, "invalid :61: statement line")
+	}
+
+	valueDate, err := time.Parse("060102", m[1])
+	if err != nil {
+		return t, statementErrorf(field.line, "invalid value date %q", m[1])
+	}
+	// The entry date is when it was booked, it can fall in the year before or after the value date
+	booked := valueDate
+	if m[2] != "" {
+		entry, err := time.Parse("0102", m[2])
+		if err != nil {
+			return t, statementErrorf(field.line, "invalid entry date %q", m[2])
+		}
+		booked = time.Date(valueDate.Year(), entry.Month(), entry.Day(), 0, 0, 0, 0, time.UTC)
+		switch {
+		case booked.Sub(valueDate) > 180*24*time.Hour:
+			booked = booked.AddDate(-1, 0, 0)
+		case valueDate.Sub(booked) > 180*24*time.Hour:
+			booked = booked.AddDate(1, 0, 0)
+		}
+	}
+
+	amount, ok := parseStatementAmount(m[5])
+	if !ok {
+		return t, statementErrorf(field.line, "invalid amount %q", m[5])
+	}
+	// A reversed credit takes money out, a reversed debit brings it back
+	if m[3] == "D" || m[3] == "RC" {
+		amount = -amount
+	}
+
+	t.Date = booked.Format(dateLayout)
+	t.Amount = amount
+	t.Memo = strings.TrimSpace(supplementary)
+	// Only the bank reference after "//" is unique. The customer reference is
+	// the account holder's own and repeats, a standing order sends the same
+	// one every month, so without a bank reference the content gives the ID.
+	if ref := mt940Reference(strings.TrimSpace(m[8])); ref != "" {
+		t.ExternalID = fmt.Sprintf("mt940:%s:%s", account, ref)
+	}
+	return t, nil
+}
+
+// "NONREF" stands for a missing reference
+func mt940Reference(ref string) string {
+	if strings.EqualFold(ref, "NONREF") {
+		return ""
+	}
+	return ref
+}
+
+// Counterparty and remittance information of a :86: field. German banks
+// structure it into "?nn" subfields, Dutch ones into "/NAME/" and
+// "/REMI/" fields, others write free text.
+func mt940Information(value string) (string, string) {
+	value = strings.ReplaceAll(value, "\n", "")
+	if loc := mt940Subfield.FindAllStringSubmatchIndex(value, -1); len(loc) > 0 {
+		subfields := map[string]string{}
+		for i, l := range loc {
+			end := len(value)
+			if i+1 < len(loc) {
+				end = loc[i+1][0]
+			}
+			subfields[value[l[2]:l[3]]] += value[l[1]:end]
+		}
+		var remittance strings.Builder
+		for n := 20; n <= 29; n++ {
+			remittance.WriteString(subfields[fmt.Sprint(n)])
+		}
+		for n := 60; n <= 63; n++ {
+			remittance.WriteString(subfields[fmt.Sprint(n)])
+		}
+		return strings.TrimSpace(subfields["32"] + subfields["33"]), sepaRemittance(remittance.String())
+	}
+
+	if strings.Contains(value, "/NAME/") || strings.Contains(value, "/REMI/") {
+		return strings.TrimSpace(slashField(value, "NAME")), strings.TrimSpace(slashField(value, "REMI"))
+	}
+	return "", strings.TrimSpace(value)
+}
+
+// SEPA transfers put "EREF+", "SVWZ+" and similar keys into the
+// remittance, the purpose is what follows "SVWZ+"
+func sepaRemittance(text string) string {
+	i := strings.Index(text, "SVWZ+")
+	if i < 0 {
+		return strings.TrimSpace(text)
+	}
+	purpose := text[i+len("SVWZ+"):]
+	if next := sepaKey.FindStringIndex(purpose); next != nil {
+		purpose = purpose[:next[0]]
+	}
+	return strings.TrimSpace(purpose)
+}
+
+// Value of a "/KEY/value/" field. Remittance fields of the Dutch format
+// start with a type such as "USTD//".
+func slashField(value, key string) string {
+	_, rest, found := strings.Cut(value, "/"+key+"/")
+	if !found {
+		return ""
+	}
+	rest = strings.TrimPrefix(rest, "USTD//")
+	rest = strings.TrimPrefix(rest, "STRD/")
+	text, _, _ := strings.Cut(rest, "/")
+	return text
+}
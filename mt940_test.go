@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMT940(t *testing.T) {
+	got, err := parseMT940(readStatement(t, "statement.sta"), statementOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTransactions(t, got, []StatementTransaction{
+		{ExternalID: "mt940:37040044/0532013000:8327000090031789", Date: "2024-10-05", Amount: -12.5, Payee: "Telekom Deutschland GmbH", Memo: "Handyvertrag Oktober 2024"},
+		{ExternalID: "mt940:37040044/0532013000:8327000090031790", Date: "2024-10-06", Amount: 100, Payee: "Max Mustermann", Memo: "Erstattung"},
+		// Without a bank reference the ID comes from the content, Dutch :86: fields
+		{ExternalID: "mt940:37040044/0532013000:*", Date: "2024-12-31", Amount: -45, Payee: "Albert Heijn", Memo: "Boodschappen week 52"},
+		// Booked in the year after the value date, and the year before
+		{ExternalID: "mt940:37040044/0532013000:*", Date: "2025-01-02", Amount: -9.99, Memo: "Kartenzahlung Kiosk"},
+		// A reversed credit takes money out, a reversed debit brings it back
+		{ExternalID: "mt940:37040044/0532013000:*", Date: "2024-12-31", Amount: -3, Memo: "Storno Gutschrift"},
+		{ExternalID: "mt940:37040044/0532013000:8327000090031791", Date: "2024-12-31", Amount: 3},
+		{ExternalID: "mt940:37040044/0532013001:*", Date: "2024-10-07", Amount: -5, Memo: "Entgelt"},
+		{ExternalID: "mt940:37040044/0532013001:*", Date: "2024-10-07", Amount: -5, Memo: "Entgelt"},
+	})
+	if got[6].ExternalID == got[7].ExternalID {
+		t.Errorf("identical transactions share the ID %q", got[6].ExternalID)
+	}
+}
+
+// A standing order repeats its customer reference every month, the
+// months must not be taken for the same transaction
+func TestParseMT940CustomerReference(t *testing.T) {
+	content := readStatement(t, "statement-standing-order.sta")
+	got, err := parseMT940(content, statementOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTransactions(t, got, []StatementTransaction{
+		{ExternalID: "mt940:NL91ABNA0417164300:*", Date: "2024-10-01", Amount: -950, Payee: "Woonstichting Thuis", Memo: "Huur"},
+		{ExternalID: "mt940:NL91ABNA0417164300:*", Date: "2024-11-01", Amount: -950, Payee: "Woonstichting Thuis", Memo: "Huur"},
+	})
+	october, november := got[0].ExternalID, got[1].ExternalID
+	if october == november || strings.Contains(october, "HUUR") || strings.Contains(november, "HUUR") {
+		t.Errorf("months got IDs %q and %q, want IDs from their content", october, november)
+	}
+
+	// Each month imported on its own gets the ID it has in the whole file
+	start := strings.LastIndex(content, "{1:")
+	alone, err := parseMT940(content[start:], statementOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alone) != 1 || alone[0].ExternalID != november {
+		t.Errorf("November on its own = %+v, want ID %q", alone, november)
+	}
+}
+
+func TestParseMT940Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"no account", ":20:X\n:61:2410051005D1,00NMSCNONREF\n", "no :25: account field"},
+		{"invalid line", ":20:X\n:25:1\n:61:24100X1005D1,00NMSCNONREF\n", "line 3: invalid :61: statement line"},
+		{"invalid value date", ":20:X\n:25:1\n\n:61:241305D1,00NMSCNONREF\n", `line 4: invalid value date "241305"`},
+		{"invalid entry date", ":20:X\n:25:1\n:61:2410051332D1,00NMSCNONREF\n", `line 3: invalid entry date "1332"`},
+	}
+	for _, tt := range tests {
+		_, err := parseMT940(tt.content, statementOptions{})
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestMT940Information(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		payee string
+		memo  string
+	}{
+		{"German subfields", "166?00GUTSCHRIFT?20Miete?32Max Mustermann", "Max Mustermann", "Miete"},
+		{"remittance over ?20 to ?29 and ?60",
+			"105?00SEPA?20EREF+1?21SVWZ+Beitrag ?22Verein?60 2024?32Sportverein e.V.", "Sportverein e.V.", "Beitrag Verein 2024"},
+		{"payee over ?32 and ?33", "?20Kauf?32Telekom Deutschla?33nd GmbH", "Telekom Deutschland GmbH", "Kauf"},
+		{"purpose followed by another key", "?20SVWZ+Rechnung 42 ABWA+Someone Else", "", "Rechnung 42"},
+		{"lines joined", "?20Rechnung\n?21 42", "", "Rechnung 42"},
+		{"Dutch fields", "/TRTP/SEPA OVERBOEKING/NAME/Albert Heijn/REMI/USTD//Week 52/EREF/NOTPROVIDED", "Albert Heijn", "Week 52"},
+		{"free text", "Kartenzahlung Kiosk", "", "Kartenzahlung Kiosk"},
+	}
+	for _, tt := range tests {
+		payee, memo := mt940Information(tt.value)
+		if payee != tt.payee || memo != tt.memo {
+			t.Errorf("%s: got %q, %q, want %q, %q", tt.name, payee, memo, tt.payee, tt.memo)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"html"
+	"strings"
+	"time"
+)
+
+// OFX 1.x files are SGML, where elements holding a value have no end tag,
+// OFX 2.x files are XML. QFX is OFX with a few Quicken specific elements.
+// Both are read as a list of tags with the text following each, which
+// covers either way of writing values.
+
+func isOFX(content string) bool {
+	head := strings.ToUpper(content[:min(len(content), 4096)])
+	return strings.Contains(head, "OFXHEADER") || strings.Contains(head, "<OFX>")
+}
+
+type ofxTag struct {
+	name  string // Upper case, "/NAME" for end tags
+	value string // Text up to the next tag
+	line  int
+}
+
+func ofxTags(content string) ([]ofxTag, error) {
+	var tags []ofxTag
+	line := 1
+	for pos := 0; pos < len(content); {
+		start := strings.IndexByte(content[pos:], '<')
+		if start < 0 {
+			break
+		}
+		line += strings.Count(content[pos:pos+start], "\n")
+		pos += start
+
+		// Skip the XML declaration, processing instructions and comments
+		if strings.HasPrefix(content[pos:], "<?") || strings.HasPrefix(content[pos:], "<!") {
+			end := ">"
+			if strings.HasPrefix(content[pos:], "<!--") {
+				end = "-->"
+			}
+			n := strings.Index(content[pos:], end)
+			if n < 0 {
+				return nil, statementErrorf(line, "unterminated %q", content[pos:pos+2])
+			}
+			line += strings.Count(content[pos:pos+n], "\n")
+			pos += n + len(end)
+			continue
+		}
+
+		end := strings.IndexByte(content[pos:], '>')
+		if end < 0 {
+			return nil, statementErrorf(line, "unterminated tag")
+		}
+		name := strings.ToUpper(strings.TrimSpace(content[pos+1 : pos+end]))
+		if i := strings.IndexAny(name, " \t\r\n"); i >= 0 {
+			name = name[:i] // Attributes are not used by OFX
+		}
+		pos += end + 1
+
+		next := strings.IndexByte(content[pos:], '<')
+		if next < 0 {
+			next = len(content) - pos
+		}
+		value := html.UnescapeString(strings.TrimSpace(content[pos : pos+next]))
+		tags = append(tags, ofxTag{name: name, value: value, line: line})
+	}
+	return tags, nil
+}
+
+func parseOFX(content string, _ statementOptions) ([]StatementTransaction, error) {
+	tags, err := ofxTags(content)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, tag := range tags {
+		if tag.name == "OFX" {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, statementErrorf(0, "no <OFX> element")
+	}
+
+	var transactions []StatementTransaction
+	var account string
+	var fields map[string]string // Of the transaction being read, nil outside of one
+	var startLine int
+	finish := func() error {
+		if fields == nil {
+			return nil
+		}
+		t, err := ofxTransaction(fields, account, startLine)
+		fields = nil
+		if err != nil {
+			return err
+		}
+		transactions = append(transactions, t)
+		return nil
+	}
+
+	for _, tag := range tags {
+		switch tag.name {
+		case "STMTTRN":
+			if err := finish(); err != nil {
+				return nil, err
+			}
+			fields, startLine = map[string]string{}, tag.line
+		case "/STMTTRN", "/BANKTRANLIST":
+			if err := finish(); err != nil {
+				return nil, err
+			}
+		case "ACCTID":
+			if fields == nil {
+				account = tag.value
+			}
+		default:
+			// The first value wins, NAME of a transaction comes before that of a PAYEE aggregate
+			if fields != nil && !strings.HasPrefix(tag.name, "/") && tag.value != "" && fields[tag.name] == "" {
+				fields[tag.name] = tag.value
+			}
+		}
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	fillExternalIDs("ofx:"+account, transactions)
+	return transactions, nil
+}
+
+func ofxTransaction(fields map[string]string, account string, line int) (StatementTransaction, error) {
+	var t StatementTransaction
+	date, ok := parseOFXDate(fields["DTPOSTED"])
+	if !ok {
+		return t, statementErrorf(line, "transaction without a valid DTPOSTED")
+	}
+	amount, ok := parseStatementAmount(fields["TRNAMT"])
+	if !ok {
+		return t, statementErrorf(line, "transaction without a valid TRNAMT")
+	}
+	t.Date = date
+	t.Amount = amount
+	t.Payee = fields["NAME"]
+	t.Memo = fields["MEMO"]
+	if fitID := fields["FITID"]; fitID != "" {
+		// FITIDs are only unique within an account
+		t.ExternalID = "ofx:" + account + ":" + fitID
+	}
+	return t, nil
+}
+
+// OFX dates start with YYYYMMDD, optionally followed by a time and zone
+// such as 20240115120000.000[-5:EST]. The calendar date is used as is.
+func parseOFXDate(value string) (string, bool) {
+	if len(value) < 8 {
+		return "", false
+	}
+	t, err := time.Parse("20060102", value[:8])
+	if err != nil || t.Year() < minExpenseYear || t.Year() > maxExpenseYear {
+		return "", false
+	}
+	return t.Format(dateLayout), true
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseOFX(t *testing.T) {
+	tests := []struct {
+		file string
+		want []StatementTransaction
+	}{
+		{"statement.ofx", []StatementTransaction{
+			{ExternalID: "ofx:999-1:A3", Date: "2024-10-07", Amount: -35.2, Payee: "UBER TRIP", Memo: "Ride & tip"},
+			{ExternalID: "ofx:999-1:A2", Date: "2024-10-06", Amount: 1500, Payee: "ACME PAYROLL"},
+			// Without a FITID the ID comes from the content
+			{ExternalID: "ofx:999-1:*", Date: "2024-10-08", Amount: -4.5, Payee: "COFFEE"},
+		}},
+		{"statement-v2.ofx", []StatementTransaction{
+			{ExternalID: "ofx:4111-22:X1", Date: "2024-01-15", Amount: -12, Payee: "Bookshop", Memo: "Novel"},
+			{ExternalID: "ofx:4111-22:X2", Date: "2024-01-16", Amount: -1234.56, Payee: "Furniture Co"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			got, err := parseOFX(readStatement(t, tt.file), statementOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTransactions(t, got, tt.want)
+		})
+	}
+}
+
+func TestParseOFXErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"no OFX element", "OFXHEADER:100\n<BANKTRANLIST></BANKTRANLIST>", "no <OFX> element"},
+		{"unterminated tag", "<OFX>\n<STMTTRN\n", "line 2: unterminated tag"},
+		{"unterminated comment", "<OFX>\n<!-- never closed", `line 2: unterminated "<!"`},
+		{"missing date", "<OFX>\n<STMTTRN>\n<TRNAMT>-1.00\n</STMTTRN>", "line 2: transaction without a valid DTPOSTED"},
+		{"invalid date", "<OFX>\n<STMTTRN><DTPOSTED>20241301<TRNAMT>-1.00</STMTTRN>", "line 2: transaction without a valid DTPOSTED"},
+		{"missing amount", "<OFX>\n\n<STMTTRN><DTPOSTED>20241007</STMTTRN>", "line 3: transaction without a valid TRNAMT"},
+	}
+	for _, tt := range tests {
+		_, err := parseOFX(tt.content, statementOptions{})
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestParseOFXDate(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string // Empty for invalid dates
+	}{
+		{"20241007", "2024-10-07"},
+		{"20241007120000", "2024-10-07"},
+		{"20241007235959.999[-5:EST]", "2024-10-07"},
+		{"2024100", ""},
+		{"20241301", ""},
+		{"18991231", ""},
+		{"yyyymmdd", ""},
+	}
+	for _, tt := range tests {
+		got, ok := parseOFXDate(tt.value)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("parseOFXDate(%q) = %q, %v, want %q", tt.value, got, ok, tt.want)
+		}
+	}
+}
+
+func TestIsOFX(t *testing.T) {
+	for content, want := range map[string]bool{
+		"OFXHEADER:100\nDATA:OFXSGML":       true,
+		"<?xml version=\"1.0\"?>\n<ofx>":    true,
+		"!Type:Bank\nD1/1/24\n^":            false,
+		strings.Repeat(" ", 5000) + "<OFX>": false,
+	} {
+		if got := isOFX(content); got != want {
+			t.Errorf("isOFX(%.30q) = %v, want %v", content, got, want)
+		}
+	}
+}
@@ -0,0 +1,900 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// How long the user may take at the provider before the callback is refused
+	oidcLoginTTL = 10 * time.Minute
+	// The provider's signing keys are fetched again at most this often when a token uses an unknown key
+	oidcKeysRefreshInterval = time.Minute
+	// Longest username created for auto-provisioned accounts
+	oidcMaxUsernameLength = 32
+	// Cookie tying a sign-in to the browser that started it
+	oidcStateCookie = "oidc_state"
+)
+
+// The configured OpenID Connect provider, nil when single sign-on is disabled
+var oidcProvider *OIDCProvider
+
+// Client for an OpenID Connect provider using the authorization code flow with PKCE.
+// The provider's metadata and keys are fetched on first use, so the server
+// starts even while the provider is unreachable.
+type OIDCProvider struct {
+	issuer        string
+	clientID      string
+	clientSecret  string
+	redirectURL   string
+	scopes        []string
+	name          string
+	autoProvision bool
+	client        *http.Client
+
+	mu          sync.Mutex
+	metadata    *oidcMetadata
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+// The parts of the provider's discovery document the flow needs
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Claims read from ID tokens
+type idTokenClaims struct {
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     flexBool `json:"email_verified"`
+	PreferredUsername string   `json:"preferred_username"`
+	Name              string   `json:"name"`
+	AuthorizedParty   string   `json:"azp"`
+	jwt.RegisteredClaims
+}
+
+// Some providers send booleans as "true" and "false" strings
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseBool(strings.Trim(string(data), `"`))
+	if err != nil {
+		return fmt.Errorf("invalid boolean %s", data)
+	}
+	*b = flexBool(value)
+	return nil
+}
+
+func newOIDCProvider(cfg Config) *OIDCProvider {
+	if cfg.OIDCIssuer == "" {
+		return nil
+	}
+	return &OIDCProvider{
+		issuer:        cfg.OIDCIssuer,
+		clientID:      cfg.OIDCClientID,
+		clientSecret:  cfg.OIDCClientSecret,
+		redirectURL:   cfg.OIDCRedirectURL,
+		scopes:        cfg.OIDCScopes,
+		name:          cfg.OIDCProviderName,
+		autoProvision: cfg.OIDCAutoProvision,
+		client:        &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// GET a JSON document from the provider
+func (p *OIDCProvider) getJSON(ctx context.Context, endpoint string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", endpoint, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	var metadata oidcMetadata
+	if err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", &metadata); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	// ID tokens are checked against the configured issuer, a provider
+	// claiming to be someone else would fail every sign-in
+	if strings.TrimRight(metadata.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("discovery: provider reports issuer %q, expected %q", metadata.Issuer, p.issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("discovery: provider metadata is incomplete")
+	}
+	p.metadata = &metadata
+	return p.metadata, nil
+}
+
+// Get the RSA key an ID token was signed with, refreshing the key set when
+// the provider has rotated its keys
+func (p *OIDCProvider) signingKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key := p.lookupKey(kid); key != nil {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < oidcKeysRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, metadata.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("fetching signing keys: %w", err)
+	}
+	p.keysFetched = time.Now()
+
+	p.keys = map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			log.Printf("Skipping malformed signing key %q of the OIDC provider", k.Kid)
+			continue
+		}
+		p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	if key := p.lookupKey(kid); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// Find a cached key. Tokens without a key ID are accepted when the provider has a single key.
+func (p *OIDCProvider) lookupKey(kid string) *rsa.PublicKey {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+	return p.keys[kid]
+}
+
+// Address to send the browser to for signing in
+func (p *OIDCProvider) authorizationURL(ctx context.Context, login OIDCLogin) (string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(login.CodeVerifier))
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.clientID)
+	query.Set("redirect_uri", p.redirectURL)
+	query.Set("scope", strings.Join(p.scopes, " "))
+	query.Set("state", login.State)
+	query.Set("nonce", login.Nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return metadata.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Redeem an authorization code and return the verified claims of its ID token
+func (p *OIDCProvider) exchange(ctx context.Context, code string, login OIDCLogin) (*idTokenClaims, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL)
+	form.Set("code_verifier", login.CodeVerifier)
+	form.Set("client_id", p.clientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("token endpoint: %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.Error != "" {
+		return nil, fmt.Errorf("token endpoint: %s: %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return nil, errors.New("token endpoint returned no ID token")
+	}
+
+	return p.verifyIDToken(ctx, body.IDToken, login.Nonce)
+}
+
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, raw, nonce string) (*idTokenClaims, error) {
+	claims := &idTokenClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.signingKey(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256"}),
+		jwt.WithIssuer(p.issuer),
+		jwt.WithAudience(p.clientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("ID token: %w", err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, errors.New("ID token: nonce does not match")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("ID token: subject is missing")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.clientID {
+		return nil, errors.New("ID token: issued to another client")
+	}
+	return claims, nil
+}
+
+// Random URL safe value for state, nonce and the PKCE verifier
+func newOIDCSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func errSSODisabled() *APIError {
+	return newAPIError(http.StatusNotFound, CodeNotFound, "Single sign-on is not configured")
+}
+
+// Check that the page the result is sent to belongs to the frontend, so the
+// callback cannot be used to send tokens to another site
+func oidcRedirectTarget(redirectTo string) (string, error) {
+	if redirectTo == "" {
+		return appURL + "/", nil
+	}
+	app, err := url.Parse(appURL)
+	if err != nil {
+		return "", err
+	}
+	target, err := url.Parse(redirectTo)
+	if err != nil || target.Scheme != app.Scheme || target.Host != app.Host {
+		return "", errors.New("redirect_to must be a page of the frontend")
+	}
+	target.Fragment = ""
+	return target.String(), nil
+}
+
+// Store a new sign-in attempt and get the provider address for it. The
+// browser gets a cookie with a hash of the state, the callback is only
+// accepted from the browser holding it. Otherwise a sign-in or link started
+// by someone else could be completed by a victim following their link.
+func startOIDCLogin(c echo.Context, redirectTo string, linkUserID int) (string, error) {
+	ctx := c.Request().Context()
+	login := OIDCLogin{RedirectTo: redirectTo, LinkUserID: linkUserID}
+	for _, secret := range []*string{&login.State, &login.Nonce, &login.CodeVerifier} {
+		value, err := newOIDCSecret()
+		if err != nil {
+			return "", errInternal("Failed to start sign-in", err)
+		}
+		*secret = value
+	}
+
+	authURL, err := oidcProvider.authorizationURL(ctx, login)
+	if err != nil {
+		return "", errInternal("Identity provider is unavailable", err)
+	}
+
+	now := time.Now().UTC()
+	login.CreatedAt = now
+	login.ExpiresAt = now.Add(oidcLoginTTL)
+	if err := store.DeleteExpiredOIDCLogins(ctx, now); err != nil {
+		return "", errDatabase(err)
+	}
+	if err := store.CreateOIDCLogin(ctx, login); err != nil {
+		return "", errDatabase(err)
+	}
+	setOIDCStateCookie(c, hashOIDCState(login.State), int(oidcLoginTTL/time.Second))
+	return authURL, nil
+}
+
+func hashOIDCState(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Lax so the cookie comes along when the provider redirects the browser
+// back, a maxAge below 0 removes it
+func setOIDCStateCookie(c echo.Context, value string, maxAge int) {
+	c.SetCookie(&http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     "/auth/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Whether the callback comes from the browser that started the sign-in
+func oidcStateMatches(c echo.Context, state string) bool {
+	cookie, err := c.Cookie(oidcStateCookie)
+	if err != nil || state == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(hashOIDCState(state))) == 1
+}
+
+// Tell the frontend whether single sign-on is available
+func GetOIDCConfig(c echo.Context) error {
+	if oidcProvider == nil {
+		return respond(c, http.StatusOK, "", map[string]interface{}{"enabled": false})
+	}
+	return respond(c, http.StatusOK, "", map[string]interface{}{
+		"enabled": true,
+		"name":    oidcProvider.name,
+	})
+}
+
+// Start signing in: redirects the browser to the identity provider. The
+// optional redirect_to query parameter names the frontend page that gets the
+// result, see OIDCCallback.
+func StartOIDCLogin(c echo.Context) error {
+	if oidcProvider == nil {
+		return errSSODisabled()
+	}
+
+	redirectTo, err := oidcRedirectTarget(c.QueryParam("redirect_to"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeValidationFailed, err.Error())
+	}
+
+	authURL, err := startOIDCLogin(c, redirectTo, 0)
+	if err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusFound, authURL)
+}
+
+type LinkIdentityRequest struct {
+	Token      string `json:"token"`                 // JWT token for authentication
+	RedirectTo string `json:"redirect_to,omitempty"` // Frontend page that gets the result
+}
+
+// Start linking an identity to the caller's account. The browser has to be
+// sent to the returned authorization_url.
+func LinkIdentity(c echo.Context) error {
+	var req LinkIdentityRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := validateToken(c.Request().Context(), requestToken(c, req.Token))
+	if err != nil {
+		return errInvalidToken(err)
+	}
+	if oidcProvider == nil {
+		return errSSODisabled()
+	}
+
+	redirectTo, err := oidcRedirectTarget(req.RedirectTo)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeValidationFailed, err.Error())
+	}
+
+	authURL, err := startOIDCLogin(c, redirectTo, userID)
+	if err != nil {
+		return err
+	}
+	return respond(c, http.StatusOK, "Continue at the identity provider", map[string]interface{}{
+		"authorization_url": authURL,
+	})
+}
+
+// The identity provider sends the browser here. The result goes to the
+// frontend page the sign-in started from, in the URL fragment so tokens stay
+// out of server logs: token and user_id, challenge_token when two-factor
+// authentication is required, linked after linking an identity, or error and
+// error_description.
+func OIDCCallback(c echo.Context) error {
+	if oidcProvider == nil {
+		return errSSODisabled()
+	}
+
+	// Checked before the state is used up, a forged callback must not
+	// cancel the real sign-in of the browser
+	state := c.QueryParam("state")
+	if !oidcStateMatches(c, state) {
+		return newAPIError(http.StatusBadRequest, CodeSSOFailed, "Sign-in was not started from this browser, start again")
+	}
+	setOIDCStateCookie(c, "", -1)
+
+	ctx := c.Request().Context()
+	login, err := store.TakeOIDCLogin(ctx, state)
+	if errors.Is(err, ErrNotFound) || (err == nil && time.Now().After(login.ExpiresAt)) {
+		// Without a valid state there is no trusted page to send the result to
+		return newAPIError(http.StatusBadRequest, CodeSSOFailed, "Sign-in request is invalid or has expired, start again")
+	}
+	if err != nil {
+		return errDatabase(err)
+	}
+
+	finish := func(result url.Values) error {
+		return c.Redirect(http.StatusFound, login.RedirectTo+"#"+result.Encode())
+	}
+	fail := func(apiErr *APIError) error {
+		return finish(url.Values{"error": {apiErr.Code}, "error_description": {apiErr.Message}})
+	}
+
+	if providerErr := c.QueryParam("error"); providerErr != "" {
+		log.Printf("OIDC provider refused sign-in: %s %s", providerErr, c.QueryParam("error_description"))
+		return fail(newAPIError(http.StatusUnauthorized, CodeSSOFailed, "Sign-in was cancelled or refused by the identity provider"))
+	}
+	code := c.QueryParam("code")
+	if code == "" {
+		return fail(newAPIError(http.StatusBadRequest, CodeSSOFailed, "Identity provider returned no authorization code"))
+	}
+
+	claims, err := oidcProvider.exchange(ctx, code, login)
+	if err != nil {
+		log.Printf("OIDC sign-in failed: %v", err)
+		return fail(newAPIError(http.StatusUnauthorized, CodeSSOFailed, "Sign-in could not be verified with the identity provider"))
+	}
+
+	if login.LinkUserID != 0 {
+		if err := linkIdentity(ctx, login.LinkUserID, claims); err != nil {
+			return fail(asAPIError(err))
+		}
+		return finish(url.Values{"linked": {"true"}})
+	}
+
+	user, err := signInWithIdentity(ctx, claims)
+	if err != nil {
+		return fail(asAPIError(err))
+	}
+
+	// The identity provider replaces the password, not the second factor
+	enabled, err := twoFactorEnabled(ctx, store, user.ID)
+	if err != nil {
+		return fail(errDatabase(err))
+	}
+	if enabled {
+		challenge, err := signToken(user, twoFactorPurpose, twoFactorChallengeTTL)
+		if err != nil {
+			return fail(errInternal("Failed to generate token", err))
+		}
+		return finish(url.Values{
+			"user_id":             {strconv.Itoa(user.ID)},
+			"two_factor_required": {"true"},
+			"challenge_token":     {challenge},
+		})
+	}
+
+	token, err := generateToken(user)
+	if err != nil {
+		return fail(errInternal("Failed to generate token", err))
+	}
+	return finish(url.Values{"user_id": {strconv.Itoa(user.ID)}, "token": {token}})
+}
+
+// Turn any error into an APIError for the callback's redirect
+func asAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return errInternal("Sign-in failed", err)
+}
+
+func newIdentity(userID int, claims *idTokenClaims) *UserIdentity {
+	return &UserIdentity{
+		UserID:    userID,
+		Issuer:    oidcProvider.issuer,
+		Subject:   claims.Subject,
+		Email:     strings.ToLower(claims.Email),
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+func linkIdentity(ctx context.Context, userID int, claims *idTokenClaims) error {
+	return store.WithTx(ctx, func(tx Store) error {
+		existing, err := tx.GetIdentity(ctx, oidcProvider.issuer, claims.Subject)
+		if err == nil {
+			if existing.UserID == userID {
+				return nil
+			}
+			return newAPIError(http.StatusConflict, CodeConflict, "This identity is already linked to another account")
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return errDatabase(err)
+		}
+
+		if _, err := tx.GetUser(ctx, userID); err != nil {
+			return errDatabase(err)
+		}
+		err = tx.CreateIdentity(ctx, newIdentity(userID, claims))
+		if errors.Is(err, ErrConflict) {
+			return newAPIError(http.StatusConflict, CodeConflict, "This identity is already linked to another account")
+		}
+		if err != nil {
+			return errInternal("Failed to link identity", err)
+		}
+		return nil
+	})
+}
+
+// Find the user an identity is linked to, creating one when auto-provisioning is on.
+// Identities are never matched to existing accounts by email, whoever controls
+// an address at the provider must not take over an account that uses it.
+func signInWithIdentity(ctx context.Context, claims *idTokenClaims) (User, error) {
+	var user User
+	err := store.WithTx(ctx, func(tx Store) error {
+		identity, err := tx.GetIdentity(ctx, oidcProvider.issuer, claims.Subject)
+		if err == nil {
+			if err := tx.TouchIdentity(ctx, identity.ID, time.Now().UTC()); err != nil {
+				return errDatabase(err)
+			}
+			user, err = tx.GetUser(ctx, identity.UserID)
+			if err != nil {
+				return errDatabase(err)
+			}
+			return nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return errDatabase(err)
+		}
+
+		if !oidcProvider.autoProvision {
+			return newAPIError(http.StatusForbidden, CodeSSONotLinked,
+				"No account is linked to this identity. Sign in with your password and link it from your account first.")
+		}
+
+		user, err = provisionUser(ctx, tx, claims)
+		if err != nil {
+			return err
+		}
+		identity = *newIdentity(user.ID, claims)
+		identity.LastLoginAt = &identity.CreatedAt
+		if err := tx.CreateIdentity(ctx, &identity); err != nil {
+			return errInternal("Failed to link identity", err)
+		}
+		return nil
+	})
+	return user, err
+}
+
+// Create an account without a password for a new identity
+func provisionUser(ctx context.Context, tx Store, claims *idTokenClaims) (User, error) {
+	base := oidcUsername(claims)
+	for n := 1; n <= 100; n++ {
+		username := base
+		if n > 1 {
+			suffix := strconv.Itoa(n)
+			username = truncateRunes(base, oidcMaxUsernameLength-len(suffix)) + suffix
+		}
+		taken, err := tx.UsernameExists(ctx, username)
+		if err != nil {
+			return User{}, errDatabase(err)
+		}
+		if taken {
+			continue
+		}
+
+		// An empty hash never matches a password, the account can only sign
+		// in through the provider until a password is set by reset link
+		user, err := tx.CreateUser(ctx, username, "")
+		if err != nil {
+			return User{}, errInternal("Failed to create user", err)
+		}
+
+		email := verifiedEmail(claims)
+		if email != "" {
+			_, err := tx.GetUserByEmail(ctx, email)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return User{}, errDatabase(err)
+			}
+			// An address another account uses is left off rather than shared
+			if errors.Is(err, ErrNotFound) {
+				if err := tx.SetUserEmail(ctx, user.ID, email); err != nil {
+					return User{}, errInternal("Failed to create user", err)
+				}
+				user.Email = email
+			}
+		}
+		return user, nil
+	}
+	return User{}, newAPIError(http.StatusConflict, CodeUsernameTaken, "Could not find a free username for this identity")
+}
+
+// The verified email of an identity, empty when the provider did not vouch for it
+func verifiedEmail(claims *idTokenClaims) string {
+	if !claims.EmailVerified {
+		return ""
+	}
+	v := &validator{}
+	email := v.email("email", claims.Email)
+	if v.err() != nil {
+		return ""
+	}
+	return email
+}
+
+// Username for a new account, from the provider's username, the email or the name
+func oidcUsername(claims *idTokenClaims) string {
+	local, _, _ := strings.Cut(claims.Email, "@")
+	for _, candidate := range []string{claims.PreferredUsername, local, claims.Name} {
+		username := strings.Map(func(r rune) rune {
+			switch {
+			case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '_' || r == '-':
+				return r
+			case unicode.IsSpace(r):
+				return '.'
+			}
+			return -1
+		}, strings.TrimSpace(candidate))
+		username = strings.Trim(username, ".")
+		if username != "" {
+			return truncateRunes(username, oidcMaxUsernameLength)
+		}
+	}
+	return "user"
+}
+
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) > n {
+		return string(runes[:n])
+	}
+	return s
+}
+
+type ListIdentitiesRequest struct {
+	Token string `json:"token"` // JWT token for authentication
+}
+
+// List the identities linked to the caller's account
+func ListIdentities(c echo.Context) error {
+	var req ListIdentitiesRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := validateToken(c.Request().Context(), requestToken(c, req.Token))
+	if err != nil {
+		return errInvalidToken(err)
+	}
+
+	identities, err := store.ListIdentities(c.Request().Context(), userID)
+	if err != nil {
+		return errDatabase(err)
+	}
+	return respond(c, http.StatusOK, "", identities)
+}
+
+type UnlinkIdentityRequest struct {
+	Token      string `json:"token"` // JWT token for authentication
+	IdentityID int    `json:"identity_id"`
+}
+
+// Unlink an identity. The last one of an account without a password cannot
+// be unlinked, that would leave no way to sign in.
+func UnlinkIdentity(c echo.Context) error {
+	var req UnlinkIdentityRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := validateToken(c.Request().Context(), requestToken(c, req.Token))
+	if err != nil {
+		return errInvalidToken(err)
+	}
+
+	v := &validator{}
+	v.requiredID("identity_id", req.IdentityID)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	err = store.WithTx(ctx, func(tx Store) error {
+		user, err := tx.GetUser(ctx, userID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if user.Password == "" {
+			identities, err := tx.ListIdentities(ctx, userID)
+			if err != nil {
+				return errDatabase(err)
+			}
+			if len(identities) == 1 && identities[0].ID == req.IdentityID {
+				return newAPIError(http.StatusConflict, CodeConflict,
+					"Set a password before unlinking the last identity, otherwise the account cannot sign in")
+			}
+		}
+
+		err = tx.DeleteIdentity(ctx, userID, req.IdentityID)
+		if errors.Is(err, ErrNotFound) {
+			return newAPIError(http.StatusNotFound, CodeNotFound, "Identity not found")
+		}
+		if err != nil {
+			return errInternal("Failed to unlink identity", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return respond(c, http.StatusOK, "Identity unlinked", nil)
+}
+
+func (s *sqlStore) CreateOIDCLogin(ctx context.Context, login OIDCLogin) error {
+	linkUserID := sql.NullInt64{Int64: int64(login.LinkUserID), Valid: login.LinkUserID != 0}
+	_, err := s.exec(ctx, `INSERT INTO oidc_logins (state, nonce, code_verifier, redirect_to, link_user_id, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		login.State, login.Nonce, login.CodeVerifier, login.RedirectTo, linkUserID, login.ExpiresAt, login.CreatedAt)
+	return err
+}
+
+func (s *sqlStore) TakeOIDCLogin(ctx context.Context, state string) (OIDCLogin, error) {
+	// Deleting and reading in one statement makes every state single-use
+	login := OIDCLogin{State: state}
+	var linkUserID sql.NullInt64
+	err := s.queryRow(ctx, `DELETE FROM oidc_logins WHERE state = ?
+		RETURNING nonce, code_verifier, redirect_to, link_user_id, expires_at, created_at`, state).
+		Scan(&login.Nonce, &login.CodeVerifier, &login.RedirectTo, &linkUserID, &login.ExpiresAt, &login.CreatedAt)
+	login.LinkUserID = int(linkUserID.Int64)
+	return login, notFound(err)
+}
+
+func (s *sqlStore) DeleteExpiredOIDCLogins(ctx context.Context, now time.Time) error {
+	_, err := s.exec(ctx, "DELETE FROM oidc_logins WHERE expires_at < ?", now)
+	return err
+}
+
+const identityColumns = "id, user_id, issuer, subject, email, created_at, last_login_at"
+
+func scanIdentity(row interface{ Scan(...interface{}) error }) (UserIdentity, error) {
+	var identity UserIdentity
+	var email sql.NullString
+	var lastLoginAt sql.NullTime
+	err := row.Scan(&identity.ID, &identity.UserID, &identity.Issuer, &identity.Subject, &email,
+		&identity.CreatedAt, &lastLoginAt)
+	identity.Email = email.String
+	if lastLoginAt.Valid {
+		identity.LastLoginAt = &lastLoginAt.Time
+	}
+	return identity, notFound(err)
+}
+
+func (s *sqlStore) GetIdentity(ctx context.Context, issuer, subject string) (UserIdentity, error) {
+	return scanIdentity(s.queryRow(ctx, "SELECT "+identityColumns+" FROM user_identities WHERE issuer = ? AND subject = ?", issuer, subject))
+}
+
+func (s *sqlStore) CreateIdentity(ctx context.Context, identity *UserIdentity) error {
+	email := sql.NullString{String: identity.Email, Valid: identity.Email != ""}
+	id, err := s.insertID(ctx, `INSERT INTO user_identities (user_id, issuer, subject, email, created_at, last_login_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		identity.UserID, identity.Issuer, identity.Subject, email, identity.CreatedAt, identity.LastLoginAt)
+	if err != nil {
+		return err
+	}
+	identity.ID = id
+	return nil
+}
+
+func (s *sqlStore) ListIdentities(ctx context.Context, userID int) ([]UserIdentity, error) {
+	rows, err := s.query(ctx, "SELECT "+identityColumns+" FROM user_identities WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []UserIdentity{}
+	for rows.Next() {
+		identity, err := scanIdentity(rows)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+func (s *sqlStore) TouchIdentity(ctx context.Context, identityID int, at time.Time) error {
+	_, err := s.exec(ctx, "UPDATE user_identities SET last_login_at = ? WHERE id = ?", at, identityID)
+	return err
+}
+
+func (s *sqlStore) DeleteIdentity(ctx context.Context, userID, identityID int) error {
+	result, err := s.exec(ctx, "DELETE FROM user_identities WHERE id = ? AND user_id = ?", identityID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteIdentities(ctx context.Context, userID int) error {
+	_, err := s.exec(ctx, "DELETE FROM user_identities WHERE user_id = ?", userID)
+	return err
+}
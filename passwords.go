@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Static salt appended to passwords by the bcrypt hashes of older versions
+const legacyBcryptSalt = "1afdcf647dbd07d353987550168"
+
+// Longest password accepted, hashing is deliberately slow and should not be fed megabytes
+const passwordMaxLength = 256
+
+// A way of turning passwords into stored hashes
+type PasswordHasher interface {
+	// Hash encodes a password together with its salt and parameters
+	Hash(password string) (string, error)
+	// Recognizes reports whether an encoded hash belongs to this scheme
+	Recognizes(encoded string) bool
+	Verify(password, encoded string) bool
+	// NeedsRehash reports whether a recognized hash uses outdated parameters
+	NeedsRehash(encoded string) bool
+}
+
+var (
+	// Hashes new passwords, set from the configuration
+	passwordHasher PasswordHasher
+	// Verifies hashes written by older versions, they are replaced on the next login
+	legacyHashers = []PasswordHasher{legacyBcryptHasher{}}
+)
+
+// Accounts without a password confirm sensitive changes with a sign-in this recent
+const reauthenticationWindow = 10 * time.Minute
+
+// Confirm a sensitive change with the user's password, field names the
+// request field it was sent in. Accounts created through single sign-on
+// have no password until they set one, a token from a sign-in at the
+// provider within the last minutes takes its place.
+func confirmPassword(user User, token, field, password string) error {
+	if user.Password == "" {
+		issuedAt, err := tokenIssuedAt(token)
+		if err != nil || time.Since(issuedAt) > reauthenticationWindow {
+			return newAPIError(http.StatusForbidden, CodeReauthRequired, "Sign in again with single sign-on to confirm this change")
+		}
+		return nil
+	}
+
+	v := &validator{}
+	v.required(field, password)
+	if err := v.err(); err != nil {
+		return err
+	}
+	if !verifyPassword(password, user.Password) {
+		label := strings.ReplaceAll(field, "_", " ")
+		return newAPIError(http.StatusForbidden, CodeInvalidCreds, strings.ToUpper(label[:1])+label[1:]+" is incorrect")
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	return passwordHasher.Hash(password)
+}
+
+// Check a password against a hash of any supported scheme
+func verifyPassword(password, encoded string) bool {
+	if passwordHasher.Recognizes(encoded) {
+		return passwordHasher.Verify(password, encoded)
+	}
+	for _, h := range legacyHashers {
+		if h.Recognizes(encoded) {
+			return h.Verify(password, encoded)
+		}
+	}
+	// Also covers the empty hash of accounts that only sign in through SSO
+	return false
+}
+
+// Whether a verified hash should be replaced by one of the current hasher
+func passwordNeedsRehash(encoded string) bool {
+	if passwordHasher.Recognizes(encoded) {
+		return passwordHasher.NeedsRehash(encoded)
+	}
+	return encoded != ""
+}
+
+// Argon2id hashes in the PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+type argon2idHasher struct {
+	memory      uint32 // KiB
+	iterations  uint32
+	parallelism uint8
+	saltLength  int
+	keyLength   uint32
+}
+
+func newArgon2idHasher(cfg Config) argon2idHasher {
+	return argon2idHasher{
+		memory:      cfg.Argon2Memory,
+		iterations:  cfg.Argon2Iterations,
+		parallelism: cfg.Argon2Parallelism,
+		saltLength:  16,
+		keyLength:   32,
+	}
+}
+
+func (h argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.iterations, h.memory, h.parallelism, h.keyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.memory, h.iterations, h.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h argon2idHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+// Parameters, salt and key of an encoded hash
+type argon2idHash struct {
+	version     int
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt, key   []byte
+}
+
+func parseArgon2id(encoded string) (argon2idHash, error) {
+	var parsed argon2idHash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return parsed, fmt.Errorf("malformed argon2id hash")
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &parsed.version); err != nil {
+		return parsed, err
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &parsed.memory, &parsed.iterations, &parsed.parallelism); err != nil {
+		return parsed, err
+	}
+	var err error
+	if parsed.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return parsed, err
+	}
+	if parsed.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return parsed, err
+	}
+	return parsed, nil
+}
+
+func (h argon2idHasher) Verify(password, encoded string) bool {
+	parsed, err := parseArgon2id(encoded)
+	if err != nil || parsed.version != argon2.Version || len(parsed.key) == 0 {
+		return false
+	}
+	key := argon2.IDKey([]byte(password), parsed.salt, parsed.iterations, parsed.memory, parsed.parallelism, uint32(len(parsed.key)))
+	return subtle.ConstantTimeCompare(key, parsed.key) == 1
+}
+
+func (h argon2idHasher) NeedsRehash(encoded string) bool {
+	parsed, err := parseArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return parsed.version != argon2.Version || parsed.memory != h.memory || parsed.iterations != h.iterations ||
+		parsed.parallelism != h.parallelism || len(parsed.salt) != h.saltLength || len(parsed.key) != int(h.keyLength)
+}
+
+// bcrypt over the password plus legacyBcryptSalt, as written by older
+// versions. Only verifies, bcrypt ignores everything after 72 bytes.
+type legacyBcryptHasher struct{}
+
+func (legacyBcryptHasher) Hash(password string) (string, error) {
+	return "", fmt.Errorf("legacy bcrypt hashes are only verified")
+}
+
+func (legacyBcryptHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (legacyBcryptHasher) Verify(password, encoded string) bool {
+	// Hashes were made of the truncated input, compare the same bytes
+	salted := []byte(password + legacyBcryptSalt)
+	if len(salted) > 72 {
+		salted = salted[:72]
+	}
+	return bcrypt.CompareHashAndPassword([]byte(encoded), salted) == nil
+}
+
+func (legacyBcryptHasher) NeedsRehash(encoded string) bool {
+	return true
+}
+
+// Rules new passwords must follow
+type PasswordPolicy struct {
+	MinLength int
+	// SHA-1 hashes (upper case hex) of passwords known from breaches
+	breached map[string]struct{}
+}
+
+var passwordPolicy PasswordPolicy
+
+// Build the policy, reading the breached password list if one is configured
+func loadPasswordPolicy(cfg Config) (PasswordPolicy, error) {
+	policy := PasswordPolicy{MinLength: cfg.PasswordMinLength}
+	if cfg.PasswordBlocklist == "" {
+		return policy, nil
+	}
+
+	breached, err := readPasswordBlocklist(cfg.PasswordBlocklist)
+	if err != nil {
+		return policy, fmt.Errorf("reading PASSWORD_BLOCKLIST: %w", err)
+	}
+	policy.breached = breached
+	return policy, nil
+}
+
+// Read a list with one password per line. Lines of 40 hex digits, optionally
+// followed by ":<count>" as in the Have I Been Pwned downloads, are taken as
+// SHA-1 hashes of passwords.
+func readPasswordBlocklist(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	breached := map[string]struct{}{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if hash, _, _ := strings.Cut(line, ":"); len(hash) == 40 {
+			if _, err := hex.DecodeString(hash); err == nil {
+				breached[strings.ToUpper(hash)] = struct{}{}
+				continue
+			}
+		}
+		breached[sha1Hex(line)] = struct{}{}
+	}
+	return breached, scanner.Err()
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func (p PasswordPolicy) isBreached(password string) bool {
+	_, found := p.breached[sha1Hex(password)]
+	return found
+}
+
+// Check a new password against the password policy
+func (v *validator) password(field, value string) {
+	if value == "" {
+		v.required(field, value)
+		return
+	}
+	length := utf8.RuneCountInString(value)
+	switch {
+	case length < passwordPolicy.MinLength:
+		v.add(field, FieldTooShort, fmt.Sprintf("%s must be at least %d characters long", field, passwordPolicy.MinLength))
+	case len(value) > passwordMaxLength:
+		v.add(field, FieldTooLong, fmt.Sprintf("%s must be at most %d bytes long", field, passwordMaxLength))
+	case passwordPolicy.isBreached(value):
+		v.add(field, FieldBreached, field+" appears in a list of breached passwords, choose another one")
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	displayNameMaxLength = 64
+	avatarURLMaxLength   = 512
+	defaultSearchLimit   = 10
+	maxSearchLimit       = 50
+)
+
+var (
+	currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+	// A BCP 47 language tag such as "sk", "en-GB" or "zh-Hant-TW"
+	localePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+)
+
+// What other users see of a user
+type PublicProfile struct {
+	ID          int    `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// A user's own profile and preferences
+type Profile struct {
+	PublicProfile
+	Email    string `json:"email,omitempty"`
+	Timezone string `json:"timezone"`
+	Currency string `json:"currency"` // ISO 4217 code amounts are entered in by default
+	Locale   string `json:"locale"`   // BCP 47 language tag for formatting
+}
+
+func publicProfile(user User) PublicProfile {
+	return PublicProfile{ID: user.ID, Username: user.Username, DisplayName: user.DisplayName, AvatarURL: user.AvatarURL}
+}
+
+func publicProfiles(users []User) []PublicProfile {
+	profiles := make([]PublicProfile, 0, len(users))
+	for _, user := range users {
+		profiles = append(profiles, publicProfile(user))
+	}
+	return profiles
+}
+
+func ownProfile(user User) Profile {
+	return Profile{
+		PublicProfile: publicProfile(user),
+		Email:         user.Email,
+		Timezone:      user.Timezone,
+		Currency:      user.Currency,
+		Locale:        user.Locale,
+	}
+}
+
+type GetProfileRequest struct {
+	Token string `json:"token"` // JWT token or API key for authentication
+}
+
+// Get the caller's own profile
+func GetProfile(c echo.Context) error {
+	var req GetProfileRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := authenticate(c, req.Token, scopeRead)
+	if err != nil {
+		return err
+	}
+
+	user, err := store.GetUser(c.Request().Context(), userID)
+	if errors.Is(err, ErrNotFound) {
+		return newAPIError(http.StatusNotFound, CodeUserNotFound, "User not found")
+	}
+	if err != nil {
+		return errDatabase(err)
+	}
+	return respond(c, http.StatusOK, "", ownProfile(user))
+}
+
+// Fields left out of the request keep their value, empty strings clear
+// display_name and avatar_url
+type UpdateProfileRequest struct {
+	Token       string  `json:"token"` // JWT token for authentication
+	DisplayName *string `json:"display_name,omitempty"`
+	AvatarURL   *string `json:"avatar_url,omitempty"`
+	Timezone    *string `json:"timezone,omitempty"` // IANA time zone name
+	Currency    *string `json:"currency,omitempty"` // ISO 4217 code, e.g. "EUR"
+	Locale      *string `json:"locale,omitempty"`   // BCP 47 tag, e.g. "sk-SK"
+}
+
+func UpdateProfile(c echo.Context) error {
+	var req UpdateProfileRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := validateToken(c.Request().Context(), requestToken(c, req.Token))
+	if err != nil {
+		return errInvalidToken(err)
+	}
+
+	ctx := c.Request().Context()
+	var user User
+	err = store.WithTx(ctx, func(tx Store) error {
+		user, err = tx.GetUser(ctx, userID)
+		if errors.Is(err, ErrNotFound) {
+			return newAPIError(http.StatusNotFound, CodeUserNotFound, "User not found")
+		}
+		if err != nil {
+			return errDatabase(err)
+		}
+
+		v := &validator{}
+		if req.DisplayName != nil {
+			user.DisplayName = strings.TrimSpace(*req.DisplayName)
+			if utf8.RuneCountInString(user.DisplayName) > displayNameMaxLength {
+				v.add("display_name", FieldTooLong, "display_name must be at most 64 characters long")
+			}
+		}
+		if req.AvatarURL != nil {
+			user.AvatarURL = strings.TrimSpace(*req.AvatarURL)
+			v.avatarURL("avatar_url", user.AvatarURL)
+		}
+		if req.Timezone != nil {
+			user.Timezone = *req.Timezone
+			if _, err := time.LoadLocation(user.Timezone); err != nil || user.Timezone == "" {
+				v.add("timezone", FieldInvalidFormat, "timezone must be an IANA time zone name")
+			}
+		}
+		if req.Currency != nil {
+			user.Currency = strings.ToUpper(strings.TrimSpace(*req.Currency))
+			if !currencyPattern.MatchString(user.Currency) {
+				v.add("currency", FieldInvalidFormat, "currency must be a three letter ISO 4217 code")
+			}
+		}
+		if req.Locale != nil {
+			user.Locale = strings.ReplaceAll(strings.TrimSpace(*req.Locale), "_", "-")
+			if !localePattern.MatchString(user.Locale) {
+				v.add("locale", FieldInvalidFormat, "locale must be a language tag such as en or sk-SK")
+			}
+		}
+		if err := v.err(); err != nil {
+			return err
+		}
+
+		if err := tx.UpdateProfile(ctx, user); err != nil {
+			return errInternal("Failed to update profile", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return respond(c, http.StatusOK, "Profile updated successfully", ownProfile(user))
+}
+
+// Avatars are linked, not uploaded, and must be absolute http(s) URLs
+func (v *validator) avatarURL(field, value string) {
+	if value == "" {
+		return
+	}
+	if len(value) > avatarURLMaxLength {
+		v.add(field, FieldTooLong, field+" must be at most 512 characters long")
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		v.add(field, FieldInvalidFormat, field+" must be an http or https URL")
+	}
+}
+
+type SearchUsersRequest struct {
+	Token string `json:"token"` // JWT token or API key for authentication
+	Query string `json:"query"` // Username, email address or part of a name
+	Limit int    `json:"limit,omitempty"`
+}
+
+// Find users to add to a group. Anyone can be found by their exact username
+// or email address; partial matches only find people the caller already
+// shares a group with, so the user directory cannot be enumerated.
+func SearchUsers(c echo.Context) error {
+	var req SearchUsersRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := authenticate(c, req.Token, scopeRead)
+	if err != nil {
+		return err
+	}
+
+	query := strings.TrimSpace(req.Query)
+	v := &validator{}
+	v.required("query", query)
+	if req.Limit < 0 {
+		v.add("limit", FieldMustBePositive, "limit must be greater than zero")
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+	limit := req.Limit
+	if limit == 0 {
+		limit = defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+
+	ctx := c.Request().Context()
+	users, err := store.SearchUsers(ctx, UserSearch{
+		CallerID: userID,
+		Query:    query,
+		GroupIDs: principalFromContext(ctx).groupIDs(),
+		Limit:    limit,
+	})
+	if err != nil {
+		return errDatabase(err)
+	}
+	return respond(c, http.StatusOK, "", publicProfiles(users))
+}
+
+// Users sharing at least one group with the caller
+func listContacts(ctx context.Context, userID int) ([]PublicProfile, error) {
+	users, err := store.ListContacts(ctx, userID, principalFromContext(ctx).groupIDs())
+	if err != nil {
+		return nil, err
+	}
+	return publicProfiles(users), nil
+}
+
+// Escape LIKE wildcards in user input
+func likePattern(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+	return "%" + s + "%"
+}
+
+// Subquery of the users sharing a group with the caller, limited to groupIDs unless nil
+func contactsQuery(userID int, groupIDs []int) (string, []interface{}) {
+	query := `SELECT other.user_id FROM group_members mine
+		JOIN group_members other ON other.group_id = mine.group_id
+		WHERE mine.user_id = ?`
+	args := []interface{}{userID}
+	if groupIDs != nil {
+		if len(groupIDs) == 0 {
+			return query + " AND 1 = 0", args
+		}
+		query += " AND mine.group_id IN (?" + strings.Repeat(", ?", len(groupIDs)-1) + ")"
+		for _, id := range groupIDs {
+			args = append(args, id)
+		}
+	}
+	return query, args
+}
+
+func (s *sqlStore) ListContacts(ctx context.Context, userID int, groupIDs []int) ([]User, error) {
+	contacts, args := contactsQuery(userID, groupIDs)
+	return s.listUsers(ctx, "SELECT "+userColumns+" FROM users u WHERE u.id IN ("+contacts+") AND u.id != ? ORDER BY u.username",
+		append(args, userID)...)
+}
+
+func (s *sqlStore) SearchUsers(ctx context.Context, search UserSearch) ([]User, error) {
+	exact := strings.ToLower(search.Query)
+	pattern := likePattern(exact)
+	contacts, contactArgs := contactsQuery(search.CallerID, search.GroupIDs)
+
+	query := `SELECT ` + userColumns + ` FROM users u
+		WHERE u.id != ? AND (
+			LOWER(u.username) = ? OR u.email = ?
+			OR (u.id IN (` + contacts + `) AND (
+				LOWER(u.username) LIKE ? ESCAPE '\' OR LOWER(COALESCE(u.display_name, '')) LIKE ? ESCAPE '\'))
+		)
+		ORDER BY CASE WHEN LOWER(u.username) = ? THEN 0 ELSE 1 END, u.username
+		LIMIT ?`
+	args := []interface{}{search.CallerID, exact, exact}
+	args = append(args, contactArgs...)
+	args = append(args, pattern, pattern, exact, search.Limit)
+	return s.listUsers(ctx, query, args...)
+}
+
+func (s *sqlStore) UpdateProfile(ctx context.Context, user User) error {
+	result, err := s.exec(ctx, "UPDATE users SET display_name = ?, avatar_url = ?, timezone = ?, currency = ?, locale = ? WHERE id = ?",
+		user.DisplayName, user.AvatarURL, user.Timezone, user.Currency, user.Locale, user.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
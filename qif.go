@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// QIF files are lines starting with a letter telling what the rest of the
+// line is, grouped into records ending with "^". A "!Type:" line tells
+// what the following records are. Only bank, cash and card transactions
+// are read, lists of categories, classes and investments are skipped.
+
+// Record types holding transactions of an account
+var qifTransactionTypes = map[string]bool{"bank": true, "cash": true, "ccard": true, "oth a": true, "oth l": true}
+
+func isQIF(content string) bool {
+	head := strings.ToUpper(strings.TrimLeft(content, "\ufeff \t\r\n"))
+	return strings.HasPrefix(head, "!TYPE:") || strings.HasPrefix(head, "!ACCOUNT") || strings.HasPrefix(head, "!OPTION")
+}
+
+func parseQIF(content string, options statementOptions) ([]StatementTransaction, error) {
+	var transactions []StatementTransaction
+	recordType := ""
+	account := ""
+	inAccount := false // Reading an account record after "!Account"
+	fields := map[string]string{}
+	startLine := 0
+
+	for i, line := range strings.Split(strings.TrimPrefix(content, "\ufeff"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		number := i + 1
+
+		if strings.HasPrefix(line, "!") {
+			header := strings.ToLower(strings.TrimSpace(line[1:]))
+			switch {
+			case header == "account":
+				inAccount = true
+			case strings.HasPrefix(header, "type:"):
+				recordType = strings.TrimSpace(strings.TrimPrefix(header, "type:"))
+				inAccount = false
+			}
+			// "!Option" and "!Clear" lines change nothing read here
+			continue
+		}
+
+		if line[0] == '^' {
+			if inAccount {
+				account = fields["N"]
+				inAccount = false
+			} else if qifTransactionTypes[recordType] {
+				t, err := qifTransaction(fields, options, startLine)
+				if err != nil {
+					return nil, err
+				}
+				transactions = append(transactions, t)
+			}
+			fields = map[string]string{}
+			continue
+		}
+
+		if len(fields) == 0 {
+			startLine = number
+		}
+		if recordType == "" && !inAccount {
+			return nil, statementErrorf(number, "record before the first !Type line")
+		}
+		// Split lines (S, E and $) repeat, the transaction's own fields come first
+		code := line[:1]
+		if _, ok := fields[code]; !ok {
+			fields[code] = strings.TrimSpace(line[1:])
+		}
+	}
+	if len(fields) > 0 && qifTransactionTypes[recordType] && !inAccount {
+		return nil, statementErrorf(startLine, `record not ended with "^"`)
+	}
+
+	fillExternalIDs("qif:"+account, transactions)
+	return transactions, nil
+}
+
+func qifTransaction(fields map[string]string, options statementOptions, line int) (StatementTransaction, error) {
+	var t StatementTransaction
+	date, ok := parseQIFDate(fields["D"], options.DateFormat)
+	if !ok {
+		return t, statementErrorf(line, "invalid date %q, check date_format", fields["D"])
+	}
+	value := fields["T"]
+	if value == "" {
+		value = fields["U"]
+	}
+	amount, ok := parseStatementAmount(value)
+	if !ok {
+		return t, statementErrorf(line, "invalid amount %q", value)
+	}
+	t.Date = date
+	t.Amount = amount
+	t.Payee = fields["P"]
+	t.Memo = fields["M"]
+
+	// "[Account]" is a transfer, "Category/Class" carries a class
+	category := fields["L"]
+	if !strings.HasPrefix(category, "[") {
+		category, _, _ = strings.Cut(category, "/")
+		t.Category = strings.TrimSpace(category)
+	}
+	return t, nil
+}
+
+// Quicken writes dates like 1/15/2024, 01/15/24 or 1/15'04, where the
+// apostrophe marks years from 2000. Others use 15.01.2024 or 2024-01-15.
+// Whether the day or month comes first depends on the program's locale,
+// dateFormat tells which.
+func parseQIFDate(value, dateFormat string) (string, bool) {
+	apostrophe := strings.Contains(value, "'")
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return !unicode.IsDigit(r)
+	})
+	if len(parts) != 3 {
+		return "", false
+	}
+	numbers := make([]int, 3)
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return "", false
+		}
+		numbers[i] = n
+	}
+
+	var year, month, day int
+	switch {
+	case len(parts[0]) == 4:
+		year, month, day = numbers[0], numbers[1], numbers[2]
+	case dateFormat == "dmy":
+		day, month, year = numbers[0], numbers[1], numbers[2]
+	default:
+		month, day, year = numbers[0], numbers[1], numbers[2]
+	}
+	if len(parts[2]) <= 2 && len(parts[0]) != 4 {
+		switch {
+		case apostrophe || year < 70:
+			year += 2000
+		default:
+			year += 1900
+		}
+	}
+
+	t := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if t.Month() != time.Month(month) || t.Day() != day || year < minExpenseYear || year > maxExpenseYear {
+		return "", false
+	}
+	return t.Format(dateLayout), true
+}
@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestParseQIF(t *testing.T) {
+	got, err := parseQIF(readStatement(t, "statement.qif"), statementOptions{DateFormat: "mdy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTransactions(t, got, []StatementTransaction{
+		// The class after "/" is left out of the category
+		{ExternalID: "qif:Checking:*", Date: "2024-01-15", Amount: -12.5, Payee: "Corner Shop", Memo: "Milk", Category: "Groceries:Food"},
+		// Transfers to another account have no category
+		{ExternalID: "qif:Checking:*", Date: "2024-01-16", Amount: -1200, Payee: "Landlord"},
+		// U is the amount when T is missing, splits do not replace it
+		{ExternalID: "qif:Checking:*", Date: "2024-01-17", Amount: -3, Payee: "Kiosk"},
+	})
+}
+
+func TestParseQIFErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		options statementOptions
+		want    string
+	}{
+		{"record before a type", "D1/15/24\nT-1.00\n^\n", statementOptions{}, "line 1: record before the first !Type line"},
+		{"unended record", "!Type:Bank\nD1/15/24\nT-1.00\n", statementOptions{}, `line 2: record not ended with "^"`},
+		{"day first in a month first file", "!Type:Bank\nD15/01/2024\nT-1.00\n^\n", statementOptions{DateFormat: "mdy"}, `line 2: invalid date "15/01/2024", check date_format`},
+		{"invalid amount", "!Type:Bank\n\nD1/15/24\nT-1.00.00x\n^\n", statementOptions{}, `line 3: invalid amount "-1.00.00x"`},
+	}
+	for _, tt := range tests {
+		_, err := parseQIF(tt.content, tt.options)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestParseQIFDate(t *testing.T) {
+	tests := []struct {
+		value      string
+		dateFormat string
+		want       string // Empty for invalid dates
+	}{
+		{"1/15/2024", "mdy", "2024-01-15"},
+		{"01/15/24", "mdy", "2024-01-15"},
+		{"1/15'04", "mdy", "2004-01-15"},
+		{" 1/15' 4", "mdy", "2004-01-15"},
+		{"12/31/99", "mdy", "1999-12-31"},
+		{"12/31/69", "mdy", "2069-12-31"},
+		{"12/31/70", "mdy", "1970-12-31"},
+		{"15.01.2024", "dmy", "2024-01-15"},
+		{"15/01/24", "dmy", "2024-01-15"},
+		{"02/01/2024", "mdy", "2024-02-01"},
+		{"02/01/2024", "dmy", "2024-01-02"},
+		// Year first is read the same either way
+		{"2024-01-15", "mdy", "2024-01-15"},
+		{"2024-01-15", "dmy", "2024-01-15"},
+		{"15/01/2024", "mdy", ""},
+		{"02/30/2024", "mdy", ""},
+		{"2/29/2023", "mdy", ""},
+		{"2/29/2024", "mdy", "2024-02-29"},
+		{"1/15", "mdy", ""},
+		{"1/15/1850", "mdy", ""},
+		{"", "mdy", ""},
+	}
+	for _, tt := range tests {
+		got, ok := parseQIFDate(tt.value, tt.dateFormat)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("parseQIFDate(%q, %q) = %q, %v, want %q", tt.value, tt.dateFormat, got, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Limits how often a key (an IP address, a username) may be used. The
+// in-memory implementation works for a single instance; deployments running
+// several instances need one backed by shared storage.
+type Limiter interface {
+	// Check returns how long the key is still locked, 0 if it may be used
+	Check(ctx context.Context, key string) (time.Duration, error)
+	// Hit records an attempt and returns the lockout it triggered, if any
+	Hit(ctx context.Context, key string) (time.Duration, error)
+	// Reset forgets the attempts and lockouts of a key
+	Reset(ctx context.Context, key string) error
+}
+
+// How many attempts are allowed and how long keys are locked after that
+type LimitPolicy struct {
+	Attempts   int
+	Window     time.Duration
+	Lockout    time.Duration // First lockout, doubled every time the key is locked again
+	MaxLockout time.Duration
+}
+
+// Lockout for the n-th consecutive lock of a key
+func (p LimitPolicy) lockout(n int) time.Duration {
+	d := float64(p.Lockout) * math.Pow(2, float64(n-1))
+	if d > float64(p.MaxLockout) {
+		return p.MaxLockout
+	}
+	return time.Duration(d)
+}
+
+var (
+	// Failed logins per username
+	loginLimiter Limiter
+	// Attempts per client IP, keyed by endpoint
+	ipLimiter Limiter
+)
+
+func setupRateLimits(cfg Config) {
+	policy := LimitPolicy{
+		Attempts:   cfg.LoginMaxAttempts,
+		Window:     cfg.RateLimitWindow,
+		Lockout:    cfg.RateLimitLockout,
+		MaxLockout: cfg.RateLimitMaxLockout,
+	}
+	loginLimiter = newMemoryLimiter(policy)
+
+	policy.Attempts = cfg.IPMaxAttempts
+	ipLimiter = newMemoryLimiter(policy)
+}
+
+type limitEntry struct {
+	count       int
+	windowStart time.Time
+	lockouts    int // Consecutive lockouts, decides the next lockout's length
+	lockedUntil time.Time
+}
+
+type memoryLimiter struct {
+	policy    LimitPolicy
+	mu        sync.Mutex
+	entries   map[string]*limitEntry
+	lastSweep time.Time
+}
+
+func newMemoryLimiter(policy LimitPolicy) *memoryLimiter {
+	return &memoryLimiter{policy: policy, entries: map[string]*limitEntry{}, lastSweep: time.Now()}
+}
+
+func (l *memoryLimiter) Check(ctx context.Context, key string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if entry, ok := l.entries[key]; ok {
+		if remaining := time.Until(entry.lockedUntil); remaining > 0 {
+			return remaining, nil
+		}
+	}
+	return 0, nil
+}
+
+func (l *memoryLimiter) Hit(ctx context.Context, key string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	entry, ok := l.entries[key]
+	if !ok {
+		entry = &limitEntry{windowStart: now}
+		l.entries[key] = entry
+	}
+	if remaining := entry.lockedUntil.Sub(now); remaining > 0 {
+		return remaining, nil
+	}
+	if now.Sub(entry.windowStart) > l.policy.Window {
+		entry.count = 0
+		entry.windowStart = now
+	}
+
+	entry.count++
+	if entry.count < l.policy.Attempts {
+		return 0, nil
+	}
+
+	entry.lockouts++
+	lockout := l.policy.lockout(entry.lockouts)
+	entry.lockedUntil = now.Add(lockout)
+	entry.count = 0
+	entry.windowStart = entry.lockedUntil
+	return lockout, nil
+}
+
+func (l *memoryLimiter) Reset(ctx context.Context, key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+	return nil
+}
+
+// Drop entries that no longer affect anything. A key's lockout history is
+// forgotten once it has been quiet for the longest lockout.
+func (l *memoryLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.policy.Window {
+		return
+	}
+	l.lastSweep = now
+
+	for key, entry := range l.entries {
+		quietSince := entry.windowStart.Add(l.policy.Window)
+		if entry.lockedUntil.After(quietSince) {
+			quietSince = entry.lockedUntil
+		}
+		if now.Sub(quietSince) > l.policy.MaxLockout {
+			delete(l.entries, key)
+		}
+	}
+}
+
+func errTooManyRequests(c echo.Context, retryAfter time.Duration) *APIError {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	return newAPIError(http.StatusTooManyRequests, CodeTooManyRequests, "Too many attempts, try again in "+(time.Duration(seconds)*time.Second).String())
+}
+
+// A key to check against a limiter
+type limitKey struct {
+	limiter Limiter
+	key     string
+}
+
+func ipKey(c echo.Context, endpoint string) limitKey {
+	return limitKey{ipLimiter, endpoint + ":" + c.RealIP()}
+}
+
+func usernameKey(username string) limitKey {
+	return limitKey{loginLimiter, "user:" + strings.ToLower(username)}
+}
+
+// Reject the request with 429 if any of the keys is locked
+func checkRateLimits(c echo.Context, keys ...limitKey) error {
+	ctx := c.Request().Context()
+	var longest time.Duration
+	for _, k := range keys {
+		remaining, err := k.limiter.Check(ctx, k.key)
+		if err != nil {
+			return errInternal("Rate limiter error", err)
+		}
+		if remaining > longest {
+			longest = remaining
+		}
+	}
+	if longest > 0 {
+		return errTooManyRequests(c, longest)
+	}
+	return nil
+}
+
+// Count an attempt against every key. Errors are only logged so a failing
+// limiter backend does not take logins down with it.
+func hitRateLimits(c echo.Context, keys ...limitKey) {
+	ctx := c.Request().Context()
+	for _, k := range keys {
+		if _, err := k.limiter.Hit(ctx, k.key); err != nil {
+			log.Printf("Rate limiter error: %v", err)
+		}
+	}
+}
+
+func resetRateLimits(c echo.Context, keys ...limitKey) {
+	ctx := c.Request().Context()
+	for _, k := range keys {
+		if err := k.limiter.Reset(ctx, k.key); err != nil {
+			log.Printf("Rate limiter error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Envelope used for every successful API response
+type APIResponse struct {
+	Message  string      `json:"message,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+	Warnings []Warning   `json:"warnings,omitempty"`
+}
+
+// Something about a successful request the user may want to know
+type Warning struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	ExpenseIDs []int  `json:"expense_ids,omitempty"` // Expenses the warning is about
+}
+
+// Send a successful response wrapped in the API envelope
+func respond(c echo.Context, status int, message string, data interface{}) error {
+	return c.JSON(status, APIResponse{Message: message, Data: data})
+}
+
+// Send a 201 Created response pointing at the new resource
+func respondCreated(c echo.Context, location, message string, data interface{}, warnings ...Warning) error {
+	if location != "" {
+		c.Response().Header().Set(echo.HeaderLocation, location)
+	}
+	return c.JSON(http.StatusCreated, APIResponse{Message: message, Data: data, Warnings: warnings})
+}
+
+// Get the JWT token from the request body, falling back to the
+// "Authorization: Bearer <token>" header used by GET endpoints
+func requestToken(c echo.Context, bodyToken string) string {
+	if bodyToken != "" {
+		return bodyToken
+	}
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
@@ -0,0 +1,687 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	maxRulesPerGroup   = 100
+	ruleNameMaxLength  = 100
+	ruleRegexMaxLength = 200
+)
+
+func errRuleNotFound() *APIError {
+	return newAPIError(http.StatusNotFound, CodeNotFound, "Rule not found")
+}
+
+// The rules of a group, ready for matching
+type ruleSet struct {
+	rules   []Rule
+	regexps map[int]*regexp.Regexp // By rule ID
+}
+
+func loadRules(ctx context.Context, tx Store, groupID int) (*ruleSet, error) {
+	rules, err := tx.ListRules(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	set := &ruleSet{rules: rules, regexps: map[int]*regexp.Regexp{}}
+	for _, rule := range rules {
+		if rule.DescriptionRegex != "" {
+			// Checked when the rule was saved
+			set.regexps[rule.ID], _ = compileRuleRegex(rule.DescriptionRegex)
+		}
+	}
+	return set, nil
+}
+
+// Patterns ignore case like the other conditions
+func compileRuleRegex(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("(?i)" + pattern)
+}
+
+// The first rule matching the expense, nil if none does
+func (s *ruleSet) match(expense Expense) *Rule {
+	for i := range s.rules {
+		if s.matches(&s.rules[i], expense) {
+			return &s.rules[i]
+		}
+	}
+	return nil
+}
+
+func (s *ruleSet) matches(rule *Rule, expense Expense) bool {
+	if rule.DescriptionContains != "" && !strings.Contains(strings.ToLower(expense.Description), strings.ToLower(rule.DescriptionContains)) {
+		return false
+	}
+	if rule.DescriptionRegex != "" {
+		re := s.regexps[rule.ID]
+		if re == nil || !re.MatchString(expense.Description) {
+			return false
+		}
+	}
+	if rule.Merchant != "" && !strings.Contains(strings.ToLower(expense.Merchant), strings.ToLower(rule.Merchant)) {
+		return false
+	}
+	if rule.MinAmount != nil && expense.Amount < *rule.MinAmount {
+		return false
+	}
+	if rule.MaxAmount != nil && expense.Amount > *rule.MaxAmount {
+		return false
+	}
+	return true
+}
+
+// Let the group's rules fill in a new expense. Only the category and payer
+// the caller left out are set, the rule's tags are added to tags. Returns
+// the tags the expense gets.
+func applyRules(ctx context.Context, tx Store, expense *Expense, tags []string, payerGiven bool) ([]string, error) {
+	rules, err := loadRules(ctx, tx, expense.OwnerGroupID)
+	if err != nil {
+		return nil, err
+	}
+	rule, tags, err := rules.fill(ctx, tx, expense, tags, payerGiven)
+	if err != nil || rule == nil {
+		return tags, err
+	}
+	return tags, tx.RecordRuleHits(ctx, map[int]int{rule.ID: 1}, time.Now().UTC())
+}
+
+// Fill in a new expense from the first matching rule without recording the
+// hit. Returns the rule, nil when none matched, and the expense's tags.
+func (s *ruleSet) fill(ctx context.Context, tx Store, expense *Expense, tags []string, payerGiven bool) (*Rule, []string, error) {
+	rule := s.match(*expense)
+	if rule == nil {
+		return nil, tags, nil
+	}
+
+	if expense.Category == "" {
+		expense.Category = rule.Category
+	}
+	tags = mergeTags(tags, rule.Tags)
+	if !payerGiven && rule.PaidBy != nil {
+		// The payer may have left the group since the rule was written
+		isMember, err := tx.IsMember(ctx, *rule.PaidBy, expense.OwnerGroupID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isMember {
+			expense.PaidBy = rule.PaidBy
+		}
+	}
+	return rule, tags, nil
+}
+
+// Sorted union of two tag lists
+func mergeTags(tags, more []string) []string {
+	merged := append([]string{}, tags...)
+	for _, tag := range more {
+		if !containsString(merged, tag) {
+			merged = append(merged, tag)
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+type RuleRequest struct {
+	Token    string `json:"token"`              // JWT token or API key for authentication
+	RuleID   int    `json:"rule_id,omitempty"`  // Rule to update, only for /rules/update
+	GroupID  int    `json:"group_id,omitempty"` // Group the rule is for, only when creating
+	Name     string `json:"name"`
+	Priority int    `json:"priority,omitempty"` // Optional: higher is tried first, 0 by default
+	// Conditions, at least one is required
+	DescriptionContains string   `json:"description_contains,omitempty"`
+	DescriptionRegex    string   `json:"description_regex,omitempty"`
+	Merchant            string   `json:"merchant,omitempty"`
+	MinAmount           *float64 `json:"min_amount,omitempty"`
+	MaxAmount           *float64 `json:"max_amount,omitempty"`
+	// Actions, at least one is required
+	Category string   `json:"category,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	PaidBy   int      `json:"paid_by,omitempty"`
+}
+
+// Check a create or update request and turn it into a rule
+func (req RuleRequest) rule(v *validator) Rule {
+	rule := Rule{
+		Name:                strings.TrimSpace(req.Name),
+		Priority:            req.Priority,
+		DescriptionContains: strings.TrimSpace(req.DescriptionContains),
+		DescriptionRegex:    req.DescriptionRegex,
+		Merchant:            strings.TrimSpace(req.Merchant),
+		MinAmount:           req.MinAmount,
+		MaxAmount:           req.MaxAmount,
+		Category:            strings.TrimSpace(req.Category),
+		Tags:                v.tags("tags", req.Tags),
+	}
+	v.required("name", rule.Name)
+	if len(rule.Name) > ruleNameMaxLength {
+		v.add("name", FieldTooLong, fmt.Sprintf("name must be at most %d characters long", ruleNameMaxLength))
+	}
+
+	if rule.DescriptionContains == "" && rule.DescriptionRegex == "" && rule.Merchant == "" && rule.MinAmount == nil && rule.MaxAmount == nil {
+		v.add("conditions", FieldRequired, "at least one of description_contains, description_regex, merchant, min_amount and max_amount is required")
+	}
+	if len(rule.DescriptionRegex) > ruleRegexMaxLength {
+		v.add("description_regex", FieldTooLong, fmt.Sprintf("description_regex must be at most %d characters long", ruleRegexMaxLength))
+	} else if rule.DescriptionRegex != "" {
+		if _, err := compileRuleRegex(rule.DescriptionRegex); err != nil {
+			v.add("description_regex", FieldInvalidFormat, "description_regex is not a valid regular expression")
+		}
+	}
+	v.merchant("merchant", rule.Merchant)
+	if rule.MinAmount != nil && *rule.MinAmount < 0 {
+		v.add("min_amount", FieldMustBePositive, "min_amount cannot be negative")
+	}
+	if rule.MaxAmount != nil && *rule.MaxAmount <= 0 {
+		v.add("max_amount", FieldMustBePositive, "max_amount must be greater than zero")
+	}
+	if rule.MinAmount != nil && rule.MaxAmount != nil && *rule.MinAmount > *rule.MaxAmount {
+		v.add("max_amount", FieldInvalidFormat, "max_amount cannot be below min_amount")
+	}
+
+	if rule.Category == "" && len(rule.Tags) == 0 && req.PaidBy <= 0 {
+		v.add("actions", FieldRequired, "at least one of category, tags and paid_by is required")
+	}
+	if req.PaidBy > 0 {
+		rule.PaidBy = &req.PaidBy
+	}
+	return rule
+}
+
+// Load a rule of a group the caller is a member of
+func memberRule(ctx context.Context, tx Store, userID, ruleID int) (Rule, error) {
+	rule, err := tx.GetRule(ctx, ruleID)
+	if errors.Is(err, ErrNotFound) {
+		return rule, errRuleNotFound()
+	}
+	if err != nil {
+		return rule, errDatabase(err)
+	}
+	isMember, err := isMemberOf(ctx, tx, userID, rule.GroupID)
+	if err != nil {
+		return rule, errDatabase(err)
+	}
+	if !isMember {
+		// Do not reveal rules of other groups
+		return rule, errRuleNotFound()
+	}
+	return rule, nil
+}
+
+func CreateRule(c echo.Context) error {
+	var req RuleRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	v := &validator{}
+	v.requiredID("group_id", req.GroupID)
+	rule := req.rule(v)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	userID, err := authenticate(c, req.Token, scopeWrite)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	rule.GroupID = req.GroupID
+	rule.CreatedAt = time.Now().UTC()
+	err = store.WithTx(ctx, func(tx Store) error {
+		isMember, err := isMemberOf(ctx, tx, userID, req.GroupID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if !isMember {
+			return errNotGroupMember()
+		}
+		if err := checkPayer(ctx, tx, req.GroupID, req.PaidBy); err != nil {
+			return err
+		}
+
+		existing, err := tx.ListRules(ctx, req.GroupID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if len(existing) >= maxRulesPerGroup {
+			return newAPIError(http.StatusConflict, CodeConflict, fmt.Sprintf("A group can have at most %d rules", maxRulesPerGroup))
+		}
+		if err := tx.CreateRule(ctx, &rule); err != nil {
+			return errInternal("Failed to create rule", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return respondCreated(c, "", "Rule created successfully", rule)
+}
+
+type ListRulesRequest struct {
+	Token   string `json:"token"`    // JWT token or API key for authentication
+	GroupID int    `json:"group_id"` // ID of the group whose rules are listed
+}
+
+// List a group's rules in the order they are tried
+func ListRules(c echo.Context) error {
+	var req ListRulesRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	v := &validator{}
+	v.requiredID("group_id", req.GroupID)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	userID, err := authenticate(c, req.Token, scopeRead)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	isMember, err := isUserInGroup(ctx, userID, req.GroupID)
+	if err != nil {
+		return errDatabase(err)
+	}
+	if !isMember {
+		return errNotGroupMember()
+	}
+
+	rules, err := store.ListRules(ctx, req.GroupID)
+	if err != nil {
+		return errDatabase(err)
+	}
+	return respond(c, http.StatusOK, "", rules)
+}
+
+// Replace the name, priority, conditions and actions of a rule. Its hit count is kept.
+func UpdateRule(c echo.Context) error {
+	var req RuleRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	v := &validator{}
+	v.requiredID("rule_id", req.RuleID)
+	update := req.rule(v)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	userID, err := authenticate(c, req.Token, scopeWrite)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	var rule Rule
+	err = store.WithTx(ctx, func(tx Store) error {
+		current, err := memberRule(ctx, tx, userID, req.RuleID)
+		if err != nil {
+			return err
+		}
+		if err := checkPayer(ctx, tx, current.GroupID, req.PaidBy); err != nil {
+			return err
+		}
+
+		rule = update
+		rule.ID = current.ID
+		rule.GroupID = current.GroupID
+		rule.HitCount = current.HitCount
+		rule.LastHitAt = current.LastHitAt
+		rule.CreatedAt = current.CreatedAt
+		if err := tx.UpdateRule(ctx, rule); err != nil {
+			return errInternal("Failed to update rule", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return respond(c, http.StatusOK, "Rule updated successfully", rule)
+}
+
+type DeleteRuleRequest struct {
+	Token  string `json:"token"`   // JWT token or API key for authentication
+	RuleID int    `json:"rule_id"` // ID of the rule to delete
+}
+
+func DeleteRule(c echo.Context) error {
+	var req DeleteRuleRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	v := &validator{}
+	v.requiredID("rule_id", req.RuleID)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	userID, err := authenticate(c, req.Token, scopeWrite)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	err = store.WithTx(ctx, func(tx Store) error {
+		if _, err := memberRule(ctx, tx, userID, req.RuleID); err != nil {
+			return err
+		}
+		if err := tx.DeleteRule(ctx, req.RuleID); err != nil {
+			return errInternal("Failed to delete rule", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return respond(c, http.StatusOK, "Rule deleted successfully", nil)
+}
+
+type ApplyRulesRequest struct {
+	Token   string `json:"token"`             // JWT token or API key for authentication
+	GroupID int    `json:"group_id"`          // ID of the group whose expenses are checked
+	RuleID  int    `json:"rule_id,omitempty"` // Optional: only try this rule
+	// Optional: list the changes without making them, true by default
+	DryRun *bool `json:"dry_run,omitempty"`
+}
+
+// The fields a rule sets, before or after it was applied
+type RuledFields struct {
+	Category string   `json:"category"`
+	Tags     []string `json:"tags"`
+	PaidBy   *int     `json:"paid_by"`
+}
+
+type RuleChange struct {
+	ExpenseID   int         `json:"expense_id"`
+	Description string      `json:"description"`
+	RuleID      int         `json:"rule_id"`
+	Before      RuledFields `json:"before"`
+	After       RuledFields `json:"after"`
+}
+
+type ApplyRulesResult struct {
+	DryRun  bool         `json:"dry_run"`
+	Checked int          `json:"checked"` // Expenses of the group
+	Changes []RuleChange `json:"changes"` // Expenses a rule changes
+}
+
+// Run the group's rules over its existing expenses. Unlike for new
+// expenses, the category and payer a rule sets replace those the expense
+// has. Only lists the changes unless dry_run is false.
+func ApplyRules(c echo.Context) error {
+	var req ApplyRulesRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	v := &validator{}
+	v.requiredID("group_id", req.GroupID)
+	if err := v.err(); err != nil {
+		return err
+	}
+	dryRun := req.DryRun == nil || *req.DryRun
+
+	scope := scopeWrite
+	if dryRun {
+		scope = scopeRead
+	}
+	userID, err := authenticate(c, req.Token, scope)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	result := ApplyRulesResult{DryRun: dryRun, Changes: []RuleChange{}}
+	var changes []Event
+	err = store.WithTx(ctx, func(tx Store) error {
+		isMember, err := isMemberOf(ctx, tx, userID, req.GroupID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if !isMember {
+			return errNotGroupMember()
+		}
+
+		rules, err := loadRules(ctx, tx, req.GroupID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if req.RuleID > 0 {
+			var only []Rule
+			for _, rule := range rules.rules {
+				if rule.ID == req.RuleID {
+					only = append(only, rule)
+				}
+			}
+			if only == nil {
+				return errRuleNotFound()
+			}
+			rules.rules = only
+		}
+
+		expenses, err := tx.ListExpenses(ctx, ExpenseFilter{UserID: userID, GroupID: req.GroupID})
+		if err != nil {
+			return errDatabase(err)
+		}
+		result.Checked = len(expenses)
+
+		payers := map[int]bool{}
+		hits := map[int]int{}
+		for _, expense := range expenses {
+			rule := rules.match(expense)
+			if rule == nil {
+				continue
+			}
+			change, changed, err := ruleChange(ctx, tx, rule, expense, payers)
+			if err != nil {
+				return errDatabase(err)
+			}
+			if !changed {
+				continue
+			}
+			result.Changes = append(result.Changes, change)
+			if dryRun {
+				continue
+			}
+
+			hits[rule.ID]++
+			expense.Category = change.After.Category
+			expense.PaidBy = change.After.PaidBy
+			if err := tx.UpdateExpense(ctx, &expense); err != nil {
+				return errInternal("Failed to update expense", err)
+			}
+			if err := tx.SetExpenseTags(ctx, &expense, change.After.Tags); err != nil {
+				return errInternal("Failed to tag expense", err)
+			}
+			event := Event{Type: EventExpenseUpdated, GroupID: expense.OwnerGroupID, ActorID: userID, Data: expense}
+			if err := queueWebhooks(ctx, tx, event); err != nil {
+				return errInternal("Failed to queue webhooks", err)
+			}
+			changes = append(changes, event)
+		}
+		if len(hits) > 0 {
+			if err := tx.RecordRuleHits(ctx, hits, time.Now().UTC()); err != nil {
+				return errDatabase(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, event := range changes {
+		publish(event)
+	}
+
+	return respond(c, http.StatusOK, "", result)
+}
+
+// What applying a rule to an existing expense changes. payers caches which
+// payers are members of the group.
+func ruleChange(ctx context.Context, tx Store, rule *Rule, expense Expense, payers map[int]bool) (RuleChange, bool, error) {
+	before := RuledFields{Category: expense.Category, Tags: expense.Tags, PaidBy: expense.PaidBy}
+	if before.Tags == nil {
+		before.Tags = []string{}
+	}
+	after := before
+	if rule.Category != "" {
+		after.Category = rule.Category
+	}
+	after.Tags = mergeTags(before.Tags, rule.Tags)
+	if rule.PaidBy != nil {
+		isMember, ok := payers[*rule.PaidBy]
+		if !ok {
+			var err error
+			isMember, err = tx.IsMember(ctx, *rule.PaidBy, expense.OwnerGroupID)
+			if err != nil {
+				return RuleChange{}, false, err
+			}
+			payers[*rule.PaidBy] = isMember
+		}
+		if isMember {
+			after.PaidBy = rule.PaidBy
+		}
+	}
+
+	changed := after.Category != before.Category || len(after.Tags) != len(before.Tags) ||
+		(after.PaidBy != nil && (before.PaidBy == nil || *before.PaidBy != *after.PaidBy))
+	return RuleChange{
+		ExpenseID:   expense.ID,
+		Description: expense.Description,
+		RuleID:      rule.ID,
+		Before:      before,
+		After:       after,
+	}, changed, nil
+}
+
+const ruleColumns = `r.id, r.group_id, r.name, r.priority, r.description_contains, r.description_regex, r.merchant,
+	r.min_amount, r.max_amount, r.category, r.tags, r.paid_by, r.hit_count, r.last_hit_at, r.created_at`
+
+func scanRule(row interface{ Scan(...interface{}) error }) (Rule, error) {
+	var rule Rule
+	var minAmount, maxAmount sql.NullFloat64
+	var tags string
+	var paidBy sql.NullInt64
+	var lastHitAt sql.NullTime
+	err := row.Scan(&rule.ID, &rule.GroupID, &rule.Name, &rule.Priority, &rule.DescriptionContains, &rule.DescriptionRegex, &rule.Merchant,
+		&minAmount, &maxAmount, &rule.Category, &tags, &paidBy, &rule.HitCount, &lastHitAt, &rule.CreatedAt)
+	if err != nil {
+		return rule, notFound(err)
+	}
+	if minAmount.Valid {
+		rule.MinAmount = &minAmount.Float64
+	}
+	if maxAmount.Valid {
+		rule.MaxAmount = &maxAmount.Float64
+	}
+	if paidBy.Valid {
+		payer := int(paidBy.Int64)
+		rule.PaidBy = &payer
+	}
+	if lastHitAt.Valid {
+		rule.LastHitAt = &lastHitAt.Time
+	}
+	return rule, json.Unmarshal([]byte(tags), &rule.Tags)
+}
+
+// Tags are stored as a JSON array, they may contain commas
+func ruleTags(rule Rule) string {
+	if len(rule.Tags) == 0 {
+		return "[]"
+	}
+	data, _ := json.Marshal(rule.Tags)
+	return string(data)
+}
+
+func (s *sqlStore) CreateRule(ctx context.Context, rule *Rule) error {
+	id, err := s.insertID(ctx, `INSERT INTO expense_rules (group_id, name, priority, description_contains, description_regex, merchant,
+		min_amount, max_amount, category, tags, paid_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rule.GroupID, rule.Name, rule.Priority, rule.DescriptionContains, rule.DescriptionRegex, rule.Merchant,
+		rule.MinAmount, rule.MaxAmount, rule.Category, ruleTags(*rule), rule.PaidBy, rule.CreatedAt)
+	if err != nil {
+		return err
+	}
+	rule.ID = id
+	return nil
+}
+
+func (s *sqlStore) GetRule(ctx context.Context, ruleID int) (Rule, error) {
+	return scanRule(s.queryRow(ctx, "SELECT "+ruleColumns+" FROM expense_rules r WHERE r.id = ?", ruleID))
+}
+
+func (s *sqlStore) ListRules(ctx context.Context, groupID int) ([]Rule, error) {
+	rows, err := s.query(ctx, "SELECT "+ruleColumns+" FROM expense_rules r WHERE r.group_id = ? ORDER BY r.priority DESC, r.id", groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []Rule{}
+	for rows.Next() {
+		rule, err := scanRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func (s *sqlStore) UpdateRule(ctx context.Context, rule Rule) error {
+	result, err := s.exec(ctx, `UPDATE expense_rules SET name = ?, priority = ?, description_contains = ?, description_regex = ?, merchant = ?,
+		min_amount = ?, max_amount = ?, category = ?, tags = ?, paid_by = ?
+		WHERE id = ?`,
+		rule.Name, rule.Priority, rule.DescriptionContains, rule.DescriptionRegex, rule.Merchant,
+		rule.MinAmount, rule.MaxAmount, rule.Category, ruleTags(rule), rule.PaidBy, rule.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteRule(ctx context.Context, ruleID int) error {
+	result, err := s.exec(ctx, "DELETE FROM expense_rules WHERE id = ?", ruleID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) RecordRuleHits(ctx context.Context, hits map[int]int, at time.Time) error {
+	for id, n := range hits {
+		if _, err := s.exec(ctx, "UPDATE expense_rules SET hit_count = hit_count + ?, last_hit_at = ? WHERE id = ?", n, at, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
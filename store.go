@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// Returned by stores when the requested row does not exist
+	ErrNotFound = errors.New("not found")
+	// Returned when a write would break a unique constraint
+	ErrConflict = errors.New("conflict")
+	// Returned when a write refers to a row that does not exist
+	ErrInvalidReference = errors.New("invalid reference")
+)
+
+// A user search, see SearchUsers in profiles.go
+type UserSearch struct {
+	CallerID int
+	Query    string
+	GroupIDs []int // Groups partial matches may come from, nil for all of the caller's
+	Limit    int
+}
+
+type UserStore interface {
+	CreateUser(ctx context.Context, username, passwordHash string) (User, error)
+	GetUser(ctx context.Context, userID int) (User, error)
+	GetUserByUsername(ctx context.Context, username string) (User, error)
+	UserExists(ctx context.Context, userID int) (bool, error)
+	UsernameExists(ctx context.Context, username string) (bool, error)
+	// ListContacts returns the users sharing a group with userID, only looking
+	// at groupIDs unless it is nil
+	ListContacts(ctx context.Context, userID int, groupIDs []int) ([]User, error)
+	SearchUsers(ctx context.Context, search UserSearch) ([]User, error)
+	// UpdateProfile saves the profile fields and time zone of the user
+	UpdateProfile(ctx context.Context, user User) error
+	SetUserTimezone(ctx context.Context, userID int, timezone string) error
+	CountUsers(ctx context.Context) (int, error)
+	GetUserByEmail(ctx context.Context, email string) (User, error)
+	// SetUserEmail clears the address when email is empty
+	SetUserEmail(ctx context.Context, userID int, email string) error
+	// SetUserPassword also bumps the token version, revoking issued tokens
+	SetUserPassword(ctx context.Context, userID int, passwordHash string) (User, error)
+	// UpdatePasswordHash swaps a hash for a new one of the same password without
+	// revoking tokens, doing nothing if the hash has changed in the meantime
+	UpdatePasswordHash(ctx context.Context, userID int, oldHash, newHash string) error
+	DeleteUser(ctx context.Context, userID int) error
+}
+
+type GroupStore interface {
+	CreateGroup(ctx context.Context, name string, ownerID int) (int, error)
+	// GetGroup also fills UsersIDs with the group's members
+	GetGroup(ctx context.Context, groupID int) (UsersGroup, error)
+	// ListUserGroups also fills UsersIDs of every group
+	ListUserGroups(ctx context.Context, userID int) ([]UsersGroup, error)
+	SetGroupOwner(ctx context.Context, groupID, ownerID int) error
+	// DeleteGroup removes the group together with its members and expenses
+	DeleteGroup(ctx context.Context, groupID int) error
+}
+
+// A user's membership of a group
+type Membership struct {
+	GroupID  int
+	User     User
+	JoinedAt *time.Time // nil for members added by older versions
+}
+
+type MembershipStore interface {
+	AddMember(ctx context.Context, groupID, userID int) error
+	IsMember(ctx context.Context, userID, groupID int) (bool, error)
+	ListMembers(ctx context.Context, groupID int) ([]User, error)
+	// ListMemberships returns the members of all the groups, ordered by group and username
+	ListMemberships(ctx context.Context, groupIDs []int) ([]Membership, error)
+	RemoveMember(ctx context.Context, groupID, userID int) error
+}
+
+// Which expenses ListExpenses returns
+type ExpenseFilter struct {
+	UserID   int      // Only expenses of groups this user is a member of
+	GroupID  int      // Only expenses of this group, 0 for all of the user's groups
+	GroupIDs []int    // When not nil, only expenses of these groups
+	Tags     []string // Only expenses with all of these tags
+}
+
+type ExpenseStore interface {
+	// CreateExpense sets ID, CreatedAt and UpdatedAt on the expense
+	CreateExpense(ctx context.Context, expense *Expense) error
+	GetExpense(ctx context.Context, expenseID int) (Expense, error)
+	// UpdateExpense updates the expense with matching ID and OwnerGroupID and sets UpdatedAt
+	UpdateExpense(ctx context.Context, expense *Expense) error
+	DeleteExpense(ctx context.Context, expenseID int) error
+	// MoveExpense moves the expense from its OwnerGroupID to another group and
+	// sets OwnerGroupID and UpdatedAt
+	MoveExpense(ctx context.Context, expense *Expense, toGroupID int) error
+	// GetExpenseByClientID finds an expense created through sync by its client generated ID
+	GetExpenseByClientID(ctx context.Context, clientID string) (Expense, error)
+	// ListExpensesByID returns those of the expenses that still exist
+	ListExpensesByID(ctx context.Context, expenseIDs []int) ([]Expense, error)
+	// ClearPayer unsets paid_by on every expense the user paid and every rule naming them
+	ClearPayer(ctx context.Context, userID int) error
+	ExpenseExists(ctx context.Context, expenseID int) (bool, error)
+	ListExpenses(ctx context.Context, filter ExpenseFilter) ([]Expense, error)
+}
+
+// Stored outcome of a request made with an Idempotency-Key
+type IdempotencyRecord struct {
+	Key         string
+	Method      string
+	Path        string
+	RequestHash string
+	StatusCode  int // 0 while the request is still running
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+type IdempotencyStore interface {
+	GetIdempotencyRecord(ctx context.Context, key, method, path string) (IdempotencyRecord, error)
+	// ReserveIdempotencyKey fails if the key is already taken
+	ReserveIdempotencyKey(ctx context.Context, record IdempotencyRecord) error
+	CompleteIdempotencyKey(ctx context.Context, record IdempotencyRecord) error
+	DeleteIdempotencyKey(ctx context.Context, key, method, path string) error
+	// DeleteAbandonedIdempotencyKey removes the key only if it is still
+	// reserved and was reserved before the cutoff
+	DeleteAbandonedIdempotencyKey(ctx context.Context, key, method, path string, cutoff time.Time) error
+	DeleteIdempotencyKeysBefore(ctx context.Context, cutoff time.Time) error
+}
+
+// Single-use token letting a user choose a new password
+type PasswordReset struct {
+	TokenHash string // SHA-256 of the token sent by email, the token itself is never stored
+	UserID    int
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+type PasswordResetStore interface {
+	CreatePasswordReset(ctx context.Context, reset PasswordReset) error
+	GetPasswordReset(ctx context.Context, tokenHash string) (PasswordReset, error)
+	// UsePasswordReset marks the token used, failing with ErrNotFound if it already was
+	UsePasswordReset(ctx context.Context, tokenHash string, usedAt time.Time) error
+	DeletePasswordResets(ctx context.Context, userID int) error
+}
+
+// Two-factor authentication settings of a user
+type TOTPState struct {
+	UserID    int
+	Secret    string     // Base32 encoded shared secret
+	EnabledAt *time.Time // nil while enrollment is not yet confirmed
+	LastStep  int64      // Last accepted time step, codes from it or earlier are rejected
+}
+
+type TwoFactorStore interface {
+	// GetTOTP returns ErrNotFound for users who never started enrollment
+	GetTOTP(ctx context.Context, userID int) (TOTPState, error)
+	// SetPendingTOTP stores a new secret that is not enabled yet
+	SetPendingTOTP(ctx context.Context, userID int, secret string) error
+	// EnableTOTP activates the pending secret and replaces the recovery codes
+	EnableTOTP(ctx context.Context, userID int, enabledAt time.Time, step int64, recoveryCodeHashes []string) error
+	// UseTOTPStep records an accepted code, failing with ErrNotFound if the step is not newer than the last one
+	UseTOTPStep(ctx context.Context, userID int, step int64) error
+	// UseRecoveryCode marks an unused code used, failing with ErrNotFound otherwise
+	UseRecoveryCode(ctx context.Context, userID int, codeHash string, usedAt time.Time) error
+	CountRecoveryCodes(ctx context.Context, userID int) (int, error)
+	// DeleteTOTP removes the secret and all recovery codes
+	DeleteTOTP(ctx context.Context, userID int) error
+}
+
+type APIKeyStore interface {
+	// CreateAPIKey sets the ID of the key
+	CreateAPIKey(ctx context.Context, key *APIKey) error
+	GetAPIKeyByHash(ctx context.Context, keyHash string) (APIKey, error)
+	ListAPIKeys(ctx context.Context, userID int) ([]APIKey, error)
+	// RevokeAPIKey fails with ErrNotFound unless the user has an active key with that ID
+	RevokeAPIKey(ctx context.Context, userID, keyID int, revokedAt time.Time) error
+	TouchAPIKey(ctx context.Context, keyID int, usedAt time.Time) error
+	DeleteAPIKeys(ctx context.Context, userID int) error
+}
+
+// A single sign-on attempt between redirecting to the provider and its callback
+type OIDCLogin struct {
+	State        string // Random value echoed back by the provider
+	Nonce        string // Must come back inside the ID token
+	CodeVerifier string // PKCE secret the authorization code is redeemed with
+	RedirectTo   string // Frontend page the result is sent to
+	LinkUserID   int    // User linking an identity, 0 when signing in
+	ExpiresAt    time.Time
+	CreatedAt    time.Time
+}
+
+// An account at an OpenID Connect provider linked to a user
+type UserIdentity struct {
+	ID          int        `json:"id"`
+	UserID      int        `json:"-"`
+	Issuer      string     `json:"issuer"`
+	Subject     string     `json:"subject"`
+	Email       string     `json:"email,omitempty"` // As reported by the provider when linked
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+}
+
+type IdentityStore interface {
+	CreateOIDCLogin(ctx context.Context, login OIDCLogin) error
+	// TakeOIDCLogin deletes and returns a login, ErrNotFound if there is none
+	TakeOIDCLogin(ctx context.Context, state string) (OIDCLogin, error)
+	DeleteExpiredOIDCLogins(ctx context.Context, now time.Time) error
+	GetIdentity(ctx context.Context, issuer, subject string) (UserIdentity, error)
+	// CreateIdentity sets the ID, ErrConflict if the identity is linked already
+	CreateIdentity(ctx context.Context, identity *UserIdentity) error
+	ListIdentities(ctx context.Context, userID int) ([]UserIdentity, error)
+	TouchIdentity(ctx context.Context, identityID int, at time.Time) error
+	// DeleteIdentity fails with ErrNotFound unless the user has an identity with that ID
+	DeleteIdentity(ctx context.Context, userID, identityID int) error
+	DeleteIdentities(ctx context.Context, userID int) error
+}
+
+// A URL a group's events are posted to
+type Webhook struct {
+	ID      int    `json:"id"`
+	GroupID int    `json:"group_id"`
+	URL     string `json:"url"`
+	// Event types delivered, empty for all of them
+	Events    []string  `json:"events"`
+	Secret    string    `json:"-"` // Key of the HMAC signatures
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Delivery states
+const (
+	deliveryPending   = "pending"
+	deliverySucceeded = "succeeded"
+	deliveryFailed    = "failed" // Gave up after the last retry
+)
+
+// One event queued for one webhook, with the outcome of its latest attempt
+type WebhookDelivery struct {
+	ID            int             `json:"id"`
+	WebhookID     int             `json:"webhook_id"`
+	EventID       string          `json:"event_id"` // Same for all deliveries and redeliveries of an event
+	EventType     string          `json:"event_type"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt *time.Time      `json:"next_attempt_at,omitempty"`
+	LastAttemptAt *time.Time      `json:"last_attempt_at,omitempty"`
+	// HTTP status and start of the body of the latest response
+	ResponseStatus int    `json:"response_status,omitempty"`
+	ResponseBody   string `json:"response_body,omitempty"`
+	// Why the latest attempt failed
+	Error        string    `json:"error,omitempty"`
+	RedeliveryOf *int      `json:"redelivery_of,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type WebhookStore interface {
+	// CreateWebhook sets the ID of the webhook
+	CreateWebhook(ctx context.Context, hook *Webhook) error
+	GetWebhook(ctx context.Context, webhookID int) (Webhook, error)
+	ListWebhooks(ctx context.Context, groupID int) ([]Webhook, error)
+	// DeleteWebhook also removes its deliveries
+	DeleteWebhook(ctx context.Context, webhookID int) error
+	// CreateWebhookDelivery sets the ID of the delivery
+	CreateWebhookDelivery(ctx context.Context, delivery *WebhookDelivery) error
+	GetWebhookDelivery(ctx context.Context, deliveryID int) (WebhookDelivery, error)
+	// ListWebhookDeliveries returns the newest deliveries first
+	ListWebhookDeliveries(ctx context.Context, webhookID, limit int) ([]WebhookDelivery, error)
+	// DueWebhookDeliveries returns pending deliveries whose next attempt is at or before now
+	DueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]WebhookDelivery, error)
+	// ClaimWebhookDelivery postpones a due delivery to until, failing with
+	// ErrNotFound if it is no longer due because another worker took it
+	ClaimWebhookDelivery(ctx context.Context, deliveryID int, now, until time.Time) error
+	// FinishWebhookAttempt stores the outcome of an attempt
+	FinishWebhookAttempt(ctx context.Context, delivery WebhookDelivery) error
+	// DeleteWebhookDeliveriesBefore removes finished deliveries created before cutoff
+	DeleteWebhookDeliveriesBefore(ctx context.Context, cutoff time.Time) error
+}
+
+// Entities and operations recorded in the change log
+const (
+	entityExpense    = "expense"
+	entityGroup      = "group"
+	entityMembership = "membership"
+
+	changeUpsert = "upsert"
+	changeDelete = "delete"
+)
+
+// An entry of the change log sync cursors point into. Stores write one for
+// every change to expenses, groups and memberships, in the same transaction.
+type Change struct {
+	ID       int64
+	Entity   string
+	EntityID int // Expense or group ID, the member's user ID for memberships
+	GroupID  int
+	Op       string
+}
+
+type ChangeStore interface {
+	// LatestChangeID returns 0 when nothing was logged yet
+	LatestChangeID(ctx context.Context) (int64, error)
+	// ListChanges returns the changes after "after" up to and including
+	// "upTo" that happened in groupIDs or to memberships of userID, oldest first
+	ListChanges(ctx context.Context, userID int, groupIDs []int, after, upTo int64, limit int) ([]Change, error)
+}
+
+// A tag as listed for a group
+type Tag struct {
+	Name         string    `json:"name"`
+	ExpenseCount int       `json:"expense_count"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type TagStore interface {
+	// SetExpenseTags replaces the tags of the expense, creating those its
+	// group does not have yet, and sets expense.Tags
+	SetExpenseTags(ctx context.Context, expense *Expense, names []string) error
+	// ListTags returns the group's tags starting with prefix, most used first
+	ListTags(ctx context.Context, groupID int, prefix string, limit int) ([]Tag, error)
+	// RenameTag returns ErrNotFound for an unknown tag, ErrConflict when the
+	// new name is taken, and the IDs of the expenses that carry the tag
+	RenameTag(ctx context.Context, groupID int, name, newName string) ([]int, error)
+	// MergeTags moves the expenses of the tags in names to the tag into,
+	// which is created when missing, and deletes the others. Returns
+	// ErrNotFound when one of names does not exist, and the IDs of the
+	// expenses that changed.
+	MergeTags(ctx context.Context, groupID int, names []string, into string) ([]int, error)
+}
+
+// A rule filling in the category, tags and payer of expenses whose
+// description, merchant and amount match its conditions
+type Rule struct {
+	ID      int    `json:"id"`
+	GroupID int    `json:"group_id"`
+	Name    string `json:"name"`
+	// Rules with a higher priority are tried first, the first one that matches applies
+	Priority int `json:"priority"`
+	// Conditions, all of those set must match. Text is compared ignoring case.
+	DescriptionContains string   `json:"description_contains,omitempty"`
+	DescriptionRegex    string   `json:"description_regex,omitempty"`
+	Merchant            string   `json:"merchant,omitempty"` // Part of the merchant
+	MinAmount           *float64 `json:"min_amount,omitempty"`
+	MaxAmount           *float64 `json:"max_amount,omitempty"`
+	// Actions
+	Category string   `json:"category,omitempty"`
+	Tags     []string `json:"tags,omitempty"` // Added to the expense's tags
+	PaidBy   *int     `json:"paid_by,omitempty"`
+	// Expenses the rule was applied to
+	HitCount  int        `json:"hit_count"`
+	LastHitAt *time.Time `json:"last_hit_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type RuleStore interface {
+	// CreateRule sets the ID of the rule
+	CreateRule(ctx context.Context, rule *Rule) error
+	GetRule(ctx context.Context, ruleID int) (Rule, error)
+	// ListRules returns the group's rules in the order they are tried
+	ListRules(ctx context.Context, groupID int) ([]Rule, error)
+	// UpdateRule stores the name, priority, conditions and actions of the rule
+	UpdateRule(ctx context.Context, rule Rule) error
+	DeleteRule(ctx context.Context, ruleID int) error
+	// RecordRuleHits adds to the hit counts of rules, keyed by rule ID
+	RecordRuleHits(ctx context.Context, hits map[int]int, at time.Time) error
+}
+
+type SuggestionStore interface {
+	// CategoryModel returns what was learned from the group's expenses, with
+	// the per category counts of the given features
+	CategoryModel(ctx context.Context, groupID int, features []string) (CategoryModel, error)
+}
+
+type DuplicateStore interface {
+	// ListExpensesBetween returns the group's expenses dated from to to, both included
+	ListExpensesBetween(ctx context.Context, groupID int, from, to string) ([]Expense, error)
+	// DismissDuplicate records that two expenses are not duplicates
+	DismissDuplicate(ctx context.Context, expenseID, otherID int) error
+	// ListDismissedDuplicates returns the dismissed pairs of the group's expenses, lower ID first
+	ListDismissedDuplicates(ctx context.Context, groupID int) ([][2]int, error)
+}
+
+type ImportStore interface {
+	// CreateImport sets the ID of the import
+	CreateImport(ctx context.Context, imp *StatementImport) error
+	GetImport(ctx context.Context, importID int) (StatementImport, error)
+	// SaveImport stores the rows and commit time of the import
+	SaveImport(ctx context.Context, imp StatementImport) error
+	// DeleteImportsBefore deletes previews created before the time that were never committed
+	DeleteImportsBefore(ctx context.Context, before time.Time) error
+	// DeleteUserImports deletes the previews and committed imports of the user,
+	// the transactions they imported stay known
+	DeleteUserImports(ctx context.Context, userID int) error
+	// ImportedTransactions tells which of the external IDs were imported into the group
+	ImportedTransactions(ctx context.Context, groupID int, externalIDs []string) (map[string]bool, error)
+	// RecordImportedTransaction returns ErrConflict when the transaction was imported before
+	RecordImportedTransaction(ctx context.Context, groupID int, externalID string, expenseID, importID int) error
+}
+
+// All data access used by the handlers
+type Store interface {
+	UserStore
+	GroupStore
+	MembershipStore
+	ExpenseStore
+	IdempotencyStore
+	PasswordResetStore
+	TwoFactorStore
+	APIKeyStore
+	IdentityStore
+	WebhookStore
+	ChangeStore
+	TagStore
+	RuleStore
+	SuggestionStore
+	DuplicateStore
+	ImportStore
+	// WithTx runs fn in a transaction, committing if it returns nil
+	WithTx(ctx context.Context, fn func(tx Store) error) error
+	Close() error
+}
+
+var store Store
+
+// Open the backend selected by the configuration and bring its schema up to date
+func openStore(cfg Config) (Store, error) {
+	switch normalizeDBDriver(cfg.DBDriver) {
+	case "sqlite":
+		return newSQLiteStore(cfg.DatabaseURL)
+	case "postgres":
+		return newPostgresStore(cfg.DatabaseURL)
+	default:
+		return nil, fmt.Errorf("unknown DB_DRIVER %q", cfg.DBDriver)
+	}
+}
@@ -0,0 +1,1081 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Differences between the SQL databases the store runs on
+type dialect struct {
+	name   string
+	driver string
+	// Convert "?" placeholders to "$1", "$2", ...
+	numberedPlaceholders bool
+	// Column type replacements applied to the SQLite flavoured schema
+	types []typeReplacement
+}
+
+type typeReplacement struct {
+	pattern *regexp.Regexp
+	replace string
+}
+
+var sqliteDialect = dialect{
+	name:   "sqlite",
+	driver: "sqlite3",
+}
+
+var postgresDialect = dialect{
+	name:                 "postgres",
+	driver:               "postgres",
+	numberedPlaceholders: true,
+	types: []typeReplacement{
+		{regexp.MustCompile(`\bINTEGER PRIMARY KEY AUTOINCREMENT\b`), "SERIAL PRIMARY KEY"},
+		{regexp.MustCompile(`\bTIMESTAMP\b`), "TIMESTAMPTZ"},
+		{regexp.MustCompile(`\bREAL\b`), "DOUBLE PRECISION"},
+		{regexp.MustCompile(`\bBLOB\b`), "BYTEA"},
+	},
+}
+
+// Rewrite a query written with "?" placeholders for the dialect
+func (d dialect) rebind(query string) string {
+	if !d.numberedPlaceholders {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Rewrite a schema statement written for SQLite for the dialect
+func (d dialect) ddl(stmt string) string {
+	for _, t := range d.types {
+		stmt = t.pattern.ReplaceAllString(stmt, t.replace)
+	}
+	return stmt
+}
+
+// Methods shared by *sql.DB and *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Store backed by database/sql, shared by the SQLite and PostgreSQL backends
+type sqlStore struct {
+	db      *sql.DB
+	q       querier // db, or the transaction inside WithTx
+	inTx    bool
+	dialect dialect
+}
+
+// SQLite settings applied to every connection: WAL so readers do not block
+// the writer, a busy timeout instead of failing with SQLITE_BUSY, enforced
+// foreign keys, and write locks taken when a transaction begins
+const sqliteOptions = "_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=on&_txlock=immediate"
+
+// SQLite backend storing everything in a single file
+func newSQLiteStore(path string) (*sqlStore, error) {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	return openSQLStore(sqliteDialect, path+separator+sqliteOptions)
+}
+
+// PostgreSQL backend, url is a libpq connection string or URL
+func newPostgresStore(url string) (*sqlStore, error) {
+	return openSQLStore(postgresDialect, url)
+}
+
+func openSQLStore(d dialect, dsn string) (*sqlStore, error) {
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &sqlStore{db: db, q: db, dialect: d}
+	if err := s.migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sqlStore) Close() error {
+	if s.inTx {
+		return errors.New("cannot close a store inside a transaction")
+	}
+	return s.db.Close()
+}
+
+// Run fn in a transaction, committing if it returns nil and rolling back
+// otherwise. Calls nested inside fn reuse the outer transaction.
+func (s *sqlStore) WithTx(ctx context.Context, fn func(tx Store) error) (err error) {
+	if s.inTx {
+		return fn(s)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	return fn(&sqlStore{db: s.db, q: tx, inTx: true, dialect: s.dialect})
+}
+
+func (s *sqlStore) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	result, err := s.q.ExecContext(ctx, s.dialect.rebind(query), args...)
+	return result, s.constraintError(err)
+}
+
+func (s *sqlStore) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return s.q.QueryContext(ctx, s.dialect.rebind(query), args...)
+}
+
+func (s *sqlStore) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return s.q.QueryRowContext(ctx, s.dialect.rebind(query), args...)
+}
+
+// Run an INSERT ... RETURNING id and get the new ID
+func (s *sqlStore) insertID(ctx context.Context, query string, args ...interface{}) (int, error) {
+	var id int
+	err := s.queryRow(ctx, query+" RETURNING id", args...).Scan(&id)
+	return id, s.constraintError(err)
+}
+
+// Translate constraint violations of either database into ErrConflict and ErrInvalidReference
+func (s *sqlStore) constraintError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.ExtendedCode {
+		case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+			return fmt.Errorf("%w: %v", ErrConflict, err)
+		case sqlite3.ErrConstraintForeignKey:
+			return fmt.Errorf("%w: %v", ErrInvalidReference, err)
+		}
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "23505": // unique_violation
+			return fmt.Errorf("%w: %v", ErrConflict, err)
+		case "23503": // foreign_key_violation
+			return fmt.Errorf("%w: %v", ErrInvalidReference, err)
+		}
+	}
+	return err
+}
+
+func (s *sqlStore) exists(ctx context.Context, query string, args ...interface{}) (bool, error) {
+	var exists bool
+	err := s.queryRow(ctx, "SELECT EXISTS("+query+")", args...).Scan(&exists)
+	return exists, err
+}
+
+// Tables in creation order, written for SQLite and translated by dialect.ddl
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT UNIQUE NOT NULL,
+		password TEXT NOT NULL,
+		timezone TEXT NOT NULL DEFAULT 'UTC',
+		email TEXT,
+		token_version INTEGER NOT NULL DEFAULT 0,
+		display_name TEXT NOT NULL DEFAULT '',
+		avatar_url TEXT NOT NULL DEFAULT '',
+		currency TEXT NOT NULL DEFAULT 'EUR',
+		locale TEXT NOT NULL DEFAULT 'en'
+	)`,
+	`CREATE TABLE IF NOT EXISTS users_groups (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		owner_id INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		FOREIGN KEY (owner_id) REFERENCES users(id)
+	)`,
+	// Many-to-many relationship between users and groups
+	`CREATE TABLE IF NOT EXISTS group_members (
+		group_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		joined_at TIMESTAMP,
+		PRIMARY KEY (group_id, user_id),
+		FOREIGN KEY (group_id) REFERENCES users_groups(id),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS expenses (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		description TEXT NOT NULL,
+		amount REAL NOT NULL,
+		category TEXT NOT NULL,
+		date TEXT NOT NULL,
+		owner_group_id INTEGER NOT NULL,
+		occurred_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		paid_by INTEGER,
+		client_id TEXT,
+		notes TEXT NOT NULL DEFAULT '',
+		merchant TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (owner_group_id) REFERENCES users_groups(id),
+		FOREIGN KEY (paid_by) REFERENCES users(id)
+	)`,
+	// Tags are per group, expenses can have many
+	`CREATE TABLE IF NOT EXISTS tags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		group_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		UNIQUE (group_id, name),
+		FOREIGN KEY (group_id) REFERENCES users_groups(id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS expense_tags (
+		expense_id INTEGER NOT NULL,
+		tag_id INTEGER NOT NULL,
+		PRIMARY KEY (expense_id, tag_id),
+		FOREIGN KEY (expense_id) REFERENCES expenses(id),
+		FOREIGN KEY (tag_id) REFERENCES tags(id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS expense_rules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		group_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		priority INTEGER NOT NULL DEFAULT 0,
+		description_contains TEXT NOT NULL DEFAULT '',
+		description_regex TEXT NOT NULL DEFAULT '',
+		merchant TEXT NOT NULL DEFAULT '',
+		min_amount REAL,
+		max_amount REAL,
+		category TEXT NOT NULL DEFAULT '',
+		tags TEXT NOT NULL DEFAULT '[]',
+		paid_by INTEGER,
+		hit_count INTEGER NOT NULL DEFAULT 0,
+		last_hit_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL,
+		FOREIGN KEY (group_id) REFERENCES users_groups(id),
+		FOREIGN KEY (paid_by) REFERENCES users(id)
+	)`,
+	// Counts the category classifier learned from each group's expenses
+	`CREATE TABLE IF NOT EXISTS category_counts (
+		group_id INTEGER NOT NULL,
+		category TEXT NOT NULL,
+		expenses INTEGER NOT NULL,
+		PRIMARY KEY (group_id, category),
+		FOREIGN KEY (group_id) REFERENCES users_groups(id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS category_features (
+		group_id INTEGER NOT NULL,
+		category TEXT NOT NULL,
+		feature TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (group_id, category, feature),
+		FOREIGN KEY (group_id) REFERENCES users_groups(id)
+	)`,
+	// Pairs of expenses a member said are not duplicates, lower ID first
+	`CREATE TABLE IF NOT EXISTS duplicate_dismissals (
+		expense_id INTEGER NOT NULL,
+		other_id INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (expense_id, other_id),
+		FOREIGN KEY (expense_id) REFERENCES expenses(id),
+		FOREIGN KEY (other_id) REFERENCES expenses(id)
+	)`,
+	// Statement previews, their rows are stored as JSON
+	`CREATE TABLE IF NOT EXISTS statement_imports (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		group_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		format TEXT NOT NULL,
+		file_name TEXT NOT NULL DEFAULT '',
+		transactions TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		committed_at TIMESTAMP,
+		FOREIGN KEY (group_id) REFERENCES users_groups(id),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	)`,
+	// Transactions imported into a group, kept when the expense is deleted
+	// so importing the statement again does not bring it back
+	`CREATE TABLE IF NOT EXISTS imported_transactions (
+		group_id INTEGER NOT NULL,
+		external_id TEXT NOT NULL,
+		expense_id INTEGER NOT NULL,
+		import_id INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (group_id, external_id),
+		FOREIGN KEY (group_id) REFERENCES users_groups(id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		idempotency_key TEXT NOT NULL,
+		method TEXT NOT NULL,
+		path TEXT NOT NULL,
+		request_hash TEXT NOT NULL,
+		status_code INTEGER,
+		content_type TEXT,
+		response_body BLOB,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (idempotency_key, method, path)
+	)`,
+	`CREATE TABLE IF NOT EXISTS password_resets (
+		token_hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS user_totp (
+		user_id INTEGER PRIMARY KEY,
+		secret TEXT NOT NULL,
+		enabled_at TIMESTAMP,
+		last_step INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+		user_id INTEGER NOT NULL,
+		code_hash TEXT NOT NULL,
+		used_at TIMESTAMP,
+		PRIMARY KEY (user_id, code_hash),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		key_hash TEXT UNIQUE NOT NULL,
+		scope TEXT NOT NULL,
+		group_limited INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP NOT NULL,
+		last_used_at TIMESTAMP,
+		revoked_at TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS api_key_groups (
+		key_id INTEGER NOT NULL,
+		group_id INTEGER NOT NULL,
+		PRIMARY KEY (key_id, group_id),
+		FOREIGN KEY (key_id) REFERENCES api_keys(id),
+		FOREIGN KEY (group_id) REFERENCES users_groups(id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS oidc_logins (
+		state TEXT PRIMARY KEY,
+		nonce TEXT NOT NULL,
+		code_verifier TEXT NOT NULL,
+		redirect_to TEXT NOT NULL,
+		link_user_id INTEGER,
+		expires_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS user_identities (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		email TEXT,
+		created_at TIMESTAMP NOT NULL,
+		last_login_at TIMESTAMP,
+		UNIQUE (issuer, subject),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS change_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		entity TEXT NOT NULL,
+		entity_id INTEGER NOT NULL,
+		group_id INTEGER NOT NULL,
+		op TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		group_id INTEGER NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL,
+		FOREIGN KEY (group_id) REFERENCES users_groups(id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER NOT NULL,
+		event_id TEXT NOT NULL,
+		event_type TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP,
+		last_attempt_at TIMESTAMP,
+		response_status INTEGER,
+		response_body TEXT,
+		error TEXT,
+		redelivery_of INTEGER,
+		created_at TIMESTAMP NOT NULL,
+		FOREIGN KEY (webhook_id) REFERENCES webhooks(id)
+	)`,
+}
+
+// Indexes created once all added columns exist
+var indexes = []string{
+	`CREATE UNIQUE INDEX IF NOT EXISTS users_email ON users (email)`,
+	`CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS expenses_client_id ON expenses (client_id)`,
+	`CREATE INDEX IF NOT EXISTS change_log_group ON change_log (group_id, id)`,
+	`CREATE INDEX IF NOT EXISTS expense_tags_tag ON expense_tags (tag_id)`,
+}
+
+// Columns added after a table was first released, for databases created by older versions
+var addedColumns = []struct {
+	table, column, definition string
+}{
+	{"expenses", "created_at", "TIMESTAMP"},
+	{"expenses", "updated_at", "TIMESTAMP"},
+	{"users_groups", "created_at", "TIMESTAMP"},
+	{"expenses", "occurred_at", "TIMESTAMP"},
+	{"users", "timezone", "TEXT NOT NULL DEFAULT 'UTC'"},
+	{"users", "email", "TEXT"},
+	{"users", "token_version", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "display_name", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "avatar_url", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "currency", "TEXT NOT NULL DEFAULT 'EUR'"},
+	{"users", "locale", "TEXT NOT NULL DEFAULT 'en'"},
+	{"group_members", "joined_at", "TIMESTAMP"},
+	{"expenses", "paid_by", "INTEGER"},
+	{"expenses", "client_id", "TEXT"},
+	{"expenses", "notes", "TEXT NOT NULL DEFAULT ''"},
+	{"expenses", "merchant", "TEXT NOT NULL DEFAULT ''"},
+}
+
+func (s *sqlStore) migrate(ctx context.Context) error {
+	for _, stmt := range schema {
+		if _, err := s.db.ExecContext(ctx, s.dialect.ddl(stmt)); err != nil {
+			return err
+		}
+	}
+
+	for _, col := range addedColumns {
+		if err := s.addColumnIfMissing(ctx, col.table, col.column, s.dialect.ddl(col.definition)); err != nil {
+			return err
+		}
+	}
+
+	for _, stmt := range indexes {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	// Backfill timestamps of rows created before the columns existed
+	now := time.Now().UTC()
+	backfills := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"UPDATE expenses SET created_at = ? WHERE created_at IS NULL", []interface{}{now}},
+		{"UPDATE expenses SET updated_at = created_at WHERE updated_at IS NULL", nil},
+		{"UPDATE users_groups SET created_at = ? WHERE created_at IS NULL", []interface{}{now}},
+	}
+	for _, b := range backfills {
+		if _, err := s.exec(ctx, b.query, b.args...); err != nil {
+			return err
+		}
+	}
+
+	if err := s.normalizeStoredDates(ctx); err != nil {
+		return err
+	}
+	return s.learnUntrainedGroups(ctx)
+}
+
+// Add a column to an existing table unless it is already there
+func (s *sqlStore) addColumnIfMissing(ctx context.Context, table, column, definition string) error {
+	if s.dialect.name == "postgres" {
+		_, err := s.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", table, column, definition))
+		return err
+	}
+
+	found, err := s.exists(ctx, "SELECT 1 FROM pragma_table_info(?) WHERE name = ?", table, column)
+	if err != nil || found {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// Rewrite expense dates stored by older versions into the normalised form.
+// Dates in ambiguous formats such as 05/01/2024 are left alone and logged.
+func (s *sqlStore) normalizeStoredDates(ctx context.Context) error {
+	rows, err := s.query(ctx, "SELECT id, date FROM expenses")
+	if err != nil {
+		return err
+	}
+
+	updates := map[int]string{}
+	for rows.Next() {
+		var id int
+		var date string
+		if err := rows.Scan(&id, &date); err != nil {
+			rows.Close()
+			return err
+		}
+		if _, err := time.Parse(dateLayout, date); err == nil {
+			continue
+		}
+		normalized, ok := parseLegacyDate(date)
+		if !ok {
+			log.Printf("Expense %d has an unrecognised date %q, leaving it unchanged", id, date)
+			continue
+		}
+		updates[id] = normalized
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, date := range updates {
+		if _, err := s.exec(ctx, "UPDATE expenses SET date = ? WHERE id = ?", date, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Map sql.ErrNoRows to the store level ErrNotFound
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Users
+
+const userColumns = "u.id, u.username, u.password, u.timezone, u.email, u.token_version, u.display_name, u.avatar_url, u.currency, u.locale"
+
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+	var user User
+	var email sql.NullString
+	err := row.Scan(&user.ID, &user.Username, &user.Password, &user.Timezone, &email, &user.TokenVersion,
+		&user.DisplayName, &user.AvatarURL, &user.Currency, &user.Locale)
+	user.Email = email.String
+	return user, notFound(err)
+}
+
+func (s *sqlStore) CreateUser(ctx context.Context, username, passwordHash string) (User, error) {
+	id, err := s.insertID(ctx, "INSERT INTO users (username, password) VALUES (?, ?)", username, passwordHash)
+	if err != nil {
+		return User{}, err
+	}
+	return s.GetUser(ctx, id)
+}
+
+func (s *sqlStore) GetUser(ctx context.Context, userID int) (User, error) {
+	return scanUser(s.queryRow(ctx, "SELECT "+userColumns+" FROM users u WHERE u.id = ?", userID))
+}
+
+func (s *sqlStore) GetUserByUsername(ctx context.Context, username string) (User, error) {
+	return scanUser(s.queryRow(ctx, "SELECT "+userColumns+" FROM users u WHERE u.username = ?", username))
+}
+
+func (s *sqlStore) UserExists(ctx context.Context, userID int) (bool, error) {
+	return s.exists(ctx, "SELECT 1 FROM users WHERE id = ?", userID)
+}
+
+func (s *sqlStore) UsernameExists(ctx context.Context, username string) (bool, error) {
+	return s.exists(ctx, "SELECT 1 FROM users WHERE username = ?", username)
+}
+
+func (s *sqlStore) listUsers(ctx context.Context, query string, args ...interface{}) ([]User, error) {
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *sqlStore) SetUserTimezone(ctx context.Context, userID int, timezone string) error {
+	result, err := s.exec(ctx, "UPDATE users SET timezone = ? WHERE id = ?", timezone, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) CountUsers(ctx context.Context) (int, error) {
+	var count int
+	err := s.queryRow(ctx, "SELECT COUNT(*) FROM users").Scan(&count)
+	return count, err
+}
+
+func (s *sqlStore) GetUserByEmail(ctx context.Context, email string) (User, error) {
+	return scanUser(s.queryRow(ctx, "SELECT "+userColumns+" FROM users u WHERE u.email = ?", email))
+}
+
+func (s *sqlStore) SetUserEmail(ctx context.Context, userID int, email string) error {
+	value := sql.NullString{String: email, Valid: email != ""}
+	result, err := s.exec(ctx, "UPDATE users SET email = ? WHERE id = ?", value, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) SetUserPassword(ctx context.Context, userID int, passwordHash string) (User, error) {
+	result, err := s.exec(ctx, "UPDATE users SET password = ?, token_version = token_version + 1 WHERE id = ?", passwordHash, userID)
+	if err != nil {
+		return User{}, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return User{}, ErrNotFound
+	}
+	return s.GetUser(ctx, userID)
+}
+
+func (s *sqlStore) UpdatePasswordHash(ctx context.Context, userID int, oldHash, newHash string) error {
+	_, err := s.exec(ctx, "UPDATE users SET password = ? WHERE id = ? AND password = ?", newHash, userID, oldHash)
+	return err
+}
+
+func (s *sqlStore) DeleteUser(ctx context.Context, userID int) error {
+	result, err := s.exec(ctx, "DELETE FROM users WHERE id = ?", userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Groups and memberships
+
+func (s *sqlStore) CreateGroup(ctx context.Context, name string, ownerID int) (int, error) {
+	id, err := s.insertID(ctx, "INSERT INTO users_groups (name, owner_id, created_at) VALUES (?, ?, ?)", name, ownerID, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return id, s.logChange(ctx, entityGroup, id, id, changeUpsert)
+}
+
+func (s *sqlStore) GetGroup(ctx context.Context, groupID int) (UsersGroup, error) {
+	var group UsersGroup
+	err := s.queryRow(ctx, "SELECT id, name, owner_id, created_at FROM users_groups WHERE id = ?", groupID).
+		Scan(&group.ID, &group.Name, &group.OwnerID, &group.CreatedAt)
+	if err != nil {
+		return group, notFound(err)
+	}
+
+	rows, err := s.query(ctx, "SELECT user_id FROM group_members WHERE group_id = ? ORDER BY user_id", groupID)
+	if err != nil {
+		return group, err
+	}
+	defer rows.Close()
+
+	group.UsersIDs = []int{}
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return group, err
+		}
+		group.UsersIDs = append(group.UsersIDs, userID)
+	}
+	return group, rows.Err()
+}
+
+func (s *sqlStore) ListUserGroups(ctx context.Context, userID int) ([]UsersGroup, error) {
+	rows, err := s.query(ctx, `SELECT ug.id, ug.name, ug.owner_id, ug.created_at
+		FROM users_groups ug
+		INNER JOIN group_members gm ON ug.id = gm.group_id
+		WHERE gm.user_id = ?
+		ORDER BY ug.name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []UsersGroup{}
+	for rows.Next() {
+		var group UsersGroup
+		if err := rows.Scan(&group.ID, &group.Name, &group.OwnerID, &group.CreatedAt); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Members of all the groups in one query
+	memberRows, err := s.query(ctx, `SELECT gm.group_id, gm.user_id FROM group_members gm
+		WHERE gm.group_id IN (SELECT group_id FROM group_members WHERE user_id = ?)
+		ORDER BY gm.group_id, gm.user_id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer memberRows.Close()
+
+	members := map[int][]int{}
+	for memberRows.Next() {
+		var groupID, memberID int
+		if err := memberRows.Scan(&groupID, &memberID); err != nil {
+			return nil, err
+		}
+		members[groupID] = append(members[groupID], memberID)
+	}
+	for i := range groups {
+		groups[i].UsersIDs = members[groups[i].ID]
+		if groups[i].UsersIDs == nil {
+			groups[i].UsersIDs = []int{}
+		}
+	}
+	return groups, memberRows.Err()
+}
+
+func (s *sqlStore) SetGroupOwner(ctx context.Context, groupID, ownerID int) error {
+	result, err := s.exec(ctx, "UPDATE users_groups SET owner_id = ? WHERE id = ?", ownerID, groupID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return s.logChange(ctx, entityGroup, groupID, groupID, changeUpsert)
+}
+
+func (s *sqlStore) DeleteGroup(ctx context.Context, groupID int) error {
+	members, err := s.groupMemberIDs(ctx, groupID)
+	if err != nil {
+		return err
+	}
+	for _, query := range []string{
+		"DELETE FROM expense_tags WHERE expense_id IN (SELECT id FROM expenses WHERE owner_group_id = ?)",
+		"DELETE FROM duplicate_dismissals WHERE expense_id IN (SELECT id FROM expenses WHERE owner_group_id = ?)",
+		"DELETE FROM expenses WHERE owner_group_id = ?",
+		"DELETE FROM tags WHERE group_id = ?",
+		"DELETE FROM expense_rules WHERE group_id = ?",
+		"DELETE FROM category_counts WHERE group_id = ?",
+		"DELETE FROM category_features WHERE group_id = ?",
+		"DELETE FROM imported_transactions WHERE group_id = ?",
+		"DELETE FROM statement_imports WHERE group_id = ?",
+		"DELETE FROM group_members WHERE group_id = ?",
+		"DELETE FROM api_key_groups WHERE group_id = ?",
+		"DELETE FROM webhook_deliveries WHERE webhook_id IN (SELECT id FROM webhooks WHERE group_id = ?)",
+		"DELETE FROM webhooks WHERE group_id = ?",
+	} {
+		if _, err := s.exec(ctx, query, groupID); err != nil {
+			return err
+		}
+	}
+
+	result, err := s.exec(ctx, "DELETE FROM users_groups WHERE id = ?", groupID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	// Former members find out from their membership ending, the group's
+	// expenses go with it
+	for _, userID := range members {
+		if err := s.logChange(ctx, entityMembership, userID, groupID, changeDelete); err != nil {
+			return err
+		}
+	}
+	return s.logChange(ctx, entityGroup, groupID, groupID, changeDelete)
+}
+
+func (s *sqlStore) groupMemberIDs(ctx context.Context, groupID int) ([]int, error) {
+	rows, err := s.query(ctx, "SELECT user_id FROM group_members WHERE group_id = ?", groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *sqlStore) AddMember(ctx context.Context, groupID, userID int) error {
+	_, err := s.exec(ctx, "INSERT INTO group_members (group_id, user_id, joined_at) VALUES (?, ?, ?)", groupID, userID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return s.logChange(ctx, entityMembership, userID, groupID, changeUpsert)
+}
+
+func (s *sqlStore) IsMember(ctx context.Context, userID, groupID int) (bool, error) {
+	return s.exists(ctx, "SELECT 1 FROM group_members WHERE user_id = ? AND group_id = ?", userID, groupID)
+}
+
+func (s *sqlStore) RemoveMember(ctx context.Context, groupID, userID int) error {
+	_, err := s.exec(ctx, "DELETE FROM group_members WHERE group_id = ? AND user_id = ?", groupID, userID)
+	if err != nil {
+		return err
+	}
+	return s.logChange(ctx, entityMembership, userID, groupID, changeDelete)
+}
+
+func (s *sqlStore) ListMembers(ctx context.Context, groupID int) ([]User, error) {
+	return s.listUsers(ctx, `SELECT `+userColumns+`
+		FROM users u
+		INNER JOIN group_members gm ON u.id = gm.user_id
+		WHERE gm.group_id = ?
+		ORDER BY u.username`, groupID)
+}
+
+// Expenses
+
+const expenseColumns = "e.id, e.description, e.amount, e.category, e.date, e.owner_group_id, e.occurred_at, e.created_at, e.updated_at, e.paid_by, e.client_id, e.notes, e.merchant"
+
+func scanExpense(row interface{ Scan(...interface{}) error }) (Expense, error) {
+	var expense Expense
+	var occurredAt sql.NullTime
+	var paidBy sql.NullInt64
+	var clientID sql.NullString
+	err := row.Scan(&expense.ID, &expense.Description, &expense.Amount,
+		&expense.Category, &expense.Date, &expense.OwnerGroupID, &occurredAt, &expense.CreatedAt, &expense.UpdatedAt, &paidBy, &clientID, &expense.Notes, &expense.Merchant)
+	expense.ClientID = clientID.String
+	if occurredAt.Valid {
+		expense.OccurredAt = &occurredAt.Time
+	}
+	if paidBy.Valid {
+		payer := int(paidBy.Int64)
+		expense.PaidBy = &payer
+	}
+	return expense, notFound(err)
+}
+
+func (s *sqlStore) CreateExpense(ctx context.Context, expense *Expense) error {
+	now := time.Now().UTC()
+	clientID := sql.NullString{String: expense.ClientID, Valid: expense.ClientID != ""}
+	id, err := s.insertID(ctx, `INSERT INTO expenses (description, amount, category, date, owner_group_id, occurred_at, created_at, updated_at, paid_by, client_id, notes, merchant)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		expense.Description, expense.Amount, expense.Category, expense.Date, expense.OwnerGroupID, expense.OccurredAt, now, now, expense.PaidBy, clientID, expense.Notes, expense.Merchant)
+	if err != nil {
+		return err
+	}
+	expense.ID = id
+	expense.CreatedAt = now
+	expense.UpdatedAt = now
+	if err := s.learnCategories(ctx, []categorySample{expenseSample(*expense)}, 1); err != nil {
+		return err
+	}
+	return s.logChange(ctx, entityExpense, id, expense.OwnerGroupID, changeUpsert)
+}
+
+func (s *sqlStore) GetExpense(ctx context.Context, expenseID int) (Expense, error) {
+	return s.withTags(ctx, s.queryRow(ctx, "SELECT "+expenseColumns+" FROM expenses e WHERE e.id = ?", expenseID))
+}
+
+func (s *sqlStore) UpdateExpense(ctx context.Context, expense *Expense) error {
+	// Corrections replace what was learned from the expense before
+	if err := s.unlearnExpense(ctx, expense.ID); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	result, err := s.exec(ctx, `UPDATE expenses SET description = ?, amount = ?, category = ?, date = ?, occurred_at = ?, updated_at = ?, paid_by = ?, notes = ?, merchant = ?
+		WHERE id = ? AND owner_group_id = ?`,
+		expense.Description, expense.Amount, expense.Category, expense.Date, expense.OccurredAt, now, expense.PaidBy, expense.Notes, expense.Merchant, expense.ID, expense.OwnerGroupID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	expense.UpdatedAt = now
+	if err := s.learnCategories(ctx, []categorySample{expenseSample(*expense)}, 1); err != nil {
+		return err
+	}
+	return s.logChange(ctx, entityExpense, expense.ID, expense.OwnerGroupID, changeUpsert)
+}
+
+func (s *sqlStore) MoveExpense(ctx context.Context, expense *Expense, toGroupID int) error {
+	// Tags belong to a group, the expense gets those of the same name in the other group
+	tags, err := s.expenseTagNames(ctx, []int{expense.ID})
+	if err != nil {
+		return err
+	}
+	if err := s.unlearnExpense(ctx, expense.ID); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	result, err := s.exec(ctx, "UPDATE expenses SET owner_group_id = ?, updated_at = ? WHERE id = ? AND owner_group_id = ?",
+		toGroupID, now, expense.ID, expense.OwnerGroupID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	// Gone for members of the old group, new for those of the other
+	if err := s.logChange(ctx, entityExpense, expense.ID, expense.OwnerGroupID, changeDelete); err != nil {
+		return err
+	}
+	expense.OwnerGroupID = toGroupID
+	expense.UpdatedAt = now
+	if err := s.SetExpenseTags(ctx, expense, tags[expense.ID]); err != nil {
+		return err
+	}
+	if err := s.learnCategories(ctx, []categorySample{expenseSample(*expense)}, 1); err != nil {
+		return err
+	}
+	return s.logChange(ctx, entityExpense, expense.ID, toGroupID, changeUpsert)
+}
+
+func (s *sqlStore) DeleteExpense(ctx context.Context, expenseID int) error {
+	var groupID int
+	err := s.queryRow(ctx, "SELECT owner_group_id FROM expenses WHERE id = ?", expenseID).Scan(&groupID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.unlearnExpense(ctx, expenseID); err != nil {
+		return err
+	}
+	if _, err := s.exec(ctx, "DELETE FROM expense_tags WHERE expense_id = ?", expenseID); err != nil {
+		return err
+	}
+	if _, err := s.exec(ctx, "DELETE FROM duplicate_dismissals WHERE expense_id = ? OR other_id = ?", expenseID, expenseID); err != nil {
+		return err
+	}
+	if _, err := s.exec(ctx, "DELETE FROM expenses WHERE id = ?", expenseID); err != nil {
+		return err
+	}
+	return s.logChange(ctx, entityExpense, expenseID, groupID, changeDelete)
+}
+
+func (s *sqlStore) ExpenseExists(ctx context.Context, expenseID int) (bool, error) {
+	return s.exists(ctx, "SELECT 1 FROM expenses WHERE id = ?", expenseID)
+}
+
+func (s *sqlStore) ListExpenses(ctx context.Context, filter ExpenseFilter) ([]Expense, error) {
+	query := `SELECT ` + expenseColumns + `
+		FROM expenses e
+		INNER JOIN group_members gm ON e.owner_group_id = gm.group_id
+		WHERE gm.user_id = ?`
+	args := []interface{}{filter.UserID}
+	if filter.GroupID > 0 {
+		query += " AND e.owner_group_id = ?"
+		args = append(args, filter.GroupID)
+	}
+	if filter.GroupIDs != nil {
+		if len(filter.GroupIDs) == 0 {
+			return []Expense{}, nil
+		}
+		query += " AND e.owner_group_id IN (?" + strings.Repeat(", ?", len(filter.GroupIDs)-1) + ")"
+		for _, id := range filter.GroupIDs {
+			args = append(args, id)
+		}
+	}
+	if len(filter.Tags) > 0 {
+		// Tag names are unique within a group, so matching all of them means matching as many rows
+		query += ` AND e.id IN (SELECT et.expense_id FROM expense_tags et
+			INNER JOIN tags t ON t.id = et.tag_id
+			WHERE t.name IN (?` + strings.Repeat(", ?", len(filter.Tags)-1) + `)
+			GROUP BY et.expense_id HAVING COUNT(*) = ?)`
+		for _, name := range filter.Tags {
+			args = append(args, name)
+		}
+		args = append(args, len(filter.Tags))
+	}
+	query += " ORDER BY e.date DESC, e.occurred_at DESC"
+	return s.listExpenses(ctx, query, args...)
+}
+
+// Run a query selecting expenseColumns and load the tags of the expenses
+func (s *sqlStore) listExpenses(ctx context.Context, query string, args ...interface{}) ([]Expense, error) {
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	expenses := []Expense{}
+	for rows.Next() {
+		expense, err := scanExpense(rows)
+		if err != nil {
+			return nil, err
+		}
+		expenses = append(expenses, expense)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	ids := make([]int, len(expenses))
+	for i, expense := range expenses {
+		ids[i] = expense.ID
+	}
+	tags, err := s.expenseTagNames(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range expenses {
+		expenses[i].Tags = tags[expenses[i].ID]
+	}
+	return expenses, nil
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The conformance suite every Store backend has to pass. SQLite always
+// runs, PostgreSQL runs when TEST_POSTGRES_URL names a database the tests
+// may create schemas in, for example
+// TEST_POSTGRES_URL=postgres://localhost:5432/expenses_test?sslmode=disable
+
+type storeBackend struct {
+	name string
+	open func(t *testing.T) Store
+}
+
+var storeBackends = []storeBackend{
+	{"sqlite", openSQLiteTestStore},
+	{"postgres", openPostgresTestStore},
+}
+
+func openSQLiteTestStore(t *testing.T) Store {
+	s, err := newSQLiteStore(filepath.Join(t.TempDir(), "expenses.db"))
+	if err != nil {
+		t.Fatalf("open SQLite store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// Every run gets a schema of its own, dropped when the test ends
+func openPostgresTestStore(t *testing.T) Store {
+	url := os.Getenv("TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("TEST_POSTGRES_URL is not set")
+	}
+	admin, err := newPostgresStore(url)
+	if err != nil {
+		t.Fatalf("open PostgreSQL store: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schemaName := fmt.Sprintf("store_test_%d", time.Now().UnixNano())
+	if _, err := admin.db.Exec("CREATE SCHEMA " + schemaName); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.db.Exec("DROP SCHEMA " + schemaName + " CASCADE"); err != nil {
+			t.Errorf("drop schema: %v", err)
+		}
+	})
+
+	// lib/pq passes unknown parameters on as run-time settings
+	switch {
+	case strings.Contains(url, "://") && strings.Contains(url, "?"):
+		url += "&search_path=" + schemaName
+	case strings.Contains(url, "://"):
+		url += "?search_path=" + schemaName
+	default:
+		url += " search_path=" + schemaName
+	}
+	s, err := newPostgresStore(url)
+	if err != nil {
+		t.Fatalf("open PostgreSQL store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestStore(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s Store)
+	}{
+		{"Users", testStoreUsers},
+		{"Groups", testStoreGroups},
+		{"Memberships", testStoreMemberships},
+		{"Expenses", testStoreExpenses},
+		{"WithTx", testStoreWithTx},
+		{"IdempotencyKeys", testStoreIdempotencyKeys},
+		{"DeltaSync", testStoreDeltaSync},
+		{"ConstraintErrors", testStoreConstraintErrors},
+	}
+	for _, backend := range storeBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			s := backend.open(t)
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					tt.run(t, s)
+				})
+			}
+		})
+	}
+}
+
+// Names are unique per call so the tests can share a database
+var testNameSequence int
+
+func uniqueName(prefix string) string {
+	testNameSequence++
+	return fmt.Sprintf("%s-%d", prefix, testNameSequence)
+}
+
+func mustCreateUser(t *testing.T, s Store) User {
+	t.Helper()
+	user, err := s.CreateUser(context.Background(), uniqueName("user"), "hash")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	return user
+}
+
+// A group owned by owner, who is also its first member
+func mustCreateGroup(t *testing.T, s Store, owner User) int {
+	t.Helper()
+	ctx := context.Background()
+	groupID, err := s.CreateGroup(ctx, uniqueName("group"), owner.ID)
+	if err != nil {
+		t.Fatalf("CreateGroup: %v", err)
+	}
+	if err := s.AddMember(ctx, groupID, owner.ID); err != nil {
+		t.Fatalf("AddMember: %v", err)
+	}
+	return groupID
+}
+
+func testStoreUsers(t *testing.T, s Store) {
+	ctx := context.Background()
+	user, err := s.CreateUser(ctx, uniqueName("alice"), "hash")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if user.ID == 0 || user.Password != "hash" || user.Timezone != "UTC" {
+		t.Errorf("CreateUser returned %+v", user)
+	}
+
+	byName, err := s.GetUserByUsername(ctx, user.Username)
+	if err != nil || byName.ID != user.ID {
+		t.Errorf("GetUserByUsername = %+v, %v, want user %d", byName, err, user.ID)
+	}
+	if exists, err := s.UsernameExists(ctx, user.Username); err != nil || !exists {
+		t.Errorf("UsernameExists = %v, %v, want true", exists, err)
+	}
+	if _, err := s.GetUser(ctx, user.ID+1000); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetUser of a missing user: got %v, want ErrNotFound", err)
+	}
+
+	if err := s.SetUserTimezone(ctx, user.ID, "Europe/Berlin"); err != nil {
+		t.Fatalf("SetUserTimezone: %v", err)
+	}
+	updated, err := s.SetUserPassword(ctx, user.ID, "new hash")
+	if err != nil {
+		t.Fatalf("SetUserPassword: %v", err)
+	}
+	if updated.Password != "new hash" || updated.TokenVersion != user.TokenVersion+1 || updated.Timezone != "Europe/Berlin" {
+		t.Errorf("SetUserPassword returned %+v", updated)
+	}
+
+	if err := s.DeleteUser(ctx, user.ID); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if _, err := s.GetUser(ctx, user.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetUser after DeleteUser: got %v, want ErrNotFound", err)
+	}
+	if err := s.DeleteUser(ctx, user.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeleteUser of a deleted user: got %v, want ErrNotFound", err)
+	}
+}
+
+func testStoreGroups(t *testing.T, s Store) {
+	ctx := context.Background()
+	owner := mustCreateUser(t, s)
+	groupID := mustCreateGroup(t, s, owner)
+
+	group, err := s.GetGroup(ctx, groupID)
+	if err != nil {
+		t.Fatalf("GetGroup: %v", err)
+	}
+	if group.OwnerID != owner.ID || len(group.UsersIDs) != 1 || group.UsersIDs[0] != owner.ID {
+		t.Errorf("GetGroup returned %+v", group)
+	}
+
+	groups, err := s.ListUserGroups(ctx, owner.ID)
+	if err != nil {
+		t.Fatalf("ListUserGroups: %v", err)
+	}
+	if len(groups) != 1 || groups[0].ID != groupID || len(groups[0].UsersIDs) != 1 {
+		t.Errorf("ListUserGroups returned %+v", groups)
+	}
+
+	other := mustCreateUser(t, s)
+	if err := s.AddMember(ctx, groupID, other.ID); err != nil {
+		t.Fatalf("AddMember: %v", err)
+	}
+	if err := s.SetGroupOwner(ctx, groupID, other.ID); err != nil {
+		t.Fatalf("SetGroupOwner: %v", err)
+	}
+	if group, _ := s.GetGroup(ctx, groupID); group.OwnerID != other.ID {
+		t.Errorf("owner after SetGroupOwner = %d, want %d", group.OwnerID, other.ID)
+	}
+
+	expense := Expense{Description: "Lunch", Amount: 12.5, Category: "Food", Date: "2024-10-07", OwnerGroupID: groupID}
+	if err := s.CreateExpense(ctx, &expense); err != nil {
+		t.Fatalf("CreateExpense: %v", err)
+	}
+	if err := s.DeleteGroup(ctx, groupID); err != nil {
+		t.Fatalf("DeleteGroup: %v", err)
+	}
+	if _, err := s.GetGroup(ctx, groupID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetGroup after DeleteGroup: got %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetExpense(ctx, expense.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetExpense of a deleted group's expense: got %v, want ErrNotFound", err)
+	}
+	if err := s.DeleteGroup(ctx, groupID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeleteGroup of a deleted group: got %v, want ErrNotFound", err)
+	}
+}
+
+func testStoreMemberships(t *testing.T, s Store) {
+	ctx := context.Background()
+	owner := mustCreateUser(t, s)
+	member := mustCreateUser(t, s)
+	groupID := mustCreateGroup(t, s, owner)
+
+	if ok, err := s.IsMember(ctx, member.ID, groupID); err != nil || ok {
+		t.Errorf("IsMember before AddMember = %v, %v, want false", ok, err)
+	}
+	if err := s.AddMember(ctx, groupID, member.ID); err != nil {
+		t.Fatalf("AddMember: %v", err)
+	}
+	if ok, err := s.IsMember(ctx, member.ID, groupID); err != nil || !ok {
+		t.Errorf("IsMember after AddMember = %v, %v, want true", ok, err)
+	}
+
+	members, err := s.ListMembers(ctx, groupID)
+	if err != nil {
+		t.Fatalf("ListMembers: %v", err)
+	}
+	if len(members) != 2 {
+		t.Fatalf("ListMembers returned %d members, want 2", len(members))
+	}
+	if members[0].Username > members[1].Username {
+		t.Errorf("ListMembers is not ordered by username: %q, %q", members[0].Username, members[1].Username)
+	}
+
+	memberships, err := s.ListMemberships(ctx, []int{groupID})
+	if err != nil {
+		t.Fatalf("ListMemberships: %v", err)
+	}
+	for _, m := range memberships {
+		if m.GroupID != groupID || m.JoinedAt == nil {
+			t.Errorf("ListMemberships returned %+v", m)
+		}
+	}
+
+	if err := s.RemoveMember(ctx, groupID, member.ID); err != nil {
+		t.Fatalf("RemoveMember: %v", err)
+	}
+	if ok, err := s.IsMember(ctx, member.ID, groupID); err != nil || ok {
+		t.Errorf("IsMember after RemoveMember = %v, %v, want false", ok, err)
+	}
+}
+
+func testStoreExpenses(t *testing.T, s Store) {
+	ctx := context.Background()
+	owner := mustCreateUser(t, s)
+	groupID := mustCreateGroup(t, s, owner)
+	otherGroupID := mustCreateGroup(t, s, owner)
+
+	paidBy := owner.ID
+	expense := Expense{
+		Description:  "Groceries",
+		Amount:       42.1,
+		Category:     "Food",
+		Date:         "2024-10-07",
+		OwnerGroupID: groupID,
+		PaidBy:       &paidBy,
+		Notes:        "weekly",
+		Merchant:     "Market",
+	}
+	if err := s.CreateExpense(ctx, &expense); err != nil {
+		t.Fatalf("CreateExpense: %v", err)
+	}
+	if expense.ID == 0 || expense.CreatedAt.IsZero() || expense.UpdatedAt.IsZero() {
+		t.Errorf("CreateExpense did not set the ID and times: %+v", expense)
+	}
+
+	stored, err := s.GetExpense(ctx, expense.ID)
+	if err != nil {
+		t.Fatalf("GetExpense: %v", err)
+	}
+	if stored.Description != "Groceries" || stored.Amount != 42.1 || stored.Date != "2024-10-07" ||
+		stored.PaidBy == nil || *stored.PaidBy != owner.ID || stored.Notes != "weekly" || stored.Merchant != "Market" {
+		t.Errorf("GetExpense returned %+v", stored)
+	}
+
+	stored.Amount = 40
+	stored.Category = "Household"
+	if err := s.UpdateExpense(ctx, &stored); err != nil {
+		t.Fatalf("UpdateExpense: %v", err)
+	}
+	if updated, _ := s.GetExpense(ctx, expense.ID); updated.Amount != 40 || updated.Category != "Household" {
+		t.Errorf("expense after UpdateExpense = %+v", updated)
+	}
+	wrongGroup := stored
+	wrongGroup.OwnerGroupID = otherGroupID
+	if err := s.UpdateExpense(ctx, &wrongGroup); !errors.Is(err, ErrNotFound) {
+		t.Errorf("UpdateExpense in another group: got %v, want ErrNotFound", err)
+	}
+
+	second := Expense{Description: "Train", Amount: 9, Category: "Transport", Date: "2024-10-08", OwnerGroupID: otherGroupID}
+	if err := s.CreateExpense(ctx, &second); err != nil {
+		t.Fatalf("CreateExpense: %v", err)
+	}
+	all, err := s.ListExpenses(ctx, ExpenseFilter{UserID: owner.ID})
+	if err != nil {
+		t.Fatalf("ListExpenses: %v", err)
+	}
+	if len(all) != 2 {
+		t.Errorf("ListExpenses returned %d expenses, want 2", len(all))
+	}
+	inGroup, err := s.ListExpenses(ctx, ExpenseFilter{UserID: owner.ID, GroupID: otherGroupID})
+	if err != nil {
+		t.Fatalf("ListExpenses: %v", err)
+	}
+	if len(inGroup) != 1 || inGroup[0].ID != second.ID {
+		t.Errorf("ListExpenses of one group returned %+v", inGroup)
+	}
+	outsider := mustCreateUser(t, s)
+	if none, err := s.ListExpenses(ctx, ExpenseFilter{UserID: outsider.ID}); err != nil || len(none) != 0 {
+		t.Errorf("ListExpenses of a user without groups = %+v, %v, want none", none, err)
+	}
+
+	if err := s.DeleteExpense(ctx, expense.ID); err != nil {
+		t.Fatalf("DeleteExpense: %v", err)
+	}
+	if _, err := s.GetExpense(ctx, expense.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetExpense after DeleteExpense: got %v, want ErrNotFound", err)
+	}
+	if exists, err := s.ExpenseExists(ctx, expense.ID); err != nil || exists {
+		t.Errorf("ExpenseExists after DeleteExpense = %v, %v, want false", exists, err)
+	}
+}
+
+func testStoreWithTx(t *testing.T, s Store) {
+	ctx := context.Background()
+	failure := errors.New("roll back")
+
+	var rolledBack User
+	err := s.WithTx(ctx, func(tx Store) error {
+		var err error
+		rolledBack, err = tx.CreateUser(ctx, uniqueName("rolled-back"), "hash")
+		if err != nil {
+			return err
+		}
+		// Nested calls join the outer transaction
+		return tx.WithTx(ctx, func(inner Store) error {
+			if _, err := inner.GetUser(ctx, rolledBack.ID); err != nil {
+				t.Errorf("user created earlier in the transaction: %v", err)
+			}
+			return failure
+		})
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("WithTx returned %v, want the error of fn", err)
+	}
+	if _, err := s.GetUser(ctx, rolledBack.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("user of a rolled back transaction: got %v, want ErrNotFound", err)
+	}
+
+	var committed User
+	err = s.WithTx(ctx, func(tx Store) error {
+		var err error
+		committed, err = tx.CreateUser(ctx, uniqueName("committed"), "hash")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("WithTx: %v", err)
+	}
+	if _, err := s.GetUser(ctx, committed.ID); err != nil {
+		t.Errorf("user of a committed transaction: %v", err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("WithTx swallowed a panic")
+			}
+		}()
+		s.WithTx(ctx, func(tx Store) error {
+			rolledBack, _ = tx.CreateUser(ctx, uniqueName("panicked"), "hash")
+			panic("boom")
+		})
+	}()
+	if _, err := s.GetUser(ctx, rolledBack.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("user of a panicking transaction: got %v, want ErrNotFound", err)
+	}
+}
+
+// Sync reads the package store, so it is pointed at the backend under test
+func testStoreDeltaSync(t *testing.T, s Store) {
+	previous := store
+	store = s
+	t.Cleanup(func() { store = previous })
+
+	ctx := context.Background()
+	alice := mustCreateUser(t, s)
+	bob := mustCreateUser(t, s)
+	sharedID := mustCreateGroup(t, s, alice)
+	if err := s.AddMember(ctx, sharedID, bob.ID); err != nil {
+		t.Fatalf("AddMember: %v", err)
+	}
+	bobsID := mustCreateGroup(t, s, bob)
+	leftID := mustCreateGroup(t, s, bob)
+	if err := s.AddMember(ctx, leftID, alice.ID); err != nil {
+		t.Fatalf("AddMember: %v", err)
+	}
+	newExpense := func(description string) Expense {
+		t.Helper()
+		expense := Expense{Description: description, Amount: 5, Category: "Food", Date: "2024-10-07", OwnerGroupID: sharedID}
+		if err := s.CreateExpense(ctx, &expense); err != nil {
+			t.Fatalf("CreateExpense: %v", err)
+		}
+		return expense
+	}
+	fullCursor := func() int64 {
+		t.Helper()
+		resp, err := fullSync(ctx, alice.ID)
+		if err != nil {
+			t.Fatalf("fullSync: %v", err)
+		}
+		after, _ := decodeCursor(resp.Cursor)
+		return after
+	}
+	delta := func(after int64, limit int) SyncResponse {
+		t.Helper()
+		resp, err := deltaSync(ctx, alice.ID, after, limit)
+		if err != nil {
+			t.Fatalf("deltaSync: %v", err)
+		}
+		return resp
+	}
+
+	// An expense moved to a group the caller cannot see is deleted for them
+	moved := newExpense("Moved")
+	after := fullCursor()
+	if err := s.MoveExpense(ctx, &moved, bobsID); err != nil {
+		t.Fatalf("MoveExpense: %v", err)
+	}
+	resp := delta(after, defaultSyncLimit)
+	if len(resp.Expenses) != 0 || len(resp.DeletedExpenses) != 1 || resp.DeletedExpenses[0] != moved.ID {
+		t.Errorf("after moving expense %d away: expenses %+v, deleted %v", moved.ID, resp.Expenses, resp.DeletedExpenses)
+	}
+
+	// A group the caller was removed from is deleted for them
+	after = fullCursor()
+	if err := s.RemoveMember(ctx, leftID, alice.ID); err != nil {
+		t.Fatalf("RemoveMember: %v", err)
+	}
+	resp = delta(after, defaultSyncLimit)
+	if len(resp.DeletedGroups) != 1 || resp.DeletedGroups[0] != leftID || len(resp.Groups) != 0 || len(resp.DeletedMembers) != 0 {
+		t.Errorf("after leaving group %d: groups %+v, deleted %v, deleted members %+v", leftID, resp.Groups, resp.DeletedGroups, resp.DeletedMembers)
+	}
+
+	// Pages of has_more responses add up to every change
+	after = fullCursor()
+	want := map[int]bool{}
+	for i := 0; i < 5; i++ {
+		want[newExpense(fmt.Sprintf("Page %d", i)).ID] = true
+	}
+	got := map[int]bool{}
+	for page := 1; ; page++ {
+		resp = delta(after, 2)
+		for _, expense := range resp.Expenses {
+			got[expense.ID] = true
+		}
+		next, ok := decodeCursor(resp.Cursor)
+		if !ok || next <= after {
+			t.Fatalf("page %d returned cursor %q after %d", page, resp.Cursor, after)
+		}
+		after = next
+		if !resp.HasMore {
+			break
+		}
+		if page == len(want) {
+			t.Fatalf("still has_more after %d pages", page)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("pages returned expenses %v, want %v", got, want)
+	}
+	for id := range want {
+		if !got[id] {
+			t.Errorf("expense %d missing from the pages", id)
+		}
+	}
+	if resp = delta(after, defaultSyncLimit); resp.HasMore || len(resp.Expenses) != 0 {
+		t.Errorf("sync after the last page returned %+v", resp)
+	}
+
+	// A create sent again with the same client_id returns the first expense
+	create := SyncMutation{Op: mutationCreate, ClientID: uniqueName("client"), GroupID: sharedID,
+		Description: "Offline", Amount: 3, Category: "Food", Date: "2024-10-07"}
+	first := applyMutation(ctx, alice.ID, create)
+	create.Amount = 4
+	replayed := applyMutation(ctx, alice.ID, create)
+	if first.Status != mutationApplied || first.Expense == nil {
+		t.Fatalf("create mutation = %+v, error %+v", first, first.Error)
+	}
+	if replayed.Status != mutationApplied || replayed.Expense == nil || replayed.Expense.ID != first.Expense.ID || replayed.Expense.Amount != 3 {
+		t.Errorf("replayed create = %+v, want expense %d as first created", replayed, first.Expense.ID)
+	}
+	byClient, err := s.ListExpenses(ctx, ExpenseFilter{UserID: alice.ID, GroupID: sharedID})
+	if err != nil {
+		t.Fatalf("ListExpenses: %v", err)
+	}
+	count := 0
+	for _, expense := range byClient {
+		if expense.ClientID == create.ClientID {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("%d expenses have client_id %q, want 1", count, create.ClientID)
+	}
+}
+
+func testStoreIdempotencyKeys(t *testing.T, s Store) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	reserve := func(key string, createdAt time.Time) IdempotencyRecord {
+		t.Helper()
+		record := IdempotencyRecord{Key: uniqueName(key), Method: "POST", Path: "/expenses", RequestHash: "hash", CreatedAt: createdAt}
+		if err := s.ReserveIdempotencyKey(ctx, record); err != nil {
+			t.Fatalf("ReserveIdempotencyKey: %v", err)
+		}
+		return record
+	}
+	exists := func(record IdempotencyRecord) bool {
+		t.Helper()
+		_, err := s.GetIdempotencyRecord(ctx, record.Key, record.Method, record.Path)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			t.Fatalf("GetIdempotencyRecord: %v", err)
+		}
+		return err == nil
+	}
+
+	running := reserve("running", now)
+	if err := s.ReserveIdempotencyKey(ctx, running); !errors.Is(err, ErrConflict) {
+		t.Errorf("key reserved twice: got %v, want ErrConflict", err)
+	}
+
+	abandoned := reserve("abandoned", now.Add(-time.Hour))
+	completed := reserve("completed", now.Add(-time.Hour))
+	completed.StatusCode, completed.ContentType, completed.Body = 201, "application/json", []byte(`{"id":1}`)
+	if err := s.CompleteIdempotencyKey(ctx, completed); err != nil {
+		t.Fatalf("CompleteIdempotencyKey: %v", err)
+	}
+	stored, err := s.GetIdempotencyRecord(ctx, completed.Key, completed.Method, completed.Path)
+	if err != nil || stored.StatusCode != 201 || string(stored.Body) != `{"id":1}` {
+		t.Errorf("completed key read back as %+v, %v", stored, err)
+	}
+
+	// Only reservations older than the cutoff that never completed are taken over
+	cutoff := now.Add(-time.Minute)
+	for _, record := range []IdempotencyRecord{running, abandoned, completed} {
+		if err := s.DeleteAbandonedIdempotencyKey(ctx, record.Key, record.Method, record.Path, cutoff); err != nil {
+			t.Fatalf("DeleteAbandonedIdempotencyKey: %v", err)
+		}
+	}
+	if !exists(running) || exists(abandoned) || !exists(completed) {
+		t.Errorf("after removing abandoned keys: running %v, abandoned %v, completed %v, want true, false, true",
+			exists(running), exists(abandoned), exists(completed))
+	}
+}
+
+func testStoreConstraintErrors(t *testing.T, s Store) {
+	ctx := context.Background()
+	owner := mustCreateUser(t, s)
+	groupID := mustCreateGroup(t, s, owner)
+	missing := owner.ID + 1000
+
+	tests := []struct {
+		name string
+		run  func() error
+		want error
+	}{
+		{"duplicate username", func() error {
+			_, err := s.CreateUser(ctx, owner.Username, "hash")
+			return err
+		}, ErrConflict},
+		{"member added twice", func() error {
+			return s.AddMember(ctx, groupID, owner.ID)
+		}, ErrConflict},
+		{"group of a missing owner", func() error {
+			_, err := s.CreateGroup(ctx, uniqueName("group"), missing)
+			return err
+		}, ErrInvalidReference},
+		{"missing user added to a group", func() error {
+			return s.AddMember(ctx, groupID, missing)
+		}, ErrInvalidReference},
+		{"expense of a missing group", func() error {
+			return s.CreateExpense(ctx, &Expense{Description: "x", Amount: 1, Category: "Food", Date: "2024-10-07", OwnerGroupID: groupID + 1000})
+		}, ErrInvalidReference},
+		{"expense paid by a missing user", func() error {
+			return s.CreateExpense(ctx, &Expense{Description: "x", Amount: 1, Category: "Food", Date: "2024-10-07", OwnerGroupID: groupID, PaidBy: &missing})
+		}, ErrInvalidReference},
+		{"user still owning a group", func() error {
+			return s.DeleteUser(ctx, owner.ID)
+		}, ErrInvalidReference},
+	}
+	for _, tt := range tests {
+		if err := tt.run(); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Category suggestions come from a naive Bayes classifier per group. The
+// store keeps how many expenses of each category there are and how often
+// each feature (a word of the description or merchant, or the size of the
+// amount) occurs in them. Creating, changing, moving and deleting expenses
+// update these counts, so the classifier always reflects the group's
+// current expenses without being retrained from scratch.
+
+const (
+	defaultSuggestions = 3
+	maxSuggestions     = 10
+)
+
+type SuggestCategoryRequest struct {
+	Token       string  `json:"token"`    // JWT token or API key for authentication
+	GroupID     int     `json:"group_id"` // Group whose expenses the suggestions are learned from
+	Description string  `json:"description"`
+	Merchant    string  `json:"merchant,omitempty"` // Optional
+	Amount      float64 `json:"amount,omitempty"`   // Optional
+	Limit       int     `json:"limit,omitempty"`    // Optional: suggestions returned, 3 by default, at most 10
+}
+
+type CategorySuggestion struct {
+	Category string `json:"category"`
+	// Probability of the category given what the group's expenses look like, between 0 and 1
+	Confidence float64 `json:"confidence"`
+}
+
+type SuggestCategoryResult struct {
+	Suggestions []CategorySuggestion `json:"suggestions"` // Most likely first
+	TrainedOn   int                  `json:"trained_on"`  // Expenses of the group learned from
+}
+
+// Suggest categories for an expense from those of the group's earlier expenses
+func SuggestCategory(c echo.Context) error {
+	var req SuggestCategoryRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	v := &validator{}
+	v.requiredID("group_id", req.GroupID)
+	if strings.TrimSpace(req.Description) == "" && strings.TrimSpace(req.Merchant) == "" {
+		v.add("description", FieldRequired, "description or merchant is required")
+	}
+	if req.Amount < 0 {
+		v.add("amount", FieldMustBePositive, "amount cannot be negative")
+	}
+	if req.Limit < 0 || req.Limit > maxSuggestions {
+		v.add("limit", FieldInvalidFormat, fmt.Sprintf("limit must be between 1 and %d", maxSuggestions))
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+	limit := req.Limit
+	if limit == 0 {
+		limit = defaultSuggestions
+	}
+
+	userID, err := authenticate(c, req.Token, scopeRead)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	isMember, err := isUserInGroup(ctx, userID, req.GroupID)
+	if err != nil {
+		return errDatabase(err)
+	}
+	if !isMember {
+		return errNotGroupMember()
+	}
+
+	features := expenseFeatures(req.Description, req.Merchant, req.Amount)
+	model, err := store.CategoryModel(ctx, req.GroupID, features)
+	if err != nil {
+		return errDatabase(err)
+	}
+
+	suggestions := model.classify(features)
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	return respond(c, http.StatusOK, "", SuggestCategoryResult{Suggestions: suggestions, TrainedOn: model.Expenses})
+}
+
+// The features of an expense: the words of its description, those of its
+// merchant and the size of its amount. Each counts once per expense.
+func expenseFeatures(description, merchant string, amount float64) []string {
+	seen := map[string]bool{}
+	var features []string
+	add := func(feature string) {
+		if !seen[feature] {
+			seen[feature] = true
+			features = append(features, feature)
+		}
+	}
+	for _, word := range featureWords(description) {
+		add("w:" + word)
+	}
+	for _, word := range featureWords(merchant) {
+		add("m:" + word)
+	}
+	if amount > 0 {
+		add("a:" + amountBucket(amount))
+	}
+	return features
+}
+
+// Lower case words of at least two characters. Numbers are left out, they
+// tend to be dates, receipt numbers and the like.
+func featureWords(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	words := fields[:0]
+	for _, field := range fields {
+		if len([]rune(field)) < 2 || strings.IndexFunc(field, unicode.IsLetter) < 0 {
+			continue
+		}
+		words = append(words, field)
+	}
+	return words
+}
+
+// Amounts fall into buckets about three times as wide as the one before:
+// 1 to 3.16, 3.16 to 10, 10 to 31.6 and so on
+func amountBucket(amount float64) string {
+	return fmt.Sprint(int(math.Floor(2 * math.Log10(amount))))
+}
+
+// What the classifier learned from a group's expenses
+type CategoryModel struct {
+	Expenses   int            // Expenses learned from
+	Categories map[string]int // Expenses per category
+	// Features counted per category, over all features
+	FeatureTotals map[string]int
+	// Distinct features in the group
+	Vocabulary int
+	// Counts per category of the features asked for
+	Counts map[string]map[string]int
+}
+
+// Rank the categories by their probability given the features, using
+// Laplace smoothing so unseen words do not rule a category out
+func (m CategoryModel) classify(features []string) []CategorySuggestion {
+	suggestions := []CategorySuggestion{}
+	if m.Expenses == 0 {
+		return suggestions
+	}
+
+	scores := map[string]float64{}
+	best := math.Inf(-1)
+	for category, n := range m.Categories {
+		score := math.Log(float64(n+1) / float64(m.Expenses+len(m.Categories)))
+		denominator := float64(m.FeatureTotals[category] + m.Vocabulary + 1)
+		for _, feature := range features {
+			score += math.Log(float64(m.Counts[category][feature]+1) / denominator)
+		}
+		scores[category] = score
+		best = math.Max(best, score)
+	}
+
+	// Normalise in a way that does not underflow for long descriptions
+	total := 0.0
+	for _, score := range scores {
+		total += math.Exp(score - best)
+	}
+	for category, score := range scores {
+		confidence := math.Exp(score-best) / total
+		suggestions = append(suggestions, CategorySuggestion{Category: category, Confidence: math.Round(confidence*1000) / 1000})
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Confidence != suggestions[j].Confidence {
+			return suggestions[i].Confidence > suggestions[j].Confidence
+		}
+		return suggestions[i].Category < suggestions[j].Category
+	})
+	return suggestions
+}
+
+func (s *sqlStore) CategoryModel(ctx context.Context, groupID int, features []string) (CategoryModel, error) {
+	model := CategoryModel{Categories: map[string]int{}, FeatureTotals: map[string]int{}, Counts: map[string]map[string]int{}}
+	rows, err := s.query(ctx, "SELECT category, expenses FROM category_counts WHERE group_id = ?", groupID)
+	if err != nil {
+		return model, err
+	}
+	for rows.Next() {
+		var category string
+		var n int
+		if err := rows.Scan(&category, &n); err != nil {
+			rows.Close()
+			return model, err
+		}
+		model.Categories[category] = n
+		model.Expenses += n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || model.Expenses == 0 {
+		return model, err
+	}
+
+	rows, err = s.query(ctx, "SELECT category, SUM(count) FROM category_features WHERE group_id = ? GROUP BY category", groupID)
+	if err != nil {
+		return model, err
+	}
+	for rows.Next() {
+		var category string
+		var n int
+		if err := rows.Scan(&category, &n); err != nil {
+			rows.Close()
+			return model, err
+		}
+		model.FeatureTotals[category] = n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return model, err
+	}
+
+	if err := s.queryRow(ctx, "SELECT COUNT(DISTINCT feature) FROM category_features WHERE group_id = ?", groupID).Scan(&model.Vocabulary); err != nil {
+		return model, err
+	}
+	if len(features) == 0 {
+		return model, nil
+	}
+
+	args := []interface{}{groupID}
+	for _, feature := range features {
+		args = append(args, feature)
+	}
+	rows, err = s.query(ctx, `SELECT category, feature, count FROM category_features
+		WHERE group_id = ? AND feature IN (?`+strings.Repeat(", ?", len(features)-1)+`)`, args...)
+	if err != nil {
+		return model, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var category, feature string
+		var n int
+		if err := rows.Scan(&category, &feature, &n); err != nil {
+			return model, err
+		}
+		if model.Counts[category] == nil {
+			model.Counts[category] = map[string]int{}
+		}
+		model.Counts[category][feature] = n
+	}
+	return model, rows.Err()
+}
+
+// An expense as the classifier sees it
+type categorySample struct {
+	groupID     int
+	category    string
+	description string
+	merchant    string
+	amount      float64
+}
+
+func expenseSample(expense Expense) categorySample {
+	return categorySample{expense.OwnerGroupID, expense.Category, expense.Description, expense.Merchant, expense.Amount}
+}
+
+type categoryKey struct {
+	groupID  int
+	category string
+}
+
+type featureKey struct {
+	categoryKey
+	feature string
+}
+
+// Add the samples to the counts of their groups, or take them away again
+// with a delta of -1
+func (s *sqlStore) learnCategories(ctx context.Context, samples []categorySample, delta int) error {
+	expenses := map[categoryKey]int{}
+	features := map[featureKey]int{}
+	for _, sample := range samples {
+		if sample.category == "" {
+			continue
+		}
+		key := categoryKey{sample.groupID, sample.category}
+		expenses[key] += delta
+		for _, feature := range expenseFeatures(sample.description, sample.merchant, sample.amount) {
+			features[featureKey{key, feature}] += delta
+		}
+	}
+
+	for key, n := range expenses {
+		if _, err := s.exec(ctx, `INSERT INTO category_counts (group_id, category, expenses) VALUES (?, ?, ?)
+			ON CONFLICT (group_id, category) DO UPDATE SET expenses = category_counts.expenses + excluded.expenses`,
+			key.groupID, key.category, n); err != nil {
+			return err
+		}
+	}
+	for key, n := range features {
+		if _, err := s.exec(ctx, `INSERT INTO category_features (group_id, category, feature, count) VALUES (?, ?, ?, ?)
+			ON CONFLICT (group_id, category, feature) DO UPDATE SET count = category_features.count + excluded.count`,
+			key.groupID, key.category, key.feature, n); err != nil {
+			return err
+		}
+	}
+	if delta > 0 {
+		return nil
+	}
+
+	// Forget categories and features no expense has any more
+	for key := range expenses {
+		if _, err := s.exec(ctx, "DELETE FROM category_counts WHERE group_id = ? AND category = ? AND expenses <= 0", key.groupID, key.category); err != nil {
+			return err
+		}
+		if _, err := s.exec(ctx, "DELETE FROM category_features WHERE group_id = ? AND category = ? AND count <= 0", key.groupID, key.category); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Take a stored expense out of the counts, before it is changed or deleted
+func (s *sqlStore) unlearnExpense(ctx context.Context, expenseID int) error {
+	var sample categorySample
+	err := s.queryRow(ctx, "SELECT owner_group_id, category, description, merchant, amount FROM expenses WHERE id = ?", expenseID).
+		Scan(&sample.groupID, &sample.category, &sample.description, &sample.merchant, &sample.amount)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.learnCategories(ctx, []categorySample{sample}, -1)
+}
+
+// Learn from the expenses of groups that have none in the counts yet,
+// those added before the classifier existed
+func (s *sqlStore) learnUntrainedGroups(ctx context.Context) error {
+	rows, err := s.query(ctx, `SELECT e.owner_group_id, e.category, e.description, e.merchant, e.amount FROM expenses e
+		WHERE e.category <> '' AND NOT EXISTS (SELECT 1 FROM category_counts cc WHERE cc.group_id = e.owner_group_id)`)
+	if err != nil {
+		return err
+	}
+	var samples []categorySample
+	for rows.Next() {
+		var sample categorySample
+		if err := rows.Scan(&sample.groupID, &sample.category, &sample.description, &sample.merchant, &sample.amount); err != nil {
+			rows.Close()
+			return err
+		}
+		samples = append(samples, sample)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(samples) == 0 {
+		return err
+	}
+
+	return s.WithTx(ctx, func(tx Store) error {
+		return tx.(*sqlStore).learnCategories(ctx, samples, 1)
+	})
+}
@@ -0,0 +1,721 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// Version prefix of cursors, so their format can change without breaking clients
+	cursorPrefix     = "c1:"
+	defaultSyncLimit = 500
+	maxSyncLimit     = 2000
+	// Mutations accepted per request
+	maxSyncMutations  = 100
+	clientIDMaxLength = 64
+
+	mutationCreate = "create"
+	mutationUpdate = "update"
+	mutationDelete = "delete"
+
+	mutationApplied  = "applied"
+	mutationConflict = "conflict"
+	mutationRejected = "rejected"
+)
+
+// An offline change to an expense, applied in its own transaction
+type SyncMutation struct {
+	Op string `json:"op"` // "create", "update" or "delete"
+	// Client generated ID of the expense, required for create. Sending the
+	// same create again returns the expense made the first time.
+	ClientID string `json:"client_id,omitempty"`
+	// Expense to update or delete. Expenses created offline can be referred
+	// to by client_id before their ID is known.
+	ID int `json:"id,omitempty"`
+	// updated_at of the version the change was made to. When the expense was
+	// changed since, the mutation is reported as a conflict instead of applied.
+	BaseUpdatedAt *time.Time `json:"base_updated_at,omitempty"`
+	GroupID       int        `json:"group_id,omitempty"`
+	Description   string     `json:"description,omitempty"`
+	Amount        float64    `json:"amount,omitempty"`
+	Category      string     `json:"category,omitempty"`
+	Date          string     `json:"date,omitempty"`
+	PaidBy        int        `json:"paid_by,omitempty"`
+	// Notes and tags of an updated expense are unchanged when left out
+	Notes    *string  `json:"notes,omitempty"`
+	Merchant *string  `json:"merchant,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+type MutationResult struct {
+	Index    int    `json:"index"` // Position of the mutation in the request
+	ClientID string `json:"client_id,omitempty"`
+	Status   string `json:"status"` // "applied", "conflict" or "rejected"
+	// The expense after the mutation, or the server's version on a conflict.
+	// Missing when it was deleted.
+	Expense *Expense  `json:"expense,omitempty"`
+	Error   *APIError `json:"error,omitempty"`
+}
+
+type SyncRequest struct {
+	Token     string         `json:"token"`               // JWT token or API key for authentication
+	Cursor    string         `json:"cursor,omitempty"`    // From the previous response, empty for a full sync
+	Limit     int            `json:"limit,omitempty"`     // Optional: change log entries read, 500 by default
+	Mutations []SyncMutation `json:"mutations,omitempty"` // Optional: offline changes to apply first
+}
+
+// A member as sent by sync
+type SyncMember struct {
+	GroupID int `json:"group_id"`
+	PublicProfile
+	JoinedAt *time.Time `json:"joined_at,omitempty"`
+}
+
+type SyncMemberRef struct {
+	GroupID int `json:"group_id"`
+	UserID  int `json:"user_id"`
+}
+
+type SyncResponse struct {
+	Cursor string `json:"cursor"`
+	// More changes are waiting, sync again with the new cursor
+	HasMore bool `json:"has_more"`
+	// A full sync replaces everything the client stored, other syncs apply changes to it
+	Full            bool             `json:"full"`
+	Results         []MutationResult `json:"results,omitempty"`
+	Groups          []UsersGroup     `json:"groups"`
+	DeletedGroups   []int            `json:"deleted_groups"`
+	Members         []SyncMember     `json:"members"`
+	DeletedMembers  []SyncMemberRef  `json:"deleted_members"`
+	Expenses        []Expense        `json:"expenses"`
+	DeletedExpenses []int            `json:"deleted_expenses"`
+}
+
+func encodeCursor(changeID int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorPrefix + strconv.FormatInt(changeID, 10)))
+}
+
+func decodeCursor(cursor string) (int64, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(raw), cursorPrefix) {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(string(raw), cursorPrefix), 10, 64)
+	return id, err == nil && id >= 0
+}
+
+// Exchange changes with an offline client: apply its mutations, then return
+// everything that changed in its groups since its cursor
+func Sync(c echo.Context) error {
+	var req SyncRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	scope := scopeRead
+	if len(req.Mutations) > 0 {
+		scope = scopeWrite
+	}
+	userID, err := authenticate(c, req.Token, scope)
+	if err != nil {
+		return err
+	}
+
+	v := &validator{}
+	var after int64
+	if req.Cursor != "" {
+		var ok bool
+		if after, ok = decodeCursor(req.Cursor); !ok {
+			v.add("cursor", FieldInvalidFormat, "cursor is not one returned by /sync")
+		}
+	}
+	if req.Limit < 0 {
+		v.add("limit", FieldMustBePositive, "limit must be greater than zero")
+	}
+	if len(req.Mutations) > maxSyncMutations {
+		v.add("mutations", FieldTooLong, "at most 100 mutations can be sent at once")
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+	limit := req.Limit
+	if limit == 0 {
+		limit = defaultSyncLimit
+	}
+	if limit > maxSyncLimit {
+		limit = maxSyncLimit
+	}
+
+	ctx := c.Request().Context()
+	results := make([]MutationResult, 0, len(req.Mutations))
+	for i, m := range req.Mutations {
+		result := applyMutation(ctx, userID, m)
+		result.Index = i
+		results = append(results, result)
+	}
+
+	var resp SyncResponse
+	if req.Cursor == "" {
+		resp, err = fullSync(ctx, userID)
+	} else {
+		resp, err = deltaSync(ctx, userID, after, limit)
+	}
+	if err != nil {
+		return errDatabase(err)
+	}
+	if len(results) > 0 {
+		resp.Results = results
+	}
+	return respond(c, http.StatusOK, "", resp)
+}
+
+// Groups the caller sees, restricted to those of the API key
+func visibleGroups(ctx context.Context, userID int) ([]UsersGroup, error) {
+	groups, err := store.ListUserGroups(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	principal := principalFromContext(ctx)
+	visible := []UsersGroup{}
+	for _, group := range groups {
+		if principal.allowsGroup(group.ID) {
+			visible = append(visible, group)
+		}
+	}
+	return visible, nil
+}
+
+func newSyncResponse() SyncResponse {
+	return SyncResponse{
+		Groups:          []UsersGroup{},
+		DeletedGroups:   []int{},
+		Members:         []SyncMember{},
+		DeletedMembers:  []SyncMemberRef{},
+		Expenses:        []Expense{},
+		DeletedExpenses: []int{},
+	}
+}
+
+// Everything in the caller's groups, and a cursor to continue from
+func fullSync(ctx context.Context, userID int) (SyncResponse, error) {
+	resp := newSyncResponse()
+	resp.Full = true
+
+	// Read the position first, changes made while the snapshot is read are sent again next time
+	latest, err := store.LatestChangeID(ctx)
+	if err != nil {
+		return resp, err
+	}
+	resp.Cursor = encodeCursor(latest)
+
+	groups, err := visibleGroups(ctx, userID)
+	if err != nil {
+		return resp, err
+	}
+	if err := addGroupSnapshots(ctx, userID, groups, &resp); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+// Add groups with all their members and expenses
+func addGroupSnapshots(ctx context.Context, userID int, groups []UsersGroup, resp *SyncResponse) error {
+	if len(groups) == 0 {
+		return nil
+	}
+	groupIDs := make([]int, len(groups))
+	for i, group := range groups {
+		groupIDs[i] = group.ID
+	}
+	resp.Groups = append(resp.Groups, groups...)
+
+	memberships, err := store.ListMemberships(ctx, groupIDs)
+	if err != nil {
+		return err
+	}
+	for _, m := range memberships {
+		resp.Members = append(resp.Members, SyncMember{GroupID: m.GroupID, PublicProfile: publicProfile(m.User), JoinedAt: m.JoinedAt})
+	}
+
+	expenses, err := store.ListExpenses(ctx, ExpenseFilter{UserID: userID, GroupIDs: groupIDs})
+	if err != nil {
+		return err
+	}
+	resp.Expenses = append(resp.Expenses, expenses...)
+	return nil
+}
+
+// The current state of whatever changed in the caller's groups after a cursor
+func deltaSync(ctx context.Context, userID int, after int64, limit int) (SyncResponse, error) {
+	resp := newSyncResponse()
+
+	latest, err := store.LatestChangeID(ctx)
+	if err != nil {
+		return resp, err
+	}
+	groups, err := visibleGroups(ctx, userID)
+	if err != nil {
+		return resp, err
+	}
+	current := map[int]UsersGroup{}
+	groupIDs := make([]int, len(groups))
+	for i, group := range groups {
+		current[group.ID] = group
+		groupIDs[i] = group.ID
+	}
+
+	changes, err := store.ListChanges(ctx, userID, groupIDs, after, latest, limit+1)
+	if err != nil {
+		return resp, err
+	}
+	resp.Cursor = encodeCursor(latest)
+	if len(changes) > limit {
+		changes = changes[:limit]
+		resp.HasMore = true
+		resp.Cursor = encodeCursor(changes[len(changes)-1].ID)
+	}
+
+	// Only the latest state of each entity matters. Groups the caller joined
+	// or left are sent whole or dropped whole.
+	joined := map[int]bool{}
+	left := map[int]bool{}
+	changedGroups := map[int]bool{}
+	changedMembers := map[SyncMemberRef]bool{}
+	changedExpenses := map[int]int{} // Expense ID to group ID
+	for _, change := range changes {
+		switch change.Entity {
+		case entityGroup:
+			changedGroups[change.GroupID] = true
+		case entityMembership:
+			if change.EntityID == userID {
+				joined[change.GroupID] = change.Op == changeUpsert
+				left[change.GroupID] = change.Op == changeDelete
+			}
+			changedMembers[SyncMemberRef{GroupID: change.GroupID, UserID: change.EntityID}] = true
+		case entityExpense:
+			changedExpenses[change.EntityID] = change.GroupID
+		}
+	}
+
+	var snapshots []UsersGroup
+	for groupID := range current {
+		if joined[groupID] {
+			snapshots = append(snapshots, current[groupID])
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].ID < snapshots[j].ID })
+	if err := addGroupSnapshots(ctx, userID, snapshots, &resp); err != nil {
+		return resp, err
+	}
+
+	// Groups that changed, or that the caller is no longer in
+	for groupID := range changedGroups {
+		group, ok := current[groupID]
+		switch {
+		case joined[groupID]:
+		case ok:
+			resp.Groups = append(resp.Groups, group)
+		default:
+			left[groupID] = true
+		}
+	}
+	for groupID, gone := range left {
+		if _, ok := current[groupID]; gone && !ok {
+			resp.DeletedGroups = append(resp.DeletedGroups, groupID)
+		}
+	}
+	sort.Ints(resp.DeletedGroups)
+
+	// Members of groups the caller stays in
+	memberGroups := []int{}
+	for ref := range changedMembers {
+		if _, ok := current[ref.GroupID]; ok && !joined[ref.GroupID] {
+			memberGroups = append(memberGroups, ref.GroupID)
+		}
+	}
+	if len(memberGroups) > 0 {
+		memberships, err := store.ListMemberships(ctx, uniqueIDs(memberGroups))
+		if err != nil {
+			return resp, err
+		}
+		stillMember := map[SyncMemberRef]bool{}
+		for _, m := range memberships {
+			ref := SyncMemberRef{GroupID: m.GroupID, UserID: m.User.ID}
+			stillMember[ref] = true
+			if changedMembers[ref] {
+				resp.Members = append(resp.Members, SyncMember{GroupID: m.GroupID, PublicProfile: publicProfile(m.User), JoinedAt: m.JoinedAt})
+			}
+		}
+		for ref := range changedMembers {
+			if _, ok := current[ref.GroupID]; ok && !joined[ref.GroupID] && !stillMember[ref] {
+				resp.DeletedMembers = append(resp.DeletedMembers, ref)
+			}
+		}
+	}
+
+	// Expenses of groups the caller stays in
+	expenseIDs := []int{}
+	for expenseID, groupID := range changedExpenses {
+		if _, ok := current[groupID]; ok && !joined[groupID] {
+			expenseIDs = append(expenseIDs, expenseID)
+		}
+	}
+	if len(expenseIDs) > 0 {
+		expenses, err := store.ListExpensesByID(ctx, expenseIDs)
+		if err != nil {
+			return resp, err
+		}
+		found := map[int]bool{}
+		for _, expense := range expenses {
+			// An expense moved to a group the caller cannot see is gone for them
+			if _, ok := current[expense.OwnerGroupID]; ok {
+				found[expense.ID] = true
+				resp.Expenses = append(resp.Expenses, expense)
+			}
+		}
+		for _, expenseID := range expenseIDs {
+			if !found[expenseID] {
+				resp.DeletedExpenses = append(resp.DeletedExpenses, expenseID)
+			}
+		}
+		sort.Ints(resp.DeletedExpenses)
+	}
+	return resp, nil
+}
+
+// Apply one mutation in its own transaction, so one failing does not undo the others
+func applyMutation(ctx context.Context, userID int, m SyncMutation) MutationResult {
+	result := MutationResult{ClientID: m.ClientID}
+	var event *Event
+	err := store.WithTx(ctx, func(tx Store) error {
+		var err error
+		switch m.Op {
+		case mutationCreate:
+			event, err = applyCreate(ctx, tx, userID, m, &result)
+		case mutationUpdate:
+			event, err = applyUpdate(ctx, tx, userID, m, &result)
+		case mutationDelete:
+			event, err = applyDelete(ctx, tx, userID, m, &result)
+		default:
+			v := &validator{}
+			v.add("op", FieldInvalidFormat, `op must be "create", "update" or "delete"`)
+			err = v.err()
+		}
+		return err
+	})
+
+	switch {
+	case err == nil:
+		if result.Status == "" {
+			result.Status = mutationApplied
+		}
+		if event != nil {
+			publish(*event)
+		}
+	default:
+		result.Status = mutationRejected
+		result.Error = mutationError(err)
+		result.Expense = nil
+	}
+	return result
+}
+
+// Validate the fields a created or updated expense needs
+func mutationExpense(m SyncMutation) (Expense, error) {
+	v := &validator{}
+	v.requiredID("group_id", m.GroupID)
+	v.required("description", m.Description)
+	v.positive("amount", m.Amount)
+	category := v.category("category", m.Category)
+	date, occurredAt := v.expenseDate("date", m.Date)
+	var notes string
+	if m.Notes != nil {
+		notes = *m.Notes
+		v.notes("notes", notes)
+	}
+	var merchant string
+	if m.Merchant != nil {
+		merchant = strings.TrimSpace(*m.Merchant)
+		v.merchant("merchant", merchant)
+	}
+	tags := v.tags("tags", m.Tags)
+	if err := v.err(); err != nil {
+		return Expense{}, err
+	}
+	return Expense{
+		Description:  m.Description,
+		Amount:       m.Amount,
+		Category:     category,
+		Date:         date,
+		OwnerGroupID: m.GroupID,
+		OccurredAt:   occurredAt,
+		Notes:        notes,
+		Merchant:     merchant,
+		Tags:         tags,
+	}, nil
+}
+
+func applyCreate(ctx context.Context, tx Store, userID int, m SyncMutation, result *MutationResult) (*Event, error) {
+	v := &validator{}
+	v.required("client_id", m.ClientID)
+	if len(m.ClientID) > clientIDMaxLength {
+		v.add("client_id", FieldTooLong, "client_id must be at most 64 characters long")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	// Sent before, the response got lost
+	existing, err := tx.GetExpenseByClientID(ctx, m.ClientID)
+	if err == nil {
+		isMember, err := isMemberOf(ctx, tx, userID, existing.OwnerGroupID)
+		if err != nil {
+			return nil, errDatabase(err)
+		}
+		if !isMember {
+			return nil, newAPIError(http.StatusConflict, CodeConflict, "client_id is already in use")
+		}
+		result.Expense = &existing
+		return nil, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, errDatabase(err)
+	}
+
+	expense, err := mutationExpense(m)
+	if err != nil {
+		return nil, err
+	}
+	expense.ClientID = m.ClientID
+	expense.PaidBy = &userID
+	if m.PaidBy > 0 {
+		expense.PaidBy = &m.PaidBy
+	}
+
+	isMember, err := isMemberOf(ctx, tx, userID, expense.OwnerGroupID)
+	if err != nil {
+		return nil, errDatabase(err)
+	}
+	if !isMember {
+		return nil, errNotGroupMember()
+	}
+	if err := checkPayer(ctx, tx, expense.OwnerGroupID, m.PaidBy); err != nil {
+		return nil, err
+	}
+	if err := tx.CreateExpense(ctx, &expense); err != nil {
+		return nil, errInternal("Failed to add expense", err)
+	}
+	if err := tx.SetExpenseTags(ctx, &expense, expense.Tags); err != nil {
+		return nil, errInternal("Failed to tag expense", err)
+	}
+
+	event := Event{Type: EventExpenseCreated, GroupID: expense.OwnerGroupID, ActorID: userID, Data: expense}
+	if err := queueWebhooks(ctx, tx, event); err != nil {
+		return nil, errInternal("Failed to queue webhooks", err)
+	}
+	result.Expense = &expense
+	return &event, nil
+}
+
+// Find the expense an update or delete refers to, by ID or client ID
+func mutationTarget(ctx context.Context, tx Store, userID int, m SyncMutation) (Expense, error) {
+	var expense Expense
+	var err error
+	switch {
+	case m.ID > 0:
+		expense, err = tx.GetExpense(ctx, m.ID)
+	case m.ClientID != "":
+		expense, err = tx.GetExpenseByClientID(ctx, m.ClientID)
+	default:
+		v := &validator{}
+		v.add("id", FieldRequired, "id or client_id is required")
+		return expense, v.err()
+	}
+	if err != nil {
+		return expense, err
+	}
+
+	isMember, err := isMemberOf(ctx, tx, userID, expense.OwnerGroupID)
+	if err != nil {
+		return expense, err
+	}
+	if !isMember {
+		return expense, ErrNotFound
+	}
+	return expense, nil
+}
+
+// Whether the expense changed since the version the mutation was based on
+func changedSince(expense Expense, base *time.Time) bool {
+	return base != nil && expense.UpdatedAt.After(*base)
+}
+
+func applyUpdate(ctx context.Context, tx Store, userID int, m SyncMutation, result *MutationResult) (*Event, error) {
+	current, err := mutationTarget(ctx, tx, userID, m)
+	if errors.Is(err, ErrNotFound) {
+		// Deleted on the server while the client edited it
+		result.Status = mutationConflict
+		return nil, nil
+	}
+	if err != nil {
+		return nil, mutationError(err)
+	}
+	if changedSince(current, m.BaseUpdatedAt) {
+		result.Status = mutationConflict
+		result.Expense = &current
+		return nil, nil
+	}
+
+	if m.GroupID == 0 {
+		m.GroupID = current.OwnerGroupID
+	}
+	expense, err := mutationExpense(m)
+	if err != nil {
+		return nil, err
+	}
+	if expense.OwnerGroupID != current.OwnerGroupID {
+		v := &validator{}
+		v.add("group_id", FieldInvalidFormat, "group_id cannot be changed by an update")
+		return nil, v.err()
+	}
+	expense.ID = current.ID
+	expense.ClientID = current.ClientID
+	expense.PaidBy = current.PaidBy
+	if m.Notes == nil {
+		expense.Notes = current.Notes
+	}
+	if m.Merchant == nil {
+		expense.Merchant = current.Merchant
+	}
+	if m.PaidBy > 0 {
+		if err := checkPayer(ctx, tx, expense.OwnerGroupID, m.PaidBy); err != nil {
+			return nil, err
+		}
+		expense.PaidBy = &m.PaidBy
+	}
+	if err := tx.UpdateExpense(ctx, &expense); err != nil {
+		return nil, errInternal("Failed to update expense", err)
+	}
+	if m.Tags == nil {
+		expense.Tags = current.Tags
+	} else if err := tx.SetExpenseTags(ctx, &expense, expense.Tags); err != nil {
+		return nil, errInternal("Failed to tag expense", err)
+	}
+	expense.CreatedAt = current.CreatedAt
+
+	event := Event{Type: EventExpenseUpdated, GroupID: expense.OwnerGroupID, ActorID: userID, Data: expense}
+	if err := queueWebhooks(ctx, tx, event); err != nil {
+		return nil, errInternal("Failed to queue webhooks", err)
+	}
+	result.Expense = &expense
+	return &event, nil
+}
+
+func applyDelete(ctx context.Context, tx Store, userID int, m SyncMutation, result *MutationResult) (*Event, error) {
+	current, err := mutationTarget(ctx, tx, userID, m)
+	if errors.Is(err, ErrNotFound) {
+		// Already gone, which is what the client wants
+		return nil, nil
+	}
+	if err != nil {
+		return nil, mutationError(err)
+	}
+	if changedSince(current, m.BaseUpdatedAt) {
+		result.Status = mutationConflict
+		result.Expense = &current
+		return nil, nil
+	}
+
+	if err := tx.DeleteExpense(ctx, current.ID); err != nil {
+		return nil, errInternal("Failed to remove expense", err)
+	}
+	event := Event{Type: EventExpenseDeleted, GroupID: current.OwnerGroupID, ActorID: userID, Data: DeletedExpenseData{ID: current.ID}}
+	if err := queueWebhooks(ctx, tx, event); err != nil {
+		return nil, errInternal("Failed to queue webhooks", err)
+	}
+	return &event, nil
+}
+
+// Pass API errors on and report anything else as a database error
+func mutationError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return errDatabase(err)
+}
+
+// Record a change. On PostgreSQL the log is locked until the transaction
+// ends, so change IDs become visible in order and a cursor never skips a
+// change that commits late.
+func (s *sqlStore) logChange(ctx context.Context, entity string, entityID, groupID int, op string) error {
+	if s.dialect.name == "postgres" && s.inTx {
+		if _, err := s.exec(ctx, "LOCK TABLE change_log IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+			return err
+		}
+	}
+	_, err := s.exec(ctx, "INSERT INTO change_log (entity, entity_id, group_id, op, created_at) VALUES (?, ?, ?, ?, ?)",
+		entity, entityID, groupID, op, time.Now().UTC())
+	return err
+}
+
+func (s *sqlStore) LatestChangeID(ctx context.Context) (int64, error) {
+	var id int64
+	err := s.queryRow(ctx, "SELECT COALESCE(MAX(id), 0) FROM change_log").Scan(&id)
+	return id, err
+}
+
+func (s *sqlStore) ListChanges(ctx context.Context, userID int, groupIDs []int, after, upTo int64, limit int) ([]Change, error) {
+	scope := "(c.entity = ? AND c.entity_id = ?)"
+	args := []interface{}{after, upTo, entityMembership, userID}
+	if len(groupIDs) > 0 {
+		scope = "(c.group_id IN (?" + strings.Repeat(", ?", len(groupIDs)-1) + ") OR " + scope + ")"
+		args = []interface{}{after, upTo}
+		for _, id := range groupIDs {
+			args = append(args, id)
+		}
+		args = append(args, entityMembership, userID)
+	}
+	args = append(args, limit)
+
+	rows, err := s.query(ctx, `SELECT c.id, c.entity, c.entity_id, c.group_id, c.op FROM change_log c
+		WHERE c.id > ? AND c.id <= ? AND `+scope+`
+		ORDER BY c.id LIMIT ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []Change{}
+	for rows.Next() {
+		var change Change
+		if err := rows.Scan(&change.ID, &change.Entity, &change.EntityID, &change.GroupID, &change.Op); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+func (s *sqlStore) GetExpenseByClientID(ctx context.Context, clientID string) (Expense, error) {
+	return s.withTags(ctx, s.queryRow(ctx, "SELECT "+expenseColumns+" FROM expenses e WHERE e.client_id = ?", clientID))
+}
+
+func (s *sqlStore) ListExpensesByID(ctx context.Context, expenseIDs []int) ([]Expense, error) {
+	if len(expenseIDs) == 0 {
+		return []Expense{}, nil
+	}
+	args := make([]interface{}, len(expenseIDs))
+	for i, id := range expenseIDs {
+		args[i] = id
+	}
+	return s.listExpenses(ctx, "SELECT "+expenseColumns+" FROM expenses e WHERE e.id IN (?"+strings.Repeat(", ?", len(expenseIDs)-1)+") ORDER BY e.id", args...)
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	tagMaxLength      = 40
+	maxTagsPerExpense = 20
+	notesMaxLength    = 2000
+	merchantMaxLength = 200
+	defaultTagLimit   = 20
+	maxTagLimit       = 200
+	maxTagsMerged     = 50
+	tagLoadChunkSize  = 500
+)
+
+// Tags are compared in lower case with runs of spaces collapsed, so
+// "Vacation  2024" and "vacation 2024" are the same tag
+func normalizeTag(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// Normalise and check a list of tag names, dropping duplicates
+func (v *validator) tags(field string, names []string) []string {
+	if names == nil {
+		return nil
+	}
+	if len(names) > maxTagsPerExpense {
+		v.add(field, FieldTooLong, fmt.Sprintf("at most %d tags are allowed", maxTagsPerExpense))
+		return nil
+	}
+	normalized := []string{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		tag := v.tag(field, name)
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+func (v *validator) tag(field, name string) string {
+	tag := normalizeTag(name)
+	switch {
+	case tag == "":
+		v.add(field, FieldRequired, "tags cannot be empty")
+	case utf8.RuneCountInString(tag) > tagMaxLength:
+		v.add(field, FieldTooLong, fmt.Sprintf("tags must be at most %d characters long", tagMaxLength))
+	}
+	return tag
+}
+
+func (v *validator) notes(field, notes string) {
+	if utf8.RuneCountInString(notes) > notesMaxLength {
+		v.add(field, FieldTooLong, fmt.Sprintf("%s must be at most %d characters long", field, notesMaxLength))
+	}
+}
+
+// Categories are stored trimmed, so "Food " and "Food" are the same one
+func (v *validator) category(field, category string) string {
+	category = strings.TrimSpace(category)
+	v.required(field, category)
+	return category
+}
+
+func (v *validator) merchant(field, merchant string) {
+	if utf8.RuneCountInString(strings.TrimSpace(merchant)) > merchantMaxLength {
+		v.add(field, FieldTooLong, fmt.Sprintf("%s must be at most %d characters long", field, merchantMaxLength))
+	}
+}
+
+func errTagNotFound() *APIError {
+	return newAPIError(http.StatusNotFound, CodeNotFound, "Tag not found")
+}
+
+// Check the caller is a member of the group whose tags are managed
+func checkTagGroup(ctx context.Context, userID, groupID int) error {
+	isMember, err := isUserInGroup(ctx, userID, groupID)
+	if err != nil {
+		return errDatabase(err)
+	}
+	if !isMember {
+		return errNotGroupMember()
+	}
+	return nil
+}
+
+type ListTagsRequest struct {
+	Token   string `json:"token"`    // JWT token or API key for authentication
+	GroupID int    `json:"group_id"` // ID of the group whose tags are listed
+	// Optional: only tags starting with this, for autocompletion
+	Prefix string `json:"prefix,omitempty"`
+	Limit  int    `json:"limit,omitempty"` // Optional: 20 by default, at most 200
+}
+
+// List a group's tags, most used first
+func ListTags(c echo.Context) error {
+	var req ListTagsRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	v := &validator{}
+	v.requiredID("group_id", req.GroupID)
+	if req.Limit < 0 {
+		v.add("limit", FieldMustBePositive, "limit must be greater than zero")
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+	limit := req.Limit
+	if limit == 0 {
+		limit = defaultTagLimit
+	}
+	if limit > maxTagLimit {
+		limit = maxTagLimit
+	}
+
+	userID, err := authenticate(c, req.Token, scopeRead)
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	if err := checkTagGroup(ctx, userID, req.GroupID); err != nil {
+		return err
+	}
+
+	tags, err := store.ListTags(ctx, req.GroupID, normalizeTag(req.Prefix), limit)
+	if err != nil {
+		return errDatabase(err)
+	}
+	return respond(c, http.StatusOK, "", tags)
+}
+
+type RenameTagRequest struct {
+	Token   string `json:"token"`    // JWT token or API key for authentication
+	GroupID int    `json:"group_id"` // ID of the group the tag belongs to
+	Name    string `json:"name"`     // Current name of the tag
+	NewName string `json:"new_name"` // New name, use /tags/merge when it is taken
+}
+
+func RenameTag(c echo.Context) error {
+	var req RenameTagRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	v := &validator{}
+	v.requiredID("group_id", req.GroupID)
+	name := v.tag("name", req.Name)
+	newName := v.tag("new_name", req.NewName)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	userID, err := authenticate(c, req.Token, scopeWrite)
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	if err := checkTagGroup(ctx, userID, req.GroupID); err != nil {
+		return err
+	}
+
+	changes, err := retagExpenses(ctx, userID, func(tx Store) ([]int, error) {
+		expenseIDs, err := tx.RenameTag(ctx, req.GroupID, name, newName)
+		if errors.Is(err, ErrNotFound) {
+			return nil, errTagNotFound()
+		}
+		if errors.Is(err, ErrConflict) {
+			return nil, newAPIError(http.StatusConflict, CodeConflict, "A tag with the new name already exists, merge the tags instead")
+		}
+		if err != nil {
+			return nil, errInternal("Failed to rename tag", err)
+		}
+		return expenseIDs, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return respond(c, http.StatusOK, "Tag renamed successfully", map[string]interface{}{
+		"name":             newName,
+		"expenses_changed": changes,
+	})
+}
+
+type MergeTagsRequest struct {
+	Token   string   `json:"token"`    // JWT token or API key for authentication
+	GroupID int      `json:"group_id"` // ID of the group the tags belong to
+	Tags    []string `json:"tags"`     // Tags to merge, deleted afterwards
+	Into    string   `json:"into"`     // Tag the expenses get instead, created when missing
+}
+
+func MergeTags(c echo.Context) error {
+	var req MergeTagsRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	v := &validator{}
+	v.requiredID("group_id", req.GroupID)
+	if len(req.Tags) == 0 {
+		v.add("tags", FieldRequired, "tags is required")
+	}
+	if len(req.Tags) > maxTagsMerged {
+		v.add("tags", FieldTooLong, fmt.Sprintf("at most %d tags can be merged at once", maxTagsMerged))
+	}
+	names := []string{}
+	for _, name := range req.Tags {
+		names = append(names, v.tag("tags", name))
+	}
+	into := v.tag("into", req.Into)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	userID, err := authenticate(c, req.Token, scopeWrite)
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	if err := checkTagGroup(ctx, userID, req.GroupID); err != nil {
+		return err
+	}
+
+	changes, err := retagExpenses(ctx, userID, func(tx Store) ([]int, error) {
+		expenseIDs, err := tx.MergeTags(ctx, req.GroupID, names, into)
+		if errors.Is(err, ErrNotFound) {
+			return nil, errTagNotFound()
+		}
+		if err != nil {
+			return nil, errInternal("Failed to merge tags", err)
+		}
+		return expenseIDs, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return respond(c, http.StatusOK, "Tags merged successfully", map[string]interface{}{
+		"name":             into,
+		"expenses_changed": changes,
+	})
+}
+
+// Run a change to tags in a transaction and announce the expenses it
+// changed. Returns how many expenses changed.
+func retagExpenses(ctx context.Context, userID int, change func(tx Store) ([]int, error)) (int, error) {
+	var changes []Event
+	err := store.WithTx(ctx, func(tx Store) error {
+		expenseIDs, err := change(tx)
+		if err != nil {
+			return err
+		}
+		expenses, err := tx.ListExpensesByID(ctx, expenseIDs)
+		if err != nil {
+			return errDatabase(err)
+		}
+		for _, expense := range expenses {
+			event := Event{Type: EventExpenseUpdated, GroupID: expense.OwnerGroupID, ActorID: userID, Data: expense}
+			if err := queueWebhooks(ctx, tx, event); err != nil {
+				return errInternal("Failed to queue webhooks", err)
+			}
+			changes = append(changes, event)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, event := range changes {
+		publish(event)
+	}
+	return len(changes), nil
+}
+
+// Scan an expense and load its tags
+func (s *sqlStore) withTags(ctx context.Context, row interface{ Scan(...interface{}) error }) (Expense, error) {
+	expense, err := scanExpense(row)
+	if err != nil {
+		return expense, err
+	}
+	tags, err := s.expenseTagNames(ctx, []int{expense.ID})
+	expense.Tags = tags[expense.ID]
+	return expense, err
+}
+
+// Tag names of expenses, sorted, keyed by expense ID
+func (s *sqlStore) expenseTagNames(ctx context.Context, expenseIDs []int) (map[int][]string, error) {
+	tags := map[int][]string{}
+	for start := 0; start < len(expenseIDs); start += tagLoadChunkSize {
+		chunk := expenseIDs[start:min(start+tagLoadChunkSize, len(expenseIDs))]
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+		rows, err := s.query(ctx, `SELECT et.expense_id, t.name FROM expense_tags et
+			INNER JOIN tags t ON t.id = et.tag_id
+			WHERE et.expense_id IN (?`+strings.Repeat(", ?", len(chunk)-1)+`)
+			ORDER BY t.name`, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int
+			var name string
+			if err := rows.Scan(&id, &name); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			tags[id] = append(tags[id], name)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return tags, nil
+}
+
+// ID of a group's tag, creating it when create is set
+func (s *sqlStore) tagID(ctx context.Context, groupID int, name string, create bool) (int, error) {
+	var id int
+	err := s.queryRow(ctx, "SELECT id FROM tags WHERE group_id = ? AND name = ?", groupID, name).Scan(&id)
+	if err == sql.ErrNoRows && create {
+		return s.insertID(ctx, "INSERT INTO tags (group_id, name, created_at) VALUES (?, ?, ?)", groupID, name, time.Now().UTC())
+	}
+	return id, notFound(err)
+}
+
+func (s *sqlStore) SetExpenseTags(ctx context.Context, expense *Expense, names []string) error {
+	if _, err := s.exec(ctx, "DELETE FROM expense_tags WHERE expense_id = ?", expense.ID); err != nil {
+		return err
+	}
+	for _, name := range names {
+		id, err := s.tagID(ctx, expense.OwnerGroupID, name, true)
+		if err != nil {
+			return err
+		}
+		if _, err := s.exec(ctx, "INSERT INTO expense_tags (expense_id, tag_id) VALUES (?, ?)", expense.ID, id); err != nil {
+			return err
+		}
+	}
+	expense.Tags = nil
+	if len(names) > 0 {
+		expense.Tags = append([]string(nil), names...)
+		sort.Strings(expense.Tags)
+	}
+	return nil
+}
+
+func (s *sqlStore) ListTags(ctx context.Context, groupID int, prefix string, limit int) ([]Tag, error) {
+	// Escape LIKE wildcards, tags may contain them
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
+	rows, err := s.query(ctx, `SELECT t.name, t.created_at, COUNT(et.expense_id) FROM tags t
+		LEFT JOIN expense_tags et ON et.tag_id = t.id
+		WHERE t.group_id = ? AND t.name LIKE ? ESCAPE '\'
+		GROUP BY t.id, t.name, t.created_at
+		ORDER BY COUNT(et.expense_id) DESC, t.name
+		LIMIT ?`, groupID, pattern, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []Tag{}
+	for rows.Next() {
+		var tag Tag
+		if err := rows.Scan(&tag.Name, &tag.CreatedAt, &tag.ExpenseCount); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+func (s *sqlStore) RenameTag(ctx context.Context, groupID int, name, newName string) ([]int, error) {
+	id, err := s.tagID(ctx, groupID, name, false)
+	if err != nil {
+		return nil, err
+	}
+	if newName == name {
+		return []int{}, nil
+	}
+	taken, err := s.exists(ctx, "SELECT 1 FROM tags WHERE group_id = ? AND name = ?", groupID, newName)
+	if err != nil {
+		return nil, err
+	}
+	if taken {
+		return nil, ErrConflict
+	}
+	if _, err := s.exec(ctx, "UPDATE tags SET name = ? WHERE id = ?", newName, id); err != nil {
+		return nil, err
+	}
+	return s.touchTagged(ctx, groupID, []int{id})
+}
+
+func (s *sqlStore) MergeTags(ctx context.Context, groupID int, names []string, into string) ([]int, error) {
+	var sources []int
+	for _, name := range names {
+		if name == into {
+			continue
+		}
+		id, err := s.tagID(ctx, groupID, name, false)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, id)
+	}
+	if len(sources) == 0 {
+		return []int{}, nil
+	}
+	target, err := s.tagID(ctx, groupID, into, true)
+	if err != nil {
+		return nil, err
+	}
+
+	changed, err := s.touchTagged(ctx, groupID, sources)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range sources {
+		if _, err := s.exec(ctx, `INSERT INTO expense_tags (expense_id, tag_id)
+			SELECT expense_id, ? FROM expense_tags
+			WHERE tag_id = ? AND expense_id NOT IN (SELECT expense_id FROM expense_tags WHERE tag_id = ?)`,
+			target, id, target); err != nil {
+			return nil, err
+		}
+		if _, err := s.exec(ctx, "DELETE FROM expense_tags WHERE tag_id = ?", id); err != nil {
+			return nil, err
+		}
+		if _, err := s.exec(ctx, "DELETE FROM tags WHERE id = ?", id); err != nil {
+			return nil, err
+		}
+	}
+	return changed, nil
+}
+
+// Mark the expenses carrying any of the tags as changed and return their IDs
+func (s *sqlStore) touchTagged(ctx context.Context, groupID int, tagIDs []int) ([]int, error) {
+	args := make([]interface{}, len(tagIDs))
+	for i, id := range tagIDs {
+		args[i] = id
+	}
+	rows, err := s.query(ctx, "SELECT DISTINCT expense_id FROM expense_tags WHERE tag_id IN (?"+strings.Repeat(", ?", len(tagIDs)-1)+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	expenseIDs := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		expenseIDs = append(expenseIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	for _, id := range expenseIDs {
+		if _, err := s.exec(ctx, "UPDATE expenses SET updated_at = ? WHERE id = ?", now, id); err != nil {
+			return nil, err
+		}
+		if err := s.logChange(ctx, entityExpense, id, groupID, changeUpsert); err != nil {
+			return nil, err
+		}
+	}
+	return expenseIDs, nil
+}
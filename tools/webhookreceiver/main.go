@@ -0,0 +1,117 @@
+// Command webhookreceiver accepts webhook deliveries locally, checks their
+// signatures and prints them, for trying webhooks without a public endpoint.
+//
+//	go run ./tools/webhookreceiver -addr :9100 -secret whsec_...
+//
+// Start the server with WEBHOOK_ALLOW_PRIVATE_NETWORKS=true and register
+// http://localhost:9100/ as the webhook URL. With -fail 2 the first two
+// deliveries are answered with 500 to watch the retries.
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signatures older than this are rejected as replays
+const tolerance = 5 * time.Minute
+
+func main() {
+	addr := flag.String("addr", ":9100", "address to listen on")
+	secret := flag.String("secret", "", "signing secret of the webhook, signatures are not checked when empty")
+	fail := flag.Int("fail", 0, "answer this many deliveries with 500 before accepting them")
+	flag.Parse()
+
+	var mu sync.Mutex
+	failures := *fail
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		event := r.Header.Get("X-Webhook-Event")
+		delivery := r.Header.Get("X-Webhook-Delivery")
+		if *secret != "" {
+			if err := verify(*secret, r.Header.Get("X-Webhook-Signature"), body, time.Now()); err != nil {
+				log.Printf("Rejected delivery %s (%s): %v", delivery, event, err)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+
+		mu.Lock()
+		failing := failures > 0
+		if failing {
+			failures--
+		}
+		mu.Unlock()
+		if failing {
+			log.Printf("Failing delivery %s (%s) on purpose", delivery, event)
+			http.Error(w, "failing on purpose", http.StatusInternalServerError)
+			return
+		}
+
+		var pretty bytes.Buffer
+		if json.Indent(&pretty, body, "", "  ") != nil {
+			pretty.Write(body)
+		}
+		log.Printf("Delivery %s (%s):\n%s", delivery, event, pretty.String())
+		fmt.Fprintln(w, "ok")
+	})
+
+	log.Printf("Webhook receiver listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+// Check a "t=<unix time>,v1=<hex HMAC-SHA256 of "<t>.<body>">" signature
+func verify(secret, header string, body []byte, now time.Time) error {
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signature = value
+		}
+	}
+	if timestamp == "" || signature == "" {
+		return fmt.Errorf("missing or malformed signature header")
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed signature time")
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("signature time is %s off", age.Round(time.Second))
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return fmt.Errorf("signature does not match")
+	}
+	return nil
+}
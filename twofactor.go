@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// Issuer shown next to the account in authenticator apps
+	totpIssuer = "ExpenseTracker"
+	totpPeriod = 30 // seconds
+	totpDigits = 6
+	// Accept codes from one step before and after the current one to allow for clock drift
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+
+	// Purpose claim of the token issued between the password and the second factor
+	twoFactorPurpose      = "2fa"
+	twoFactorChallengeTTL = 5 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Random 160 bit secret, the size RFC 4226 recommends for HMAC-SHA1
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// RFC 6238 code for a time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation from RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// Check a code against the steps around now and return the step it matched
+func verifyTOTP(secret, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// Key URI understood by authenticator apps, usually shown as a QR code
+func totpURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// Recovery codes look like "k3f9q-x7m2p" and are stored hashed
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	const alphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		for j := range b {
+			b[j] = alphabet[int(b[j])%len(alphabet)]
+		}
+		code := string(b[:5]) + "-" + string(b[5:])
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// Hash a recovery code, ignoring case, spaces and dashes
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func twoFactorEnabled(ctx context.Context, s Store, userID int) (bool, error) {
+	state, err := s.GetTOTP(ctx, userID)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return state.EnabledAt != nil, nil
+}
+
+// Check a TOTP code or, if no code is given, a recovery code. Accepted
+// codes are consumed so they cannot be replayed.
+func checkSecondFactor(ctx context.Context, tx Store, userID int, code, recoveryCode string) (bool, error) {
+	state, err := tx.GetTOTP(ctx, userID)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if state.EnabledAt == nil {
+		return false, nil
+	}
+
+	if code != "" {
+		step, ok := verifyTOTP(state.Secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		err = tx.UseTOTPStep(ctx, userID, step)
+	} else {
+		err = tx.UseRecoveryCode(ctx, userID, hashRecoveryCode(recoveryCode), time.Now().UTC())
+	}
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func errInvalidTwoFactorCode(status int) *APIError {
+	return newAPIError(status, CodeInvalidTwoFactor, "Invalid two-factor authentication code")
+}
+
+type TwoFactorSetupRequest struct {
+	Token string `json:"token"` // JWT token for authentication
+}
+
+// Start enrollment: create a secret the user adds to an authenticator app.
+// It is only used for logins once confirmed through ActivateTwoFactor.
+func SetupTwoFactor(c echo.Context) error {
+	var req TwoFactorSetupRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := validateToken(c.Request().Context(), requestToken(c, req.Token))
+	if err != nil {
+		return errInvalidToken(err)
+	}
+
+	ctx := c.Request().Context()
+	user, err := store.GetUser(ctx, userID)
+	if err != nil {
+		return errDatabase(err)
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return errInternal("Failed to create secret", err)
+	}
+
+	err = store.WithTx(ctx, func(tx Store) error {
+		enabled, err := twoFactorEnabled(ctx, tx, userID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if enabled {
+			return newAPIError(http.StatusConflict, CodeTwoFactorEnabled, "Two-factor authentication is already enabled")
+		}
+		if err := tx.SetPendingTOTP(ctx, userID, secret); err != nil {
+			return errDatabase(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return respond(c, http.StatusOK, "Scan the code with an authenticator app and confirm it with a code", map[string]string{
+		"secret":      secret,
+		"otpauth_uri": totpURI(user.Username, secret),
+	})
+}
+
+type ActivateTwoFactorRequest struct {
+	Token string `json:"token"` // JWT token for authentication
+	Code  string `json:"code"`  // Current code from the authenticator app
+}
+
+// Confirm enrollment with a code from the app and hand out recovery codes
+func ActivateTwoFactor(c echo.Context) error {
+	var req ActivateTwoFactorRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := validateToken(c.Request().Context(), requestToken(c, req.Token))
+	if err != nil {
+		return errInvalidToken(err)
+	}
+
+	v := &validator{}
+	v.required("code", req.Code)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return errInternal("Failed to create recovery codes", err)
+	}
+
+	ctx := c.Request().Context()
+	err = store.WithTx(ctx, func(tx Store) error {
+		state, err := tx.GetTOTP(ctx, userID)
+		if errors.Is(err, ErrNotFound) {
+			return newAPIError(http.StatusConflict, CodeTwoFactorDisabled, "Two-factor authentication setup has not been started")
+		}
+		if err != nil {
+			return errDatabase(err)
+		}
+		if state.EnabledAt != nil {
+			return newAPIError(http.StatusConflict, CodeTwoFactorEnabled, "Two-factor authentication is already enabled")
+		}
+
+		step, ok := verifyTOTP(state.Secret, req.Code, time.Now())
+		if !ok {
+			return errInvalidTwoFactorCode(http.StatusForbidden)
+		}
+		if err := tx.EnableTOTP(ctx, userID, time.Now().UTC(), step, hashes); err != nil {
+			return errInternal("Failed to enable two-factor authentication", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return respond(c, http.StatusOK, "Two-factor authentication enabled. Store the recovery codes somewhere safe, they are shown only once", map[string]interface{}{
+		"recovery_codes": codes,
+	})
+}
+
+// Answer a sign-in the password alone does not complete. The challenge
+// token is exchanged for a session token by /login/2fa.
+func respondTwoFactorChallenge(c echo.Context, user User, message string) error {
+	challenge, err := signToken(user, twoFactorPurpose, twoFactorChallengeTTL)
+	if err != nil {
+		return errInternal("Failed to generate token", err)
+	}
+	return respond(c, http.StatusOK, message, map[string]interface{}{
+		"user_id":             user.ID,
+		"two_factor_required": true,
+		"challenge_token":     challenge,
+	})
+}
+
+type LoginTwoFactorRequest struct {
+	ChallengeToken string `json:"challenge_token"`         // Token returned by /login
+	Code           string `json:"code,omitempty"`          // Code from the authenticator app
+	RecoveryCode   string `json:"recovery_code,omitempty"` // Or one of the recovery codes
+}
+
+// Second login step: exchange the challenge token and a code for a session token
+func LoginTwoFactor(c echo.Context) error {
+	var req LoginTwoFactorRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	v := &validator{}
+	v.required("challenge_token", req.ChallengeToken)
+	if req.Code == "" && req.RecoveryCode == "" {
+		v.add("code", FieldRequired, "code or recovery_code is required")
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	userID, err := validateTokenFor(c.Request().Context(), req.ChallengeToken, twoFactorPurpose)
+	if err != nil {
+		return errInvalidToken(err)
+	}
+
+	// Without a limit six digit codes could be guessed within one challenge
+	limits := []limitKey{ipKey(c, "login"), {loginLimiter, fmt.Sprintf("2fa:%d", userID)}}
+	if err := checkRateLimits(c, limits...); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	var user User
+	remaining := -1
+	err = store.WithTx(ctx, func(tx Store) error {
+		ok, err := checkSecondFactor(ctx, tx, userID, req.Code, req.RecoveryCode)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if !ok {
+			hitRateLimits(c, limits...)
+			return errInvalidTwoFactorCode(http.StatusUnauthorized)
+		}
+
+		if req.Code == "" {
+			remaining, err = tx.CountRecoveryCodes(ctx, userID)
+			if err != nil {
+				return errDatabase(err)
+			}
+		}
+
+		user, err = tx.GetUser(ctx, userID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	resetRateLimits(c, limits[1])
+
+	token, err := generateToken(user)
+	if err != nil {
+		return errInternal("Failed to generate token", err)
+	}
+
+	data := map[string]interface{}{
+		"user_id": userID,
+		"token":   token,
+	}
+	if remaining >= 0 {
+		data["recovery_codes_remaining"] = remaining
+	}
+	return respond(c, http.StatusOK, "Login successful", data)
+}
+
+type DisableTwoFactorRequest struct {
+	Token        string `json:"token"`                   // JWT token for authentication
+	Password     string `json:"password"`                // Current password
+	Code         string `json:"code,omitempty"`          // Code from the authenticator app
+	RecoveryCode string `json:"recovery_code,omitempty"` // Or one of the recovery codes
+}
+
+// Turn two-factor authentication off, re-authenticating with both factors
+func DisableTwoFactor(c echo.Context) error {
+	var req DisableTwoFactorRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := validateToken(c.Request().Context(), requestToken(c, req.Token))
+	if err != nil {
+		return errInvalidToken(err)
+	}
+
+	v := &validator{}
+	if req.Code == "" && req.RecoveryCode == "" {
+		v.add("code", FieldRequired, "code or recovery_code is required")
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	err = store.WithTx(ctx, func(tx Store) error {
+		user, err := tx.GetUser(ctx, userID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if err := confirmPassword(user, requestToken(c, req.Token), "password", req.Password); err != nil {
+			return err
+		}
+
+		enabled, err := twoFactorEnabled(ctx, tx, userID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if !enabled {
+			return newAPIError(http.StatusConflict, CodeTwoFactorDisabled, "Two-factor authentication is not enabled")
+		}
+
+		ok, err := checkSecondFactor(ctx, tx, userID, req.Code, req.RecoveryCode)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if !ok {
+			return errInvalidTwoFactorCode(http.StatusForbidden)
+		}
+
+		if err := tx.DeleteTOTP(ctx, userID); err != nil {
+			return errInternal("Failed to disable two-factor authentication", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return respond(c, http.StatusOK, "Two-factor authentication disabled", nil)
+}
+
+func (s *sqlStore) GetTOTP(ctx context.Context, userID int) (TOTPState, error) {
+	state := TOTPState{UserID: userID}
+	var enabledAt sql.NullTime
+	err := s.queryRow(ctx, "SELECT secret, enabled_at, last_step FROM user_totp WHERE user_id = ?", userID).
+		Scan(&state.Secret, &enabledAt, &state.LastStep)
+	if enabledAt.Valid {
+		state.EnabledAt = &enabledAt.Time
+	}
+	return state, notFound(err)
+}
+
+func (s *sqlStore) SetPendingTOTP(ctx context.Context, userID int, secret string) error {
+	_, err := s.exec(ctx, `INSERT INTO user_totp (user_id, secret, enabled_at, last_step) VALUES (?, ?, NULL, 0)
+		ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, enabled_at = NULL, last_step = 0`, userID, secret)
+	return err
+}
+
+func (s *sqlStore) EnableTOTP(ctx context.Context, userID int, enabledAt time.Time, step int64, recoveryCodeHashes []string) error {
+	result, err := s.exec(ctx, "UPDATE user_totp SET enabled_at = ?, last_step = ? WHERE user_id = ?", enabledAt, step, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+
+	if _, err := s.exec(ctx, "DELETE FROM totp_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err := s.exec(ctx, "INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) UseTOTPStep(ctx context.Context, userID int, step int64) error {
+	result, err := s.exec(ctx, "UPDATE user_totp SET last_step = ? WHERE user_id = ? AND last_step < ?", step, userID, step)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) UseRecoveryCode(ctx context.Context, userID int, codeHash string, usedAt time.Time) error {
+	result, err := s.exec(ctx, "UPDATE totp_recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		usedAt, userID, codeHash)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) CountRecoveryCodes(ctx context.Context, userID int) (int, error) {
+	var count int
+	err := s.queryRow(ctx, "SELECT COUNT(*) FROM totp_recovery_codes WHERE user_id = ? AND used_at IS NULL", userID).Scan(&count)
+	return count, err
+}
+
+func (s *sqlStore) DeleteTOTP(ctx context.Context, userID int) error {
+	if _, err := s.exec(ctx, "DELETE FROM totp_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	_, err := s.exec(ctx, "DELETE FROM user_totp WHERE user_id = ?", userID)
+	return err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// The SHA-1 seed of RFC 6238 Appendix B, "12345678901234567890" in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 Appendix B gives eight digits, six digit codes are their last six
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},          // 94287082
+		{1111111109, "081804"},  // 07081804
+		{1111111111, "050471"},  // 14050471
+		{1234567890, "005924"},  // 89005924
+		{2000000000, "279037"},  // 69279037
+		{20000000000, "353130"}, // 65353130
+	}
+	for _, tt := range tests {
+		got, err := totpCode(rfc6238Secret, tt.unix/totpPeriod)
+		if err != nil || got != tt.want {
+			t.Errorf("totpCode at %d = %q, %v, want %q", tt.unix, got, err, tt.want)
+		}
+	}
+
+	// Secrets typed in by hand may be in lower case
+	if got, _ := totpCode("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", 59/totpPeriod); got != "287082" {
+		t.Errorf("lower case secret gave %q, want %q", got, "287082")
+	}
+	if _, err := totpCode("not base32!", 1); err == nil {
+		t.Errorf("invalid secret gave no error")
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+	code := func(step int64) string {
+		c, err := totpCode(rfc6238Secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name string
+		code string
+		step int64 // Step the code matches, -1 when it is rejected
+	}{
+		{"current step", code(current), current},
+		{"one step behind", code(current - 1), current - 1},
+		{"one step ahead", code(current + 1), current + 1},
+		{"surrounding spaces", " " + code(current) + " ", current},
+		{"two steps behind", code(current - 2), -1},
+		{"two steps ahead", code(current + 2), -1},
+		{"too short", code(current)[1:], -1},
+		{"eight digits", "07081804", -1},
+		{"empty", "", -1},
+	}
+	for _, tt := range tests {
+		step, ok := verifyTOTP(rfc6238Secret, tt.code, now)
+		if ok != (tt.step >= 0) || ok && step != tt.step {
+			t.Errorf("%s: verifyTOTP(%q) = %d, %v, want step %d", tt.name, tt.code, step, ok, tt.step)
+		}
+	}
+}
+
+func TestCheckSecondFactorReplay(t *testing.T) {
+	s := openSQLiteTestStore(t)
+	ctx := context.Background()
+	user := mustCreateUser(t, s)
+	if err := s.SetPendingTOTP(ctx, user.ID, rfc6238Secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnableTOTP(ctx, user.ID, time.Now().UTC(), 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	current := time.Now().Unix() / totpPeriod
+	previous, _ := totpCode(rfc6238Secret, current-1)
+	code, _ := totpCode(rfc6238Secret, current)
+	tests := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{"previous step", previous, true},
+		{"previous step again", previous, false},
+		{"current step", code, true},
+		{"current step again", code, false},
+		// Once a step is used, codes from before it are too old
+		{"previous step after the current one", previous, false},
+	}
+	for _, tt := range tests {
+		ok, err := checkSecondFactor(ctx, s, user.ID, tt.code, "")
+		if err != nil || ok != tt.want {
+			t.Errorf("%s: checkSecondFactor = %v, %v, want %v", tt.name, ok, err, tt.want)
+		}
+	}
+}
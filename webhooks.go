@@ -0,0 +1,810 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	maxWebhooksPerGroup = 10
+	webhookURLMaxLength = 2048
+	// Signing secrets start with this, like API keys with apiKeyPrefix
+	webhookSecretPrefix = "whsec_"
+
+	// Wait before the first retry, doubled for every further one up to webhookMaxBackoff
+	webhookBackoff    = 30 * time.Second
+	webhookMaxBackoff = 6 * time.Hour
+	// How often the queue is checked when nothing wakes the dispatcher earlier
+	webhookPollInterval = 5 * time.Second
+	// Deliveries sent at the same time
+	webhookConcurrency = 4
+	webhookBatchSize   = 50
+	// Bytes of a receiver's response kept in the delivery log
+	webhookResponseLimit = 1024
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 200
+	// Finished deliveries are kept this long
+	webhookRetention = 30 * 24 * time.Hour
+
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// Events webhooks can subscribe to
+var webhookEventTypes = []string{
+	EventExpenseCreated,
+	EventExpenseUpdated,
+	EventExpenseDeleted,
+	EventMemberAdded,
+	EventMemberRemoved,
+}
+
+// Body posted to webhooks
+type WebhookPayload struct {
+	ID        string      `json:"id"` // Receivers can drop events they have already seen by it
+	Type      string      `json:"type"`
+	GroupID   int         `json:"group_id"`
+	ActorID   int         `json:"actor_id"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+func (h Webhook) wants(eventType string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, t := range h.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Queue an event for the webhooks of its group. Called inside the
+// transaction making the change, so an event is queued if and only if the
+// change is saved. publish wakes the dispatcher once it is committed.
+func queueWebhooks(ctx context.Context, tx Store, event Event) error {
+	hooks, err := tx.ListWebhooks(ctx, event.GroupID)
+	if err != nil {
+		return err
+	}
+
+	var payload []byte
+	eventID := ""
+	now := time.Now().UTC()
+	for _, hook := range hooks {
+		if !hook.wants(event.Type) {
+			continue
+		}
+		if payload == nil {
+			if eventID, err = randomID("evt_"); err != nil {
+				return err
+			}
+			createdAt := event.At
+			if createdAt.IsZero() {
+				createdAt = now
+			}
+			payload, err = json.Marshal(WebhookPayload{ID: eventID, Type: event.Type, GroupID: event.GroupID,
+				ActorID: event.ActorID, CreatedAt: createdAt, Data: event.Data})
+			if err != nil {
+				return err
+			}
+		}
+		delivery := WebhookDelivery{
+			WebhookID:     hook.ID,
+			EventID:       eventID,
+			EventType:     event.Type,
+			Payload:       payload,
+			Status:        deliveryPending,
+			NextAttemptAt: &now,
+			CreatedAt:     now,
+		}
+		if err := tx.CreateWebhookDelivery(ctx, &delivery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func randomID(prefix string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Signature header value: the time of the attempt and an HMAC-SHA256 of
+// "<time>.<body>" keyed with the webhook's secret, e.g.
+// "t=1723456789,v1=5f2b...". Receivers recompute it and reject old times.
+func signWebhook(secret string, at time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sends queued deliveries in the background and retries failed ones
+type webhookDispatcher struct {
+	client       *http.Client
+	maxAttempts  int
+	allowPrivate bool
+	wake         chan struct{}
+}
+
+var webhooks = &webhookDispatcher{wake: make(chan struct{}, 1)}
+
+func (d *webhookDispatcher) configure(cfg Config) {
+	d.client = newWebhookClient(cfg.WebhookTimeout, cfg.WebhookAllowPrivate)
+	d.maxAttempts = cfg.WebhookMaxAttempts
+	d.allowPrivate = cfg.WebhookAllowPrivate
+}
+
+// Check the queue right away instead of at the next poll
+func (d *webhookDispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *webhookDispatcher) run() {
+	poll := time.NewTicker(webhookPollInterval)
+	defer poll.Stop()
+	cleanup := time.NewTicker(time.Hour)
+	defer cleanup.Stop()
+	for {
+		d.deliverDue()
+		select {
+		case <-poll.C:
+		case <-d.wake:
+		case <-cleanup.C:
+			cutoff := time.Now().UTC().Add(-webhookRetention)
+			if err := store.DeleteWebhookDeliveriesBefore(context.Background(), cutoff); err != nil {
+				log.Printf("Error cleaning up webhook deliveries: %v", err)
+			}
+		}
+	}
+}
+
+// Send everything that is due, a batch at a time
+func (d *webhookDispatcher) deliverDue() {
+	ctx := context.Background()
+	for {
+		now := time.Now().UTC()
+		due, err := store.DueWebhookDeliveries(ctx, now, webhookBatchSize)
+		if err != nil {
+			log.Printf("Error loading webhook deliveries: %v", err)
+			return
+		}
+
+		sem := make(chan struct{}, webhookConcurrency)
+		var wg sync.WaitGroup
+		for _, delivery := range due {
+			// Hold the delivery for longer than an attempt can take, in case
+			// the process stops before recording the outcome
+			err := store.ClaimWebhookDelivery(ctx, delivery.ID, now, now.Add(2*d.client.Timeout+time.Minute))
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				log.Printf("Error claiming webhook delivery %d: %v", delivery.ID, err)
+				continue
+			}
+
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(delivery WebhookDelivery) {
+				defer func() { <-sem; wg.Done() }()
+				d.attempt(ctx, delivery)
+			}(delivery)
+		}
+		wg.Wait()
+
+		if len(due) < webhookBatchSize {
+			return
+		}
+	}
+}
+
+// Post a delivery once and record how it went
+func (d *webhookDispatcher) attempt(ctx context.Context, delivery WebhookDelivery) {
+	hook, err := store.GetWebhook(ctx, delivery.WebhookID)
+	if err != nil {
+		log.Printf("Error loading webhook %d: %v", delivery.WebhookID, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	delivery.Attempts++
+	delivery.LastAttemptAt = &now
+	delivery.Error = ""
+
+	status, body, err := d.post(ctx, hook, delivery, now)
+	delivery.ResponseStatus = status
+	delivery.ResponseBody = body
+	switch {
+	case err != nil:
+		delivery.Error = err.Error()
+	case status < 200 || status > 299:
+		delivery.Error = fmt.Sprintf("receiver answered %d", status)
+	}
+
+	switch {
+	case delivery.Error == "":
+		delivery.Status = deliverySucceeded
+		delivery.NextAttemptAt = nil
+	case delivery.Attempts >= d.maxAttempts:
+		delivery.Status = deliveryFailed
+		delivery.NextAttemptAt = nil
+	default:
+		next := now.Add(webhookRetryDelay(delivery.Attempts))
+		delivery.NextAttemptAt = &next
+	}
+
+	if err := store.FinishWebhookAttempt(ctx, delivery); err != nil {
+		log.Printf("Error saving webhook delivery %d: %v", delivery.ID, err)
+	}
+}
+
+func (d *webhookDispatcher) post(ctx context.Context, hook Webhook, delivery WebhookDelivery, at time.Time) (int, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ExpenseTracker-Webhooks/1.0")
+	req.Header.Set(webhookEventHeader, delivery.EventType)
+	req.Header.Set(webhookDeliveryHeader, strconv.Itoa(delivery.ID))
+	req.Header.Set(webhookSignatureHeader, signWebhook(hook.Secret, at, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, webhookResponseLimit))
+	return resp.StatusCode, string(body), nil
+}
+
+// Delay after the given number of failed attempts
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookBackoff
+	for i := 1; i < attempts && delay < webhookMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxBackoff {
+		delay = webhookMaxBackoff
+	}
+	return delay
+}
+
+// HTTP client for deliveries. Unless allowPrivate is set, connections to
+// loopback, private and link-local addresses are refused when dialing, which
+// also covers host names that resolve to them. Redirects are not followed.
+func newWebhookClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return fmt.Errorf("refusing to connect to non-public address %s", host)
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConnsPerHost: webhookConcurrency,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// Load a group and check that the caller owns it
+func ownedGroup(ctx context.Context, userID, groupID int) (UsersGroup, error) {
+	if !principalFromContext(ctx).allowsGroup(groupID) {
+		return UsersGroup{}, newAPIError(http.StatusNotFound, CodeGroupNotFound, "Group not found")
+	}
+	group, err := store.GetGroup(ctx, groupID)
+	if errors.Is(err, ErrNotFound) {
+		return group, newAPIError(http.StatusNotFound, CodeGroupNotFound, "Group not found")
+	}
+	if err != nil {
+		return group, errDatabase(err)
+	}
+	if group.OwnerID != userID {
+		return group, newAPIError(http.StatusForbidden, CodeNotGroupOwner, "Only the group owner can manage webhooks")
+	}
+	return group, nil
+}
+
+// Load a webhook of a group the caller owns
+func ownedWebhook(ctx context.Context, userID, webhookID int) (Webhook, error) {
+	hook, err := store.GetWebhook(ctx, webhookID)
+	if errors.Is(err, ErrNotFound) {
+		return hook, newAPIError(http.StatusNotFound, CodeNotFound, "Webhook not found")
+	}
+	if err != nil {
+		return hook, errDatabase(err)
+	}
+	if _, err := ownedGroup(ctx, userID, hook.GroupID); err != nil {
+		// Do not reveal webhooks of other groups
+		return hook, newAPIError(http.StatusNotFound, CodeNotFound, "Webhook not found")
+	}
+	return hook, nil
+}
+
+// Check a webhook URL. Private addresses are refused again when connecting,
+// this only gives early feedback for the obvious cases.
+func (v *validator) webhookURL(field, value string) {
+	if value == "" {
+		v.required(field, value)
+		return
+	}
+	if len(value) > webhookURLMaxLength {
+		v.add(field, FieldTooLong, fmt.Sprintf("%s must be at most %d characters long", field, webhookURLMaxLength))
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		v.add(field, FieldInvalidFormat, field+" must be an http or https URL")
+		return
+	}
+	if webhooks.allowPrivate {
+		return
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); (ip != nil && !isPublicIP(ip)) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		v.add(field, FieldInvalidFormat, field+" must not point to a private network address")
+	}
+}
+
+type CreateWebhookRequest struct {
+	Token   string   `json:"token"`            // JWT token or API key for authentication
+	GroupID int      `json:"group_id"`         // Group whose events are sent
+	URL     string   `json:"url"`              // Where events are posted to
+	Events  []string `json:"events,omitempty"` // Optional: event types to send, all when empty
+}
+
+// Register a webhook for a group. The signing secret is only part of this response.
+func CreateWebhook(c echo.Context) error {
+	var req CreateWebhookRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := authenticate(c, req.Token, scopeWrite)
+	if err != nil {
+		return err
+	}
+
+	v := &validator{}
+	v.requiredID("group_id", req.GroupID)
+	req.URL = strings.TrimSpace(req.URL)
+	v.webhookURL("url", req.URL)
+	eventTypes := []string{}
+	for _, t := range req.Events {
+		if !containsString(webhookEventTypes, t) {
+			v.add("events", FieldInvalidFormat, "events must be some of "+strings.Join(webhookEventTypes, ", "))
+			break
+		}
+		if !containsString(eventTypes, t) {
+			eventTypes = append(eventTypes, t)
+		}
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	if _, err := ownedGroup(ctx, userID, req.GroupID); err != nil {
+		return err
+	}
+
+	secret, err := randomID(webhookSecretPrefix)
+	if err != nil {
+		return errInternal("Failed to create webhook", err)
+	}
+	hook := Webhook{
+		GroupID:   req.GroupID,
+		URL:       req.URL,
+		Events:    eventTypes,
+		Secret:    secret,
+		CreatedAt: time.Now().UTC(),
+	}
+	err = store.WithTx(ctx, func(tx Store) error {
+		existing, err := tx.ListWebhooks(ctx, req.GroupID)
+		if err != nil {
+			return errDatabase(err)
+		}
+		if len(existing) >= maxWebhooksPerGroup {
+			return newAPIError(http.StatusConflict, CodeConflict, fmt.Sprintf("A group can have at most %d webhooks", maxWebhooksPerGroup))
+		}
+		if err := tx.CreateWebhook(ctx, &hook); err != nil {
+			return errInternal("Failed to create webhook", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return respondCreated(c, "", "Webhook created. Copy the secret now, it will not be shown again", map[string]interface{}{
+		"secret":  secret,
+		"webhook": hook,
+	})
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type ListWebhooksRequest struct {
+	Token   string `json:"token"` // JWT token or API key for authentication
+	GroupID int    `json:"group_id"`
+}
+
+func ListWebhooks(c echo.Context) error {
+	var req ListWebhooksRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := authenticate(c, req.Token, scopeRead)
+	if err != nil {
+		return err
+	}
+
+	v := &validator{}
+	v.requiredID("group_id", req.GroupID)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	if _, err := ownedGroup(ctx, userID, req.GroupID); err != nil {
+		return err
+	}
+	hooks, err := store.ListWebhooks(ctx, req.GroupID)
+	if err != nil {
+		return errDatabase(err)
+	}
+	return respond(c, http.StatusOK, "", hooks)
+}
+
+type DeleteWebhookRequest struct {
+	Token     string `json:"token"` // JWT token or API key for authentication
+	WebhookID int    `json:"webhook_id"`
+}
+
+// Delete a webhook together with its queued and logged deliveries
+func DeleteWebhook(c echo.Context) error {
+	var req DeleteWebhookRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := authenticate(c, req.Token, scopeWrite)
+	if err != nil {
+		return err
+	}
+
+	v := &validator{}
+	v.requiredID("webhook_id", req.WebhookID)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	if _, err := ownedWebhook(ctx, userID, req.WebhookID); err != nil {
+		return err
+	}
+	err = store.WithTx(ctx, func(tx Store) error {
+		if err := tx.DeleteWebhook(ctx, req.WebhookID); err != nil && !errors.Is(err, ErrNotFound) {
+			return errInternal("Failed to delete webhook", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return respond(c, http.StatusOK, "Webhook deleted", nil)
+}
+
+type ListWebhookDeliveriesRequest struct {
+	Token     string `json:"token"` // JWT token or API key for authentication
+	WebhookID int    `json:"webhook_id"`
+	Limit     int    `json:"limit,omitempty"` // Optional: newest deliveries returned, 50 by default
+}
+
+// Delivery log of a webhook, newest first
+func ListWebhookDeliveries(c echo.Context) error {
+	var req ListWebhookDeliveriesRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := authenticate(c, req.Token, scopeRead)
+	if err != nil {
+		return err
+	}
+
+	v := &validator{}
+	v.requiredID("webhook_id", req.WebhookID)
+	if req.Limit < 0 {
+		v.add("limit", FieldMustBePositive, "limit must be greater than zero")
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+	limit := req.Limit
+	if limit == 0 {
+		limit = defaultDeliveryLimit
+	}
+	if limit > maxDeliveryLimit {
+		limit = maxDeliveryLimit
+	}
+
+	ctx := c.Request().Context()
+	if _, err := ownedWebhook(ctx, userID, req.WebhookID); err != nil {
+		return err
+	}
+	deliveries, err := store.ListWebhookDeliveries(ctx, req.WebhookID, limit)
+	if err != nil {
+		return errDatabase(err)
+	}
+	return respond(c, http.StatusOK, "", deliveries)
+}
+
+type RedeliverWebhookRequest struct {
+	Token      string `json:"token"` // JWT token or API key for authentication
+	DeliveryID int    `json:"delivery_id"`
+}
+
+// Queue an event again for its webhook. The original stays in the log, the
+// new delivery carries the same event ID and payload.
+func RedeliverWebhook(c echo.Context) error {
+	var req RedeliverWebhookRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := authenticate(c, req.Token, scopeWrite)
+	if err != nil {
+		return err
+	}
+
+	v := &validator{}
+	v.requiredID("delivery_id", req.DeliveryID)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	original, err := store.GetWebhookDelivery(ctx, req.DeliveryID)
+	if errors.Is(err, ErrNotFound) {
+		return newAPIError(http.StatusNotFound, CodeNotFound, "Delivery not found")
+	}
+	if err != nil {
+		return errDatabase(err)
+	}
+	if _, err := ownedWebhook(ctx, userID, original.WebhookID); err != nil {
+		return newAPIError(http.StatusNotFound, CodeNotFound, "Delivery not found")
+	}
+
+	now := time.Now().UTC()
+	delivery := WebhookDelivery{
+		WebhookID:     original.WebhookID,
+		EventID:       original.EventID,
+		EventType:     original.EventType,
+		Payload:       original.Payload,
+		Status:        deliveryPending,
+		NextAttemptAt: &now,
+		RedeliveryOf:  &original.ID,
+		CreatedAt:     now,
+	}
+	if err := store.CreateWebhookDelivery(ctx, &delivery); err != nil {
+		return errInternal("Failed to queue delivery", err)
+	}
+	webhooks.notify()
+
+	return respondCreated(c, "", "Delivery queued", delivery)
+}
+
+const webhookColumns = "w.id, w.group_id, w.url, w.secret, w.events, w.created_at"
+
+func scanWebhook(row interface{ Scan(...interface{}) error }) (Webhook, error) {
+	var hook Webhook
+	var eventTypes string
+	err := row.Scan(&hook.ID, &hook.GroupID, &hook.URL, &hook.Secret, &eventTypes, &hook.CreatedAt)
+	hook.Events = []string{}
+	if eventTypes != "" {
+		hook.Events = strings.Split(eventTypes, ",")
+	}
+	return hook, notFound(err)
+}
+
+func (s *sqlStore) CreateWebhook(ctx context.Context, hook *Webhook) error {
+	id, err := s.insertID(ctx, "INSERT INTO webhooks (group_id, url, secret, events, created_at) VALUES (?, ?, ?, ?, ?)",
+		hook.GroupID, hook.URL, hook.Secret, strings.Join(hook.Events, ","), hook.CreatedAt)
+	if err != nil {
+		return err
+	}
+	hook.ID = id
+	return nil
+}
+
+func (s *sqlStore) GetWebhook(ctx context.Context, webhookID int) (Webhook, error) {
+	return scanWebhook(s.queryRow(ctx, "SELECT "+webhookColumns+" FROM webhooks w WHERE w.id = ?", webhookID))
+}
+
+func (s *sqlStore) ListWebhooks(ctx context.Context, groupID int) ([]Webhook, error) {
+	rows, err := s.query(ctx, "SELECT "+webhookColumns+" FROM webhooks w WHERE w.group_id = ? ORDER BY w.id", groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		hook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+func (s *sqlStore) DeleteWebhook(ctx context.Context, webhookID int) error {
+	if _, err := s.exec(ctx, "DELETE FROM webhook_deliveries WHERE webhook_id = ?", webhookID); err != nil {
+		return err
+	}
+	result, err := s.exec(ctx, "DELETE FROM webhooks WHERE id = ?", webhookID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+const deliveryColumns = `d.id, d.webhook_id, d.event_id, d.event_type, d.payload, d.status, d.attempts, d.next_attempt_at,
+	d.last_attempt_at, d.response_status, d.response_body, d.error, d.redelivery_of, d.created_at`
+
+func scanWebhookDelivery(row interface{ Scan(...interface{}) error }) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	var payload string
+	var nextAttemptAt, lastAttemptAt sql.NullTime
+	var responseStatus, redeliveryOf sql.NullInt64
+	var responseBody, deliveryError sql.NullString
+	err := row.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.EventType, &payload, &d.Status, &d.Attempts, &nextAttemptAt,
+		&lastAttemptAt, &responseStatus, &responseBody, &deliveryError, &redeliveryOf, &d.CreatedAt)
+	d.Payload = json.RawMessage(payload)
+	if nextAttemptAt.Valid {
+		d.NextAttemptAt = &nextAttemptAt.Time
+	}
+	if lastAttemptAt.Valid {
+		d.LastAttemptAt = &lastAttemptAt.Time
+	}
+	d.ResponseStatus = int(responseStatus.Int64)
+	d.ResponseBody = responseBody.String
+	d.Error = deliveryError.String
+	if redeliveryOf.Valid {
+		id := int(redeliveryOf.Int64)
+		d.RedeliveryOf = &id
+	}
+	return d, notFound(err)
+}
+
+func (s *sqlStore) listWebhookDeliveries(ctx context.Context, query string, args ...interface{}) ([]WebhookDelivery, error) {
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *sqlStore) CreateWebhookDelivery(ctx context.Context, d *WebhookDelivery) error {
+	id, err := s.insertID(ctx, `INSERT INTO webhook_deliveries
+		(webhook_id, event_id, event_type, payload, status, attempts, next_attempt_at, redelivery_of, created_at)
+		VALUES (?, ?, ?, ?, ?, 0, ?, ?, ?)`,
+		d.WebhookID, d.EventID, d.EventType, string(d.Payload), d.Status, d.NextAttemptAt, d.RedeliveryOf, d.CreatedAt)
+	if err != nil {
+		return err
+	}
+	d.ID = id
+	return nil
+}
+
+func (s *sqlStore) GetWebhookDelivery(ctx context.Context, deliveryID int) (WebhookDelivery, error) {
+	return scanWebhookDelivery(s.queryRow(ctx, "SELECT "+deliveryColumns+" FROM webhook_deliveries d WHERE d.id = ?", deliveryID))
+}
+
+func (s *sqlStore) ListWebhookDeliveries(ctx context.Context, webhookID, limit int) ([]WebhookDelivery, error) {
+	return s.listWebhookDeliveries(ctx, "SELECT "+deliveryColumns+` FROM webhook_deliveries d
+		WHERE d.webhook_id = ? ORDER BY d.id DESC LIMIT ?`, webhookID, limit)
+}
+
+func (s *sqlStore) DueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]WebhookDelivery, error) {
+	return s.listWebhookDeliveries(ctx, "SELECT "+deliveryColumns+` FROM webhook_deliveries d
+		WHERE d.status = ? AND d.next_attempt_at <= ? ORDER BY d.next_attempt_at, d.id LIMIT ?`, deliveryPending, now, limit)
+}
+
+func (s *sqlStore) ClaimWebhookDelivery(ctx context.Context, deliveryID int, now, until time.Time) error {
+	result, err := s.exec(ctx, "UPDATE webhook_deliveries SET next_attempt_at = ? WHERE id = ? AND status = ? AND next_attempt_at <= ?",
+		until, deliveryID, deliveryPending, now)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) FinishWebhookAttempt(ctx context.Context, d WebhookDelivery) error {
+	_, err := s.exec(ctx, `UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = ?, last_attempt_at = ?,
+		response_status = ?, response_body = ?, error = ? WHERE id = ?`,
+		d.Status, d.Attempts, d.NextAttemptAt, d.LastAttemptAt, d.ResponseStatus, d.ResponseBody, d.Error, d.ID)
+	return err
+}
+
+func (s *sqlStore) DeleteWebhookDeliveriesBefore(ctx context.Context, cutoff time.Time) error {
+	_, err := s.exec(ctx, "DELETE FROM webhook_deliveries WHERE status != ? AND created_at < ?", deliveryPending, cutoff)
+	return err
+}